@@ -0,0 +1,934 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+	_ "modernc.org/sqlite"
+)
+
+// 报警引擎：写入 rtdb 的数据按设备的报警规则判断，支持 hihi/hi/lo/lolo 限值报警（死区、延时）、
+// state 状态报警、roc 变化率报警和 quality 质量报警。
+// 报警产生后进入活动报警列表，恢复并且已确认后移出列表；报警的产生、恢复、确认和屏蔽由后台线程记录到 data/alarm.db，
+// 同时推送给报警订阅者，如 mqttpub 实例发布到 alarmTopic。屏蔽的报警照常判断和记录，但不推送产生和恢复。
+// 活动报警列表同时保存在 data/alarm.db 中，重启后恢复
+
+// 报警类型定义
+const (
+	AlarmTypeHiHi    = "hihi"
+	AlarmTypeHi      = "hi"
+	AlarmTypeLo      = "lo"
+	AlarmTypeLoLo    = "lolo"
+	AlarmTypeState   = "state"
+	AlarmTypeROC     = "roc"
+	AlarmTypeQuality = "quality"
+)
+
+// 报警事件定义
+const (
+	AlarmEventRaise    = "raise"    // 产生
+	AlarmEventClear    = "clear"    // 恢复
+	AlarmEventAck      = "ack"      // 确认
+	AlarmEventShelve   = "shelve"   // 屏蔽
+	AlarmEventUnshelve = "unshelve" // 取消屏蔽
+	AlarmEventRemove   = "remove"   // 规则删除、禁用或修改后移出活动报警列表
+)
+
+// 定义 AlarmRule 结构体，设备点的报警规则
+type AlarmRule struct {
+	RuleID   string  `json:"ruleId"`   // 规则ID，设备内唯一
+	TagID    string  `json:"tagId"`    // 点ID
+	Type     string  `json:"type"`     // hihi/hi/lo/lolo/state/roc/quality
+	Limit    float64 `json:"limit"`    // 限值；roc 为每秒最大变化量
+	Value    any     `json:"value"`    // state 报警的报警状态值，可以是布尔、数值或字符串
+	Deadband float64 `json:"deadband"` // 死区，报警恢复时 hi/hihi/roc 需要低于 限值-死区，lo/lolo 需要高于 限值+死区
+	Delay    int     `json:"delay"`    // 延时(秒)，条件持续满足后才产生报警
+	Priority int     `json:"priority"` // 优先级，数值越大越重要
+	Message  string  `json:"message"`  // 报警描述
+	Enable   bool    `json:"enable"`   // 是否启用
+}
+
+// 定义 Alarm 结构体，活动报警
+type Alarm struct {
+	AlarmID      string  `json:"alarmId"` // 设备ID/规则ID
+	DevID        string  `json:"devId"`
+	RuleID       string  `json:"ruleId"`
+	TagID        string  `json:"tagId"`
+	Type         string  `json:"type"`
+	Priority     int     `json:"priority"`
+	Message      string  `json:"message"`
+	Limit        float64 `json:"limit"`
+	Value        any     `json:"value"`        // 最新值
+	Quality      string  `json:"quality"`      // 最新值的质量
+	Active       bool    `json:"active"`       // 报警条件是否仍然满足
+	Acked        bool    `json:"acked"`        // 是否已确认
+	AckedBy      string  `json:"ackedBy"`      // 确认人
+	AckedAt      int64   `json:"ackedAt"`      // 确认时间，毫秒时间戳
+	Shelved      bool    `json:"shelved"`      // 是否屏蔽
+	ShelvedUntil int64   `json:"shelvedUntil"` // 屏蔽到期时间，毫秒时间戳
+	RaisedAt     int64   `json:"raisedAt"`     // 产生时间，毫秒时间戳
+	ClearedAt    int64   `json:"clearedAt"`    // 恢复时间，毫秒时间戳
+}
+
+// 定义 AlarmEvent 结构体，推送给订阅者和记录到报警日志的事件
+type AlarmEvent struct {
+	Event   string `json:"event"` // raise/clear/ack/shelve/unshelve/remove
+	Ts      int64  `json:"ts"`    // 事件时间，毫秒时间戳
+	User    string `json:"user,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	Alarm   Alarm  `json:"alarm"`
+}
+
+// 定义 AlarmRulesReq 结构体
+type AlarmRulesReq struct {
+	DevID string      `json:"devId" binding:"required"`
+	Rules []AlarmRule `json:"rules"` // 设备的全部报警规则，为空时删除设备的报警规则
+}
+
+// 定义 AlarmAckReq 结构体
+type AlarmAckReq struct {
+	AlarmIDs []string `json:"alarmIds" binding:"required"`
+	Comment  string   `json:"comment"`
+	Duration int      `json:"duration"` // 屏蔽时长(秒)，0 表示取消屏蔽，仅用于 shelveAlarms
+}
+
+// 定义 AlarmJournalReq 结构体
+type AlarmJournalReq struct {
+	DevID   string `json:"devId"`   // 为空时查询所有设备
+	AlarmID string `json:"alarmId"` // 为空时查询所有报警
+	Start   int64  `json:"start"`   // 开始时间，毫秒时间戳，默认结束时间前 24 小时
+	End     int64  `json:"end"`     // 结束时间，毫秒时间戳，默认当前时间
+	Limit   int    `json:"limit"`   // 最大返回条数，默认 1000
+}
+
+// 定义报警的判断状态
+type alarmState struct {
+	rule         AlarmRule
+	pendingSince int64 // 条件开始满足的时间，用于延时，0 表示条件不满足
+	value        any
+	quality      string
+	prevNum      float64 // 上一次的值和时间，用于变化率
+	prevTs       int64
+	hasPrev      bool
+}
+
+var (
+	AlarmRuleKey     = "alarm@dev" // 报警规则表，设备ID -> []AlarmRule
+	almdb            *sql.DB
+	almCfgdb         *redka.DB
+	almLock          sync.Mutex
+	almRules         = make(map[string][]AlarmRule)  // 设备ID -> 报警规则，读取后缓存
+	almStates        = make(map[string]*alarmState)  // 报警ID -> 判断状态
+	almActive        = make(map[string]*Alarm)       // 报警ID -> 活动报警
+	almSubscribers   = make(map[chan AlarmEvent]int) // 订阅者 -> 丢弃的事件数
+	almSubLock       sync.Mutex
+	almJournal       = make(chan AlarmEvent, 4096) // 待写入报警日志的事件，写入不阻塞南向实例
+	almJournalDrops  atomic.Int64                  // 队列满时丢弃的事件数
+	almRetentionDays = 90                          // 报警日志保留天数
+	almMaxRows       = 1000                        // 报警日志默认返回条数
+	almTypes         = []string{AlarmTypeHiHi, AlarmTypeHi, AlarmTypeLo, AlarmTypeLoLo, AlarmTypeState, AlarmTypeROC, AlarmTypeQuality}
+)
+
+// StartAlarmEngine 打开报警日志数据库，恢复活动报警，并启动报警日志写入、延时报警和屏蔽到期的检查线程
+func StartAlarmEngine(path string, cfgdb *redka.DB) error {
+	db, err := openAlarmDB(path)
+	if err != nil {
+		return err
+	}
+	almLock.Lock()
+	almCfgdb = cfgdb
+	almLock.Unlock()
+	n, err := loadActiveAlarms(db)
+	if err != nil {
+		log.Printf("恢复活动报警失败: %v", err)
+	} else if n > 0 {
+		log.Printf("已恢复 %d 个活动报警", n)
+	}
+	go alarmJournalWriter(db)
+	almdb = db
+	go func() {
+		lastMaintain := time.Time{}
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			alarmTick()
+			if time.Since(lastMaintain) >= time.Hour {
+				lastMaintain = time.Now()
+				before := time.Now().AddDate(0, 0, -almRetentionDays).UnixMilli()
+				if _, erra := almdb.Exec("DELETE FROM alarm_journal WHERE ts < ?", before); erra != nil {
+					log.Printf("清理报警日志失败: %v", erra)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// openAlarmDB 打开报警数据库，创建报警日志表和活动报警表
+func openAlarmDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	stmts := []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA synchronous=NORMAL",
+		`CREATE TABLE IF NOT EXISTS alarm_journal (
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			ts       INTEGER NOT NULL,
+			event    TEXT NOT NULL,
+			alarm_id TEXT NOT NULL,
+			dev_id   TEXT NOT NULL,
+			tag_id   TEXT,
+			type     TEXT,
+			priority INTEGER,
+			value    TEXT,
+			quality  TEXT,
+			message  TEXT,
+			user     TEXT,
+			comment  TEXT
+		)`,
+		"CREATE INDEX IF NOT EXISTS alarm_journal_ts ON alarm_journal (ts)",
+		`CREATE TABLE IF NOT EXISTS alarm_active (
+			alarm_id TEXT PRIMARY KEY,
+			alarm    TEXT NOT NULL
+		)`,
+	}
+	for _, s := range stmts {
+		if _, err = db.Exec(s); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("init alarm db: %w", err)
+		}
+	}
+	return db, nil
+}
+
+// loadActiveAlarms 恢复重启前的活动报警，规则已删除或禁用的报警不恢复，返回恢复的报警数
+func loadActiveAlarms(db *sql.DB) (int, error) {
+	rows, err := db.Query("SELECT alarm_id, alarm FROM alarm_active")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	almLock.Lock()
+	defer almLock.Unlock()
+	stale := make([]string, 0)
+	for rows.Next() {
+		var alarmID, data string
+		if err = rows.Scan(&alarmID, &data); err != nil {
+			return 0, err
+		}
+		var alarm Alarm
+		if erra := json.Unmarshal([]byte(data), &alarm); erra != nil {
+			stale = append(stale, alarmID)
+			continue
+		}
+		found := false
+		for _, rule := range almDevRules(alarm.DevID) {
+			if rule.RuleID == alarm.RuleID && rule.Enable {
+				// 恢复判断状态，修改设备的其他规则时不会移除该报警
+				almStates[alarmID] = &alarmState{rule: rule, value: alarm.Value, quality: alarm.Quality}
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, alarmID)
+			continue
+		}
+		almActive[alarmID] = &alarm
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+	for _, alarmID := range stale {
+		if _, err = db.Exec("DELETE FROM alarm_active WHERE alarm_id = ?", alarmID); err != nil {
+			return 0, err
+		}
+	}
+	return len(almActive), nil
+}
+
+// alarmJournalWriter 从队列中批量取出报警事件写入报警日志，并同步更新保存的活动报警
+func alarmJournalWriter(db *sql.DB) {
+	for event := range almJournal {
+		batch := []AlarmEvent{event}
+	drain:
+		for len(batch) < 256 {
+			select {
+			case e := <-almJournal:
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+		if err := writeAlarmJournal(db, batch); err != nil {
+			log.Printf("写入报警日志失败: %v", err)
+		}
+		if n := almJournalDrops.Swap(0); n > 0 {
+			log.Printf("报警日志队列已满，共丢弃 %d 个报警事件", n)
+		}
+	}
+}
+
+// writeAlarmJournal 在一个事务中写入一批报警事件，并按事件更新或删除保存的活动报警
+func writeAlarmJournal(db *sql.DB, events []AlarmEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, event := range events {
+		value, _ := json.Marshal(event.Alarm.Value)
+		_, err = tx.Exec(`INSERT INTO alarm_journal (ts, event, alarm_id, dev_id, tag_id, type, priority, value, quality, message, user, comment)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			event.Ts, event.Event, event.Alarm.AlarmID, event.Alarm.DevID, event.Alarm.TagID, event.Alarm.Type,
+			event.Alarm.Priority, string(value), event.Alarm.Quality, event.Alarm.Message, event.User, event.Comment)
+		if err != nil {
+			return err
+		}
+		if alarmRemoved(event) {
+			_, err = tx.Exec("DELETE FROM alarm_active WHERE alarm_id = ?", event.Alarm.AlarmID)
+		} else {
+			alarm, _ := json.Marshal(event.Alarm)
+			_, err = tx.Exec("INSERT OR REPLACE INTO alarm_active (alarm_id, alarm) VALUES (?, ?)", event.Alarm.AlarmID, string(alarm))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// alarmRemoved 事件发生后报警是否已移出活动报警列表：规则移除、已确认的报警恢复、已恢复的报警确认
+func alarmRemoved(event AlarmEvent) bool {
+	switch event.Event {
+	case AlarmEventRemove:
+		return true
+	case AlarmEventClear:
+		return event.Alarm.Acked
+	case AlarmEventAck:
+		return !event.Alarm.Active
+	}
+	return false
+}
+
+// almDevRules 返回设备的报警规则，第一次使用时从 cfgdb 读取，调用者需持有 almLock
+func almDevRules(devid string) []AlarmRule {
+	if rules, ok := almRules[devid]; ok {
+		return rules
+	}
+	rules := []AlarmRule{}
+	if value, err := almCfgdb.Hash().Get(AlarmRuleKey, devid); err == nil {
+		if erra := json.Unmarshal([]byte(value.String()), &rules); erra != nil {
+			log.Printf("Error unmarshalling alarm rules of %s: %v", devid, erra)
+		}
+	}
+	almRules[devid] = rules
+	return rules
+}
+
+// evaluateAlarms 按设备的报警规则判断写入的数据
+func evaluateAlarms(devid string, values map[string]any) {
+	now := time.Now().UnixMilli()
+	var events []AlarmEvent
+	almLock.Lock()
+	if almCfgdb == nil {
+		almLock.Unlock()
+		return
+	}
+	for _, rule := range almDevRules(devid) {
+		if !rule.Enable {
+			continue
+		}
+		value, ok := values[rule.TagID]
+		if !ok {
+			continue
+		}
+		var newValue []any
+		if err := json.Unmarshal(rtRawJSON(value), &newValue); err != nil || len(newValue) <= rtIdxValue {
+			continue
+		}
+		ts := now
+		if len(newValue) > rtIdxMilli {
+			if ms, ok := newValue[rtIdxMilli].(float64); ok {
+				ts = int64(ms)
+			}
+		}
+		alarmID := devid + "/" + rule.RuleID
+		st, ok := almStates[alarmID]
+		if !ok {
+			st = &alarmState{}
+			almStates[alarmID] = st
+		}
+		st.rule = rule
+		st.value = newValue[rtIdxValue]
+		st.quality = QualityOf(newValue)
+		alarm := almActive[alarmID]
+		cond, known := alarmCondition(st, alarm != nil && alarm.Active, ts)
+		if !known {
+			// 值不可信时重新开始延时，alarmTick 不会用不可信的数据产生延时报警
+			st.pendingSince = 0
+			continue
+		}
+		if event := alarmUpdate(devid, st, cond, now); event != nil {
+			events = append(events, *event)
+		}
+	}
+	almLock.Unlock()
+	alarmEmit(events)
+}
+
+// alarmCondition 判断报警条件是否满足，值不可信（质量为 bad 或数据超时）时返回 known=false，保持原来的报警状态
+func alarmCondition(st *alarmState, active bool, ts int64) (cond bool, known bool) {
+	rule := st.rule
+	if rule.Type == AlarmTypeQuality {
+		return IsBadQuality(st.quality), true
+	}
+	if IsBadQuality(st.quality) || st.quality == QualityUncertainStale {
+		return false, false
+	}
+	if rule.Type == AlarmTypeState {
+		return alarmValueEqual(st.value, rule.Value), true
+	}
+	f, err := toFloat64(st.value)
+	if err != nil {
+		return false, false
+	}
+	switch rule.Type {
+	case AlarmTypeHiHi, AlarmTypeHi:
+		if active {
+			return f > rule.Limit-rule.Deadband, true
+		}
+		return f > rule.Limit, true
+	case AlarmTypeLo, AlarmTypeLoLo:
+		if active {
+			return f < rule.Limit+rule.Deadband, true
+		}
+		return f < rule.Limit, true
+	case AlarmTypeROC:
+		prev, prevTs, hasPrev := st.prevNum, st.prevTs, st.hasPrev
+		if hasPrev && ts <= prevTs {
+			return false, false
+		}
+		st.prevNum, st.prevTs, st.hasPrev = f, ts, true
+		if !hasPrev {
+			return false, false
+		}
+		rate := math.Abs(f-prev) / (float64(ts-prevTs) / 1000)
+		if active {
+			return rate > rule.Limit-rule.Deadband, true
+		}
+		return rate > rule.Limit, true
+	}
+	return false, false
+}
+
+// alarmValueEqual 判断点的值是否等于 state 报警的状态值，能转换为数值时按数值比较
+func alarmValueEqual(value any, target any) bool {
+	if target == nil {
+		return false
+	}
+	f1, err1 := toFloat64(value)
+	f2, err2 := toFloat64(target)
+	if err1 == nil && err2 == nil {
+		return f1 == f2
+	}
+	return fmt.Sprint(value) == fmt.Sprint(target)
+}
+
+// alarmUpdate 根据报警条件更新报警状态，返回产生的事件，调用者需持有 almLock
+func alarmUpdate(devid string, st *alarmState, cond bool, now int64) *AlarmEvent {
+	alarmID := devid + "/" + st.rule.RuleID
+	alarm := almActive[alarmID]
+	if cond {
+		if alarm != nil && alarm.Active {
+			alarm.Value, alarm.Quality = st.value, st.quality
+			return nil
+		}
+		if st.pendingSince == 0 {
+			st.pendingSince = now
+		}
+		if now-st.pendingSince < int64(st.rule.Delay)*1000 {
+			return nil
+		}
+		return alarmRaise(devid, st, now)
+	}
+	st.pendingSince = 0
+	if alarm == nil || !alarm.Active {
+		return nil
+	}
+	alarm.Active = false
+	alarm.ClearedAt = now
+	alarm.Value, alarm.Quality = st.value, st.quality
+	event := &AlarmEvent{Event: AlarmEventClear, Ts: now, Alarm: *alarm}
+	if alarm.Acked {
+		delete(almActive, alarmID)
+	}
+	return event
+}
+
+// alarmRaise 产生报警，未确认的报警再次产生时重新计时，保留屏蔽状态，调用者需持有 almLock
+func alarmRaise(devid string, st *alarmState, now int64) *AlarmEvent {
+	rule := st.rule
+	alarmID := devid + "/" + rule.RuleID
+	alarm, ok := almActive[alarmID]
+	if !ok {
+		alarm = &Alarm{AlarmID: alarmID, DevID: devid, RuleID: rule.RuleID}
+		almActive[alarmID] = alarm
+	}
+	alarm.TagID = rule.TagID
+	alarm.Type = rule.Type
+	alarm.Priority = rule.Priority
+	alarm.Message = rule.Message
+	alarm.Limit = rule.Limit
+	alarm.Value, alarm.Quality = st.value, st.quality
+	alarm.Active = true
+	alarm.Acked, alarm.AckedBy, alarm.AckedAt = false, "", 0
+	alarm.RaisedAt = now
+	alarm.ClearedAt = 0
+	st.pendingSince = 0
+	return &AlarmEvent{Event: AlarmEventRaise, Ts: now, Alarm: *alarm}
+}
+
+// alarmTick 产生延时到期的报警，取消到期的屏蔽。数据不变化时南向实例可能不再写入，因此延时需要单独检查
+func alarmTick() {
+	now := time.Now().UnixMilli()
+	var events []AlarmEvent
+	almLock.Lock()
+	for alarmID, st := range almStates {
+		if !st.rule.Enable || st.pendingSince == 0 || now-st.pendingSince < int64(st.rule.Delay)*1000 {
+			continue
+		}
+		if alarm := almActive[alarmID]; alarm != nil && alarm.Active {
+			continue
+		}
+		devid := strings.TrimSuffix(alarmID, "/"+st.rule.RuleID)
+		events = append(events, *alarmRaise(devid, st, now))
+	}
+	for _, alarm := range almActive {
+		if alarm.Shelved && alarm.ShelvedUntil != 0 && now >= alarm.ShelvedUntil {
+			alarm.Shelved, alarm.ShelvedUntil = false, 0
+			events = append(events, AlarmEvent{Event: AlarmEventUnshelve, Ts: now, Alarm: *alarm})
+		}
+	}
+	almLock.Unlock()
+	alarmEmit(events)
+}
+
+// alarmEmit 把报警事件放入报警日志的写入队列并推送给订阅者，屏蔽的报警不推送产生和恢复事件
+func alarmEmit(events []AlarmEvent) {
+	for _, event := range events {
+		if almdb != nil {
+			select {
+			case almJournal <- event:
+			default:
+				almJournalDrops.Add(1)
+			}
+		}
+		if event.Alarm.Shelved && (event.Event == AlarmEventRaise || event.Event == AlarmEventClear) {
+			continue
+		}
+		almSubLock.Lock()
+		for ch := range almSubscribers {
+			select {
+			case ch <- event:
+			default:
+				almSubscribers[ch]++
+			}
+		}
+		almSubLock.Unlock()
+	}
+}
+
+// subscribeAlarms 订阅报警事件，订阅者处理不及时时丢弃事件，不阻塞报警判断
+func subscribeAlarms() chan AlarmEvent {
+	ch := make(chan AlarmEvent, 256)
+	almSubLock.Lock()
+	almSubscribers[ch] = 0
+	almSubLock.Unlock()
+	return ch
+}
+
+// unsubscribeAlarms 取消订阅报警事件
+func unsubscribeAlarms(ch chan AlarmEvent) {
+	almSubLock.Lock()
+	dropped := almSubscribers[ch]
+	delete(almSubscribers, ch)
+	almSubLock.Unlock()
+	if dropped > 0 {
+		log.Printf("报警订阅者处理不及时，共丢弃 %d 个报警事件", dropped)
+	}
+}
+
+// checkAlarmRules 检查报警规则
+func checkAlarmRules(rules []AlarmRule) error {
+	ruleIDs := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.RuleID == "" || rule.TagID == "" {
+			return fmt.Errorf("ruleId and tagId are required")
+		}
+		if ruleIDs[rule.RuleID] {
+			return fmt.Errorf("ruleId '%s' is duplicated", rule.RuleID)
+		}
+		ruleIDs[rule.RuleID] = true
+		if !ContainsString(almTypes, rule.Type) {
+			return fmt.Errorf("rule '%s': type '%s' is not supported", rule.RuleID, rule.Type)
+		}
+		if rule.Type == AlarmTypeState && rule.Value == nil {
+			return fmt.Errorf("rule '%s': value is required for state alarm", rule.RuleID)
+		}
+		if rule.Deadband < 0 || rule.Delay < 0 {
+			return fmt.Errorf("rule '%s': deadband and delay must not be negative", rule.RuleID)
+		}
+	}
+	return nil
+}
+
+// @Summary 查询报警规则
+// @Description 查询设备的报警规则，devId 为空时返回所有设备的报警规则
+// @Tags Alarm Manager
+// @Accept json
+// @Produce json
+// @Param devid body DevInfo true "DevId"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/getAlarmRules [post]
+func GetAlarmRules(c *gin.Context, cfgdb *redka.DB) {
+	var devInfo DevInfo
+	if err := c.ShouldBindJSON(&devInfo); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	values, err := cfgdb.Hash().Items(AlarmRuleKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from database"})
+		return
+	}
+	rulesMap := make(map[string][]AlarmRule)
+	for key, value := range values {
+		if devInfo.DevId != "" && key != devInfo.DevId {
+			continue
+		}
+		var rules []AlarmRule
+		if erra := json.Unmarshal([]byte(value.String()), &rules); erra != nil {
+			continue
+		}
+		rulesMap[key] = rules
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read alarm rules",
+		"data":    rulesMap,
+	})
+}
+
+// @Summary 修改报警规则
+// @Description 修改设备的全部报警规则，rules 为空时删除设备的报警规则。被删除的规则对应的活动报警移出活动报警列表
+// @Tags Alarm Manager
+// @Accept json
+// @Produce json
+// @Param rules body AlarmRulesReq true "alarm rules"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/setAlarmRules [post]
+func SetAlarmRules(c *gin.Context, cfgdb *redka.DB) {
+	var req AlarmRulesReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	isExist, _ := cfgdb.Hash().Exists(DevAtInstKey, req.DevID)
+	if !isExist {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devId '%s' is not exist", req.DevID)})
+		return
+	}
+	if err := checkAlarmRules(req.Rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before := []AlarmRule{}
+	if value, errg := cfgdb.Hash().Get(AlarmRuleKey, req.DevID); errg == nil {
+		_ = json.Unmarshal([]byte(value.String()), &before)
+	}
+	var err error
+	if len(req.Rules) == 0 {
+		req.Rules = []AlarmRule{}
+		_, err = cfgdb.Hash().Delete(AlarmRuleKey, req.DevID)
+	} else {
+		jsonstr, _ := json.Marshal(req.Rules)
+		_, err = cfgdb.Hash().Set(AlarmRuleKey, req.DevID, jsonstr)
+	}
+	auditAPI(c, AuditUpdate, "alarmRules", req.DevID, before, req.Rules, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to write data to database"})
+		return
+	}
+
+	updateAlarmRules(req.DevID, req.Rules)
+	commitRevision(c, cfgdb, AuditUpdate, "alarmRules", req.DevID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to write alarm rules",
+		"data":    req,
+	})
+}
+
+// updateAlarmRules 更新设备报警规则的缓存，删除已不存在、禁用或修改的规则的判断状态和活动报警，
+// 修改的规则按新的规则重新判断
+func updateAlarmRules(devid string, rules []AlarmRule) {
+	now := time.Now().UnixMilli()
+	kept := make(map[string]AlarmRule)
+	for _, rule := range rules {
+		if rule.Enable {
+			kept[devid+"/"+rule.RuleID] = rule
+		}
+	}
+	var events []AlarmEvent
+	almLock.Lock()
+	almRules[devid] = rules
+	prefix := devid + "/"
+	// unchanged 判断报警ID对应的规则仍然启用并且没有修改
+	unchanged := make(map[string]bool)
+	for alarmID, st := range almStates {
+		if !strings.HasPrefix(alarmID, prefix) {
+			continue
+		}
+		rule, ok := kept[alarmID]
+		if !ok || !reflect.DeepEqual(rule, st.rule) {
+			delete(almStates, alarmID)
+			continue
+		}
+		st.rule = rule
+		unchanged[alarmID] = true
+	}
+	for alarmID, alarm := range almActive {
+		if alarm.DevID == devid && !unchanged[alarmID] {
+			delete(almActive, alarmID)
+			events = append(events, AlarmEvent{Event: AlarmEventRemove, Ts: now, Alarm: *alarm})
+		}
+	}
+	almLock.Unlock()
+	alarmEmit(events)
+}
+
+// @Summary 查询活动报警
+// @Description 查询活动报警列表（报警中或未确认），按优先级和产生时间倒序排列，devId 为空时返回所有设备的报警
+// @Tags Alarm Manager
+// @Accept json
+// @Produce json
+// @Param devid body DevInfo true "DevId"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/listAlarms [post]
+func ListAlarms(c *gin.Context) {
+	var devInfo DevInfo
+	if err := c.ShouldBindJSON(&devInfo); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	alarms := []Alarm{}
+	almLock.Lock()
+	for _, alarm := range almActive {
+		if devInfo.DevId == "" || alarm.DevID == devInfo.DevId {
+			alarms = append(alarms, *alarm)
+		}
+	}
+	almLock.Unlock()
+	sort.Slice(alarms, func(i, j int) bool {
+		if alarms[i].Priority != alarms[j].Priority {
+			return alarms[i].Priority > alarms[j].Priority
+		}
+		return alarms[i].RaisedAt > alarms[j].RaisedAt
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to list alarms",
+		"data":    alarms,
+	})
+}
+
+// @Summary 确认报警
+// @Description 确认活动报警，已恢复的报警确认后移出活动报警列表
+// @Tags Alarm Manager
+// @Accept json
+// @Produce json
+// @Param ack body AlarmAckReq true "alarm ids"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/ackAlarms [post]
+func AckAlarms(c *gin.Context) {
+	var req AlarmAckReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// 确认人取登录用户，不使用请求中的内容
+	user := c.GetString("user")
+	now := time.Now().UnixMilli()
+	var events []AlarmEvent
+	acked := []string{}
+	almLock.Lock()
+	for _, alarmID := range req.AlarmIDs {
+		alarm, ok := almActive[alarmID]
+		if !ok || alarm.Acked {
+			continue
+		}
+		alarm.Acked, alarm.AckedBy, alarm.AckedAt = true, user, now
+		events = append(events, AlarmEvent{Event: AlarmEventAck, Ts: now, User: user, Comment: req.Comment, Alarm: *alarm})
+		if !alarm.Active {
+			delete(almActive, alarmID)
+		}
+		acked = append(acked, alarmID)
+	}
+	almLock.Unlock()
+	alarmEmit(events)
+	for _, event := range events {
+		auditAPI(c, AuditAck, "alarm", event.Alarm.AlarmID, nil, map[string]any{"comment": req.Comment}, nil)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to ack alarms",
+		"data":    acked,
+	})
+}
+
+// @Summary 屏蔽报警
+// @Description 屏蔽活动报警 duration 秒，屏蔽期间报警照常判断和记录，但不推送产生和恢复事件；duration 为 0 时取消屏蔽
+// @Tags Alarm Manager
+// @Accept json
+// @Produce json
+// @Param shelve body AlarmAckReq true "alarm ids"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/shelveAlarms [post]
+func ShelveAlarms(c *gin.Context) {
+	var req AlarmAckReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Duration < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duration must not be negative"})
+		return
+	}
+	user := c.GetString("user")
+	now := time.Now().UnixMilli()
+	var events []AlarmEvent
+	changed := []string{}
+	almLock.Lock()
+	for _, alarmID := range req.AlarmIDs {
+		alarm, ok := almActive[alarmID]
+		if !ok {
+			continue
+		}
+		event := AlarmEventShelve
+		if req.Duration == 0 {
+			if !alarm.Shelved {
+				continue
+			}
+			event = AlarmEventUnshelve
+			alarm.Shelved, alarm.ShelvedUntil = false, 0
+		} else {
+			alarm.Shelved, alarm.ShelvedUntil = true, now+int64(req.Duration)*1000
+		}
+		events = append(events, AlarmEvent{Event: event, Ts: now, User: user, Comment: req.Comment, Alarm: *alarm})
+		changed = append(changed, alarmID)
+	}
+	almLock.Unlock()
+	alarmEmit(events)
+	for _, event := range events {
+		auditAPI(c, AuditShelve, "alarm", event.Alarm.AlarmID, nil,
+			map[string]any{"shelvedUntil": event.Alarm.ShelvedUntil, "comment": req.Comment}, nil)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to shelve alarms",
+		"data":    changed,
+	})
+}
+
+// @Summary 查询报警日志
+// @Description 按时间范围查询报警的产生、恢复、确认和屏蔽记录，按时间倒序排列
+// @Tags Alarm Manager
+// @Accept json
+// @Produce json
+// @Param query body AlarmJournalReq true "journal query"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/getAlarmJournal [post]
+func GetAlarmJournal(c *gin.Context) {
+	var req AlarmJournalReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if almdb == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "alarm engine is not running"})
+		return
+	}
+	if req.End == 0 {
+		req.End = time.Now().UnixMilli()
+	}
+	if req.Start == 0 {
+		req.Start = req.End - 24*time.Hour.Milliseconds()
+	}
+	if req.Limit <= 0 {
+		req.Limit = almMaxRows
+	}
+	query := `SELECT ts, event, alarm_id, dev_id, tag_id, type, priority, value, quality, message, user, comment
+		FROM alarm_journal WHERE ts >= ? AND ts <= ?`
+	args := []any{req.Start, req.End}
+	if req.DevID != "" {
+		query += " AND dev_id = ?"
+		args = append(args, req.DevID)
+	}
+	if req.AlarmID != "" {
+		query += " AND alarm_id = ?"
+		args = append(args, req.AlarmID)
+	}
+	query += " ORDER BY ts DESC, id DESC LIMIT ?"
+	args = append(args, req.Limit)
+
+	rows, err := almdb.Query(query, args...)
+	if err != nil {
+		log.Println("Error reading from alarm database:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from alarm database"})
+		return
+	}
+	defer rows.Close()
+	events := []AlarmEvent{}
+	for rows.Next() {
+		var event AlarmEvent
+		var tagid, alarmType, value, quality, message, user, comment sql.NullString
+		var priority sql.NullInt64
+		if err = rows.Scan(&event.Ts, &event.Event, &event.Alarm.AlarmID, &event.Alarm.DevID, &tagid, &alarmType,
+			&priority, &value, &quality, &message, &user, &comment); err != nil {
+			log.Println("Error reading from alarm database:", err)
+			continue
+		}
+		event.Alarm.TagID, event.Alarm.Type = tagid.String, alarmType.String
+		event.Alarm.Priority = int(priority.Int64)
+		event.Alarm.Quality, event.Alarm.Message = quality.String, message.String
+		event.User, event.Comment = user.String, comment.String
+		if value.Valid {
+			_ = json.Unmarshal([]byte(value.String), &event.Alarm.Value)
+		}
+		event.Alarm.RuleID = strings.TrimPrefix(event.Alarm.AlarmID, event.Alarm.DevID+"/")
+		events = append(events, event)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read alarm journal",
+		"data":    events,
+	})
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nalgeon/redka"
+)
+
+// useAlarmState 为测试设置报警引擎的配置库并清空报警状态，测试结束后恢复
+func useAlarmState(t *testing.T, rules map[string][]AlarmRule) {
+	t.Helper()
+	db, err := redka.Open("file:/"+strings.ReplaceAll(t.Name(), "/", "_")+".db?vfs=memdb", &redka.Options{DriverName: "sqlite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for devid, devRules := range rules {
+		value, _ := json.Marshal(devRules)
+		if _, err = db.Hash().Set(AlarmRuleKey, devid, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	almLock.Lock()
+	oldCfgdb, oldRules, oldStates, oldActive := almCfgdb, almRules, almStates, almActive
+	almCfgdb = db
+	almRules = make(map[string][]AlarmRule)
+	almStates = make(map[string]*alarmState)
+	almActive = make(map[string]*Alarm)
+	almLock.Unlock()
+	t.Cleanup(func() {
+		almLock.Lock()
+		almCfgdb, almRules, almStates, almActive = oldCfgdb, oldRules, oldStates, oldActive
+		almLock.Unlock()
+		db.Close()
+	})
+}
+
+func TestAlarmDelayNeedsTrustedValue(t *testing.T) {
+	rule := AlarmRule{RuleID: "r1", TagID: "t1", Type: AlarmTypeHi, Limit: 10, Delay: 1, Enable: true}
+	tests := []struct {
+		name      string
+		quality   string
+		wantAlarm bool
+	}{
+		{"good value keeps the delay", QualityGood, true},
+		{"bad value restarts the delay", QualityBad, false},
+		{"stale value restarts the delay", QualityUncertainStale, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useAlarmState(t, map[string][]AlarmRule{"D": {rule}})
+			evaluateAlarms("D", map[string]any{"t1": rtValue(time.Now(), 20, QualityGood)})
+			evaluateAlarms("D", map[string]any{"t1": rtValue(time.Now(), 20, tt.quality)})
+			// 延时已到期
+			almLock.Lock()
+			st := almStates["D/r1"]
+			if st != nil && st.pendingSince != 0 {
+				st.pendingSince -= 2000
+			}
+			almLock.Unlock()
+			if st == nil {
+				t.Fatal("alarm state is missing")
+			}
+			alarmTick()
+			almLock.Lock()
+			_, got := almActive["D/r1"]
+			almLock.Unlock()
+			if got != tt.wantAlarm {
+				t.Fatalf("alarm raised = %v, want %v", got, tt.wantAlarm)
+			}
+		})
+	}
+}
+
+func TestAlarmActiveRestore(t *testing.T) {
+	db, err := openAlarmDB(filepath.Join(t.TempDir(), "alarm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	alarm := func(ruleID string, active bool, acked bool) Alarm {
+		return Alarm{AlarmID: "D/" + ruleID, DevID: "D", RuleID: ruleID, TagID: "t1", Type: AlarmTypeHi, Active: active, Acked: acked}
+	}
+	events := []AlarmEvent{
+		{Event: AlarmEventRaise, Alarm: alarm("active", true, false)},
+		{Event: AlarmEventRaise, Alarm: alarm("cleared", true, false)},
+		{Event: AlarmEventClear, Alarm: alarm("cleared", false, false)},
+		{Event: AlarmEventRaise, Alarm: alarm("clearedAcked", true, false)},
+		{Event: AlarmEventAck, Alarm: alarm("clearedAcked", true, true)},
+		{Event: AlarmEventClear, Alarm: alarm("clearedAcked", false, true)},
+		{Event: AlarmEventRaise, Alarm: alarm("ackedAfterClear", true, false)},
+		{Event: AlarmEventClear, Alarm: alarm("ackedAfterClear", false, false)},
+		{Event: AlarmEventAck, Alarm: alarm("ackedAfterClear", false, true)},
+		{Event: AlarmEventRaise, Alarm: alarm("removed", true, false)},
+		{Event: AlarmEventRemove, Alarm: alarm("removed", true, false)},
+		{Event: AlarmEventRaise, Alarm: alarm("disabled", true, false)},
+		{Event: AlarmEventRaise, Alarm: alarm("deleted", true, false)},
+	}
+	if err = writeAlarmJournal(db, events); err != nil {
+		t.Fatal(err)
+	}
+	var journal int
+	if err = db.QueryRow("SELECT COUNT(*) FROM alarm_journal").Scan(&journal); err != nil || journal != len(events) {
+		t.Fatalf("journal has %d events, err %v, want %d", journal, err, len(events))
+	}
+
+	// 重启后 disabled 的规则已禁用，deleted 的规则已删除
+	rule := func(ruleID string, enable bool) AlarmRule {
+		return AlarmRule{RuleID: ruleID, TagID: "t1", Type: AlarmTypeHi, Limit: 10, Enable: enable}
+	}
+	useAlarmState(t, map[string][]AlarmRule{"D": {
+		rule("active", true), rule("cleared", true), rule("clearedAcked", true),
+		rule("ackedAfterClear", true), rule("removed", true), rule("disabled", false),
+	}})
+	n, err := loadActiveAlarms(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		alarmID string
+		want    bool
+	}{
+		{"D/active", true},
+		{"D/cleared", true},
+		{"D/clearedAcked", false},
+		{"D/ackedAfterClear", false},
+		{"D/removed", false},
+		{"D/disabled", false},
+		{"D/deleted", false},
+	}
+	if n != 2 {
+		t.Errorf("loadActiveAlarms() = %d, want 2", n)
+	}
+	for _, tt := range tests {
+		_, got := almActive[tt.alarmID]
+		_, hasState := almStates[tt.alarmID]
+		if got != tt.want || hasState != tt.want {
+			t.Errorf("%s restored = %v, state = %v, want %v", tt.alarmID, got, hasState, tt.want)
+		}
+	}
+	var saved int
+	if err = db.QueryRow("SELECT COUNT(*) FROM alarm_active").Scan(&saved); err != nil || saved != 2 {
+		t.Fatalf("alarm_active has %d rows, err %v, want 2", saved, err)
+	}
+	if cleared := almActive["D/cleared"]; cleared == nil || cleared.Active || cleared.Acked {
+		t.Fatalf("D/cleared = %+v, want inactive and not acked", cleared)
+	}
+}
@@ -50,6 +50,17 @@ var (
 			"autoStart": false,
 			"config":    "{}",
 		},
+		"calc": {
+			"appCode":   "calc",
+			"appType":   "toSouth",
+			"instId":    "",
+			"instName":  "calc app",
+			"autoStart": false,
+			"config": map[string]any{
+				"cycle":    1,    // 周期计算的间隔(秒)，0 表示只在引用的点变化时计算
+				"onChange": true, // 引用的点变化时计算依赖它的点
+			},
+		},
 		"mqttpub": {
 			"appCode":   "mqttpub",
 			"appType":   "toNorth",
@@ -66,6 +77,9 @@ var (
 					"DEV_7JF3ZMbgvQfvAYpo",
 					"DEV_657ZMbgvQ4368Ypo",
 				},
+				"cmdTopic":   "",
+				"respTopic":  "",
+				"alarmTopic": "",
 			},
 		},
 		"dsTDengine": {
@@ -75,13 +89,14 @@ var (
 			"instName":  "dsTDengine app",
 			"autoStart": false,
 			"config": map[string]any{
-				"host":     "host or ip",
-				"port":     6041,
-				"username": "root",
-				"password": "taosdata",
-				"database": "db01",
-				"tbType":   "table",
-				"cycle":    5,
+				"host":        "host or ip",
+				"port":        6041,
+				"username":    "root",
+				"password":    "taosdata",
+				"database":    "db01",
+				"tbType":      "table", // table: 每个点一张表, stable: 每种设备类型一张超级表
+				"cycle":       5,
+				"batchCycles": 1, // 每次写入合并的周期数
 				"deviceList": []string{
 					"DEV_7JF3ZMbgvQfvAYpo",
 					"DEV_657ZMbgvQ4368Ypo",
@@ -95,11 +110,21 @@ var (
 			"instName":  "dsInfluxdb app",
 			"autoStart": false,
 			"config": map[string]any{
-				"host":   "Influxdb_url",
-				"token":  "token",
-				"org":    "org",
-				"bucket": "bucket",
-				"cycle":  5,
+				"host":             "Influxdb_url",
+				"version":          "v2", // v2: token/org/bucket, v1: username/password/database/retentionPolicy
+				"token":            "token",
+				"org":              "org",
+				"bucket":           "bucket",
+				"username":         "",
+				"password":         "",
+				"database":         "",
+				"retentionPolicy":  "",
+				"cycle":            5,
+				"batchSize":        500,   // 每批写入的点数
+				"flushInterval":    1000,  // 最长刷新间隔(毫秒)
+				"retryBufferLimit": 50000, // 内存中等待重试的最大点数
+				"maxRetries":       5,     // 重试次数，超过后写入溢出文件
+				"overflowMaxMB":    100,   // 溢出文件的最大大小(MB)
 				"deviceList": []string{
 					"DEV_7JF3ZMbgvQfvAYpo",
 					"DEV_657ZMbgvQ4368Ypo",
@@ -116,7 +141,7 @@ var (
 				"bool1":    []any{"bool1", "bool", "布尔量1", 1, "01", 0, "bool"},
 				"analog1":  []any{"analog1", "float", "模拟量1", 1, "03", 0, "float32"},
 				"digital1": []any{"digital1", "int", "数字量1", 1, "03", 2, "int16"},
-				"digital2": []any{"digital2", "int", "数字量2", 1, "04", 4, "int32"},
+				"digital2": []any{"digital2", "int", "数字量2", 1, "04", 4, "int16"},
 			},
 		},
 		"opcda": {
@@ -134,11 +159,21 @@ var (
 			"instid": "opcua@g53tOZn138pdXnup",
 			"tagsMap": map[string]any{
 				"tag1": []any{"tag1", "布尔量1", "bool", "ns=2;s=数据类型示例.8 位设备.B 寄存器.Boolean1"},
-				"tag2": []any{"tag2", "模拟量1", "float", "ns=2;s=模拟器示例.函数.Sine1"},
+				"tag2": []any{"tag2", "模拟量1", "float", "ns=2;s=模拟器示例.函数.Sine1", map[string]any{"unit": "℃", "scale": 10, "offset": -20, "decimals": 1}},
 				"tag3": []any{"tag3", "数字量1", "int", "ns=2;s=模拟器示例.函数.Ramp1"},
 				"tag4": []any{"tag4", "字符量1", "string", "ns=2;s=数据类型示例.8 位设备.S 寄存器.String1"},
 			},
 		},
+		"calc": {
+			"devId":  "DEV_9KC3ZMbgvQfvAcal",
+			"instid": "calc@c53tOZn138pdXcal",
+			"tagsMap": map[string]any{
+				"power":  []any{"power", "功率", "float", "[DEV_7JF3ZMbgvQfvAYpo.analog1] * [DEV_7JF3ZMbgvQfvAYpo.digital1] / 1000"},
+				"energy": []any{"energy", "累计电量", "float", "integrate(power, 1/3600)"},
+				"avg5m":  []any{"avg5m", "5分钟平均功率", "float", "round(avg(power, 300), 2)"},
+				"alarm":  []any{"alarm", "状态字第0位", "bool", "bit([DEV_7JF3ZMbgvQfvAYpo.digital1], 0) == 1"},
+			},
+		},
 		"simulator": {
 			"devId":  "DEV_7JF3ZMbgvQfvAYpo",
 			"instid": "simulator@888tOZn138pdXqyz",
@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/nalgeon/redka"
 	"log"
+	"log/slog"
 	"net/http"
 	"time"
 )
@@ -27,6 +28,7 @@ type AppConfig struct {
 // 定义 InstInfo 结构体
 type InstInfo struct {
 	InstId string `json:"instid"`
+	Policy string `json:"policy,omitempty"` // 删除时实例仍有设备的处理方式：forbid(默认)/cascade
 }
 
 // 定义 AppInfo 结构体
@@ -61,7 +63,7 @@ func GetAppDefault(c *gin.Context) {
 		return
 	}
 
-	fmt.Printf("newValue: %v\n", newValue["appConfig"])
+	slog.Debug("读取实例默认配置", "appCode", appcode)
 	// 返回数据库cfgdb中App配置信息 列表
 	c.JSON(http.StatusOK, gin.H{
 		"message": "get app_default ok",
@@ -116,7 +118,7 @@ func ListApps(c *gin.Context, cfgdb *redka.DB) {
 		var newValue AppConfig
 		erra := json.Unmarshal([]byte(value.String()), &newValue)
 		if erra != nil {
-			fmt.Println("Error unmarshalling JSON:", erra)
+			slog.Error("解析实例配置失败", "instId", key, "err", erra)
 			return
 		}
 
@@ -159,7 +161,7 @@ func NewApp(c *gin.Context, cfgdb *redka.DB) {
 		return
 	}
 	// 检查 appCode 是否有效
-	fmt.Printf("%+v,appConfig: %+v\n", iotappCode, appConfig)
+	slog.Debug("新增实例", "appCode", appConfig.AppCode)
 	if !contains(iotappCode, appConfig.AppCode) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "Invalid appCode",
@@ -178,6 +180,15 @@ func NewApp(c *gin.Context, cfgdb *redka.DB) {
 		return
 	}
 
+	// deviceList 中的设备需要存在
+	if err := checkDeviceList(cfgdb, appConfig); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid deviceList",
+			"details": err.Error(),
+		})
+		return
+	}
+
 	// 生成一个新的16位 UUID
 	uuidstr := appConfig.AppCode + "@" + GenID(8)
 
@@ -193,6 +204,8 @@ func NewApp(c *gin.Context, cfgdb *redka.DB) {
 		})
 		return
 	}
+	auditAPI(c, AuditCreate, "app", uuidstr, nil, appConfig, nil)
+	commitRevision(c, cfgdb, AuditCreate, "app", uuidstr)
 	// 返回数据库cfgdb中App配置信息 列表
 	c.JSON(http.StatusOK, gin.H{
 		"message":   "New App Creat OK",
@@ -201,7 +214,8 @@ func NewApp(c *gin.Context, cfgdb *redka.DB) {
 }
 
 // @Summary 删除App实例
-// @Description 这是一个删除App实例的接口
+// @Description 这是一个删除App实例的接口，policy 为 forbid(默认) 时实例仍有设备不能删除，
+// @Description 为 cascade 时同时删除实例的设备及其点表、报警规则和历史数据配置，并从北向实例的 deviceList 中移除
 // @Tags APP Manager
 // @Accept json
 // @Produce json
@@ -209,64 +223,43 @@ func NewApp(c *gin.Context, cfgdb *redka.DB) {
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]interface{}
 // @Router /api/v1/delApp [post]
-func DelApp(c *gin.Context, cfgdb *redka.DB) {
+func DelApp(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
 	var instopt InstInfo
 	if err := c.ShouldBindJSON(&instopt); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	devvalues, _ := cfgdb.Hash().Items(DevAtInstKey)
-	existsDev := false
-	for _, value := range devvalues {
-		var newValue DevConfig
-		erra := json.Unmarshal([]byte(value.String()), &newValue)
-		if erra != nil {
-			fmt.Println("Error unmarshalling JSON:", erra)
-			continue
-		}
-		//fmt.Printf("devId: %+v, InstId: %+v\n",key newValue.InstID)
-		if instopt.InstId == newValue.InstID {
-			existsDev = true
-		}
-	}
-	if existsDev {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "The instance is being used by the device and cannot be deleted",
-			"result":  "failed",
-		})
-		return
-	}
-
-	workersLock.Lock()
-	defer workersLock.Unlock()
-	instid := instopt.InstId
-	// 查找子线程的停止通道
-	stopChan, exists := Workers[instid]
-	if exists {
-		// 发送停止信号
-		close(stopChan)
-		// 从全局变量中移除子线程
-		delete(Workers, instid)
-	}
-	_, err := cfgdb.Hash().Delete(InstListKey, instopt.InstId)
+	result, before, err := deleteConfig(cfgdb, rtdb, []string{instopt.InstId}, nil, instopt.Policy)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		if refErr, ok := err.(*ConfigRefError); ok {
+			c.JSON(http.StatusConflict, gin.H{
+				"message": "The instance is being referenced and cannot be deleted",
+				"result":  "failed",
+				"details": refErr.Message,
+				"refs":    refErr.Refs,
+			})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "Failed to delete app instance",
 			"result":  "failed",
 			"error":   err.Error(),
 		})
 		return
 	}
+	if before != nil {
+		auditDelete(c, cfgdb, before, result)
+	}
 	// 返回数据库cfgdb中App配置信息 列表
 	c.JSON(http.StatusOK, gin.H{
 		"message": "App instance deleted",
 		"result":  "success",
-		"data":    instopt,
+		"data":    result,
 	})
 }
 
 // @Summary 修改App实例配置
-// @Description 这是一个修改App实例配置的接口
+// @Description 这是一个修改App实例配置的接口，运行中的实例重新读取配置，只有连接参数变化时重新连接
 // @Tags APP Manager
 // @Accept json
 // @Produce json
@@ -317,10 +310,19 @@ func ModApp(c *gin.Context, cfgdb *redka.DB) {
 		return
 	}
 
+	if err := checkDeviceList(cfgdb, appConfig); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid deviceList",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	before, _ := getAppConfig(cfgdb, uuidstr)
 	jsonstr, _ := json.Marshal(appConfig)
-	// 打印 anyConfig
-	fmt.Printf("appConfig: %+v\n", jsonstr)
+	slog.Debug("修改实例配置", "instId", uuidstr)
 	_, errb := cfgdb.Hash().Set(InstListKey, uuidstr, jsonstr)
+	auditAPI(c, AuditUpdate, "app", uuidstr, before, appConfig, errb)
 	if errb != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "App Modify Fail",
@@ -328,6 +330,9 @@ func ModApp(c *gin.Context, cfgdb *redka.DB) {
 		})
 		return
 	}
+	// 运行中的实例重新读取配置，连接参数变化时重新连接
+	publishConfig("app", AuditUpdate, uuidstr)
+	commitRevision(c, cfgdb, AuditUpdate, "app", uuidstr)
 	// 返回数据库cfgdb中App配置信息 列表
 	c.JSON(http.StatusOK, gin.H{
 		"message": "App Modify OK",
@@ -383,8 +388,6 @@ func StartApp(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	workersLock.Lock()
-	defer workersLock.Unlock()
 	instid := instopt.InstId
 	appcode, _ := extractChar(instid)
 	isSupport, msg := appCheck(appcode)
@@ -392,7 +395,7 @@ func StartApp(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
 	if !isSupport {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": appcode + " not support",
-			"details": fmt.Sprintf(msg),
+			"details": msg,
 		})
 		return
 	}
@@ -406,12 +409,8 @@ func StartApp(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
 	//	})
 	//	return
 	//}
-	now := time.Now()
-	formattedDate := now.Format("2006-01-02 15:04:05")
 	// 检查 funcMap 中是否存在对应的函数
-	//fmt.Printf("%v , %v \n", appcode, instid)
-	fn, exists := IotappMap[appcode]
-	if !exists {
+	if _, exists := IotappMap[appcode]; !exists {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "Function not found",
 			"details": fmt.Sprintf("appCode '%s' has no associated function", appcode),
@@ -419,38 +418,24 @@ func StartApp(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
 		return
 	}
 	// 检查子线程是否已经在运行
-	if _, cexists := Workers[instid]; cexists {
+	if isWorkerRunning(instid) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "Worker " + instid + " is running",
 			"data":    instopt,
 		})
 		return
 	}
-	// 创建停止通道
-	stopChan := make(chan struct{})
-
-	// 启动子线程
-	go func() {
-		defer func() {
-			// 使用 select 检查 channel 是否已关闭
-			select {
-			case <-stopChan:
-				// channel 已关闭，无需再次关闭
-			default:
-				close(stopChan) // 关闭 channel
-			}
-			// 通知全局变量 Workers 删除对应的线程 ID
-			workersLock.Lock()
-			delete(Workers, instid)
-			workersLock.Unlock()
-			fmt.Printf("StartApp提示：Worker退出,线程ID: %s 已从全局变量中删除\n", instid)
-		}()
-		fn(instid, stopChan, cfgdb, rtdb) // 调用对应的函数
-	}()
-	// 将子线程的停止通道存储到全局变量中
-	Workers[instid] = stopChan
+	err := StartInstance(instid, cfgdb, rtdb)
+	auditAPI(c, AuditStart, "app", instid, nil, nil, err)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Worker start fail",
+			"details": err.Error(),
+		})
+		return
+	}
 	// 返回子线程 ID
-	fmt.Printf("%v Worker %v started\n", formattedDate, instid)
+	workerLogger(instid).Info("实例已启动")
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Worker started",
 		"data":    instopt,
@@ -474,27 +459,15 @@ func StopApp(c *gin.Context) {
 	}
 	instid := instopt.InstId
 
-	// 查找子线程的停止通道
-	stopChan, exists := Workers[instid]
-	if !exists {
+	// 发送停止信号并从全局变量中移除子线程
+	if err := StopInstance(instid); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"message": "Worker not found",
 		})
 		return
 	}
-	// 发送停止信号
-	close(stopChan)
-	// 从全局变量中移除子线程
-	delete(Workers, instid)
-	// 等待子线程退出
-	//wg.Wait()
-
-	// 检查全局变量 Workers 是否已删除对应的线程 ID
-	workersLock.Lock()
-	if _, cexists := Workers[instid]; !cexists {
-		fmt.Printf("StopApp提示：Worker %s 已成功从全局变量中删除\n", instid)
-	}
-	workersLock.Unlock()
+	auditAPI(c, AuditStop, "app", instid, nil, nil, nil)
+	workerLogger(instid).Info("实例已停止")
 	// 返回成功消息
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Worker stopped",
@@ -518,77 +491,119 @@ func RestartApp(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
 		return
 	}
 	instid := instopt.InstId
+	err := RestartInstance(instid, cfgdb, rtdb)
+	auditAPI(c, AuditRestart, "app", instid, nil, nil, err)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Worker restart fail",
+			"details": err.Error(),
+		})
+		return
+	}
+	workerLogger(instid).Info("实例已重启")
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Worker restarted",
+		"data":    instopt,
+	})
+}
 
-	// 第一步：停止现有实例
+// isWorkerRunning 判断实例的工作线程是否在运行
+func isWorkerRunning(instid string) bool {
 	workersLock.Lock()
 	defer workersLock.Unlock()
-	stopChan, exists := Workers[instid]
-	if exists {
-		close(stopChan)
-		// 延时1秒
-		time.Sleep(2 * time.Second)
-		delete(Workers, instid)
-	}
+	_, exists := Workers[instid]
+	return exists
+}
 
-	//再次检测是否停止成功
-	// 检查全局变量 Workers 是否已删除对应的线程 ID
-	if _, cexists := Workers[instid]; !cexists {
-		fmt.Printf("RestartApp提示：Worker %s 已成功从退出\n", instid)
-	}
-	// 第二步：获取实例配置信息
+// getAppConfig 从配置库读取实例配置
+func getAppConfig(cfgdb *redka.DB, instid string) (AppConfig, error) {
+	var appConfig AppConfig
 	value, err := cfgdb.Hash().Get(InstListKey, instid)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Failed to get app data",
-			"error":   err.Error(),
-		})
-		return
+		return appConfig, fmt.Errorf("instId '%s' is not exist", instid)
 	}
-	var appConfig AppConfig
 	err = json.Unmarshal([]byte(value.String()), &appConfig)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Failed to parse app config",
-			"error":   err.Error(),
-		})
-		return
+		return appConfig, fmt.Errorf("failed to parse app config: %v", err)
 	}
+	return appConfig, nil
+}
 
+// StartInstance 按实例ID启动工作线程，供 REST 接口、MQTT 命令和程序自启动共用
+func StartInstance(instid string, cfgdb *redka.DB, rtdb *redka.DB) error {
+	appConfig, err := getAppConfig(cfgdb, instid)
+	if err != nil {
+		return err
+	}
 	appcode := appConfig.AppCode
 	isSupport, msg := appCheck(appcode)
 	if !isSupport {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"message": appcode + " not support",
-			"details": msg,
-		})
-		return
+		return fmt.Errorf("%s", msg)
+	}
+	fn, exists := IotappMap[appcode]
+	if !exists || fn == nil {
+		return fmt.Errorf("appCode '%s' has no associated function", appcode)
 	}
 
-	// 第三步：重新启动实例
-	stopChan = make(chan struct{})
-	Workers[instid] = stopChan
-
+	workersLock.Lock()
+	defer workersLock.Unlock()
+	if _, cexists := Workers[instid]; cexists {
+		return fmt.Errorf("worker %s is running", instid)
+	}
+	// 创建停止通道
+	stopChan := make(chan struct{})
+	// 启动子线程
 	go func() {
 		defer func() {
+			// 使用 select 检查 channel 是否已关闭
 			select {
 			case <-stopChan:
+				// channel 已关闭，无需再次关闭
 			default:
-				close(stopChan)
+				close(stopChan) // 关闭 channel
 			}
+			// 通知全局变量 Workers 删除对应的线程 ID，只删除本线程登记的通道，避免重启后误删新线程
 			workersLock.Lock()
-			delete(Workers, instid)
+			if Workers[instid] == stopChan {
+				delete(Workers, instid)
+			}
+			_, restarted := Workers[instid]
 			workersLock.Unlock()
-			fmt.Printf("Worker退出,线程ID: %s 已从全局变量中删除\n", instid)
+			workerLogger(instid).Info("实例线程退出")
+			// 实例停止后其设备的数据不再更新，质量设置为停止服务
+			if !restarted {
+				setInstanceQuality(cfgdb, rtdb, instid, QualityBadOutOfService)
+				metricsOf(instid).stopped()
+			}
 		}()
-		fn := IotappMap[appcode]
-		fn(instid, stopChan, cfgdb, rtdb)
+		fn(instid, stopChan, cfgdb, rtdb) // 调用对应的函数
 	}()
+	// 将子线程的停止通道存储到全局变量中
+	Workers[instid] = stopChan
+	return nil
+}
 
-	if _, dexists := Workers[instid]; dexists {
-		fmt.Printf("RestartApp提示：Worker %s restarted\n", instid)
+// StopInstance 按实例ID停止工作线程
+func StopInstance(instid string) error {
+	workersLock.Lock()
+	defer workersLock.Unlock()
+	// 查找子线程的停止通道
+	stopChan, exists := Workers[instid]
+	if !exists {
+		return fmt.Errorf("worker %s not found", instid)
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Worker restarted",
-		"data":    instopt,
-	})
+	// 发送停止信号
+	close(stopChan)
+	// 从全局变量中移除子线程
+	delete(Workers, instid)
+	return nil
+}
+
+// RestartInstance 停止（如在运行）并重新启动实例的工作线程
+func RestartInstance(instid string, cfgdb *redka.DB, rtdb *redka.DB) error {
+	if err := StopInstance(instid); err == nil {
+		// 等待旧线程释放连接等资源
+		time.Sleep(2 * time.Second)
+	}
+	return StartInstance(instid, cfgdb, rtdb)
 }
@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+	_ "modernc.org/sqlite"
+)
+
+// 审计日志：配置修改（实例、设备、点表、报警规则、历史数据配置）和控制操作（启停实例、写点、确认和屏蔽报警）
+// 记录到 data/audit.db，包括操作人、来源、操作对象、修改前后的内容和差异，用于变更追溯，不自动清理。
+// 实例配置中的密码、Token 等敏感字段保存前替换为 ******，差异中只记录有变化
+
+// 审计日志的操作
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditStart   = "start"
+	AuditStop    = "stop"
+	AuditRestart = "restart"
+	AuditWrite   = "write"
+	AuditAck     = "ack"
+	AuditShelve  = "shelve"
+	AuditLogin   = "login"
+	AuditImport  = "import"
+)
+
+// 定义 AuditEntry 结构体，一条审计日志
+type AuditEntry struct {
+	ID         int64         `json:"id"`
+	Ts         int64         `json:"ts"`         // 操作时间，毫秒时间戳
+	User       string        `json:"user"`       // 操作人，未登录时为空
+	Source     string        `json:"source"`     // 来源：api/mqtt
+	ClientIP   string        `json:"clientIp"`   // 客户端地址
+	Action     string        `json:"action"`     // create/update/delete/start/stop/restart/write/ack/shelve/login/import
+	EntityType string        `json:"entityType"` // app/device/tags/alarmRules/historyConfig/alarm/tag/user/token/config/template
+	EntityID   string        `json:"entityId"`   // 实例ID、设备ID等
+	Before     any           `json:"before,omitempty"`
+	After      any           `json:"after,omitempty"`
+	Diff       []AuditChange `json:"diff,omitempty"`
+	Result     string        `json:"result"` // success 或错误信息
+}
+
+// 定义 AuditChange 结构体，修改前后的一处差异
+type AuditChange struct {
+	Path   string `json:"path"` // 字段路径，如 config.host
+	Before any    `json:"before"`
+	After  any    `json:"after"`
+}
+
+// secretMask 敏感字段替换后的值
+const secretMask = "******"
+
+var (
+	auditdb          *sql.DB
+	auditMaxRows     = 1000  // 默认返回条数
+	auditMaxRowLimit = 10000 // 单次查询最大返回条数
+)
+
+// StartAuditLog 打开审计日志数据库
+func StartAuditLog(path string) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+	stmts := []string{
+		"PRAGMA journal_mode=WAL",
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			ts          INTEGER NOT NULL,
+			user        TEXT,
+			source      TEXT,
+			client_ip   TEXT,
+			action      TEXT NOT NULL,
+			entity_type TEXT NOT NULL,
+			entity_id   TEXT,
+			before      TEXT,
+			after       TEXT,
+			diff        TEXT,
+			result      TEXT
+		)`,
+		"CREATE INDEX IF NOT EXISTS audit_log_ts ON audit_log (ts)",
+		"CREATE INDEX IF NOT EXISTS audit_log_entity ON audit_log (entity_type, entity_id, ts)",
+	}
+	for _, s := range stmts {
+		if _, err = db.Exec(s); err != nil {
+			db.Close()
+			return fmt.Errorf("init audit db: %w", err)
+		}
+	}
+	auditdb = db
+	return nil
+}
+
+// auditRecord 写入一条审计日志，修改前后都有内容时计算差异
+func auditRecord(entry AuditEntry) {
+	if entry.Ts == 0 {
+		entry.Ts = time.Now().UnixMilli()
+	}
+	if entry.Result == "" {
+		entry.Result = "success"
+	}
+	if entry.Before != nil && entry.After != nil && entry.Diff == nil {
+		entry.Diff = auditDiff(entry.Before, entry.After)
+	}
+	maskAuditEntry(&entry)
+	log.Printf("audit: user=%q source=%s action=%s %s=%s result=%s",
+		entry.User, entry.Source, entry.Action, entry.EntityType, entry.EntityID, entry.Result)
+	if auditdb == nil {
+		return
+	}
+	_, err := auditdb.Exec(`INSERT INTO audit_log (ts, user, source, client_ip, action, entity_type, entity_id, before, after, diff, result)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Ts, entry.User, entry.Source, entry.ClientIP, entry.Action, entry.EntityType, entry.EntityID,
+		auditJSON(entry.Before), auditJSON(entry.After), auditJSON(entry.Diff), entry.Result)
+	if err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+	}
+}
+
+// auditAPI 记录 REST 接口的操作，操作人取自请求上下文中的 user
+func auditAPI(c *gin.Context, action string, entityType string, entityID string, before any, after any, err error) {
+	entry := AuditEntry{
+		User:       c.GetString("user"),
+		Source:     "api",
+		ClientIP:   c.ClientIP(),
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Before:     before,
+		After:      after,
+	}
+	if err != nil {
+		entry.Result = err.Error()
+	}
+	auditRecord(entry)
+}
+
+// auditMqtt 记录 MQTT 命令通道的操作，操作人为接收命令的 mqttpub 实例
+func auditMqtt(instid string, action string, entityType string, entityID string, before any, after any, err error) {
+	entry := AuditEntry{
+		User:       "mqtt:" + instid,
+		Source:     "mqtt",
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Before:     before,
+		After:      after,
+	}
+	if err != nil {
+		entry.Result = err.Error()
+	}
+	auditRecord(entry)
+}
+
+// auditJSON 把内容转换为 JSON 保存，空值保存为 NULL
+func auditJSON(v any) any {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Slice && reflect.ValueOf(v).Len() == 0) {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return string(b)
+}
+
+// auditDiff 按 JSON 结构比较修改前后的内容，返回有变化的字段
+func auditDiff(before any, after any) []AuditChange {
+	var b, a any
+	bb, _ := json.Marshal(before)
+	ab, _ := json.Marshal(after)
+	_ = json.Unmarshal(bb, &b)
+	_ = json.Unmarshal(ab, &a)
+	changes := []AuditChange{}
+	auditDiffValue("", b, a, &changes)
+	return changes
+}
+
+func auditDiffValue(path string, before any, after any, changes *[]AuditChange) {
+	bm, bok := before.(map[string]any)
+	am, aok := after.(map[string]any)
+	if bok && aok {
+		keys := make(map[string]bool)
+		for k := range bm {
+			keys[k] = true
+		}
+		for k := range am {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			auditDiffValue(p, bm[k], am[k], changes)
+		}
+		return
+	}
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, AuditChange{Path: path, Before: before, After: after})
+	}
+}
+
+// isSecretKey 判断字段是否为敏感字段：password/passwd/token/secret 及以它们结尾的字段，不区分大小写
+func isSecretKey(key string) bool {
+	k := strings.ToLower(key)
+	for _, suffix := range []string{"password", "passwd", "token", "secret"} {
+		if strings.HasSuffix(k, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSecrets 返回按 JSON 结构把敏感字段的值替换为 ****** 的副本，不修改原内容
+func maskSecrets(v any) any {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var j any
+	if err = json.Unmarshal(b, &j); err != nil {
+		return nil
+	}
+	return maskValue(j)
+}
+
+// maskValue 替换 JSON 值中敏感字段的值
+func maskValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, item := range val {
+			if isSecretKey(k) {
+				val[k] = maskSecret(item)
+			} else {
+				val[k] = maskValue(item)
+			}
+		}
+	case []any:
+		for i := range val {
+			val[i] = maskValue(val[i])
+		}
+	}
+	return v
+}
+
+// maskSecret 替换敏感字段的值，空值保持不变，便于区分是否设置
+func maskSecret(v any) any {
+	if v == nil || v == "" {
+		return v
+	}
+	return secretMask
+}
+
+// maskDiff 替换差异中的敏感字段：路径中含敏感字段时整个值替换，否则替换值中的敏感字段
+func maskDiff(changes []AuditChange) []AuditChange {
+	masked := make([]AuditChange, 0, len(changes))
+	for _, change := range changes {
+		secret := false
+		for _, k := range strings.Split(change.Path, ".") {
+			secret = secret || isSecretKey(k)
+		}
+		if secret {
+			change.Before, change.After = maskSecret(change.Before), maskSecret(change.After)
+		} else {
+			change.Before, change.After = maskSecrets(change.Before), maskSecrets(change.After)
+		}
+		masked = append(masked, change)
+	}
+	return masked
+}
+
+// maskAuditEntry 替换审计日志中修改前后的内容和差异中的敏感字段
+func maskAuditEntry(entry *AuditEntry) {
+	entry.Before = maskSecrets(entry.Before)
+	entry.After = maskSecrets(entry.After)
+	if entry.Diff != nil {
+		entry.Diff = maskDiff(entry.Diff)
+	}
+}
+
+// devTagsOf 读取设备的点表，用于记录修改前的内容
+func devTagsOf(cfgdb *redka.DB, devid string) map[string][]any {
+	values, err := cfgdb.Hash().Items(devid)
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+	tags := make(map[string][]any)
+	for key, value := range values {
+		var tag []any
+		if erra := json.Unmarshal([]byte(value.String()), &tag); erra == nil {
+			tags[key] = tag
+		}
+	}
+	return tags
+}
+
+// @Summary 查询审计日志
+// @Description 按时间范围和操作对象查询配置修改和控制操作的审计日志，按时间倒序排列
+// @Tags System
+// @Produce json
+// @Param start query int false "开始时间，毫秒时间戳，默认结束时间前 7 天"
+// @Param end query int false "结束时间，毫秒时间戳，默认当前时间"
+// @Param entityType query string false "操作对象类型：app/device/tags/alarmRules/historyConfig/alarm/tag/user/token/logLevel/config/template"
+// @Param entityId query string false "操作对象ID"
+// @Param action query string false "操作"
+// @Param user query string false "操作人"
+// @Param limit query int false "最大返回条数，默认 1000"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/auditLog [get]
+func GetAuditLog(c *gin.Context) {
+	if auditdb == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "audit log is not running"})
+		return
+	}
+	var start, end int64
+	limit := auditMaxRows
+	var err error
+	if s := c.Query("end"); s != "" {
+		if end, err = strconv.ParseInt(s, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "end must be a millisecond timestamp"})
+			return
+		}
+	}
+	if s := c.Query("start"); s != "" {
+		if start, err = strconv.ParseInt(s, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "start must be a millisecond timestamp"})
+			return
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+	}
+	if limit > auditMaxRowLimit {
+		limit = auditMaxRowLimit
+	}
+	if end == 0 {
+		end = time.Now().UnixMilli()
+	}
+	if start == 0 {
+		start = end - 7*24*time.Hour.Milliseconds()
+	}
+
+	query := `SELECT id, ts, user, source, client_ip, action, entity_type, entity_id, before, after, diff, result
+		FROM audit_log WHERE ts >= ? AND ts <= ?`
+	args := []any{start, end}
+	for _, f := range []struct{ param, column string }{
+		{"entityType", "entity_type"},
+		{"entityId", "entity_id"},
+		{"action", "action"},
+		{"user", "user"},
+	} {
+		if v := c.Query(f.param); v != "" {
+			query += " AND " + f.column + " = ?"
+			args = append(args, v)
+		}
+	}
+	query += " ORDER BY ts DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := auditdb.Query(query, args...)
+	if err != nil {
+		log.Println("Error reading from audit database:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from audit database"})
+		return
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var user, source, clientIP, entityID, before, after, diff, result sql.NullString
+		if err = rows.Scan(&entry.ID, &entry.Ts, &user, &source, &clientIP, &entry.Action, &entry.EntityType,
+			&entityID, &before, &after, &diff, &result); err != nil {
+			log.Println("Error reading from audit database:", err)
+			continue
+		}
+		entry.User, entry.Source, entry.ClientIP = user.String, source.String, clientIP.String
+		entry.EntityID, entry.Result = entityID.String, result.String
+		if before.Valid {
+			_ = json.Unmarshal([]byte(before.String), &entry.Before)
+		}
+		if after.Valid {
+			_ = json.Unmarshal([]byte(after.String), &entry.After)
+		}
+		if diff.Valid {
+			_ = json.Unmarshal([]byte(diff.String), &entry.Diff)
+		}
+		// 早期写入的审计日志没有屏蔽敏感字段
+		maskAuditEntry(&entry)
+		entries = append(entries, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read audit log",
+		"data":    entries,
+	})
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuditDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		before any
+		after  any
+		want   []AuditChange
+	}{
+		{
+			name:   "no change",
+			before: map[string]any{"host": "127.0.0.1", "port": 502},
+			after:  map[string]any{"host": "127.0.0.1", "port": 502},
+			want:   []AuditChange{},
+		},
+		{
+			name:   "nested field",
+			before: map[string]any{"config": map[string]any{"host": "127.0.0.1", "port": 502}},
+			after:  map[string]any{"config": map[string]any{"host": "10.0.0.1", "port": 502}},
+			want:   []AuditChange{{Path: "config.host", Before: "127.0.0.1", After: "10.0.0.1"}},
+		},
+		{
+			name:   "added and removed keys in order",
+			before: map[string]any{"b": 1, "c": true},
+			after:  map[string]any{"a": "x", "b": 1},
+			want: []AuditChange{
+				{Path: "a", Before: nil, After: "x"},
+				{Path: "c", Before: true, After: nil},
+			},
+		},
+		{
+			name:   "array compared as a whole",
+			before: map[string]any{"tag": []any{"01", "1", "int16"}},
+			after:  map[string]any{"tag": []any{"01", "2", "int16"}},
+			want:   []AuditChange{{Path: "tag", Before: []any{"01", "1", "int16"}, After: []any{"01", "2", "int16"}}},
+		},
+		{
+			name:   "struct compared by json fields",
+			before: AppConfig{AppCode: "modbus", InstName: "a"},
+			after:  AppConfig{AppCode: "modbus", InstName: "b"},
+			want:   []AuditChange{{Path: "instName", Before: "a", After: "b"}},
+		},
+		{
+			name:   "created object",
+			before: nil,
+			after:  map[string]any{"a": float64(1)},
+			want:   []AuditChange{{Path: "", Before: nil, After: map[string]any{"a": float64(1)}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := auditDiff(tt.before, tt.after)
+			// 数值经过 JSON 转换后为 float64
+			for i := range tt.want {
+				if n, ok := tt.want[i].Before.(int); ok {
+					tt.want[i].Before = float64(n)
+				}
+				if n, ok := tt.want[i].After.(int); ok {
+					tt.want[i].After = float64(n)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("auditDiff() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskDiff(t *testing.T) {
+	changes := auditDiff(
+		map[string]any{"config": map[string]any{"password": "old", "host": "a"}},
+		map[string]any{"config": map[string]any{"password": "new", "host": "b"}},
+	)
+	got := maskDiff(changes)
+	want := []AuditChange{
+		{Path: "config.host", Before: "a", After: "b"},
+		{Path: "config.password", Before: secretMask, After: secretMask},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("maskDiff() = %#v, want %#v", got, want)
+	}
+}
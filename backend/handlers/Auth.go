@@ -0,0 +1,903 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 认证和权限：本地用户保存在 cfgdb 的 user@router 中（密码为 bcrypt 哈希），登录后签发 JWT(HS256)，
+// 同时写入 HttpOnly Cookie 供 WEB 页面和 SSE 使用；机器客户端使用 API Token（ge_ 开头）。
+// 每个接口按角色授权：viewer < operator < engineer < admin
+
+// 角色
+const (
+	RoleViewer   = "viewer"   // 只读：查询配置、实时数据、历史数据和报警
+	RoleOperator = "operator" // 操作：启停实例、确认和屏蔽报警、写点
+	RoleEngineer = "engineer" // 工程：修改实例、设备、点表、报警规则等配置
+	RoleAdmin    = "admin"    // 管理：用户、API Token、审计日志和系统设置
+)
+
+var roleLevel = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleEngineer: 3,
+	RoleAdmin:    4,
+}
+
+// 定义 User 结构体，本地用户
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled"`
+	CreatedAt    int64  `json:"createdAt"`          // 秒时间戳
+	PasswordAt   int64  `json:"passwordAt"`         // 最后修改密码的时间，之前签发的 JWT 失效
+	LastLoginAt  int64  `json:"lastLoginAt"`        // 最后登录时间
+	Desc         string `json:"desc,omitempty"`     // 描述
+	Password     string `json:"password,omitempty"` // 仅用于请求，不保存
+}
+
+// 定义 APIToken 结构体，机器客户端使用的 API Token，只保存哈希
+type APIToken struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Hash      string `json:"hash,omitempty"`
+	CreatedBy string `json:"createdBy"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"` // 0 表示不过期
+}
+
+// 定义 LoginReq 结构体
+type LoginReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// 定义 PasswordReq 结构体
+type PasswordReq struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// 定义 ModUserReq 结构体，修改用户时未提供的字段保持不变
+type ModUserReq struct {
+	Username string  `json:"username"`
+	Role     string  `json:"role,omitempty"`
+	Disabled *bool   `json:"disabled,omitempty"`
+	Desc     *string `json:"desc,omitempty"`
+	Password string  `json:"password,omitempty"` // 不为空时重置密码
+}
+
+// 定义 TokenReq 结构体
+type TokenReq struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Role        string `json:"role"`
+	ExpiresDays int    `json:"expiresDays"` // 有效天数，0 表示不过期
+}
+
+// 定义 jwtClaims 结构体
+type jwtClaims struct {
+	Sub  string `json:"sub"`
+	Role string `json:"role"`
+	Iat  int64  `json:"iat"`
+	Exp  int64  `json:"exp"`
+}
+
+// 登录失败锁定记录
+type loginFailure struct {
+	count int
+	until time.Time
+	last  time.Time // 最后一次失败的时间
+}
+
+var (
+	UserKey        = "user@router"
+	TokenKey       = "token@router"
+	authKey        = "auth@router" // 签名密钥，不能放在 system@router 中，getSysinfo 会返回全部字段
+	authCfgdb      *redka.DB
+	authSecret     []byte
+	authInitFile   string
+	authCookie     = "ge_token"
+	apiTokenPrefix = "ge_"
+	jwtTTL         = 12 * time.Hour
+	minPasswordLen = 8
+	loginMaxFails  = 5                              // 连续失败次数
+	loginLockTime  = 5 * time.Minute                // 超过失败次数后锁定的时间
+	loginFailures  = make(map[string]*loginFailure) // 用户名和客户端 IP -> 失败记录
+	loginLock      sync.Mutex
+)
+
+// InitAuth 读取或生成 JWT 签名密钥；没有任何用户时创建 admin 用户，随机密码写入 initFile
+func InitAuth(cfgdb *redka.DB, initFile string) error {
+	authCfgdb = cfgdb
+	authInitFile = initFile
+	secret, err := cfgdb.Hash().Get(authKey, "jwtSecret")
+	if err != nil && !errors.Is(err, redka.ErrNotFound) {
+		return err
+	}
+	if secret.String() == "" {
+		b := make([]byte, 32)
+		if _, err = rand.Read(b); err != nil {
+			return err
+		}
+		if _, err = cfgdb.Hash().Set(authKey, "jwtSecret", hex.EncodeToString(b)); err != nil {
+			return err
+		}
+		authSecret = []byte(hex.EncodeToString(b))
+	} else {
+		authSecret = []byte(secret.String())
+	}
+
+	n, err := cfgdb.Hash().Len(UserKey)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	password := GenID(16)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	admin := User{Username: "admin", PasswordHash: string(hash), Role: RoleAdmin, CreatedAt: now, PasswordAt: now}
+	if err = saveUser(cfgdb, admin); err != nil {
+		return err
+	}
+	if err = os.WriteFile(initFile, []byte(password+"\n"), 0600); err != nil {
+		return err
+	}
+	log.Printf("已创建初始用户 admin，密码保存在 %s，请登录后修改密码", initFile)
+	return nil
+}
+
+// getUser 读取用户，不存在时返回 nil
+func getUser(cfgdb *redka.DB, username string) (*User, error) {
+	value, err := cfgdb.Hash().Get(UserKey, username)
+	if errors.Is(err, redka.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err = json.Unmarshal([]byte(value.String()), &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func saveUser(cfgdb *redka.DB, user User) error {
+	user.Password = ""
+	jsonstr, _ := json.Marshal(user)
+	_, err := cfgdb.Hash().Set(UserKey, user.Username, jsonstr)
+	return err
+}
+
+// listUsers 读取所有用户，按用户名排序
+func listUsers(cfgdb *redka.DB) ([]User, error) {
+	values, err := cfgdb.Hash().Items(UserKey)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(values))
+	for _, value := range values {
+		var user User
+		if erra := json.Unmarshal([]byte(value.String()), &user); erra != nil {
+			continue
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// activeAdmins 返回未禁用的管理员数量，避免删除或降级最后一个管理员
+func activeAdmins(cfgdb *redka.DB) int {
+	users, _ := listUsers(cfgdb)
+	n := 0
+	for _, user := range users {
+		if user.Role == RoleAdmin && !user.Disabled {
+			n++
+		}
+	}
+	return n
+}
+
+// hashToken 返回 API Token 的 SHA-256 哈希
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validRole 是否为支持的角色
+func validRole(role string) bool {
+	_, ok := roleLevel[role]
+	return ok
+}
+
+// signJWT 签发 JWT
+func signJWT(claims jwtClaims) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payloadJson, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(payloadJson)
+	mac := hmac.New(sha256.New, authSecret)
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyJWT 校验 JWT 的签名和有效期
+func verifyJWT(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJson, &header) != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	mac := hmac.New(sha256.New, authSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token")
+	}
+	payloadJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	var claims jwtClaims
+	if err = json.Unmarshal(payloadJson, &claims); err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return nil, fmt.Errorf("token expired")
+	}
+	return &claims, nil
+}
+
+// queryTokenKey StripQueryToken 从 URL 中取出的 access_token 在上下文中的键
+const queryTokenKey = "accessToken"
+
+// StripQueryToken 把 URL 中的 access_token 参数移到上下文中，需在请求日志之前注册，避免凭据写入访问日志
+func StripQueryToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if strings.Contains(c.Request.URL.RawQuery, "access_token") {
+			query := c.Request.URL.Query()
+			if query.Has("access_token") {
+				c.Set(queryTokenKey, query.Get("access_token"))
+				query.Del("access_token")
+				c.Request.URL.RawQuery = query.Encode()
+			}
+		}
+		c.Next()
+	}
+}
+
+// sseRequest 是否为 SSE 订阅请求，只有这些请求可以用 access_token 参数传递凭据（EventSource 无法设置请求头）
+func sseRequest(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet {
+		return false
+	}
+	switch c.FullPath() {
+	case "/api/v1/subscribeValues":
+		return true
+	case "/api/v1/logs":
+		return c.Query("follow") == "1"
+	}
+	return false
+}
+
+// requestToken 从 Authorization 头、Cookie 读取凭据，SSE 订阅请求还可以使用 access_token 参数
+func requestToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	if token, err := c.Cookie(authCookie); err == nil && token != "" {
+		return token
+	}
+	if sseRequest(c) {
+		return c.GetString(queryTokenKey)
+	}
+	return ""
+}
+
+// authenticate 校验请求的凭据，返回操作人和角色。用户的角色、禁用状态和密码修改立即生效
+func authenticate(c *gin.Context) (string, string, error) {
+	if authCfgdb == nil {
+		return "", "", fmt.Errorf("authentication is not initialized")
+	}
+	token := requestToken(c)
+	if token == "" {
+		return "", "", fmt.Errorf("missing credentials")
+	}
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		hash := hashToken(token)
+		values, err := authCfgdb.Hash().Items(TokenKey)
+		if err != nil {
+			return "", "", err
+		}
+		for _, value := range values {
+			var t APIToken
+			if erra := json.Unmarshal([]byte(value.String()), &t); erra != nil {
+				continue
+			}
+			if hmac.Equal([]byte(t.Hash), []byte(hash)) {
+				if t.ExpiresAt != 0 && time.Now().Unix() >= t.ExpiresAt {
+					return "", "", fmt.Errorf("token expired")
+				}
+				return "token:" + t.Name, t.Role, nil
+			}
+		}
+		return "", "", fmt.Errorf("invalid token")
+	}
+	claims, err := verifyJWT(token)
+	if err != nil {
+		return "", "", err
+	}
+	user, err := getUser(authCfgdb, claims.Sub)
+	if err != nil {
+		return "", "", err
+	}
+	if user == nil || user.Disabled {
+		return "", "", fmt.Errorf("user '%s' is not available", claims.Sub)
+	}
+	if claims.Iat < user.PasswordAt {
+		return "", "", fmt.Errorf("token revoked")
+	}
+	return user.Username, user.Role, nil
+}
+
+// RequireRole 返回认证中间件，要求请求的角色不低于 role，通过后在上下文中设置 user 和 role
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, userRole, err := authenticate(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "Unauthorized",
+				"details": err.Error(),
+			})
+			return
+		}
+		if roleLevel[userRole] < roleLevel[role] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"message": "Forbidden",
+				"details": fmt.Sprintf("role '%s' is required", role),
+			})
+			return
+		}
+		c.Set("user", username)
+		c.Set("role", userRole)
+		c.Next()
+	}
+}
+
+// loginKey 登录失败按用户名和客户端 IP 计数，其他地址的失败不会锁定合法用户
+func loginKey(username string, clientIP string) string {
+	return username + "@" + clientIP
+}
+
+// loginLocked 检查用户在该客户端是否因连续登录失败被锁定
+func loginLocked(key string) bool {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+	f, ok := loginFailures[key]
+	return ok && time.Now().Before(f.until)
+}
+
+// loginFailed 记录一次登录失败，达到次数后锁定
+func loginFailed(key string) {
+	loginLock.Lock()
+	defer loginLock.Unlock()
+	now := time.Now()
+	// 清除已过锁定时间的记录，避免不同地址的失败记录不断累积
+	for k, f := range loginFailures {
+		if now.After(f.until) && now.Sub(f.last) > loginLockTime {
+			delete(loginFailures, k)
+		}
+	}
+	f, ok := loginFailures[key]
+	if !ok {
+		f = &loginFailure{}
+		loginFailures[key] = f
+	}
+	f.last = now
+	f.count++
+	if f.count >= loginMaxFails {
+		f.until = now.Add(loginLockTime)
+	}
+}
+
+// setAuthCookie 写入或清除登录 Cookie
+func setAuthCookie(c *gin.Context, token string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     authCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// removeInitFile 初始管理员修改密码后删除保存初始密码的文件
+func removeInitFile(username string) {
+	if username == "admin" && authInitFile != "" {
+		_ = os.Remove(authInitFile)
+	}
+}
+
+// @Summary 登录
+// @Description 用户名和密码登录，返回 JWT 并写入 Cookie，请求其他接口时使用 Authorization: Bearer <token>
+// @Tags User Manager
+// @Accept json
+// @Produce json
+// @Param login body LoginReq true "username and password"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /api/v1/login [post]
+func Login(c *gin.Context, cfgdb *redka.DB) {
+	var req LoginReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set("user", req.Username)
+	key := loginKey(req.Username, c.ClientIP())
+	if loginLocked(key) {
+		auditAPI(c, AuditLogin, "user", req.Username, nil, nil, fmt.Errorf("locked"))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"message": "Login Fail",
+			"details": "too many failed attempts, try again later",
+		})
+		return
+	}
+	user, err := getUser(cfgdb, req.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from database"})
+		return
+	}
+	if user == nil || user.Disabled || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		loginFailed(key)
+		auditAPI(c, AuditLogin, "user", req.Username, nil, nil, fmt.Errorf("invalid username or password"))
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "Login Fail",
+			"details": "invalid username or password",
+		})
+		return
+	}
+	loginLock.Lock()
+	delete(loginFailures, key)
+	loginLock.Unlock()
+
+	now := time.Now()
+	user.LastLoginAt = now.Unix()
+	_ = saveUser(cfgdb, *user)
+	exp := now.Add(jwtTTL)
+	token := signJWT(jwtClaims{Sub: user.Username, Role: user.Role, Iat: now.Unix(), Exp: exp.Unix()})
+	setAuthCookie(c, token, int(jwtTTL.Seconds()))
+	auditAPI(c, AuditLogin, "user", user.Username, nil, nil, nil)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Login OK",
+		"data": gin.H{
+			"token":     token,
+			"expiresAt": exp.Unix(),
+			"username":  user.Username,
+			"role":      user.Role,
+		},
+	})
+}
+
+// @Summary 退出登录
+// @Description 清除登录 Cookie
+// @Tags User Manager
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/logout [post]
+func Logout(c *gin.Context) {
+	setAuthCookie(c, "", -1)
+	c.JSON(http.StatusOK, gin.H{"message": "Logout OK"})
+}
+
+// @Summary 查询当前用户
+// @Description 返回当前请求的用户名和角色
+// @Tags User Manager
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/currentUser [get]
+func CurrentUser(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success",
+		"data": gin.H{
+			"username": c.GetString("user"),
+			"role":     c.GetString("role"),
+		},
+	})
+}
+
+// @Summary 修改密码
+// @Description 修改当前用户的密码，修改后之前签发的 JWT 失效
+// @Tags User Manager
+// @Accept json
+// @Produce json
+// @Param password body PasswordReq true "old and new password"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/changePassword [post]
+func ChangePassword(c *gin.Context, cfgdb *redka.DB) {
+	var req PasswordReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, err := getUser(cfgdb, c.GetString("user"))
+	if err != nil || user == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Change Password Fail",
+			"details": "only local users can change password",
+		})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.OldPassword)) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Change Password Fail",
+			"details": "old password is incorrect",
+		})
+		return
+	}
+	if len(req.NewPassword) < minPasswordLen {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Change Password Fail",
+			"details": fmt.Sprintf("password must be at least %d characters", minPasswordLen),
+		})
+		return
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	user.PasswordHash = string(hash)
+	user.PasswordAt = time.Now().Unix()
+	err = saveUser(cfgdb, *user)
+	auditAPI(c, AuditUpdate, "user", user.Username, nil, map[string]any{"password": "changed"}, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Change Password Fail", "details": err.Error()})
+		return
+	}
+	removeInitFile(user.Username)
+	c.JSON(http.StatusOK, gin.H{"message": "Change Password OK"})
+}
+
+// @Summary 查询用户列表
+// @Description 查询所有本地用户，不返回密码哈希
+// @Tags User Manager
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/listUsers [get]
+func ListUsers(c *gin.Context, cfgdb *redka.DB) {
+	users, err := listUsers(cfgdb)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from database"})
+		return
+	}
+	for i := range users {
+		users[i].PasswordHash = ""
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read data from database",
+		"data":    users,
+	})
+}
+
+// @Summary 创建用户
+// @Description 创建本地用户，角色为 viewer/operator/engineer/admin
+// @Tags User Manager
+// @Accept json
+// @Produce json
+// @Param user body User true "username, password and role"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/newUser [post]
+func NewUser(c *gin.Context, cfgdb *redka.DB) {
+	var req User
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || strings.HasPrefix(req.Username, "token:") || strings.HasPrefix(req.Username, "mqtt:") {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "New User Fail", "details": "invalid username"})
+		return
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "New User Fail", "details": fmt.Sprintf("invalid role '%s'", req.Role)})
+		return
+	}
+	if len(req.Password) < minPasswordLen {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "New User Fail",
+			"details": fmt.Sprintf("password must be at least %d characters", minPasswordLen),
+		})
+		return
+	}
+	if exists, _ := cfgdb.Hash().Exists(UserKey, req.Username); exists {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "New User Fail", "details": fmt.Sprintf("user '%s' is exist", req.Username)})
+		return
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	now := time.Now().Unix()
+	user := User{
+		Username:     req.Username,
+		PasswordHash: string(hash),
+		Role:         req.Role,
+		Disabled:     req.Disabled,
+		CreatedAt:    now,
+		PasswordAt:   now,
+		Desc:         req.Desc,
+	}
+	err := saveUser(cfgdb, user)
+	user.PasswordHash = ""
+	auditAPI(c, AuditCreate, "user", user.Username, nil, user, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "New User Fail", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "New User OK",
+		"data":    user,
+	})
+}
+
+// @Summary 修改用户
+// @Description 修改用户的角色、描述和禁用状态，只修改请求中提供的字段；password 不为空时重置密码。不能禁用或降级最后一个管理员
+// @Tags User Manager
+// @Accept json
+// @Produce json
+// @Param user body ModUserReq true "username and fields to modify"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/modUser [post]
+func ModUser(c *gin.Context, cfgdb *redka.DB) {
+	var req ModUserReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, err := getUser(cfgdb, req.Username)
+	if err != nil || user == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mod User Fail", "details": fmt.Sprintf("user '%s' is not exist", req.Username)})
+		return
+	}
+	before := *user
+	before.PasswordHash = ""
+	if req.Role != "" && !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mod User Fail", "details": fmt.Sprintf("invalid role '%s'", req.Role)})
+		return
+	}
+	if req.Role == "" {
+		req.Role = user.Role
+	}
+	disabled := user.Disabled
+	if req.Disabled != nil {
+		disabled = *req.Disabled
+	}
+	demoted := user.Role == RoleAdmin && !user.Disabled && (req.Role != RoleAdmin || disabled)
+	if demoted && activeAdmins(cfgdb) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mod User Fail", "details": "cannot demote or disable the last admin"})
+		return
+	}
+	user.Role = req.Role
+	user.Disabled = disabled
+	if req.Desc != nil {
+		user.Desc = *req.Desc
+	}
+	after := *user
+	after.PasswordHash = ""
+	if req.Password != "" {
+		if len(req.Password) < minPasswordLen {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Mod User Fail",
+				"details": fmt.Sprintf("password must be at least %d characters", minPasswordLen),
+			})
+			return
+		}
+		hash, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		user.PasswordHash = string(hash)
+		user.PasswordAt = time.Now().Unix()
+		after.PasswordAt = user.PasswordAt
+	}
+	err = saveUser(cfgdb, *user)
+	auditAPI(c, AuditUpdate, "user", user.Username, before, after, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Mod User Fail", "details": err.Error()})
+		return
+	}
+	if req.Password != "" {
+		removeInitFile(user.Username)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Mod User OK",
+		"data":    after,
+	})
+}
+
+// @Summary 删除用户
+// @Description 删除本地用户，不能删除自己和最后一个管理员
+// @Tags User Manager
+// @Accept json
+// @Produce json
+// @Param user body LoginReq true "username"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/delUser [post]
+func DelUser(c *gin.Context, cfgdb *redka.DB) {
+	var req LoginReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, err := getUser(cfgdb, req.Username)
+	if err != nil || user == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Del User Fail", "details": fmt.Sprintf("user '%s' is not exist", req.Username)})
+		return
+	}
+	if user.Username == c.GetString("user") {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Del User Fail", "details": "cannot delete the current user"})
+		return
+	}
+	if user.Role == RoleAdmin && !user.Disabled && activeAdmins(cfgdb) <= 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Del User Fail", "details": "cannot delete the last admin"})
+		return
+	}
+	_, err = cfgdb.Hash().Delete(UserKey, user.Username)
+	user.PasswordHash = ""
+	auditAPI(c, AuditDelete, "user", user.Username, user, nil, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Del User Fail", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Del User OK"})
+}
+
+// @Summary 查询 API Token 列表
+// @Description 查询所有 API Token，不返回 Token 本身
+// @Tags User Manager
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/v1/listTokens [get]
+func ListTokens(c *gin.Context, cfgdb *redka.DB) {
+	values, err := cfgdb.Hash().Items(TokenKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from database"})
+		return
+	}
+	tokens := make([]APIToken, 0, len(values))
+	for _, value := range values {
+		var t APIToken
+		if erra := json.Unmarshal([]byte(value.String()), &t); erra != nil {
+			continue
+		}
+		t.Hash = ""
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt < tokens[j].CreatedAt })
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read data from database",
+		"data":    tokens,
+	})
+}
+
+// @Summary 创建 API Token
+// @Description 为机器客户端创建 API Token，Token 只在创建时返回一次
+// @Tags User Manager
+// @Accept json
+// @Produce json
+// @Param token body TokenReq true "name, role and expiresDays"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/newToken [post]
+func NewToken(c *gin.Context, cfgdb *redka.DB) {
+	var req TokenReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" || !validRole(req.Role) || req.ExpiresDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "New Token Fail",
+			"details": "name is required, role must be viewer/operator/engineer/admin and expiresDays must not be negative",
+		})
+		return
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "New Token Fail", "details": err.Error()})
+		return
+	}
+	secret := apiTokenPrefix + hex.EncodeToString(b)
+	now := time.Now()
+	t := APIToken{
+		ID:        GenID(8),
+		Name:      req.Name,
+		Role:      req.Role,
+		Hash:      hashToken(secret),
+		CreatedBy: c.GetString("user"),
+		CreatedAt: now.Unix(),
+	}
+	if req.ExpiresDays > 0 {
+		t.ExpiresAt = now.AddDate(0, 0, req.ExpiresDays).Unix()
+	}
+	jsonstr, _ := json.Marshal(t)
+	_, err := cfgdb.Hash().Set(TokenKey, t.ID, jsonstr)
+	t.Hash = ""
+	auditAPI(c, AuditCreate, "token", t.ID, nil, t, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "New Token Fail", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "New Token OK",
+		"data": gin.H{
+			"token": secret,
+			"info":  t,
+		},
+	})
+}
+
+// @Summary 删除 API Token
+// @Description 删除 API Token，使用该 Token 的客户端立即失去访问权限
+// @Tags User Manager
+// @Accept json
+// @Produce json
+// @Param token body TokenReq true "id"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/delToken [post]
+func DelToken(c *gin.Context, cfgdb *redka.DB) {
+	var req TokenReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	value, err := cfgdb.Hash().Get(TokenKey, req.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Del Token Fail", "details": fmt.Sprintf("token '%s' is not exist", req.ID)})
+		return
+	}
+	var before APIToken
+	_ = json.Unmarshal([]byte(value.String()), &before)
+	before.Hash = ""
+	_, err = cfgdb.Hash().Delete(TokenKey, req.ID)
+	auditAPI(c, AuditDelete, "token", req.ID, before, nil, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Del Token Fail", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Del Token OK"})
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerifyJWT(t *testing.T) {
+	oldSecret := authSecret
+	t.Cleanup(func() { authSecret = oldSecret })
+	authSecret = []byte("test-secret")
+	now := time.Now().Unix()
+	valid := signJWT(jwtClaims{Sub: "admin", Role: "admin", Iat: now, Exp: now + 60})
+	parts := strings.Split(valid, ".")
+
+	// 用其他密钥签名的令牌
+	authSecret = []byte("other-secret")
+	otherKey := signJWT(jwtClaims{Sub: "admin", Role: "admin", Iat: now, Exp: now + 60})
+	authSecret = []byte("test-secret")
+
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	tamperedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","role":"admin","exp":9999999999}`))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"valid", valid, ""},
+		{"expired", signJWT(jwtClaims{Sub: "admin", Role: "admin", Iat: now - 120, Exp: now - 60}), "token expired"},
+		{"other key", otherKey, "invalid token"},
+		{"tampered payload", parts[0] + "." + tamperedPayload + "." + parts[2], "invalid token"},
+		{"alg none", noneHeader + "." + parts[1] + "." + parts[2], "invalid token"},
+		{"alg none without signature", noneHeader + "." + parts[1] + ".", "invalid token"},
+		{"two parts", parts[0] + "." + parts[1], "invalid token"},
+		{"bad base64", parts[0] + "." + parts[1] + ".!!", "invalid token"},
+		{"empty", "", "invalid token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyJWT(tt.token)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("verifyJWT() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyJWT() error = %v", err)
+			}
+			if claims.Sub != "admin" || claims.Role != "admin" {
+				t.Fatalf("verifyJWT() claims = %+v", claims)
+			}
+		})
+	}
+}
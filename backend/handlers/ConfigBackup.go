@@ -0,0 +1,801 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+)
+
+// 配置备份和恢复：把实例、设备、点表、历史数据配置、报警规则和设备模板导出为带版本的 JSON 或 ZIP 配置包，
+// 导入到其他网关。导入支持 merge(按ID覆盖包中的对象，保留其他对象)和 replace(删除包中没有的对象)，
+// 可以通过 idMap 修改实例ID和设备ID，dryRun 只返回校验报告和修改内容不写入
+
+const (
+	configBundleFormat  = "ginElement-config"
+	configBundleVersion = 1
+)
+
+// ZIP 配置包中的文件
+const (
+	configZipManifest  = "manifest.json"
+	configZipInstances = "instances.json"
+	configZipDevices   = "devices.json"
+	configZipHistory   = "historyConfig.json"
+	configZipAlarms    = "alarmRules.json"
+	configZipTemplates = "templates.json"
+	configZipTagsDir   = "tags/" // tags/<设备ID>.json
+)
+
+var configMaxBytes int64 = 32 << 20 // 导入的配置包的最大大小
+
+// 定义 ConfigBundle 结构体，配置包
+type ConfigBundle struct {
+	Format        string                      `json:"format"`     // 固定为 ginElement-config
+	Version       int                         `json:"version"`    // 配置包格式版本
+	AppVersion    string                      `json:"appVersion"` // 导出时的软件版本
+	ExportedAt    int64                       `json:"exportedAt"` // 导出时间，毫秒时间戳
+	Instances     map[string]AppConfig        `json:"instances"`  // 实例ID -> 实例配置
+	Devices       map[string]DevConfig        `json:"devices"`    // 设备ID -> 设备配置
+	Tags          map[string]map[string][]any `json:"tags"`       // 设备ID -> 点ID -> 点表
+	HistoryConfig map[string]HistoryConfig    `json:"historyConfig,omitempty"`
+	AlarmRules    map[string][]AlarmRule      `json:"alarmRules,omitempty"`
+	Templates     map[string]DevTemplate      `json:"templates,omitempty"` // 模板ID -> 设备模板
+}
+
+// 定义 configManifest 结构体，ZIP 配置包的 manifest.json
+type configManifest struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	AppVersion string `json:"appVersion"`
+	ExportedAt int64  `json:"exportedAt"`
+}
+
+// 定义 ConfigImportReq 结构体
+type ConfigImportReq struct {
+	Mode   string            `json:"mode"`   // merge(默认)/replace
+	DryRun bool              `json:"dryRun"` // 只校验和比较，不写入
+	IDMap  map[string]string `json:"idMap"`  // 旧ID -> 新ID，可以修改实例ID和设备ID
+	Bundle *ConfigBundle     `json:"bundle"`
+}
+
+// 定义 ConfigIssue 结构体，校验发现的问题
+type ConfigIssue struct {
+	Path    string `json:"path"` // 如 devices.DEV_xxx.instId
+	Message string `json:"message"`
+}
+
+// 定义 ConfigChange 结构体，导入对一个对象的修改
+type ConfigChange struct {
+	Action     string        `json:"action"`     // create/update/delete
+	EntityType string        `json:"entityType"` // app/device/tags/historyConfig/alarmRules/template
+	EntityID   string        `json:"entityId"`
+	Diff       []AuditChange `json:"diff,omitempty"` // update 时有变化的字段
+}
+
+// 定义 ConfigImportReport 结构体，导入的校验报告
+type ConfigImportReport struct {
+	Mode     string         `json:"mode"`
+	DryRun   bool           `json:"dryRun"`
+	Applied  bool           `json:"applied"`  // 是否已写入
+	Errors   []ConfigIssue  `json:"errors"`   // 有错误时不写入
+	Warnings []ConfigIssue  `json:"warnings"` // 不影响写入，如引用不存在的设备
+	Changes  []ConfigChange `json:"changes"`
+	Summary  map[string]int `json:"summary"` // create/update/delete/unchanged 的数量
+}
+
+func (r *ConfigImportReport) errorf(path string, format string, args ...any) {
+	r.Errors = append(r.Errors, ConfigIssue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *ConfigImportReport) warnf(path string, format string, args ...any) {
+	r.Warnings = append(r.Warnings, ConfigIssue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// newConfigBundle 返回空的配置包
+func newConfigBundle() *ConfigBundle {
+	return &ConfigBundle{
+		Format:        configBundleFormat,
+		Version:       configBundleVersion,
+		AppVersion:    AppVersion,
+		Instances:     make(map[string]AppConfig),
+		Devices:       make(map[string]DevConfig),
+		Tags:          make(map[string]map[string][]any),
+		HistoryConfig: make(map[string]HistoryConfig),
+		AlarmRules:    make(map[string][]AlarmRule),
+		Templates:     make(map[string]DevTemplate),
+	}
+}
+
+// loadConfigBundle 从 cfgdb 读取当前的全部配置
+func loadConfigBundle(cfgdb *redka.DB) (*ConfigBundle, error) {
+	return readConfigBundle(cfgdb.Hash())
+}
+
+// configHashReader 读取哈希，*redka.DB 和事务 *redka.Tx 的 Hash() 都满足，事务中可以读取一致的配置
+type configHashReader interface {
+	Items(key string) (map[string]redka.Value, error)
+}
+
+// readConfigBundle 从 h 读取全部配置
+func readConfigBundle(h configHashReader) (*ConfigBundle, error) {
+	b := newConfigBundle()
+	b.ExportedAt = time.Now().UnixMilli()
+	values, err := h.Items(InstListKey)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		var appConfig AppConfig
+		if erra := json.Unmarshal([]byte(value.String()), &appConfig); erra != nil {
+			return nil, fmt.Errorf("instance '%s': %w", key, erra)
+		}
+		b.Instances[key] = appConfig
+	}
+	if values, err = h.Items(DevAtInstKey); err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		var devConfig DevConfig
+		if erra := json.Unmarshal([]byte(value.String()), &devConfig); erra != nil {
+			return nil, fmt.Errorf("device '%s': %w", key, erra)
+		}
+		b.Devices[key] = devConfig
+		tagValues, errt := h.Items(key)
+		if errt != nil {
+			return nil, errt
+		}
+		if len(tagValues) == 0 {
+			continue
+		}
+		tags := make(map[string][]any)
+		for tagid, tagValue := range tagValues {
+			var tag []any
+			if erra := json.Unmarshal([]byte(tagValue.String()), &tag); erra != nil {
+				return nil, fmt.Errorf("tag '%s' of device '%s': %w", tagid, key, erra)
+			}
+			tags[tagid] = tag
+		}
+		b.Tags[key] = tags
+	}
+	if values, err = h.Items(HisConfigKey); err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		var hisConfig HistoryConfig
+		if erra := json.Unmarshal([]byte(value.String()), &hisConfig); erra != nil {
+			return nil, fmt.Errorf("history config '%s': %w", key, erra)
+		}
+		b.HistoryConfig[key] = hisConfig
+	}
+	if values, err = h.Items(AlarmRuleKey); err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		rules := []AlarmRule{}
+		if erra := json.Unmarshal([]byte(value.String()), &rules); erra != nil {
+			return nil, fmt.Errorf("alarm rules '%s': %w", key, erra)
+		}
+		b.AlarmRules[key] = rules
+	}
+	if values, err = h.Items(TemplateKey); err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		var tpl DevTemplate
+		if erra := json.Unmarshal([]byte(value.String()), &tpl); erra != nil {
+			return nil, fmt.Errorf("template '%s': %w", key, erra)
+		}
+		b.Templates[key] = tpl
+	}
+	return b, nil
+}
+
+// writeConfigZip 把配置包写为 ZIP，每个设备的点表一个文件，便于比较和手工修改
+func writeConfigZip(w io.Writer, b *ConfigBundle) error {
+	zw := zip.NewWriter(w)
+	manifest := configManifest{Format: b.Format, Version: b.Version, AppVersion: b.AppVersion, ExportedAt: b.ExportedAt}
+	files := []struct {
+		name string
+		v    any
+	}{
+		{configZipManifest, manifest},
+		{configZipInstances, b.Instances},
+		{configZipDevices, b.Devices},
+		{configZipHistory, b.HistoryConfig},
+		{configZipAlarms, b.AlarmRules},
+		{configZipTemplates, b.Templates},
+	}
+	for devid, tags := range b.Tags {
+		files = append(files, struct {
+			name string
+			v    any
+		}{configZipTagsDir + devid + ".json", tags})
+	}
+	for _, f := range files {
+		data, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err = fw.Write(data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// readConfigZip 读取 ZIP 配置包
+func readConfigZip(data []byte) (*ConfigBundle, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	b := newConfigBundle()
+	var manifest *configManifest
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		var v any
+		switch {
+		case f.Name == configZipManifest:
+			manifest = &configManifest{}
+			v = manifest
+		case f.Name == configZipInstances:
+			v = &b.Instances
+		case f.Name == configZipDevices:
+			v = &b.Devices
+		case f.Name == configZipHistory:
+			v = &b.HistoryConfig
+		case f.Name == configZipAlarms:
+			v = &b.AlarmRules
+		case f.Name == configZipTemplates:
+			v = &b.Templates
+		case strings.HasPrefix(f.Name, configZipTagsDir) && path.Ext(f.Name) == ".json":
+			devid := strings.TrimSuffix(strings.TrimPrefix(f.Name, configZipTagsDir), ".json")
+			tags := make(map[string][]any)
+			b.Tags[devid] = tags
+			v = &tags
+		default:
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(io.LimitReader(rc, configMaxBytes))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(content, v); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%s is missing", configZipManifest)
+	}
+	b.Format, b.Version, b.AppVersion, b.ExportedAt = manifest.Format, manifest.Version, manifest.AppVersion, manifest.ExportedAt
+	return b, nil
+}
+
+// remapConfigID 修改配置中引用的ID：等于旧ID的字符串，以及计算点表达式中的 [旧ID.点ID]
+func remapConfigID(v any, idMap map[string]string) any {
+	switch val := v.(type) {
+	case string:
+		if newID, ok := idMap[val]; ok {
+			return newID
+		}
+		for oldID, newID := range idMap {
+			val = strings.ReplaceAll(val, "["+oldID+".", "["+newID+".")
+		}
+		return val
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = remapConfigID(item, idMap)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[k] = remapConfigID(item, idMap)
+		}
+		return out
+	}
+	return v
+}
+
+// remapConfigBundle 按 idMap 修改配置包中的实例ID和设备ID
+func remapConfigBundle(b *ConfigBundle, idMap map[string]string) *ConfigBundle {
+	if len(idMap) == 0 {
+		return b
+	}
+	mapID := func(id string) string {
+		if newID, ok := idMap[id]; ok {
+			return newID
+		}
+		return id
+	}
+	out := newConfigBundle()
+	out.Format, out.Version = b.Format, b.Version
+	out.AppVersion, out.ExportedAt = b.AppVersion, b.ExportedAt
+	for key, appConfig := range b.Instances {
+		appConfig.InstID = mapID(appConfig.InstID)
+		appConfig.Config = remapConfigID(appConfig.Config, idMap)
+		out.Instances[mapID(key)] = appConfig
+	}
+	for key, devConfig := range b.Devices {
+		devConfig.DevID = mapID(devConfig.DevID)
+		devConfig.InstID = mapID(devConfig.InstID)
+		devConfig.Config = remapConfigID(devConfig.Config, idMap)
+		out.Devices[mapID(key)] = devConfig
+	}
+	for key, tags := range b.Tags {
+		newTags := make(map[string][]any, len(tags))
+		for tagid, tag := range tags {
+			newTags[tagid] = remapConfigID(tag, idMap).([]any)
+		}
+		out.Tags[mapID(key)] = newTags
+	}
+	for key, hisConfig := range b.HistoryConfig {
+		hisConfig.DevID = mapID(hisConfig.DevID)
+		out.HistoryConfig[mapID(key)] = hisConfig
+	}
+	for key, rules := range b.AlarmRules {
+		out.AlarmRules[mapID(key)] = rules
+	}
+	for key, tpl := range b.Templates {
+		out.Templates[key] = tpl
+	}
+	return out
+}
+
+// mergeConfigBundle 计算导入后的配置：replace 为配置包本身，merge 为当前配置加上配置包中的对象，
+// 同一个设备的点表和报警规则整体替换
+func mergeConfigBundle(current *ConfigBundle, b *ConfigBundle, mode string) *ConfigBundle {
+	if mode == "replace" {
+		return b
+	}
+	out := newConfigBundle()
+	for _, src := range []*ConfigBundle{current, b} {
+		for key, v := range src.Instances {
+			out.Instances[key] = v
+		}
+		for key, v := range src.Devices {
+			out.Devices[key] = v
+		}
+		for key, v := range src.Tags {
+			out.Tags[key] = v
+		}
+		for key, v := range src.HistoryConfig {
+			out.HistoryConfig[key] = v
+		}
+		for key, v := range src.AlarmRules {
+			out.AlarmRules[key] = v
+		}
+		for key, v := range src.Templates {
+			out.Templates[key] = v
+		}
+	}
+	return out
+}
+
+// validateConfigBundle 校验配置包中的对象，引用关系按导入后的配置 target 检查
+func validateConfigBundle(b *ConfigBundle, target *ConfigBundle, report *ConfigImportReport) {
+	if b.Format != configBundleFormat {
+		report.errorf("format", "format must be '%s'", configBundleFormat)
+	}
+	if b.Version < 1 || b.Version > configBundleVersion {
+		report.errorf("version", "version %d is not supported, the newest supported version is %d", b.Version, configBundleVersion)
+	}
+	for key, appConfig := range b.Instances {
+		p := "instances." + key
+		if appConfig.InstID != key {
+			report.errorf(p+".instId", "instId '%s' does not match the key", appConfig.InstID)
+		}
+		if _, exists := IotappMap[appConfig.AppCode]; !exists {
+			report.errorf(p+".appCode", "appCode '%s' is not supported", appConfig.AppCode)
+		} else if !strings.HasPrefix(key, appConfig.AppCode+"@") {
+			report.errorf(p, "instId must start with '%s@'", appConfig.AppCode)
+		}
+		// 北向实例的 deviceList 引用的设备需要存在
+		if config, ok := appConfig.Config.(map[string]any); ok {
+			if deviceList, ok := config["deviceList"].([]any); ok {
+				for _, item := range deviceList {
+					if devid, ok := item.(string); ok {
+						if _, exists := target.Devices[devid]; !exists {
+							report.warnf(p+".config.deviceList", "device '%s' is not exist", devid)
+						}
+					}
+				}
+			}
+		}
+	}
+	for key, devConfig := range b.Devices {
+		p := "devices." + key
+		if devConfig.DevID != key {
+			report.errorf(p+".devId", "devId '%s' does not match the key", devConfig.DevID)
+		}
+		if _, exists := target.Instances[devConfig.InstID]; !exists {
+			report.errorf(p+".instId", "instance '%s' is not exist", devConfig.InstID)
+		}
+		if _, exists := target.Templates[devConfig.TplID]; devConfig.TplID != "" && !exists {
+			report.warnf(p+".tplId", "template '%s' is not exist", devConfig.TplID)
+		}
+	}
+	for key, tags := range b.Tags {
+		p := "tags." + key
+		if _, exists := target.Devices[key]; !exists {
+			report.errorf(p, "device '%s' is not exist", key)
+		}
+		for tagid, tag := range tags {
+			if len(tag) == 0 {
+				report.errorf(p+"."+tagid, "tag is empty")
+				continue
+			}
+			if _, err := parseTagEU(tag); err != nil {
+				report.errorf(p+"."+tagid, "%v", err)
+			}
+		}
+	}
+	for key, hisConfig := range b.HistoryConfig {
+		p := "historyConfig." + key
+		if hisConfig.DevID != key {
+			report.errorf(p+".devId", "devId '%s' does not match the key", hisConfig.DevID)
+		}
+		if _, exists := target.Devices[key]; key != "*" && !exists {
+			report.errorf(p, "device '%s' is not exist", key)
+		}
+		if hisConfig.Interval < 1 || hisConfig.RetentionDays < 0 || hisConfig.DownsampleAfter < 0 || hisConfig.DownsampleBucket < 0 {
+			report.errorf(p, "interval must be at least 1 second, other values must not be negative")
+		}
+	}
+	for key, tpl := range b.Templates {
+		p := "templates." + key
+		if tpl.TplID != key {
+			report.errorf(p+".tplId", "tplId '%s' does not match the key", tpl.TplID)
+		}
+		if err := checkTemplate(&tpl); err != nil {
+			report.errorf(p, "%v", err)
+		}
+	}
+	for key, rules := range b.AlarmRules {
+		p := "alarmRules." + key
+		if _, exists := target.Devices[key]; !exists {
+			report.errorf(p, "device '%s' is not exist", key)
+		}
+		if err := checkAlarmRules(rules); err != nil {
+			report.errorf(p, "%v", err)
+		}
+		for _, rule := range rules {
+			if _, exists := target.Tags[key][rule.TagID]; !exists {
+				report.warnf(p+"."+rule.RuleID, "tag '%s' is not exist", rule.TagID)
+			}
+		}
+	}
+}
+
+// diffConfigBundle 比较当前配置和导入后的配置，返回按对象类型和ID排序的修改
+func diffConfigBundle(current *ConfigBundle, target *ConfigBundle) ([]ConfigChange, int) {
+	changes := []ConfigChange{}
+	unchanged := 0
+	diff := func(entityType string, before map[string]any, after map[string]any) {
+		keys := make([]string, 0, len(before)+len(after))
+		for key := range before {
+			keys = append(keys, key)
+		}
+		for key := range after {
+			if _, ok := before[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b, inBefore := before[key]
+			a, inAfter := after[key]
+			switch {
+			case !inBefore:
+				changes = append(changes, ConfigChange{Action: AuditCreate, EntityType: entityType, EntityID: key})
+			case !inAfter:
+				changes = append(changes, ConfigChange{Action: AuditDelete, EntityType: entityType, EntityID: key})
+			default:
+				if d := auditDiff(b, a); len(d) > 0 {
+					changes = append(changes, ConfigChange{Action: AuditUpdate, EntityType: entityType, EntityID: key, Diff: maskDiff(d)})
+				} else {
+					unchanged++
+				}
+			}
+		}
+	}
+	before, after := configSections(current), configSections(target)
+	for _, entityType := range configEntityTypes {
+		diff(entityType, before[entityType], after[entityType])
+	}
+	return changes, unchanged
+}
+
+// 配置包中的对象类型，按写入顺序排列
+var configEntityTypes = []string{"template", "app", "device", "tags", "historyConfig", "alarmRules"}
+
+// configSections 按对象类型返回配置包中的对象
+func configSections(b *ConfigBundle) map[string]map[string]any {
+	return map[string]map[string]any{
+		"app":           toAnyMap(b.Instances),
+		"device":        toAnyMap(b.Devices),
+		"tags":          toAnyMap(b.Tags),
+		"historyConfig": toAnyMap(b.HistoryConfig),
+		"alarmRules":    toAnyMap(b.AlarmRules),
+		"template":      toAnyMap(b.Templates),
+	}
+}
+
+// toAnyMap 把 map[string]T 转换为 map[string]any
+func toAnyMap(m any) map[string]any {
+	out := make(map[string]any)
+	v := reflect.ValueOf(m)
+	for _, key := range v.MapKeys() {
+		out[key.String()] = v.MapIndex(key).Interface()
+	}
+	return out
+}
+
+// applyConfigChanges 在一个事务中写入修改，任何一处失败时全部回滚
+func applyConfigChanges(cfgdb *redka.DB, target *ConfigBundle, changes []ConfigChange) error {
+	return cfgdb.Update(func(tx *redka.Tx) error {
+		for _, change := range changes {
+			id := change.EntityID
+			var key string
+			var value any
+			switch change.EntityType {
+			case "app":
+				key, value = InstListKey, target.Instances[id]
+			case "device":
+				key, value = DevAtInstKey, target.Devices[id]
+			case "historyConfig":
+				key, value = HisConfigKey, target.HistoryConfig[id]
+			case "alarmRules":
+				key, value = AlarmRuleKey, target.AlarmRules[id]
+			case "template":
+				key, value = TemplateKey, target.Templates[id]
+			case "tags":
+				// 点表整体替换
+				if _, err := tx.Key().Delete(id); err != nil {
+					return err
+				}
+				tagsMap := make(map[string]any)
+				for tagid, tag := range target.Tags[id] {
+					jsonstr, _ := json.Marshal(tag)
+					tagsMap[tagid] = string(jsonstr)
+				}
+				if change.Action != AuditDelete && len(tagsMap) > 0 {
+					if _, err := tx.Hash().SetMany(id, tagsMap); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if change.Action == AuditDelete {
+				if _, err := tx.Hash().Delete(key, id); err != nil {
+					return err
+				}
+				continue
+			}
+			jsonstr, _ := json.Marshal(value)
+			if _, err := tx.Hash().Set(key, id, jsonstr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readConfigImportReq 读取导入请求：JSON 请求体，或 multipart 表单的 file(JSON 或 ZIP 配置包)
+// 加 mode、dryRun 和 idMap(JSON) 字段
+func readConfigImportReq(c *gin.Context) (*ConfigImportReq, error) {
+	var req ConfigImportReq
+	if !strings.HasPrefix(c.ContentType(), "multipart/") {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, configMaxBytes)
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return nil, err
+		}
+		if req.Bundle == nil {
+			return nil, fmt.Errorf("bundle is required")
+		}
+		return &req, nil
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return nil, fmt.Errorf("file is required")
+	}
+	if fh.Size > configMaxBytes {
+		return nil, fmt.Errorf("file is too large")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, configMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		if req.Bundle, err = readConfigZip(data); err != nil {
+			return nil, fmt.Errorf("invalid zip bundle: %w", err)
+		}
+	} else if err = json.Unmarshal(data, &req.Bundle); err != nil {
+		return nil, fmt.Errorf("invalid json bundle: %w", err)
+	}
+	req.Mode = c.PostForm("mode")
+	req.DryRun = c.PostForm("dryRun") == "1" || c.PostForm("dryRun") == "true"
+	if s := c.PostForm("idMap"); s != "" {
+		if err = json.Unmarshal([]byte(s), &req.IDMap); err != nil {
+			return nil, fmt.Errorf("invalid idMap: %w", err)
+		}
+	}
+	return &req, nil
+}
+
+// @Summary 导出配置
+// @Description 导出全部实例、设备、点表、历史数据配置、报警规则和设备模板，format=json(默认) 为单个 JSON 文件，format=zip 为每个设备的点表一个文件的 ZIP
+// @Tags Config
+// @Produce json
+// @Produce application/zip
+// @Param format query string false "json/zip"
+// @Success 200 {object} ConfigBundle
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/config/export [get]
+func ExportConfig(c *gin.Context, cfgdb *redka.DB) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "zip" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or zip"})
+		return
+	}
+	b, err := loadConfigBundle(cfgdb)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Export Config Fail",
+			"details": err.Error(),
+		})
+		return
+	}
+	filename := fmt.Sprintf("ginElement-config-%s.%s", time.Now().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "json" {
+		c.IndentedJSON(http.StatusOK, b)
+		return
+	}
+	var buf bytes.Buffer
+	if err = writeConfigZip(&buf, b); err != nil {
+		c.Header("Content-Disposition", "")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Export Config Fail",
+			"details": err.Error(),
+		})
+		return
+	}
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
+
+// @Summary 导入配置
+// @Description 导入配置包。mode=merge(默认) 写入配置包中的对象，保留其他对象；mode=replace 同时删除配置包中没有的对象。
+// @Description 设备的点表和报警规则整体替换。idMap 修改实例ID和设备ID，dryRun 只返回校验报告和修改内容。
+// @Description 校验有错误时不写入；修改在一个事务中写入，运行中的实例重新读取修改后的配置
+// @Tags Config
+// @Accept json
+// @Accept multipart/form-data
+// @Produce json
+// @Param req body ConfigImportReq false "导入请求"
+// @Param file formData file false "JSON 或 ZIP 配置包"
+// @Param mode formData string false "merge/replace"
+// @Param dryRun formData string false "1 只校验不写入"
+// @Param idMap formData string false "ID 映射 JSON，如 {\"DEV_old\":\"DEV_new\"}"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/config/import [post]
+func ImportConfig(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
+	req, err := readConfigImportReq(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Import Config Fail", "details": err.Error()})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "merge"
+	}
+	if req.Mode != "merge" && req.Mode != "replace" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Import Config Fail", "details": "mode must be merge or replace"})
+		return
+	}
+	for oldID, newID := range req.IDMap {
+		if oldID == "" || newID == "" || oldID == "*" || newID == "*" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Import Config Fail", "details": "idMap must not contain empty or '*' ids"})
+			return
+		}
+	}
+	current, err := loadConfigBundle(cfgdb)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Import Config Fail", "details": err.Error()})
+		return
+	}
+
+	bundle := remapConfigBundle(req.Bundle, req.IDMap)
+	target := mergeConfigBundle(current, bundle, req.Mode)
+	report := &ConfigImportReport{
+		Mode:     req.Mode,
+		DryRun:   req.DryRun,
+		Errors:   []ConfigIssue{},
+		Warnings: []ConfigIssue{},
+	}
+	validateConfigBundle(bundle, target, report)
+	var unchanged int
+	report.Changes, unchanged = diffConfigBundle(current, target)
+	report.Summary = map[string]int{AuditCreate: 0, AuditUpdate: 0, AuditDelete: 0, "unchanged": unchanged}
+	for _, change := range report.Changes {
+		report.Summary[change.Action]++
+	}
+
+	// 运行中的实例不能删除，配置、设备或点表的修改由实例重新读取
+	for _, change := range report.Changes {
+		if change.EntityType == "app" && change.Action == AuditDelete && isWorkerRunning(change.EntityID) {
+			report.errorf("instances."+change.EntityID, "instance is running, stop it before deleting")
+		}
+	}
+	sort.Slice(report.Warnings, func(i, j int) bool { return report.Warnings[i].Path < report.Warnings[j].Path })
+	sort.Slice(report.Errors, func(i, j int) bool { return report.Errors[i].Path < report.Errors[j].Path })
+
+	if len(report.Errors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Import Config Fail", "data": report})
+		return
+	}
+	if req.DryRun || len(report.Changes) == 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "Import Config Check OK", "data": report})
+		return
+	}
+
+	err = applyConfigChanges(cfgdb, target, report.Changes)
+	auditAPI(c, AuditImport, "config", req.Mode, nil, report.Summary, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Import Config Fail", "details": err.Error(), "data": report})
+		return
+	}
+	report.Applied = true
+	// 每个修改的对象单独记录审计日志，并更新缓存
+	before, after := configSections(current), configSections(target)
+	for _, change := range report.Changes {
+		auditAPI(c, change.Action, change.EntityType, change.EntityID,
+			before[change.EntityType][change.EntityID], after[change.EntityType][change.EntityID], nil)
+		commitRevision(c, cfgdb, AuditImport, change.EntityType, change.EntityID)
+		switch change.EntityType {
+		case "app":
+			publishConfig("app", change.Action, change.EntityID)
+		case "tags", "device":
+			invalidateTagEU(change.EntityID)
+			if change.EntityType == "device" && change.Action == AuditDelete {
+				removeDevRuntime(rtdb, change.EntityID)
+			}
+			publishConfig(change.EntityType, change.Action, change.EntityID)
+		case "alarmRules":
+			rules := target.AlarmRules[change.EntityID]
+			if rules == nil {
+				rules = []AlarmRule{}
+			}
+			updateAlarmRules(change.EntityID, rules)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Import Config OK", "data": report})
+}
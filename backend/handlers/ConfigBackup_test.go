@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemapConfigID(t *testing.T) {
+	idMap := map[string]string{"dev1": "dev9", "inst1": "inst9"}
+	tests := []struct {
+		name string
+		v    any
+		want any
+	}{
+		{"exact id", "dev1", "dev9"},
+		{"other id", "dev10", "dev10"},
+		{"expression reference", "[dev1.t1] + [dev10.t2] * 2", "[dev9.t1] + [dev10.t2] * 2"},
+		{"id without bracket", "dev1.t1", "dev1.t1"},
+		{"number", float64(1), float64(1)},
+		{"nested", map[string]any{
+			"instId": "inst1",
+			"refs":   []any{"dev1", "[dev1.t1]", true},
+		}, map[string]any{
+			"instId": "inst9",
+			"refs":   []any{"dev9", "[dev9.t1]", true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remapConfigID(tt.v, idMap); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("remapConfigID() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeConfigBundle(t *testing.T) {
+	current := newConfigBundle()
+	current.Instances["inst1"] = AppConfig{InstID: "inst1", InstName: "old"}
+	current.Devices["dev1"] = DevConfig{DevID: "dev1", InstID: "inst1"}
+	current.Tags["dev1"] = map[string][]any{"t1": {"01", "1"}}
+
+	b := newConfigBundle()
+	b.Instances["inst1"] = AppConfig{InstID: "inst1", InstName: "new"}
+	b.Devices["dev2"] = DevConfig{DevID: "dev2", InstID: "inst1"}
+
+	tests := []struct {
+		name      string
+		mode      string
+		instName  string
+		devices   []string
+		keepsTags bool
+	}{
+		{"merge", "merge", "new", []string{"dev1", "dev2"}, true},
+		{"replace", "replace", "new", []string{"dev2"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeConfigBundle(current, b, tt.mode)
+			if got.Instances["inst1"].InstName != tt.instName {
+				t.Fatalf("instance name = %q, want %q", got.Instances["inst1"].InstName, tt.instName)
+			}
+			if len(got.Devices) != len(tt.devices) {
+				t.Fatalf("devices = %v, want %v", got.Devices, tt.devices)
+			}
+			for _, devid := range tt.devices {
+				if _, ok := got.Devices[devid]; !ok {
+					t.Fatalf("device %s is missing", devid)
+				}
+			}
+			if _, ok := got.Tags["dev1"]; ok != tt.keepsTags {
+				t.Fatalf("tags of dev1 kept = %v, want %v", ok, tt.keepsTags)
+			}
+		})
+	}
+	// 合并不修改原配置
+	if current.Instances["inst1"].InstName != "old" || len(current.Devices) != 1 {
+		t.Fatalf("current bundle was modified: %+v", current)
+	}
+}
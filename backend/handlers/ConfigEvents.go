@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/nalgeon/redka"
+)
+
+// 配置变化通知：接口修改 cfgdb 中的实例配置、设备或点表后发布事件，运行中的工作线程订阅事件，
+// 收到后重新读取自己的配置并与当前使用的比较，点表和普通参数原地生效，只有连接参数变化时才重新连接。
+// 事件只用于通知，不携带配置内容，订阅者处理不及时时丢弃的事件不影响结果
+
+// 定义 ConfigEvent 结构体
+type ConfigEvent struct {
+	Kind   string `json:"kind"`   // app/device/tags
+	ID     string `json:"id"`     // 实例ID或设备ID
+	Action string `json:"action"` // create/update/delete
+}
+
+var (
+	configSubscribers = make(map[chan ConfigEvent]string) // 订阅通道 -> 实例ID
+	configSubLock     sync.Mutex                          // 用于保护 configSubscribers 的并发访问
+)
+
+// concerns 判断事件是否需要实例重新读取配置：实例配置只通知本实例，设备和点表的变化通知所有实例，
+// 设备是否属于实例（或北向实例的 deviceList）由实例重新读取后判断
+func (e ConfigEvent) concerns(instid string) bool {
+	return e.Kind != "app" || e.ID == instid
+}
+
+// subscribeConfig 工作线程启动时订阅配置变化，应在读取配置之前订阅，避免遗漏读取期间的修改
+func subscribeConfig(instid string) chan ConfigEvent {
+	ch := make(chan ConfigEvent, 64)
+	configSubLock.Lock()
+	configSubscribers[ch] = instid
+	configSubLock.Unlock()
+	return ch
+}
+
+// unsubscribeConfig 工作线程退出时取消订阅
+func unsubscribeConfig(ch chan ConfigEvent) {
+	configSubLock.Lock()
+	delete(configSubscribers, ch)
+	configSubLock.Unlock()
+}
+
+// publishConfig 发布配置变化事件，不阻塞调用的接口
+func publishConfig(kind string, action string, ids ...string) {
+	configSubLock.Lock()
+	defer configSubLock.Unlock()
+	for _, id := range ids {
+		event := ConfigEvent{Kind: kind, ID: id, Action: action}
+		for ch := range configSubscribers {
+			select {
+			case ch <- event:
+			default:
+				// 通道已满时已有待处理的通知，重新读取配置时会包含本次修改
+			}
+		}
+	}
+}
+
+// configNotified 取出通道中所有待处理的事件，有需要实例重新读取配置的事件时返回 true
+func configNotified(ch chan ConfigEvent, instid string) bool {
+	notified := false
+	for {
+		select {
+		case event := <-ch:
+			notified = notified || event.concerns(instid)
+		default:
+			return notified
+		}
+	}
+}
+
+// loadInstConfig 读取实例配置中的 config
+func loadInstConfig(cfgdb *redka.DB, instid string) (map[string]any, error) {
+	appConfig, err := getAppConfig(cfgdb, instid)
+	if err != nil {
+		return nil, err
+	}
+	config, ok := appConfig.Config.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("配置不是 map[string]any 或不存在")
+	}
+	return config, nil
+}
+
+// loadInstDevices 读取绑定到实例的设备
+func loadInstDevices(cfgdb *redka.DB, instid string) (map[string]DevConfig, error) {
+	devValues, err := cfgdb.Hash().Items(DevAtInstKey)
+	if err != nil {
+		return nil, err
+	}
+	devMap := make(map[string]DevConfig)
+	for key, value := range devValues {
+		var newValue DevConfig
+		if erra := json.Unmarshal([]byte(value.String()), &newValue); erra != nil {
+			return nil, fmt.Errorf("devId %s: %v", key, erra)
+		}
+		if newValue.InstID == instid {
+			devMap[key] = newValue
+		}
+	}
+	return devMap, nil
+}
+
+// configDeviceList 读取北向实例配置中的 deviceList，为空表示所有设备
+func configDeviceList(config map[string]any) ([]string, error) {
+	deviceListany, _ := config["deviceList"].([]any)
+	var deviceList []string
+	for _, item := range deviceListany {
+		device, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("deviceList 包含非字符串的值")
+		}
+		deviceList = append(deviceList, device)
+	}
+	return deviceList, nil
+}
+
+// devicesSignature 返回设备配置和点表的签名，fmt 输出 map 时按键排序，可直接比较是否变化
+func devicesSignature(cfgdb *redka.DB, devMap map[string]DevConfig) string {
+	devids := make([]string, 0, len(devMap))
+	for devid := range devMap {
+		devids = append(devids, devid)
+	}
+	sort.Strings(devids)
+	tags := make([]map[string][]any, 0, len(devids))
+	for _, devid := range devids {
+		tags = append(tags, devTagsOf(cfgdb, devid))
+	}
+	return fmt.Sprint(devMap, tags)
+}
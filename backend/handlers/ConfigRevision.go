@@ -0,0 +1,589 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+	_ "modernc.org/sqlite"
+)
+
+// 配置修订：实例、设备和设备模板每次修改后把修改后的完整内容保存为一个修订，设备的内容包括点表、报警规则和历史数据配置。
+// 修订记录作者、时间和说明（修改接口的请求参数 comment），用于查看修改历史、比较两个修订和回滚。
+// 保存在 data/revision.db，不自动清理；内容与对象的上一个修订相同时不保存。
+// 第一次启动时为已有的对象保存基线修订，升级后的第一次修改也可以回滚。
+// 修订中保存完整的配置用于回滚，查询和比较接口返回时密码、Token 等敏感字段替换为 ******
+
+// 修订的来源和操作，其他操作与审计日志相同
+const (
+	RevisionBaseline = "baseline"
+	AuditRollback    = "rollback"
+)
+
+// 定义 ConfigRevision 结构体，一个修订
+type ConfigRevision struct {
+	ID         int64  `json:"id"`         // 修订号，全局递增
+	Ts         int64  `json:"ts"`         // 修改时间，毫秒时间戳
+	Author     string `json:"author"`     // 修改人
+	Source     string `json:"source"`     // 来源：api/mqtt/system
+	Comment    string `json:"comment"`    // 修改说明
+	Action     string `json:"action"`     // baseline/create/update/delete/import/rollback
+	EntityType string `json:"entityType"` // app/device/template
+	EntityID   string `json:"entityId"`
+	Content    any    `json:"content,omitempty"` // 修改后的内容，删除时为空
+}
+
+// 定义 DeviceRevision 结构体，设备修订的内容
+type DeviceRevision struct {
+	DevConfig     DevConfig        `json:"devConfig"`
+	Tags          map[string][]any `json:"tags"`
+	AlarmRules    []AlarmRule      `json:"alarmRules,omitempty"`
+	HistoryConfig *HistoryConfig   `json:"historyConfig,omitempty"` // 单独配置时才有，否则使用默认配置
+}
+
+// 定义 RollbackReq 结构体
+type RollbackReq struct {
+	Revision int64  `json:"revision"` // 回滚到的修订号
+	Comment  string `json:"comment"`  // 回滚说明
+}
+
+var (
+	revdb          *sql.DB
+	revMaxRows     = 100  // 默认返回条数
+	revMaxRowLimit = 1000 // 单次查询最大返回条数
+	revisionLock   sync.Mutex
+)
+
+// StartConfigRevision 打开配置修订数据库，为还没有修订的实例、设备和设备模板保存基线修订
+func StartConfigRevision(path string, cfgdb *redka.DB) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+	stmts := []string{
+		"PRAGMA journal_mode=WAL",
+		`CREATE TABLE IF NOT EXISTS config_revision (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			ts          INTEGER NOT NULL,
+			author      TEXT,
+			source      TEXT,
+			comment     TEXT,
+			action      TEXT NOT NULL,
+			entity_type TEXT NOT NULL,
+			entity_id   TEXT NOT NULL,
+			content     TEXT
+		)`,
+		"CREATE INDEX IF NOT EXISTS config_revision_entity ON config_revision (entity_type, entity_id, id)",
+	}
+	for _, s := range stmts {
+		if _, err = db.Exec(s); err != nil {
+			db.Close()
+			return fmt.Errorf("init revision db: %w", err)
+		}
+	}
+	revdb = db
+
+	b, err := loadConfigBundle(cfgdb)
+	if err != nil {
+		return err
+	}
+	baseline := ConfigRevision{Author: "system", Source: "system", Action: RevisionBaseline}
+	for _, entity := range []struct {
+		entityType string
+		ids        []string
+	}{
+		{"app", sortedKeys(b.Instances)},
+		{"device", sortedKeys(b.Devices)},
+		{"template", sortedKeys(b.Templates)},
+	} {
+		for _, id := range entity.ids {
+			if last, _ := lastRevision(entity.entityType, id); last != nil {
+				continue
+			}
+			saveRevision(cfgdb, baseline, entity.entityType, id)
+		}
+	}
+	return nil
+}
+
+// sortedKeys 返回 map 排序后的键
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// revisionEntity 返回修改的对象所属的修订对象类型，点表、报警规则和历史数据配置属于设备
+func revisionEntity(entityType string) string {
+	switch entityType {
+	case "tags", "alarmRules", "historyConfig":
+		return "device"
+	case "app", "device", "template":
+		return entityType
+	}
+	return ""
+}
+
+// revisionContent 读取对象当前的内容，对象不存在时返回 nil
+func revisionContent(cfgdb *redka.DB, entityType string, id string) (any, error) {
+	switch entityType {
+	case "app":
+		appConfig, err := getAppConfig(cfgdb, id)
+		if err != nil {
+			return nil, nil
+		}
+		return appConfig, nil
+	case "device":
+		value, err := cfgdb.Hash().Get(DevAtInstKey, id)
+		if err != nil {
+			return nil, nil
+		}
+		dev := DeviceRevision{Tags: devTagsOf(cfgdb, id)}
+		if err = json.Unmarshal([]byte(value.String()), &dev.DevConfig); err != nil {
+			return nil, err
+		}
+		if dev.Tags == nil {
+			dev.Tags = map[string][]any{}
+		}
+		if v, errg := cfgdb.Hash().Get(AlarmRuleKey, id); errg == nil {
+			_ = json.Unmarshal([]byte(v.String()), &dev.AlarmRules)
+		}
+		if v, errg := cfgdb.Hash().Get(HisConfigKey, id); errg == nil {
+			var hisConfig HistoryConfig
+			if json.Unmarshal([]byte(v.String()), &hisConfig) == nil {
+				dev.HistoryConfig = &hisConfig
+			}
+		}
+		return dev, nil
+	case "template":
+		tpl, err := getTemplate(cfgdb, id)
+		if err != nil {
+			return nil, nil
+		}
+		return tpl, nil
+	}
+	return nil, fmt.Errorf("entityType '%s' is not supported", entityType)
+}
+
+// lastRevision 返回对象最新的修订，没有时返回 nil
+func lastRevision(entityType string, id string) (*ConfigRevision, error) {
+	row := revdb.QueryRow(`SELECT id, ts, author, source, comment, action, entity_type, entity_id, content
+		FROM config_revision WHERE entity_type = ? AND entity_id = ? ORDER BY id DESC LIMIT 1`, entityType, id)
+	rev, err := scanRevision(row.Scan, true)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rev, err
+}
+
+// getRevision 按修订号读取修订
+func getRevision(revid int64) (*ConfigRevision, error) {
+	row := revdb.QueryRow(`SELECT id, ts, author, source, comment, action, entity_type, entity_id, content
+		FROM config_revision WHERE id = ?`, revid)
+	rev, err := scanRevision(row.Scan, true)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("revision %d is not exist", revid)
+	}
+	return rev, err
+}
+
+// scanRevision 读取一行修订，withContent 为 false 时不解析内容
+func scanRevision(scan func(dest ...any) error, withContent bool) (*ConfigRevision, error) {
+	var rev ConfigRevision
+	var author, source, comment, content sql.NullString
+	if err := scan(&rev.ID, &rev.Ts, &author, &source, &comment, &rev.Action, &rev.EntityType, &rev.EntityID, &content); err != nil {
+		return nil, err
+	}
+	rev.Author, rev.Source, rev.Comment = author.String, source.String, comment.String
+	if withContent && content.Valid {
+		_ = json.Unmarshal([]byte(content.String), &rev.Content)
+	}
+	return &rev, nil
+}
+
+// saveRevision 读取对象修改后的内容保存为修订，与上一个修订相同时不保存，返回保存的修订号
+func saveRevision(cfgdb *redka.DB, rev ConfigRevision, entityType string, id string) int64 {
+	entityType = revisionEntity(entityType)
+	if revdb == nil || entityType == "" || id == "" {
+		return 0
+	}
+	content, err := revisionContent(cfgdb, entityType, id)
+	if err != nil {
+		log.Printf("读取 %s %s 的配置失败，不保存修订: %v", entityType, id, err)
+		return 0
+	}
+	revisionLock.Lock()
+	defer revisionLock.Unlock()
+	var contentJSON sql.NullString
+	if content != nil {
+		b, _ := json.Marshal(content)
+		contentJSON = sql.NullString{String: string(b), Valid: true}
+	}
+	var lastContent sql.NullString
+	errl := revdb.QueryRow(`SELECT content FROM config_revision WHERE entity_type = ? AND entity_id = ? ORDER BY id DESC LIMIT 1`,
+		entityType, id).Scan(&lastContent)
+	if errl == nil && lastContent == contentJSON {
+		return 0
+	}
+	// 没有修订的对象被删除时不需要保存
+	if errl == sql.ErrNoRows && content == nil {
+		return 0
+	}
+	if content == nil {
+		rev.Action = AuditDelete
+	}
+	if rev.Ts == 0 {
+		rev.Ts = time.Now().UnixMilli()
+	}
+	res, err := revdb.Exec(`INSERT INTO config_revision (ts, author, source, comment, action, entity_type, entity_id, content)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		rev.Ts, rev.Author, rev.Source, rev.Comment, rev.Action, entityType, id, contentJSON)
+	if err != nil {
+		log.Printf("保存配置修订失败: %v", err)
+		return 0
+	}
+	revid, _ := res.LastInsertId()
+	return revid
+}
+
+// commitRevision 保存 REST 接口修改的对象的修订，作者为登录用户，说明取自请求参数 comment
+func commitRevision(c *gin.Context, cfgdb *redka.DB, action string, entityType string, ids ...string) {
+	rev := ConfigRevision{Author: c.GetString("user"), Source: "api", Comment: c.Query("comment"), Action: action}
+	for _, id := range ids {
+		saveRevision(cfgdb, rev, entityType, id)
+	}
+}
+
+// commitRevisionMqtt 保存 MQTT 命令通道修改的对象的修订，作者为接收命令的 mqttpub 实例
+func commitRevisionMqtt(instid string, cfgdb *redka.DB, action string, entityType string, id string) {
+	saveRevision(cfgdb, ConfigRevision{Author: "mqtt:" + instid, Source: "mqtt", Action: action}, entityType, id)
+}
+
+// @Summary 查询配置修订
+// @Description 按对象查询配置修订，按修订号倒序排列。修改实例、设备、点表、报警规则、历史数据配置和模板的接口
+// @Description 可以通过请求参数 comment 填写修改说明
+// @Tags Config
+// @Produce json
+// @Param entityType query string false "app/device/template"
+// @Param entityId query string false "实例ID、设备ID或模板ID"
+// @Param author query string false "修改人"
+// @Param start query int false "开始时间，毫秒时间戳"
+// @Param end query int false "结束时间，毫秒时间戳"
+// @Param content query bool false "是否返回修订的内容，默认不返回"
+// @Param limit query int false "返回条数，默认 100，最大 1000"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/config/revisions [get]
+func ListRevisions(c *gin.Context) {
+	if revdb == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "config revision is not running"})
+		return
+	}
+	var start, end int64
+	limit := revMaxRows
+	var err error
+	if s := c.Query("start"); s != "" {
+		if start, err = strconv.ParseInt(s, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "start must be a millisecond timestamp"})
+			return
+		}
+	}
+	if s := c.Query("end"); s != "" {
+		if end, err = strconv.ParseInt(s, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "end must be a millisecond timestamp"})
+			return
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+	}
+	if limit > revMaxRowLimit {
+		limit = revMaxRowLimit
+	}
+	withContent := c.Query("content") == "true" || c.Query("content") == "1"
+
+	query := `SELECT id, ts, author, source, comment, action, entity_type, entity_id, content FROM config_revision WHERE 1 = 1`
+	args := []any{}
+	for _, f := range []struct{ param, column string }{
+		{"entityType", "entity_type"},
+		{"entityId", "entity_id"},
+		{"author", "author"},
+	} {
+		if v := c.Query(f.param); v != "" {
+			query += " AND " + f.column + " = ?"
+			args = append(args, v)
+		}
+	}
+	if start > 0 {
+		query += " AND ts >= ?"
+		args = append(args, start)
+	}
+	if end > 0 {
+		query += " AND ts <= ?"
+		args = append(args, end)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := revdb.Query(query, args...)
+	if err != nil {
+		log.Println("Error reading from revision database:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from revision database"})
+		return
+	}
+	defer rows.Close()
+	revisions := []ConfigRevision{}
+	for rows.Next() {
+		rev, errs := scanRevision(rows.Scan, withContent)
+		if errs != nil {
+			log.Println("Error reading from revision database:", errs)
+			continue
+		}
+		rev.Content = maskSecrets(rev.Content)
+		revisions = append(revisions, *rev)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read data from database",
+		"data":    revisions,
+	})
+}
+
+// @Summary 比较配置修订
+// @Description 比较同一对象的两个修订，to 为空时与当前配置比较
+// @Tags Config
+// @Produce json
+// @Param from query int true "修订号"
+// @Param to query int false "修订号，默认当前配置"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/config/revisions/diff [get]
+func DiffRevisions(c *gin.Context, cfgdb *redka.DB) {
+	if revdb == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "config revision is not running"})
+		return
+	}
+	fromID, err := strconv.ParseInt(c.Query("from"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a revision id"})
+		return
+	}
+	from, err := getRevision(fromID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var to *ConfigRevision
+	if s := c.Query("to"); s != "" {
+		toID, errp := strconv.ParseInt(s, 10, 64)
+		if errp != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a revision id"})
+			return
+		}
+		if to, err = getRevision(toID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if to.EntityType != from.EntityType || to.EntityID != from.EntityID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "revisions belong to different entities"})
+			return
+		}
+	} else {
+		content, errc := revisionContent(cfgdb, from.EntityType, from.EntityID)
+		if errc != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": errc.Error()})
+			return
+		}
+		to = &ConfigRevision{EntityType: from.EntityType, EntityID: from.EntityID, Action: "current", Content: content}
+	}
+	diff := maskDiff(auditDiff(from.Content, to.Content))
+	from.Content, to.Content = maskSecrets(from.Content), maskSecrets(to.Content)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to diff revisions",
+		"data": gin.H{
+			"from": from,
+			"to":   to,
+			"diff": diff,
+		},
+	})
+}
+
+// restoreRevision 把对象恢复为修订的内容，返回需要重启的运行中的实例
+func restoreRevision(cfgdb *redka.DB, rev *ConfigRevision) ([]string, error) {
+	if rev.Content == nil {
+		return nil, fmt.Errorf("revision %d is a delete, use the delete API instead", rev.ID)
+	}
+	jsonstr, _ := json.Marshal(rev.Content)
+	restart := make([]string, 0)
+	switch rev.EntityType {
+	case "app":
+		var appConfig AppConfig
+		if err := json.Unmarshal(jsonstr, &appConfig); err != nil {
+			return nil, err
+		}
+		if err := checkAppConfig(cfgdb, appConfig); err != nil {
+			return nil, err
+		}
+		// 修订中的敏感字段为 ****** 时保留当前的值
+		if current, err := getAppConfig(cfgdb, rev.EntityID); err == nil {
+			appConfig.Config = keepSecrets(appConfig.Config, current.Config)
+			jsonstr, _ = json.Marshal(appConfig)
+		}
+		if _, err := cfgdb.Hash().Set(InstListKey, rev.EntityID, jsonstr); err != nil {
+			return nil, err
+		}
+		restart = append(restart, rev.EntityID)
+
+	case "device":
+		var dev DeviceRevision
+		if err := json.Unmarshal(jsonstr, &dev); err != nil {
+			return nil, err
+		}
+		// 与修改设备相同，只能恢复到与当前实例 appCode 相同的实例
+		fromInstID := dev.DevConfig.InstID
+		if value, errg := cfgdb.Hash().Get(DevAtInstKey, rev.EntityID); errg == nil {
+			var current DevConfig
+			if json.Unmarshal([]byte(value.String()), &current) == nil {
+				fromInstID = current.InstID
+			}
+		}
+		if err := checkDevInstance(cfgdb, dev.DevConfig.InstID, fromInstID); err != nil {
+			return nil, err
+		}
+		// 设备当前绑定的实例和恢复后绑定的实例都需要重启
+		if fromInstID != dev.DevConfig.InstID {
+			restart = append(restart, fromInstID)
+		}
+		if !ContainsString(restart, dev.DevConfig.InstID) {
+			restart = append(restart, dev.DevConfig.InstID)
+		}
+		rules := dev.AlarmRules
+		if rules == nil {
+			rules = []AlarmRule{}
+		}
+		err := cfgdb.Update(func(tx *redka.Tx) error {
+			if errw := writeDevice(tx, dev.DevConfig, dev.Tags, dev.AlarmRules); errw != nil {
+				return errw
+			}
+			if dev.HistoryConfig == nil {
+				_, errd := tx.Hash().Delete(HisConfigKey, rev.EntityID)
+				return errd
+			}
+			hisjson, _ := json.Marshal(dev.HistoryConfig)
+			_, errs := tx.Hash().Set(HisConfigKey, rev.EntityID, hisjson)
+			return errs
+		})
+		if err != nil {
+			return nil, err
+		}
+		invalidateTagEU(rev.EntityID)
+		updateAlarmRules(rev.EntityID, rules)
+
+	case "template":
+		if _, err := cfgdb.Hash().Set(TemplateKey, rev.EntityID, jsonstr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("entityType '%s' is not supported", rev.EntityType)
+	}
+	return restart, nil
+}
+
+// keepSecrets 把 restored 中值为 ****** 的敏感字段替换为 current 中同一位置的值
+func keepSecrets(restored any, current any) any {
+	rm, ok := restored.(map[string]any)
+	if !ok {
+		return restored
+	}
+	cm, _ := current.(map[string]any)
+	for k, v := range rm {
+		if isSecretKey(k) && v == secretMask {
+			if cv, exists := cm[k]; exists {
+				rm[k] = cv
+			}
+			continue
+		}
+		rm[k] = keepSecrets(v, cm[k])
+	}
+	return rm
+}
+
+// @Summary 回滚配置
+// @Description 把实例、设备（含点表、报警规则和历史数据配置）或设备模板恢复为指定修订的内容，保存为新的修订，
+// @Description 并重启受影响的运行中的实例。不能回滚到删除的修订
+// @Tags Config
+// @Accept json
+// @Produce json
+// @Param rollback body RollbackReq true "revision"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/config/rollback [post]
+func RollbackConfig(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
+	if revdb == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "config revision is not running"})
+		return
+	}
+	var req RollbackReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rev, err := getRevision(req.Revision)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before, _ := revisionContent(cfgdb, rev.EntityType, rev.EntityID)
+	restart, err := restoreRevision(cfgdb, rev)
+	auditAPI(c, AuditRollback, rev.EntityType, rev.EntityID, before, rev.Content, err)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Rollback Config Fail", "details": err.Error()})
+		return
+	}
+	comment := req.Comment
+	if comment == "" {
+		comment = fmt.Sprintf("rollback to revision %d", rev.ID)
+	}
+	revid := saveRevision(cfgdb, ConfigRevision{Author: c.GetString("user"), Source: "api", Comment: comment, Action: AuditRollback},
+		rev.EntityType, rev.EntityID)
+	publishConfig(rev.EntityType, AuditUpdate, rev.EntityID)
+
+	// 重启受影响的运行中的实例
+	restarted := make(map[string]string)
+	for _, instid := range restart {
+		if !isWorkerRunning(instid) {
+			continue
+		}
+		errr := RestartInstance(instid, cfgdb, rtdb)
+		auditAPI(c, AuditRestart, "app", instid, nil, nil, errr)
+		if errr != nil {
+			restarted[instid] = errr.Error()
+			continue
+		}
+		restarted[instid] = "Restart OK"
+		workerLogger(instid).Info("配置回滚后实例已重启", "entityType", rev.EntityType, "entityId", rev.EntityID, "revision", rev.ID)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Rollback Config OK",
+		"data": gin.H{
+			"entityType": rev.EntityType,
+			"entityId":   rev.EntityID,
+			"revision":   revid,
+			"restarted":  restarted,
+		},
+	})
+}
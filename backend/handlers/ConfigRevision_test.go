@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nalgeon/redka"
+)
+
+func TestRestoreDeviceRevisionAppCode(t *testing.T) {
+	db, err := redka.Open("file:/"+strings.ReplaceAll(t.Name(), "/", "_")+".db?vfs=memdb", &redka.Options{DriverName: "sqlite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, app := range []AppConfig{
+		{InstID: "modbus@a", AppCode: "modbus"},
+		{InstID: "modbus@c", AppCode: "modbus"},
+		{InstID: "opcua@b", AppCode: "opcua"},
+	} {
+		value, _ := json.Marshal(app)
+		if _, err = db.Hash().Set(InstListKey, app.InstID, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value, _ := json.Marshal(DevConfig{DevID: "d1", DevName: "d1", InstID: "modbus@a"})
+	if _, err = db.Hash().Set(DevAtInstKey, "d1", value); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		instid  string
+		restart string
+		wantErr bool
+	}{
+		{"opcua@b", "", true},
+		{"missing@x", "", true},
+		{"modbus@c", "[modbus@a modbus@c]", false},
+		{"modbus@a", "[modbus@c modbus@a]", false},
+	}
+	for _, tt := range tests {
+		content := DeviceRevision{
+			DevConfig: DevConfig{DevID: "d1", DevName: "d1", InstID: tt.instid},
+			Tags:      map[string][]any{"t1": {"01", "1"}},
+		}
+		restart, err := restoreRevision(db, &ConfigRevision{ID: 1, EntityType: "device", EntityID: "d1", Content: content})
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("restore to %s: err = %v, wantErr %v", tt.instid, err, tt.wantErr)
+		}
+		if err == nil && fmt.Sprint(restart) != tt.restart {
+			t.Errorf("restore to %s: restart = %v, want %s", tt.instid, restart, tt.restart)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+)
+
+// 配置的引用关系：设备绑定实例(DevConfig.InstID)，北向实例的 deviceList 引用设备，
+// 计算点表达式 [devId.tagId] 引用其他设备的点，报警规则和历史数据配置属于设备。
+// 删除实例和设备统一通过这里检查引用并在一个事务中删除，policy 为 forbid(默认) 时有引用不删除，
+// 为 cascade 时同时删除实例的设备、设备的点表、报警规则和历史数据配置，并从北向实例的 deviceList 中移除
+
+// removeDevRuntime 设备删除后清除 rtdb 中设备的实时值，以及推送、通讯状态和历史采样的缓存
+func removeDevRuntime(rtdb *redka.DB, devid string) {
+	if _, err := rtdb.Key().Delete(devid); err != nil {
+		slog.Error("删除设备实时数据失败", "devId", devid, "err", err)
+	}
+	realtimeHub.removeDevice(devid)
+	removeDevStatus(devid)
+	removeHistorySample(devid)
+}
+
+// 删除被引用的对象时的处理方式
+const (
+	DelForbid  = "forbid"
+	DelCascade = "cascade"
+)
+
+// 计算点表达式中对其他设备的点的引用 [devId.tagId]
+var calcRefRe = regexp.MustCompile(`\[([^\[\].\s]+)\.([^\[\]\s]+)\]`)
+
+// 定义 ConfigRef 结构体，对实例或设备的一处引用
+type ConfigRef struct {
+	EntityType string `json:"entityType"` // app/device/tags
+	EntityID   string `json:"entityId"`
+	Path       string `json:"path"` // 引用所在的字段，如 config.deviceList、tag1
+	Ref        string `json:"ref"`  // 被引用的实例ID或设备ID
+}
+
+// 定义 ConfigRefError 结构体，因为有引用而不能删除
+type ConfigRefError struct {
+	Message string      `json:"message"`
+	Refs    []ConfigRef `json:"refs"`
+}
+
+func (e *ConfigRefError) Error() string {
+	return e.Message
+}
+
+// 定义 ConfigDeleteResult 结构体，删除的结果
+type ConfigDeleteResult struct {
+	Deleted  []ConfigRef `json:"deleted"`  // 删除的实例和设备
+	Updated  []ConfigRef `json:"updated"`  // 移除了已删除设备的北向实例
+	Warnings []ConfigRef `json:"warnings"` // 仍然引用已删除设备的计算点
+}
+
+// deviceListOf 返回实例配置中的 deviceList，没有时 ok 为 false
+func deviceListOf(appConfig AppConfig) ([]string, bool) {
+	config, ok := appConfig.Config.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	items, ok := config["deviceList"].([]any)
+	if !ok {
+		return nil, false
+	}
+	deviceList := make([]string, 0, len(items))
+	for _, item := range items {
+		if devid, ok := item.(string); ok {
+			deviceList = append(deviceList, devid)
+		}
+	}
+	return deviceList, true
+}
+
+// calcRefs 返回计算点表达式引用的其他设备的点 devId.tagId
+func calcRefs(appCode string, tag []any) [][2]string {
+	if appCode != "calc" || len(tag) <= 3 {
+		return nil
+	}
+	expr, _ := tag[3].(string)
+	refs := make([][2]string, 0)
+	for _, m := range calcRefRe.FindAllStringSubmatch(expr, -1) {
+		refs = append(refs, [2]string{m[1], m[2]})
+	}
+	return refs
+}
+
+// checkDeviceList 检查实例配置中 deviceList 引用的设备都存在
+func checkDeviceList(cfgdb *redka.DB, appConfig AppConfig) error {
+	deviceList, ok := deviceListOf(appConfig)
+	if !ok {
+		return nil
+	}
+	missing := make([]string, 0)
+	for _, devid := range deviceList {
+		if isExist, _ := cfgdb.Hash().Exists(DevAtInstKey, devid); !isExist {
+			missing = append(missing, devid)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("devices %v in deviceList are not exist", missing)
+	}
+	return nil
+}
+
+// checkAppConfig 检查修改后的实例配置：appCode 有对应的程序，deviceList 引用的设备都存在
+func checkAppConfig(cfgdb *redka.DB, appConfig AppConfig) error {
+	if _, exists := IotappMap[appConfig.AppCode]; !exists {
+		return fmt.Errorf("appCode '%s' is not supported", appConfig.AppCode)
+	}
+	return checkDeviceList(cfgdb, appConfig)
+}
+
+// configDeletePlan 删除实例和设备时要删除和修改的配置
+type configDeletePlan struct {
+	delInst    map[string]bool
+	delDev     map[string]bool
+	newConfigs map[string]AppConfig // 移除了已删除设备的北向实例配置
+}
+
+// planConfigDelete 按 policy 检查 b 中对要删除的实例和设备的引用，返回要删除和修改的配置，
+// 级联修改和提示记录到 result 中
+func planConfigDelete(b *ConfigBundle, instids []string, devids []string, policy string, result *ConfigDeleteResult) (*configDeletePlan, error) {
+	refErr := &ConfigRefError{Refs: []ConfigRef{}}
+
+	delInst := make(map[string]bool)
+	for _, instid := range instids {
+		if _, exists := b.Instances[instid]; !exists {
+			return nil, fmt.Errorf("instId '%s' is not exist", instid)
+		}
+		delInst[instid] = true
+	}
+	delDev := make(map[string]bool)
+	for _, devid := range devids {
+		devConfig, exists := b.Devices[devid]
+		if !exists {
+			return nil, fmt.Errorf("devId '%s' is not exist", devid)
+		}
+		// 按设备实际绑定的实例判断是否在运行，删除实例时实例会先停止
+		if !delInst[devConfig.InstID] && isWorkerRunning(devConfig.InstID) {
+			return nil, fmt.Errorf("instance '%s' of device '%s' is running, stop it before deleting the device", devConfig.InstID, devid)
+		}
+		delDev[devid] = true
+	}
+	// 实例的设备
+	for devid, devConfig := range b.Devices {
+		if !delInst[devConfig.InstID] || delDev[devid] {
+			continue
+		}
+		if policy == DelCascade {
+			delDev[devid] = true
+		} else {
+			refErr.Refs = append(refErr.Refs, ConfigRef{EntityType: "device", EntityID: devid, Path: "instId", Ref: devConfig.InstID})
+		}
+	}
+
+	// 北向实例的 deviceList
+	newConfigs := make(map[string]AppConfig)
+	for instid, appConfig := range b.Instances {
+		deviceList, ok := deviceListOf(appConfig)
+		if !ok || delInst[instid] {
+			continue
+		}
+		kept := make([]any, 0, len(deviceList))
+		removed := false
+		for _, devid := range deviceList {
+			if !delDev[devid] {
+				kept = append(kept, devid)
+				continue
+			}
+			removed = true
+			ref := ConfigRef{EntityType: "app", EntityID: instid, Path: "config.deviceList", Ref: devid}
+			if policy == DelForbid {
+				refErr.Refs = append(refErr.Refs, ref)
+			} else {
+				result.Updated = append(result.Updated, ref)
+			}
+		}
+		if !removed || policy == DelForbid {
+			continue
+		}
+		// deviceList 为空表示转发所有设备，不能通过级联删除变为空
+		if len(kept) == 0 {
+			refErr.Refs = append(refErr.Refs, ConfigRef{EntityType: "app", EntityID: instid, Path: "config.deviceList", Ref: "*"})
+			continue
+		}
+		config := make(map[string]any)
+		for k, v := range appConfig.Config.(map[string]any) {
+			config[k] = v
+		}
+		config["deviceList"] = kept
+		appConfig.Config = config
+		newConfigs[instid] = appConfig
+	}
+
+	// 计算点表达式，级联删除时不能修改表达式，只提示
+	for devid, tags := range b.Tags {
+		if delDev[devid] {
+			continue
+		}
+		appCode, _ := extractChar(b.Devices[devid].InstID)
+		for tagid, tag := range tags {
+			for _, ref := range calcRefs(appCode, tag) {
+				if !delDev[ref[0]] {
+					continue
+				}
+				r := ConfigRef{EntityType: "tags", EntityID: devid, Path: tagid, Ref: ref[0]}
+				if policy == DelForbid {
+					refErr.Refs = append(refErr.Refs, r)
+				} else {
+					result.Warnings = append(result.Warnings, r)
+				}
+			}
+		}
+	}
+	if len(refErr.Refs) > 0 {
+		sort.Slice(refErr.Refs, func(i, j int) bool {
+			return refErr.Refs[i].EntityID+refErr.Refs[i].Path < refErr.Refs[j].EntityID+refErr.Refs[j].Path
+		})
+		refErr.Message = fmt.Sprintf("%d references are found", len(refErr.Refs))
+		return nil, refErr
+	}
+	return &configDeletePlan{delInst: delInst, delDev: delDev, newConfigs: newConfigs}, nil
+}
+
+// deleteConfig 按 policy 删除实例和设备：在一个事务中读取配置、检查引用，停止要删除的实例，
+// 删除并修改引用它们的北向实例，返回结果和删除前的配置
+func deleteConfig(cfgdb *redka.DB, rtdb *redka.DB, instids []string, devids []string, policy string) (*ConfigDeleteResult, *ConfigBundle, error) {
+	if policy == "" {
+		policy = DelForbid
+	}
+	if policy != DelForbid && policy != DelCascade {
+		return nil, nil, fmt.Errorf("policy must be forbid or cascade")
+	}
+	result := &ConfigDeleteResult{Deleted: []ConfigRef{}, Updated: []ConfigRef{}, Warnings: []ConfigRef{}}
+	var b *ConfigBundle
+	var plan *configDeletePlan
+	err := cfgdb.Update(func(tx *redka.Tx) error {
+		var errp error
+		if b, errp = readConfigBundle(tx.Hash()); errp != nil {
+			return errp
+		}
+		if plan, errp = planConfigDelete(b, instids, devids, policy, result); errp != nil {
+			return errp
+		}
+		// 检查通过后先停止实例，运行中的实例不会读到删除了一半的配置
+		for instid := range plan.delInst {
+			_ = StopInstance(instid)
+		}
+		for devid := range plan.delDev {
+			if _, errd := tx.Hash().Delete(DevAtInstKey, devid); errd != nil {
+				return errd
+			}
+			if _, errd := tx.Key().Delete(devid); errd != nil {
+				return errd
+			}
+			if _, errd := tx.Hash().Delete(AlarmRuleKey, devid); errd != nil {
+				return errd
+			}
+			if _, errd := tx.Hash().Delete(HisConfigKey, devid); errd != nil {
+				return errd
+			}
+		}
+		for instid := range plan.delInst {
+			if _, errd := tx.Hash().Delete(InstListKey, instid); errd != nil {
+				return errd
+			}
+		}
+		for instid, appConfig := range plan.newConfigs {
+			jsonstr, _ := json.Marshal(appConfig)
+			if _, errs := tx.Hash().Set(InstListKey, instid, jsonstr); errs != nil {
+				return errs
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for instid := range plan.delInst {
+		result.Deleted = append(result.Deleted, ConfigRef{EntityType: "app", EntityID: instid})
+	}
+	for devid := range plan.delDev {
+		invalidateTagEU(devid)
+		updateAlarmRules(devid, []AlarmRule{})
+		removeDevRuntime(rtdb, devid)
+		result.Deleted = append(result.Deleted, ConfigRef{EntityType: "device", EntityID: devid, Ref: b.Devices[devid].InstID})
+		publishConfig("device", AuditDelete, devid)
+	}
+	// 运行中的北向实例重新读取 deviceList
+	for instid := range plan.newConfigs {
+		publishConfig("app", AuditUpdate, instid)
+	}
+	sort.Slice(result.Deleted, func(i, j int) bool {
+		return result.Deleted[i].EntityType+result.Deleted[i].EntityID < result.Deleted[j].EntityType+result.Deleted[j].EntityID
+	})
+	return result, b, nil
+}
+
+// deletedBefore 返回删除前的实例或设备配置，用于审计日志
+func deletedBefore(b *ConfigBundle, ref ConfigRef) any {
+	if ref.EntityType == "app" {
+		return b.Instances[ref.EntityID]
+	}
+	return map[string]any{"devConfig": b.Devices[ref.EntityID], "tags": b.Tags[ref.EntityID]}
+}
+
+// auditDelete 记录删除和级联修改的审计日志
+func auditDelete(c *gin.Context, cfgdb *redka.DB, before *ConfigBundle, result *ConfigDeleteResult) {
+	for _, ref := range result.Deleted {
+		auditAPI(c, AuditDelete, ref.EntityType, ref.EntityID, deletedBefore(before, ref), nil, nil)
+		commitRevision(c, cfgdb, AuditDelete, ref.EntityType, ref.EntityID)
+	}
+	updated := make(map[string]bool)
+	for _, ref := range result.Updated {
+		if updated[ref.EntityID] {
+			continue
+		}
+		updated[ref.EntityID] = true
+		after, _ := getAppConfig(cfgdb, ref.EntityID)
+		auditAPI(c, AuditUpdate, "app", ref.EntityID, before.Instances[ref.EntityID], after, nil)
+		commitRevision(c, cfgdb, AuditUpdate, "app", ref.EntityID)
+	}
+}
+
+// @Summary 检查配置
+// @Description 检查配置的引用关系：设备绑定的实例、北向实例 deviceList 中的设备、计算点引用的点、
+// @Description 报警规则和历史数据配置的设备、设备的模板，以及没有设备的点表
+// @Tags Config
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/config/check [get]
+func CheckConfig(c *gin.Context, cfgdb *redka.DB) {
+	b, err := loadConfigBundle(cfgdb)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Check Config Fail", "details": err.Error()})
+		return
+	}
+	report := &ConfigImportReport{Errors: []ConfigIssue{}, Warnings: []ConfigIssue{}}
+	validateConfigBundle(b, b, report)
+
+	// 北向实例 deviceList 中不存在的设备会被忽略，这里作为错误报告
+	for i, issue := range report.Warnings {
+		if strings.HasSuffix(issue.Path, ".config.deviceList") {
+			report.Errors = append(report.Errors, issue)
+			report.Warnings[i].Path = ""
+		}
+	}
+	warnings := report.Warnings[:0]
+	for _, issue := range report.Warnings {
+		if issue.Path != "" {
+			warnings = append(warnings, issue)
+		}
+	}
+	report.Warnings = warnings
+
+	// 计算点引用的点
+	for devid, tags := range b.Tags {
+		appCode, _ := extractChar(b.Devices[devid].InstID)
+		for tagid, tag := range tags {
+			for _, ref := range calcRefs(appCode, tag) {
+				if _, exists := b.Tags[ref[0]][ref[1]]; !exists {
+					report.errorf("tags."+devid+"."+tagid, "tag '%s.%s' is not exist", ref[0], ref[1])
+				}
+			}
+		}
+	}
+	// 没有设备的点表
+	if keys, errk := cfgdb.Key().Keys("DEV_*"); errk == nil {
+		for _, key := range keys {
+			if _, exists := b.Devices[key.Key]; !exists {
+				report.warnf("tags."+key.Key, "tag table has no device")
+			}
+		}
+	}
+	sort.Slice(report.Errors, func(i, j int) bool { return report.Errors[i].Path < report.Errors[j].Path })
+	sort.Slice(report.Warnings, func(i, j int) bool { return report.Warnings[i].Path < report.Warnings[j].Path })
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to check config",
+		"data": gin.H{
+			"ok":       len(report.Errors) == 0,
+			"errors":   report.Errors,
+			"warnings": report.Warnings,
+		},
+	})
+}
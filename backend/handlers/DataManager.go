@@ -7,6 +7,8 @@ import (
 	"github.com/nalgeon/redka"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // 定义 DevInfo 结构体
@@ -118,3 +120,72 @@ func GetTagValues(c *gin.Context, rtdb *redka.DB) {
 		"data":    OutterMap,
 	})
 }
+
+// TagWriteReq 写点请求，由设备所属南向实例的工作线程执行，结果通过 Result 返回
+type TagWriteReq struct {
+	DevID  string
+	TagID  string
+	Value  any
+	Result chan error
+}
+
+var (
+	tagWriters      = make(map[string]chan *TagWriteReq) // 实例ID -> 写点请求通道
+	tagWritersLock  sync.Mutex                           // 用于保护 tagWriters 的并发访问
+	tagWriteTimeout = 10 * time.Second                   // 写点请求超时时间
+)
+
+// registerTagWriter 南向实例启动后登记写点请求通道
+func registerTagWriter(instid string) chan *TagWriteReq {
+	ch := make(chan *TagWriteReq, 16)
+	tagWritersLock.Lock()
+	tagWriters[instid] = ch
+	tagWritersLock.Unlock()
+	return ch
+}
+
+// unregisterTagWriter 南向实例退出时注销写点请求通道
+func unregisterTagWriter(instid string, ch chan *TagWriteReq) {
+	tagWritersLock.Lock()
+	if tagWriters[instid] == ch {
+		delete(tagWriters, instid)
+	}
+	tagWritersLock.Unlock()
+}
+
+// WriteTagValue 向设备点写值：查找设备绑定的实例，把请求交给该实例的工作线程并等待执行结果
+func WriteTagValue(cfgdb *redka.DB, devid string, tagid string, value any) error {
+	devValue, err := cfgdb.Hash().Get(DevAtInstKey, devid)
+	if err != nil {
+		return fmt.Errorf("devId '%s' is not exist", devid)
+	}
+	var devConfig DevConfig
+	err = json.Unmarshal([]byte(devValue.String()), &devConfig)
+	if err != nil {
+		return fmt.Errorf("failed to parse device config: %v", err)
+	}
+	isExist, _ := cfgdb.Hash().Exists(devid, tagid)
+	if !isExist {
+		return fmt.Errorf("tagId '%s' is not exist in device '%s'", tagid, devid)
+	}
+
+	tagWritersLock.Lock()
+	ch, ok := tagWriters[devConfig.InstID]
+	tagWritersLock.Unlock()
+	if !ok {
+		return fmt.Errorf("instance '%s' is not running or does not support tag write", devConfig.InstID)
+	}
+
+	req := &TagWriteReq{DevID: devid, TagID: tagid, Value: tagEURaw(devid, tagid, value), Result: make(chan error, 1)}
+	select {
+	case ch <- req:
+	case <-time.After(tagWriteTimeout):
+		return fmt.Errorf("instance '%s' is busy, write request timeout", devConfig.InstID)
+	}
+	select {
+	case err = <-req.Result:
+		return err
+	case <-time.After(tagWriteTimeout):
+		return fmt.Errorf("write tag '%s.%s' timeout", devid, tagid)
+	}
+}
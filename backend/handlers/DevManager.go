@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/nalgeon/redka"
+	"log/slog"
 	"net/http"
-	"strings"
 )
 
 // 定义 DevConfig 结构体
@@ -17,12 +17,16 @@ type DevConfig struct {
 	DevDesc string `json:"devDesc"`
 	InstID  string `json:"instId"`
 	Config  any    `json:"config"`
+	// 按模板创建的设备记录模板ID和参数，见 DevTemplate
+	TplID     string         `json:"tplId,omitempty"`
+	TplParams map[string]any `json:"tplParams,omitempty"`
 }
 
 // 定义 DevOpt 结构体
 type DevOpt struct {
 	DevList []string `json:"devList"`
 	InstID  string   `json:"instID"`
+	Policy  string   `json:"policy,omitempty"` // 删除时设备仍被引用的处理方式：forbid(默认)/cascade
 }
 
 type DevObj struct {
@@ -64,8 +68,9 @@ func ListDevices(c *gin.Context, cfgdb *redka.DB) {
 		return
 	}
 	type NewConfig struct {
-		DevConfig      // 嵌入 AppConfig 结构体
-		IsRunning bool `json:"isRunning"` // 新增字段
+		DevConfig            // 嵌入 AppConfig 结构体
+		IsRunning  bool      `json:"isRunning"`  // 新增字段
+		CommStatus DevStatus `json:"commStatus"` // 设备通讯状态
 	}
 	OutterMap := make(map[string]NewConfig)
 	if len(values) == 0 {
@@ -90,7 +95,7 @@ func ListDevices(c *gin.Context, cfgdb *redka.DB) {
 		var newValue DevConfig
 		erra := json.Unmarshal([]byte(value.String()), &newValue)
 		if erra != nil {
-			fmt.Println("Error unmarshalling JSON:", erra)
+			slog.Error("解析设备配置失败", "devId", key, "err", erra)
 			return
 		}
 		if ContainsString(ids, newValue.InstID) {
@@ -105,8 +110,9 @@ func ListDevices(c *gin.Context, cfgdb *redka.DB) {
 		}
 
 		newData := NewConfig{
-			DevConfig: newValue,
-			IsRunning: isrun, // 设置新增的 Status 字段
+			DevConfig:  newValue,
+			IsRunning:  isrun, // 设置新增的 Status 字段
+			CommStatus: GetDevStatus(key),
 		}
 		if instid == "" {
 			OutterMap[key] = newData
@@ -152,6 +158,14 @@ func NewDev(c *gin.Context, cfgdb *redka.DB) {
 		})
 		return
 	}
+	// 设备绑定的实例需要存在
+	if isExist, _ := cfgdb.Hash().Exists(InstListKey, instId); !isExist {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "New Dev Creat Fail",
+			"details": fmt.Sprintf("instId '%s' is not exist", instId),
+		})
+		return
+	}
 	// 生成一个新的16位 UUID
 	uuidstr := "DEV_" + GenID(8)
 	devConfig.DevID = uuidstr
@@ -169,6 +183,9 @@ func NewDev(c *gin.Context, cfgdb *redka.DB) {
 		})
 		return
 	}
+	auditAPI(c, AuditCreate, "device", uuidstr, nil, devConfig, nil)
+	publishConfig("device", AuditCreate, uuidstr)
+	commitRevision(c, cfgdb, AuditCreate, "device", uuidstr)
 	// 返回数据库cfgdb中App配置信息 列表
 	c.JSON(http.StatusOK, gin.H{
 		"message":   "New Dev Creat OK",
@@ -177,7 +194,9 @@ func NewDev(c *gin.Context, cfgdb *redka.DB) {
 }
 
 // @Summary 删除设备配置信息
-// @Description 这是一个删除设备配置信息的接口
+// @Description 这是一个删除设备配置信息的接口，设备实际绑定的实例运行时不能删除；
+// @Description policy 为 forbid(默认) 时设备仍被北向实例 deviceList 或计算点引用不能删除，
+// @Description 为 cascade 时从 deviceList 中移除设备，计算点的引用只提示
 // @Tags DEV Manager
 // @Accept json
 // @Produce json
@@ -185,61 +204,114 @@ func NewDev(c *gin.Context, cfgdb *redka.DB) {
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]interface{}
 // @Router /api/v1/delDev [post]
-func DelDev(c *gin.Context, cfgdb *redka.DB) {
+func DelDev(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
 	var devOpt DevOpt
 	if err := c.ShouldBindJSON(&devOpt); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	devlist := devOpt.DevList
-	instid := devOpt.InstID
-	// 查找子线程的停止通道
-	_, exists := Workers[instid]
-	if exists {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "The instance of the device binding is running and the device cannot be deleted",
+	result, before, err := deleteConfig(cfgdb, rtdb, nil, devOpt.DevList, devOpt.Policy)
+	if err != nil {
+		if refErr, ok := err.(*ConfigRefError); ok {
+			c.JSON(http.StatusConflict, gin.H{
+				"message": "The device is being referenced and cannot be deleted",
+				"result":  "fail",
+				"details": refErr.Message,
+				"refs":    refErr.Refs,
+			})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Del Dev Fail",
 			"result":  "fail",
+			"details": err.Error(),
 		})
 		return
 	}
-	delResult := make(map[string]string)
-	delError := make([]string, 0)
-	for _, devid := range devlist {
-		devidstr := devid
-		_, err := cfgdb.Hash().Delete(DevAtInstKey, devidstr)
-		if err != nil {
-			delResult[devidstr] = err.Error()
-			delError = append(delError, devidstr)
-		} else {
-			delResult[devidstr] = "Delete OK"
-		}
-		delNum, err1 := cfgdb.Key().Delete(devidstr)
-		if err1 != nil {
-			delResult[devidstr] = err1.Error()
-			delError = append(delError, devidstr)
-		} else {
-			delResult[devidstr] = "Delete OK"
-			fmt.Printf("del %d tags\n", delNum)
-		}
-
+	if before != nil {
+		auditDelete(c, cfgdb, before, result)
 	}
+	// 返回数据库cfgdb中App配置信息 列表
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Del Dev OK",
+		"result":  "success",
+		"devlist": devOpt,
+		"data":    result,
+	})
+}
 
-	if len(delError) > 0 {
+// @Summary 修改设备配置信息
+// @Description 修改设备的名称、描述、类型、配置和绑定的实例，设备ID不变。新实例的 appCode 需要与原实例一致，
+// @Description 修改后原实例和新实例重新读取设备，不需要重启。模板ID和模板参数不能通过此接口修改
+// @Tags DEV Manager
+// @Accept json
+// @Produce json
+// @Param devConfig body DevConfig true "DevConfig"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/modDev [post]
+func ModDev(c *gin.Context, cfgdb *redka.DB) {
+	var devConfig DevConfig
+	if err := c.ShouldBindJSON(&devConfig); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if devConfig.DevID == "" || devConfig.InstID == "" || devConfig.DevName == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "Del Dev Fail",
-			"result":  "fail",
-			"details": delResult,
+			"message": "Mod Dev Fail",
+			"details": "devId, instId and devName are not allowed to be empty",
 		})
 		return
-	} else {
-		// 返回数据库cfgdb中App配置信息 列表
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Del Dev OK",
-			"result":  "success",
-			"devlist": devOpt,
+	}
+	value, err := cfgdb.Hash().Get(DevAtInstKey, devConfig.DevID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Mod Dev Fail",
+			"details": fmt.Sprintf("devId '%s' is not exist", devConfig.DevID),
 		})
+		return
+	}
+	var before DevConfig
+	if err = json.Unmarshal([]byte(value.String()), &before); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Mod Dev Fail", "details": err.Error()})
+		return
+	}
+	if err = checkDevInstance(cfgdb, devConfig.InstID, before.InstID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mod Dev Fail", "details": err.Error()})
+		return
+	}
+	if devConfig.DevType == "" {
+		devConfig.DevType = before.DevType
 	}
+	devConfig.TplID, devConfig.TplParams = before.TplID, before.TplParams
+	jsonstr, _ := json.Marshal(devConfig)
+	_, err = cfgdb.Hash().Set(DevAtInstKey, devConfig.DevID, jsonstr)
+	auditAPI(c, AuditUpdate, "device", devConfig.DevID, before, devConfig, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Mod Dev Fail", "details": err.Error()})
+		return
+	}
+
+	// 运行中的实例重新读取设备，原实例移除设备，新实例增加设备
+	publishConfig("device", AuditUpdate, devConfig.DevID)
+	commitRevision(c, cfgdb, AuditUpdate, "device", devConfig.DevID)
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Mod Dev OK",
+		"devConfig": devConfig,
+	})
+}
 
+// checkDevInstance 检查设备绑定的实例存在。点表的格式由实例的 appCode 决定，
+// 设备只能从 fromInstID 移动到相同 appCode 的实例
+func checkDevInstance(cfgdb *redka.DB, instid string, fromInstID string) error {
+	appConfig, err := getAppConfig(cfgdb, instid)
+	if err != nil {
+		return err
+	}
+	if oldAppCode, _ := extractChar(fromInstID); instid != fromInstID && appConfig.AppCode != oldAppCode {
+		return fmt.Errorf("appCode of instance '%s' is '%s', the device belongs to '%s'", instid, appConfig.AppCode, oldAppCode)
+	}
+	return nil
 }
 
 // @Summary 向设备增加点表信息
@@ -257,30 +329,40 @@ func NewDevTags(c *gin.Context, cfgdb *redka.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// 点表需要属于已存在的设备
+	if isExist, _ := cfgdb.Hash().Exists(DevAtInstKey, devTags.DevID); !isExist {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devId '%s' is not exist", devTags.DevID)})
+		return
+	}
 
 	tagsMap := make(map[string]any)
+	afterTags := make(map[string][]any)
 
 	for key, values := range devTags.TagsMap {
-		trimmedValues := make([]any, len(values))
-		for i, v := range values {
-			if str, ok := v.(string); ok { // 检查是否为字符串类型
-				trimmedValues[i] = strings.TrimSpace(str) // 清除首尾空白字符
-			} else {
-				trimmedValues[i] = v
-			}
+		trimmedValues := trimTag(values)
+		// 点表末尾的工程量属性需要能够解析
+		if _, err := parseTagEU(trimmedValues); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("tag '%s': %v", key, err)})
+			return
 		}
 		jsonData, err := json.Marshal(trimmedValues)
 		if err != nil {
-			fmt.Println("Error marshalling to JSON:", err)
+			slog.Error("序列化点表失败", "devId", devTags.DevID, "tagId", key, "err", err)
 			continue
 		}
 		tagsMap[key] = string(jsonData) // 保留JSON字符串格式
+		afterTags[key] = trimmedValues
 	}
+	before := devTagsOf(cfgdb, devTags.DevID)
 	_, err1 := cfgdb.Key().Delete(devTags.DevID)
 	if err1 != nil {
-		fmt.Println("Error: ", err1)
+		slog.Error("删除点表失败", "devId", devTags.DevID, "err", err1)
 	}
 	_, err := cfgdb.Hash().SetMany(devTags.DevID, tagsMap)
+	invalidateTagEU(devTags.DevID)
+	publishConfig("tags", AuditUpdate, devTags.DevID)
+	auditAPI(c, AuditUpdate, "tags", devTags.DevID, before, afterTags, err)
+	commitRevision(c, cfgdb, AuditUpdate, "tags", devTags.DevID)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "New Dev Creat Fail",
@@ -333,7 +415,7 @@ func GetDevTags(c *gin.Context, cfgdb *redka.DB) {
 				var newValue []interface{}
 				erra := json.Unmarshal([]byte(value.String()), &newValue)
 				if erra != nil {
-					fmt.Println("Error unmarshalling JSON:", erra)
+					slog.Error("解析点表失败", "devId", devidstr, "tagId", key, "err", erra)
 					return
 				}
 				newtag[key] = newValue
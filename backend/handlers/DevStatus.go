@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nalgeon/redka"
+)
+
+// 设备通讯状态：由 WriteDevValues 写入的数据质量计算，
+// 所有点正常为 online，部分点失败为 degraded，所有点失败或数据超时未更新为 offline。
+// 状态变化时写入设备的伪点 _commStatus，北向应用可以像普通点一样转发和报警
+
+// 设备通讯状态定义
+const (
+	DevStatusUnknown  = "unknown"
+	DevStatusOnline   = "online"
+	DevStatusDegraded = "degraded"
+	DevStatusOffline  = "offline"
+
+	CommStatusTag = "_commStatus" // 通讯状态伪点ID
+)
+
+// 定义 DevStatus 结构体，设备的通讯状态
+type DevStatus struct {
+	Status     string `json:"status"`     // online/degraded/offline/unknown
+	Since      int64  `json:"since"`      // 进入当前状态的时间，毫秒时间戳
+	LastSeen   int64  `json:"lastSeen"`   // 最后收到正常数据的时间，毫秒时间戳
+	LastError  string `json:"lastError"`  // 最后一次失败的质量
+	ErrorCount int64  `json:"errorCount"` // 失败的点数累计
+	ReadCount  int64  `json:"readCount"`  // 正常的点数累计
+	BadTags    int    `json:"badTags"`    // 当前失败的点数
+	TotalTags  int    `json:"totalTags"`  // 当前有数据的点数
+}
+
+var (
+	devsStatus     = make(map[string]*DevStatus)      // 设备ID -> 通讯状态
+	devsTagFailed  = make(map[string]map[string]bool) // 设备ID -> 点ID -> 是否失败
+	devsInst       = make(map[string]string)          // 设备ID -> 实例ID，用于按实例累计读取计数，数据超时检测时刷新
+	devsCfgdb      *redka.DB
+	devsStatusLock sync.Mutex
+	// 未单独配置 staleAfter 时数据超时的秒数，按实例类型区分；
+	// OPC UA/DA 为订阅方式，值不变时不会更新，默认不检测超时
+	defaultStaleAfter = map[string]int{
+		"simulator": 30,
+		"modbus":    30,
+	}
+)
+
+// isFailedQuality 判断质量是否表示通讯失败：bad 或数据超时
+func isFailedQuality(quality string) bool {
+	return IsBadQuality(quality) || quality == QualityUncertainStale
+}
+
+// updateDevStatus 根据写入的数据更新设备通讯状态，状态变化时写入 _commStatus 伪点
+func updateDevStatus(rtdb *redka.DB, devid string, values map[string]any) {
+	now := time.Now().UnixMilli()
+	instid := devInstOf(devid)
+	devsStatusLock.Lock()
+	status, ok := devsStatus[devid]
+	if !ok {
+		status = &DevStatus{Status: DevStatusUnknown, Since: now}
+		devsStatus[devid] = status
+		devsTagFailed[devid] = make(map[string]bool)
+	}
+	tagFailed := devsTagFailed[devid]
+	var reads, readErrors int64
+	for tagid, value := range values {
+		if tagid == CommStatusTag {
+			continue
+		}
+		var newValue []any
+		if err := json.Unmarshal(rtRawJSON(value), &newValue); err != nil {
+			continue
+		}
+		quality := QualityOf(newValue)
+		if isFailedQuality(quality) {
+			tagFailed[tagid] = true
+			readErrors++
+			status.LastError = quality
+		} else {
+			tagFailed[tagid] = false
+			reads++
+			status.LastSeen = now
+		}
+	}
+	status.ReadCount += reads
+	status.ErrorCount += readErrors
+	bad := 0
+	for _, failed := range tagFailed {
+		if failed {
+			bad++
+		}
+	}
+	status.BadTags = bad
+	status.TotalTags = len(tagFailed)
+	newStatus := DevStatusOnline
+	if bad == len(tagFailed) {
+		newStatus = DevStatusOffline
+	} else if bad > 0 {
+		newStatus = DevStatusDegraded
+	}
+	changed := newStatus != status.Status
+	if changed {
+		status.Status = newStatus
+		status.Since = now
+	}
+	devsStatusLock.Unlock()
+
+	if instid != "" {
+		m := metricsOf(instid)
+		m.reads.Add(reads)
+		m.readErrors.Add(readErrors)
+	}
+	if changed {
+		commStatus := map[string]any{CommStatusTag: rtValue(time.UnixMilli(now), newStatus, QualityGood)}
+		_ = writeRtdb(rtdb, devid, commStatus)
+	}
+}
+
+// devInstOf 返回设备所属的实例ID，第一次使用时从 cfgdb 读取。
+// 读取 cfgdb 时不持有 devsStatusLock，避免写入路径等待配置库
+func devInstOf(devid string) string {
+	devsStatusLock.Lock()
+	instid, ok := devsInst[devid]
+	cfgdb := devsCfgdb
+	devsStatusLock.Unlock()
+	if ok || cfgdb == nil {
+		return instid
+	}
+	value, err := cfgdb.Hash().Get(DevAtInstKey, devid)
+	if err != nil {
+		return ""
+	}
+	var dev DevConfig
+	if err = json.Unmarshal([]byte(value.String()), &dev); err != nil {
+		return ""
+	}
+	devsStatusLock.Lock()
+	if _, ok = devsInst[devid]; !ok {
+		devsInst[devid] = dev.InstID
+	}
+	devsStatusLock.Unlock()
+	return dev.InstID
+}
+
+// GetDevStatus 返回设备的通讯状态
+func GetDevStatus(devid string) DevStatus {
+	devsStatusLock.Lock()
+	defer devsStatusLock.Unlock()
+	if status, ok := devsStatus[devid]; ok {
+		return *status
+	}
+	return DevStatus{Status: DevStatusUnknown}
+}
+
+// removeDevStatus 设备删除后清除设备的通讯状态
+func removeDevStatus(devid string) {
+	devsStatusLock.Lock()
+	delete(devsStatus, devid)
+	delete(devsTagFailed, devid)
+	delete(devsInst, devid)
+	devsStatusLock.Unlock()
+}
+
+// devNormalTags 返回设备当前未失败的点
+func devNormalTags(devid string) []string {
+	devsStatusLock.Lock()
+	defer devsStatusLock.Unlock()
+	var tagids []string
+	for tagid, failed := range devsTagFailed[devid] {
+		if !failed {
+			tagids = append(tagids, tagid)
+		}
+	}
+	return tagids
+}
+
+// devStaleAfter 返回设备数据超时的秒数，设备配置中的 staleAfter 优先，0 表示不检测
+func devStaleAfter(dev DevConfig) int {
+	if config, ok := dev.Config.(map[string]any); ok {
+		if v, ok := config["staleAfter"].(float64); ok {
+			return int(v)
+		}
+	}
+	appcode, _, _ := strings.Cut(dev.InstID, "@")
+	return defaultStaleAfter[appcode]
+}
+
+// StartDevMonitor 启动数据超时检测：正常数据超过 staleAfter 秒未更新的设备，点质量设置为 uncertain:stale
+func StartDevMonitor(cfgdb *redka.DB, rtdb *redka.DB) {
+	devsStatusLock.Lock()
+	devsCfgdb = cfgdb
+	devsStatusLock.Unlock()
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			devValues, err := cfgdb.Hash().Items(DevAtInstKey)
+			if err != nil {
+				continue
+			}
+			now := time.Now().UnixMilli()
+			insts := make(map[string]string, len(devValues))
+			for devid, value := range devValues {
+				var dev DevConfig
+				if erra := json.Unmarshal([]byte(value.String()), &dev); erra != nil {
+					continue
+				}
+				insts[devid] = dev.InstID
+				staleAfter := devStaleAfter(dev)
+				if staleAfter <= 0 {
+					continue
+				}
+				status := GetDevStatus(devid)
+				if status.Status == DevStatusOffline || status.Status == DevStatusUnknown {
+					continue
+				}
+				if now-status.LastSeen > int64(staleAfter)*1000 {
+					// 已经失败的点保留原来的质量
+					if tagids := devNormalTags(devid); len(tagids) != 0 {
+						setDevQuality(rtdb, devid, tagids, QualityUncertainStale)
+					}
+				}
+			}
+			// 设备改变所属实例后读取计数累计到新的实例
+			devsStatusLock.Lock()
+			devsInst = insts
+			devsStatusLock.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,635 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+)
+
+// 设备模板：一种设备类型的点表、默认配置和报警规则只定义一次，按模板批量创建设备。
+// 模板中的字符串可以使用 ${name} 参数，创建设备时替换为设备的参数值，如 modbus 点表的单元地址列为 "${unitId}"，
+// OPC 点表的节点为 "ns=2;s=${prefix}.Temp"。整个字符串只有一个参数时保留参数值的类型。
+// 除了模板定义的参数，还可以使用内置参数 devId、devName 和 index(批量创建时从 1 开始的序号)。
+// 设备记录模板ID和参数，修改模板时可以用设备自己的参数重新生成点表、配置和报警规则
+
+var (
+	TemplateKey = "tpl@dev" // 设备模板表，模板ID -> DevTemplate
+	tplParamRe  = regexp.MustCompile(`\$\{(\w+)\}`)
+	tplMaxCount = 1000 // 单次批量创建的最大设备数
+)
+
+// 定义 DevTemplate 结构体
+type DevTemplate struct {
+	TplID      string           `json:"tplId"`
+	TplName    string           `json:"tplName"`
+	TplDesc    string           `json:"tplDesc"`
+	AppCode    string           `json:"appCode"` // 适用的实例 appCode，为空时不限制
+	DevType    string           `json:"devType"` // 按模板创建的设备的 devType
+	Config     any              `json:"config"`  // 设备的默认配置
+	Params     map[string]any   `json:"params"`  // 参数的默认值
+	Tags       map[string][]any `json:"tags"`    // 点ID -> 点表
+	AlarmRules []AlarmRule      `json:"alarmRules"`
+	UpdatedAt  int64            `json:"updatedAt"` // 毫秒时间戳
+}
+
+// 定义 TemplateReq 结构体
+type TemplateReq struct {
+	DevTemplate
+	FromDevID string `json:"fromDevId"` // 新建模板时从已有设备复制点表、配置和报警规则
+	Propagate bool   `json:"propagate"` // 修改模板时同时更新按模板创建的设备
+}
+
+// 定义 TemplateInfo 结构体
+type TemplateInfo struct {
+	TplID string `json:"tplId" binding:"required"`
+}
+
+// 定义 TplDevice 结构体，按模板创建的一个设备
+type TplDevice struct {
+	DevName string         `json:"devName"`
+	DevDesc string         `json:"devDesc"`
+	Params  map[string]any `json:"params"` // 覆盖模板的参数默认值
+}
+
+// 定义 TplDevicesReq 结构体
+type TplDevicesReq struct {
+	TplID      string      `json:"tplId" binding:"required"`
+	InstID     string      `json:"instId" binding:"required"`
+	Devices    []TplDevice `json:"devices"`    // 逐个指定设备
+	Count      int         `json:"count"`      // 或者按数量创建，设备名为 namePrefix+序号，使用默认参数
+	NamePrefix string      `json:"namePrefix"` // 按数量创建时的设备名前缀，默认为模板名
+}
+
+// getTemplate 从配置库读取模板
+func getTemplate(cfgdb *redka.DB, tplid string) (*DevTemplate, error) {
+	value, err := cfgdb.Hash().Get(TemplateKey, tplid)
+	if err != nil {
+		return nil, fmt.Errorf("tplId '%s' is not exist", tplid)
+	}
+	var tpl DevTemplate
+	if err = json.Unmarshal([]byte(value.String()), &tpl); err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+	return &tpl, nil
+}
+
+// tplRender 替换值中的 ${name} 参数，返回未定义的参数
+func tplRender(v any, params map[string]any, missing map[string]bool) any {
+	switch val := v.(type) {
+	case string:
+		if m := tplParamRe.FindStringSubmatch(val); m != nil && m[0] == val {
+			if p, ok := params[m[1]]; ok {
+				return p
+			}
+		}
+		return tplParamRe.ReplaceAllStringFunc(val, func(s string) string {
+			name := s[2 : len(s)-1]
+			p, ok := params[name]
+			if !ok {
+				missing[name] = true
+				return s
+			}
+			return fmt.Sprintf("%v", p)
+		})
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = tplRender(item, params, missing)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[k] = tplRender(item, params, missing)
+		}
+		return out
+	}
+	return v
+}
+
+// render 用设备的参数生成设备的配置、点表和报警规则，并检查生成的点表和报警规则
+func (t *DevTemplate) render(devConfig DevConfig) (any, map[string][]any, []AlarmRule, error) {
+	params := make(map[string]any, len(t.Params)+3)
+	for k, v := range t.Params {
+		params[k] = v
+	}
+	for k, v := range devConfig.TplParams {
+		params[k] = v
+	}
+	params["devId"], params["devName"] = devConfig.DevID, devConfig.DevName
+	// 通过 JSON 转换为通用结构再替换，报警规则等结构体中的字符串也能使用参数
+	var body map[string]any
+	b, _ := json.Marshal(map[string]any{"config": t.Config, "tags": t.Tags, "alarmRules": t.AlarmRules})
+	_ = json.Unmarshal(b, &body)
+	missing := make(map[string]bool)
+	body = tplRender(body, params, missing).(map[string]any)
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, nil, nil, fmt.Errorf("parameters %v are not defined", names)
+	}
+	var rendered struct {
+		Tags       map[string][]any `json:"tags"`
+		AlarmRules []AlarmRule      `json:"alarmRules"`
+	}
+	b, _ = json.Marshal(body)
+	if err := json.Unmarshal(b, &rendered); err != nil {
+		return nil, nil, nil, err
+	}
+	for tagid, tag := range rendered.Tags {
+		if err := checkTag(t.AppCode, tagid, tag); err != nil {
+			return nil, nil, nil, fmt.Errorf("tag '%s': %v", tagid, err)
+		}
+	}
+	if err := checkAlarmRules(rendered.AlarmRules); err != nil {
+		return nil, nil, nil, err
+	}
+	return body["config"], rendered.Tags, rendered.AlarmRules, nil
+}
+
+// checkTemplate 检查模板：appCode 需要支持，点表和报警规则使用参数默认值和内置参数能够生成
+func checkTemplate(tpl *DevTemplate) error {
+	if tpl.TplName == "" {
+		return fmt.Errorf("tplName is required")
+	}
+	if _, exists := IotappMap[tpl.AppCode]; tpl.AppCode != "" && !exists {
+		return fmt.Errorf("appCode '%s' is not supported", tpl.AppCode)
+	}
+	for tagid, tag := range tpl.Tags {
+		if len(tag) == 0 || tag[0] != tagid {
+			return fmt.Errorf("tag '%s': the first column must be the tagId", tagid)
+		}
+	}
+	// 模板使用但没有默认值的参数，创建设备时必须指定，这里用占位值检查
+	params := make(map[string]any)
+	for _, name := range tplParamRe.FindAllStringSubmatch(fmt.Sprintf("%v %v %v", tpl.Config, tpl.Tags, tpl.AlarmRules), -1) {
+		params[name[1]] = 1
+	}
+	probe := *tpl
+	probe.Params = params
+	for k, v := range tpl.Params {
+		probe.Params[k] = v
+	}
+	_, _, _, err := probe.render(DevConfig{DevID: "DEV_template", DevName: tpl.TplName})
+	return err
+}
+
+// writeDevice 在事务中写入设备配置、点表和报警规则，点表和报警规则整体替换
+func writeDevice(tx *redka.Tx, devConfig DevConfig, tags map[string][]any, rules []AlarmRule) error {
+	jsonstr, _ := json.Marshal(devConfig)
+	if _, err := tx.Hash().Set(DevAtInstKey, devConfig.DevID, jsonstr); err != nil {
+		return err
+	}
+	if _, err := tx.Key().Delete(devConfig.DevID); err != nil {
+		return err
+	}
+	if len(tags) > 0 {
+		tagsMap := make(map[string]any, len(tags))
+		for tagid, tag := range tags {
+			b, _ := json.Marshal(tag)
+			tagsMap[tagid] = string(b)
+		}
+		if _, err := tx.Hash().SetMany(devConfig.DevID, tagsMap); err != nil {
+			return err
+		}
+	}
+	if len(rules) == 0 {
+		_, err := tx.Hash().Delete(AlarmRuleKey, devConfig.DevID)
+		return err
+	}
+	b, _ := json.Marshal(rules)
+	_, err := tx.Hash().Set(AlarmRuleKey, devConfig.DevID, b)
+	return err
+}
+
+// templateDevices 返回按模板创建的设备
+func templateDevices(cfgdb *redka.DB, tplid string) ([]DevConfig, error) {
+	values, err := cfgdb.Hash().Items(DevAtInstKey)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]DevConfig, 0)
+	for _, value := range values {
+		var devConfig DevConfig
+		if erra := json.Unmarshal([]byte(value.String()), &devConfig); erra != nil {
+			continue
+		}
+		if devConfig.TplID == tplid {
+			devices = append(devices, devConfig)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DevID < devices[j].DevID })
+	return devices, nil
+}
+
+// @Summary 查询设备模板列表
+// @Description 查询所有设备模板，包括按模板创建的设备数量
+// @Tags DEV Template
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/listTemplates [get]
+func ListTemplates(c *gin.Context, cfgdb *redka.DB) {
+	values, err := cfgdb.Hash().Items(TemplateKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from database"})
+		return
+	}
+	devCount := make(map[string]int)
+	if devValues, errd := cfgdb.Hash().Items(DevAtInstKey); errd == nil {
+		for _, value := range devValues {
+			var devConfig DevConfig
+			if erra := json.Unmarshal([]byte(value.String()), &devConfig); erra == nil && devConfig.TplID != "" {
+				devCount[devConfig.TplID]++
+			}
+		}
+	}
+	type TemplateItem struct {
+		DevTemplate
+		DevCount int `json:"devCount"`
+	}
+	templates := make(map[string]TemplateItem)
+	for key, value := range values {
+		var tpl DevTemplate
+		if erra := json.Unmarshal([]byte(value.String()), &tpl); erra != nil {
+			continue
+		}
+		templates[key] = TemplateItem{DevTemplate: tpl, DevCount: devCount[key]}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read templates",
+		"data":    templates,
+	})
+}
+
+// @Summary 查询设备模板
+// @Description 查询设备模板和按模板创建的设备
+// @Tags DEV Template
+// @Accept json
+// @Produce json
+// @Param tplId body TemplateInfo true "tplId"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/getTemplate [post]
+func GetTemplate(c *gin.Context, cfgdb *redka.DB) {
+	var req TemplateInfo
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tpl, err := getTemplate(cfgdb, req.TplID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	devices, _ := templateDevices(cfgdb, req.TplID)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read template",
+		"data":    gin.H{"template": tpl, "devices": devices},
+	})
+}
+
+// @Summary 新建设备模板
+// @Description 新建设备模板，指定 fromDevId 时从已有设备复制模板中没有填写的点表、配置和报警规则
+// @Tags DEV Template
+// @Accept json
+// @Produce json
+// @Param template body TemplateReq true "template"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/newTemplate [post]
+func NewTemplate(c *gin.Context, cfgdb *redka.DB) {
+	var req TemplateReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tpl := req.DevTemplate
+	if req.FromDevID != "" {
+		value, err := cfgdb.Hash().Get(DevAtInstKey, req.FromDevID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devId '%s' is not exist", req.FromDevID)})
+			return
+		}
+		var devConfig DevConfig
+		_ = json.Unmarshal([]byte(value.String()), &devConfig)
+		if tpl.AppCode == "" {
+			tpl.AppCode, _ = extractChar(devConfig.InstID)
+		}
+		if tpl.DevType == "" {
+			tpl.DevType = devConfig.DevType
+		}
+		if tpl.Config == nil {
+			tpl.Config = devConfig.Config
+		}
+		if len(tpl.Tags) == 0 {
+			tpl.Tags = devTagsOf(cfgdb, req.FromDevID)
+		}
+		if len(tpl.AlarmRules) == 0 {
+			if value, errg := cfgdb.Hash().Get(AlarmRuleKey, req.FromDevID); errg == nil {
+				_ = json.Unmarshal([]byte(value.String()), &tpl.AlarmRules)
+			}
+		}
+	}
+	if tpl.DevType == "" {
+		tpl.DevType = "01"
+	}
+	for tagid, tag := range tpl.Tags {
+		tpl.Tags[tagid] = trimTag(tag)
+	}
+	if err := checkTemplate(&tpl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "New Template Fail", "details": err.Error()})
+		return
+	}
+	tpl.TplID = "TPL_" + GenID(8)
+	tpl.UpdatedAt = time.Now().UnixMilli()
+	jsonstr, _ := json.Marshal(tpl)
+	_, err := cfgdb.Hash().Set(TemplateKey, tpl.TplID, jsonstr)
+	auditAPI(c, AuditCreate, "template", tpl.TplID, nil, tpl, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "New Template Fail", "details": err.Error()})
+		return
+	}
+	commitRevision(c, cfgdb, AuditCreate, "template", tpl.TplID)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "New Template OK",
+		"data":    tpl,
+	})
+}
+
+// @Summary 修改设备模板
+// @Description 修改设备模板，propagate=true 时用每个设备自己的参数重新生成按模板创建的设备的点表、配置和报警规则，
+// @Description 所有设备都能生成时才写入；运行中的实例重新读取设备和点表，不需要重启
+// @Tags DEV Template
+// @Accept json
+// @Produce json
+// @Param template body TemplateReq true "template"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/modTemplate [post]
+func ModTemplate(c *gin.Context, cfgdb *redka.DB) {
+	var req TemplateReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tpl := req.DevTemplate
+	before, err := getTemplate(cfgdb, tpl.TplID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if tpl.DevType == "" {
+		tpl.DevType = before.DevType
+	}
+	for tagid, tag := range tpl.Tags {
+		tpl.Tags[tagid] = trimTag(tag)
+	}
+	if err = checkTemplate(&tpl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Mod Template Fail", "details": err.Error()})
+		return
+	}
+	tpl.UpdatedAt = time.Now().UnixMilli()
+
+	// 按新模板生成每个设备的内容，有设备不能生成时不写入
+	type devUpdate struct {
+		before map[string]any
+		dev    DevConfig
+		tags   map[string][]any
+		rules  []AlarmRule
+	}
+	var updates []devUpdate
+	if req.Propagate {
+		devices, errd := templateDevices(cfgdb, tpl.TplID)
+		if errd != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Mod Template Fail", "details": errd.Error()})
+			return
+		}
+		devErrors := make(map[string]string)
+		for _, devConfig := range devices {
+			appCode, _ := extractChar(devConfig.InstID)
+			if tpl.AppCode != "" && appCode != tpl.AppCode {
+				devErrors[devConfig.DevID] = fmt.Sprintf("appCode of instance '%s' is not '%s'", devConfig.InstID, tpl.AppCode)
+				continue
+			}
+			config, tags, rules, errr := tpl.render(devConfig)
+			if errr != nil {
+				devErrors[devConfig.DevID] = errr.Error()
+				continue
+			}
+			old := devConfig
+			devConfig.DevType, devConfig.Config = tpl.DevType, config
+			updates = append(updates, devUpdate{
+				before: map[string]any{"devConfig": old, "tags": devTagsOf(cfgdb, devConfig.DevID)},
+				dev:    devConfig, tags: tags, rules: rules,
+			})
+		}
+		if len(devErrors) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Mod Template Fail", "details": devErrors})
+			return
+		}
+	}
+
+	err = cfgdb.Update(func(tx *redka.Tx) error {
+		jsonstr, _ := json.Marshal(tpl)
+		if _, errs := tx.Hash().Set(TemplateKey, tpl.TplID, jsonstr); errs != nil {
+			return errs
+		}
+		for _, u := range updates {
+			if errw := writeDevice(tx, u.dev, u.tags, u.rules); errw != nil {
+				return errw
+			}
+		}
+		return nil
+	})
+	auditAPI(c, AuditUpdate, "template", tpl.TplID, before, tpl, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Mod Template Fail", "details": err.Error()})
+		return
+	}
+	commitRevision(c, cfgdb, AuditUpdate, "template", tpl.TplID)
+	devids := make([]string, 0, len(updates))
+	for _, u := range updates {
+		invalidateTagEU(u.dev.DevID)
+		rules := u.rules
+		if rules == nil {
+			rules = []AlarmRule{}
+		}
+		updateAlarmRules(u.dev.DevID, rules)
+		auditAPI(c, AuditUpdate, "device", u.dev.DevID, u.before, map[string]any{"devConfig": u.dev, "tags": u.tags}, nil)
+		devids = append(devids, u.dev.DevID)
+	}
+	publishConfig("device", AuditUpdate, devids...)
+	commitRevision(c, cfgdb, AuditUpdate, "device", devids...)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Mod Template OK",
+		"data": gin.H{
+			"template":       tpl,
+			"updatedDevices": devids,
+		},
+	})
+}
+
+// @Summary 删除设备模板
+// @Description 删除设备模板，有按模板创建的设备时不能删除
+// @Tags DEV Template
+// @Accept json
+// @Produce json
+// @Param tplId body TemplateInfo true "tplId"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/delTemplate [post]
+func DelTemplate(c *gin.Context, cfgdb *redka.DB) {
+	var req TemplateInfo
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before, err := getTemplate(cfgdb, req.TplID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	devices, _ := templateDevices(cfgdb, req.TplID)
+	if len(devices) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Del Template Fail",
+			"details": fmt.Sprintf("template is used by %d devices", len(devices)),
+		})
+		return
+	}
+	_, err = cfgdb.Hash().Delete(TemplateKey, req.TplID)
+	auditAPI(c, AuditDelete, "template", req.TplID, before, nil, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Del Template Fail", "details": err.Error()})
+		return
+	}
+	commitRevision(c, cfgdb, AuditDelete, "template", req.TplID)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Del Template OK",
+		"data":    req,
+	})
+}
+
+// @Summary 按模板创建设备
+// @Description 按模板在实例下创建设备：devices 逐个指定设备名和参数，或 count 按数量创建。
+// @Description 实例的 appCode 需要与模板一致，所有设备都能生成时才在一个事务中写入
+// @Tags DEV Template
+// @Accept json
+// @Produce json
+// @Param req body TplDevicesReq true "devices"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/newDevsFromTemplate [post]
+func NewDevsFromTemplate(c *gin.Context, cfgdb *redka.DB) {
+	var req TplDevicesReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tpl, err := getTemplate(cfgdb, req.TplID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	appConfig, err := getAppConfig(cfgdb, req.InstID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if tpl.AppCode != "" && appConfig.AppCode != tpl.AppCode {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("template is for appCode '%s', instance '%s' is '%s'", tpl.AppCode, req.InstID, appConfig.AppCode),
+		})
+		return
+	}
+	devices := req.Devices
+	if len(devices) == 0 {
+		prefix := req.NamePrefix
+		if prefix == "" {
+			prefix = tpl.TplName
+		}
+		for i := 1; i <= req.Count; i++ {
+			devices = append(devices, TplDevice{DevName: prefix + strconv.Itoa(i)})
+		}
+	}
+	if len(devices) == 0 || len(devices) > tplMaxCount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devices or count must be between 1 and %d", tplMaxCount)})
+		return
+	}
+
+	type newDevice struct {
+		dev   DevConfig
+		tags  map[string][]any
+		rules []AlarmRule
+	}
+	created := make([]newDevice, 0, len(devices))
+	devErrors := make(map[string]string)
+	for i, d := range devices {
+		// 序号保存在设备参数中，修改模板后重新生成时保持不变
+		params := map[string]any{"index": i + 1}
+		for k, v := range d.Params {
+			params[k] = v
+		}
+		devConfig := DevConfig{
+			DevID:     "DEV_" + GenID(8),
+			DevType:   tpl.DevType,
+			DevName:   d.DevName,
+			DevDesc:   d.DevDesc,
+			InstID:    req.InstID,
+			TplID:     tpl.TplID,
+			TplParams: params,
+		}
+		if devConfig.DevName == "" {
+			devErrors[strconv.Itoa(i)] = "devName is required"
+			continue
+		}
+		config, tags, rules, errr := tpl.render(devConfig)
+		if errr != nil {
+			devErrors[strconv.Itoa(i)] = errr.Error()
+			continue
+		}
+		devConfig.Config = config
+		created = append(created, newDevice{dev: devConfig, tags: tags, rules: rules})
+	}
+	if len(devErrors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "New Dev Creat Fail", "details": devErrors})
+		return
+	}
+	err = cfgdb.Update(func(tx *redka.Tx) error {
+		for _, d := range created {
+			if errw := writeDevice(tx, d.dev, d.tags, d.rules); errw != nil {
+				return errw
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "New Dev Creat Fail", "details": err.Error()})
+		return
+	}
+	devConfigs := make([]DevConfig, 0, len(created))
+	for _, d := range created {
+		if len(d.rules) > 0 {
+			updateAlarmRules(d.dev.DevID, d.rules)
+		}
+		auditAPI(c, AuditCreate, "device", d.dev.DevID, nil, map[string]any{"devConfig": d.dev, "tags": d.tags}, nil)
+		publishConfig("device", AuditCreate, d.dev.DevID)
+		commitRevision(c, cfgdb, AuditCreate, "device", d.dev.DevID)
+		devConfigs = append(devConfigs, d.dev)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "New Dev Creat OK",
+		"data":    devConfigs,
+	})
+}
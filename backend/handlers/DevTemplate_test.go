@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTplRender(t *testing.T) {
+	params := map[string]any{"host": "10.0.0.1", "port": float64(502), "slave": float64(1), "enabled": true}
+	tests := []struct {
+		name    string
+		v       any
+		want    any
+		missing []string
+	}{
+		{"whole string keeps number", "${port}", float64(502), nil},
+		{"whole string keeps bool", "${enabled}", true, nil},
+		{"embedded", "tcp://${host}:${port}", "tcp://10.0.0.1:502", nil},
+		{"missing whole", "${unit}", "${unit}", []string{"unit"}},
+		{"missing embedded", "${host}/${path}", "10.0.0.1/${path}", []string{"path"}},
+		{"no param", "plain", "plain", nil},
+		{"number", float64(3), float64(3), nil},
+		{"nested", map[string]any{
+			"config": map[string]any{"host": "${host}", "slave": "${slave}"},
+			"tag":    []any{"03", "${slave}", "${name}"},
+		}, map[string]any{
+			"config": map[string]any{"host": "10.0.0.1", "slave": float64(1)},
+			"tag":    []any{"03", float64(1), "${name}"},
+		}, []string{"name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing := make(map[string]bool)
+			got := tplRender(tt.v, params, missing)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("tplRender() = %#v, want %#v", got, tt.want)
+			}
+			if len(missing) != len(tt.missing) {
+				t.Fatalf("missing = %v, want %v", missing, tt.missing)
+			}
+			for _, name := range tt.missing {
+				if !missing[name] {
+					t.Fatalf("missing = %v, want %v", missing, tt.missing)
+				}
+			}
+		})
+	}
+}
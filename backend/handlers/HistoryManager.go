@@ -0,0 +1,494 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+	_ "modernc.org/sqlite"
+)
+
+// 历史数据库：按设备配置的周期把 rtdb 中的最新值保存到 data/history.db，
+// 超过保留天数的数据被删除，超过降采样时间的原始数据按时间桶合并为平均值。
+// 质量为 bad 的数据只用于原始数据查询，不参与聚合
+
+// 定义 HistoryConfig 结构体，设备的历史数据存储配置
+type HistoryConfig struct {
+	DevID            string `json:"devId"`            // 设备ID，"*" 为未单独配置设备的默认配置
+	Enable           bool   `json:"enable"`           // 是否保存历史数据
+	Interval         int    `json:"interval"`         // 采样周期(秒)
+	RetentionDays    int    `json:"retentionDays"`    // 保留天数
+	DownsampleAfter  int    `json:"downsampleAfter"`  // 原始数据保留小时数，超过后降采样，0 不降采样
+	DownsampleBucket int    `json:"downsampleBucket"` // 降采样的时间桶(秒)
+}
+
+// 定义 TagHistoryReq 结构体
+type TagHistoryReq struct {
+	DevID       string   `json:"devId" binding:"required"`
+	TagIDs      []string `json:"tagIds"`      // 为空时查询设备的所有点
+	Start       int64    `json:"start"`       // 开始时间，毫秒时间戳，默认结束时间前 1 小时
+	End         int64    `json:"end"`         // 结束时间，毫秒时间戳，默认当前时间
+	Aggregation string   `json:"aggregation"` // raw(默认)/avg/min/max/last
+	Bucket      int64    `json:"bucket"`      // 聚合的时间桶(秒)，默认把查询范围分为 500 段
+}
+
+var (
+	HisConfigKey      = "his@router" // 历史数据存储配置表，设备ID -> HistoryConfig
+	hisdb             *sql.DB
+	hisLastSample     = make(map[string]time.Time) // 设备ID -> 上次采样时间
+	hisLock           sync.Mutex
+	hisMaintainCycle  = 10 * time.Minute // 清理和降采样的周期
+	hisMaxRawRows     = 100000           // 单次查询返回的最大原始数据条数
+	hisDefaultBuckets = int64(500)       // 未指定时间桶时的分段数
+	// 时间桶的质量：有 good 数据时为 good，否则有 uncertain 数据时为 uncertain，否则为 bad
+	hisBucketQualitySQL = `CASE WHEN max(coalesce(quality, 'good') LIKE 'good%') THEN 'good'
+		WHEN max(quality LIKE 'uncertain%') THEN 'uncertain' ELSE 'bad' END`
+	defaultHistoryConf = HistoryConfig{
+		DevID:            "*",
+		Enable:           true,
+		Interval:         10,
+		RetentionDays:    30,
+		DownsampleAfter:  24,
+		DownsampleBucket: 60,
+	}
+)
+
+// StartHistorian 打开历史数据库并启动采样和维护线程
+func StartHistorian(path string, cfgdb *redka.DB, rtdb *redka.DB) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	// 采样、维护和查询共用一个连接，避免 SQLite 写锁冲突
+	db.SetMaxOpenConns(1)
+	stmts := []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA synchronous=NORMAL",
+		`CREATE TABLE IF NOT EXISTS history (
+			dev_id TEXT NOT NULL,
+			tag_id TEXT NOT NULL,
+			ts     INTEGER NOT NULL,
+			value  REAL,
+			text   TEXT,
+			quality TEXT,
+			PRIMARY KEY (dev_id, tag_id, ts)
+		) WITHOUT ROWID`,
+		`CREATE TABLE IF NOT EXISTS history_meta (
+			dev_id         TEXT PRIMARY KEY,
+			downsampled_to INTEGER NOT NULL
+		)`,
+	}
+	for _, s := range stmts {
+		if _, err = db.Exec(s); err != nil {
+			db.Close()
+			return fmt.Errorf("init history db: %w", err)
+		}
+	}
+	// 早期创建的历史表没有质量列
+	if _, err = db.Exec("SELECT quality FROM history LIMIT 1"); err != nil {
+		if _, err = db.Exec("ALTER TABLE history ADD COLUMN quality TEXT"); err != nil {
+			db.Close()
+			return fmt.Errorf("init history db: %w", err)
+		}
+	}
+	hisdb = db
+
+	go func() {
+		lastMaintain := time.Now()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			historianSample(cfgdb, rtdb)
+			if time.Since(lastMaintain) >= hisMaintainCycle {
+				lastMaintain = time.Now()
+				historianMaintain(cfgdb)
+			}
+		}
+	}()
+	return nil
+}
+
+// getHistoryConfig 读取设备的历史数据存储配置，未单独配置时使用默认配置
+func getHistoryConfig(cfgdb *redka.DB, devid string) HistoryConfig {
+	for _, key := range []string{devid, "*"} {
+		value, err := cfgdb.Hash().Get(HisConfigKey, key)
+		if err != nil {
+			continue
+		}
+		var hisConfig HistoryConfig
+		if erra := json.Unmarshal([]byte(value.String()), &hisConfig); erra != nil {
+			log.Printf("Error unmarshalling history config of %s: %v", key, erra)
+			continue
+		}
+		hisConfig.DevID = devid
+		return hisConfig
+	}
+	hisConfig := defaultHistoryConf
+	hisConfig.DevID = devid
+	return hisConfig
+}
+
+// removeHistorySample 设备删除后清除设备的上次采样时间，已保存的历史数据按保存期限清理
+func removeHistorySample(devid string) {
+	hisLock.Lock()
+	delete(hisLastSample, devid)
+	hisLock.Unlock()
+}
+
+// historianSample 对到达采样周期的设备保存一次最新值，时间戳使用数据的采集时间，
+// 未更新的数据不会重复保存
+func historianSample(cfgdb *redka.DB, rtdb *redka.DB) {
+	devValues, err := cfgdb.Hash().Items(DevAtInstKey)
+	if err != nil {
+		log.Printf("historian: read devices: %v", err)
+		return
+	}
+	now := time.Now()
+	for devid := range devValues {
+		hisConfig := getHistoryConfig(cfgdb, devid)
+		if !hisConfig.Enable {
+			continue
+		}
+		interval := time.Duration(hisConfig.Interval) * time.Second
+		hisLock.Lock()
+		last := hisLastSample[devid]
+		if now.Sub(last) < interval {
+			hisLock.Unlock()
+			continue
+		}
+		hisLastSample[devid] = now
+		hisLock.Unlock()
+
+		values, erra := rtdb.Hash().Items(devid)
+		if erra != nil || len(values) == 0 {
+			continue
+		}
+		tx, errb := hisdb.Begin()
+		if errb != nil {
+			log.Printf("historian: begin: %v", errb)
+			return
+		}
+		for tagid, value := range values {
+			var newValue []any
+			if errc := json.Unmarshal([]byte(value.String()), &newValue); errc != nil || len(newValue) < 3 {
+				continue
+			}
+			ts, ok := newValue[2].(float64)
+			if !ok {
+				continue
+			}
+			num, text := historyValue(newValue[1])
+			_, errc := tx.Exec("INSERT OR IGNORE INTO history (dev_id, tag_id, ts, value, text, quality) VALUES (?, ?, ?, ?, ?, ?)",
+				devid, tagid, int64(ts), num, text, QualityOf(newValue))
+			if errc != nil {
+				log.Printf("historian: insert %s.%s: %v", devid, tagid, errc)
+			}
+		}
+		if errb = tx.Commit(); errb != nil {
+			log.Printf("historian: commit: %v", errb)
+		}
+	}
+}
+
+// historyValue 数值和布尔量保存为数值（布尔量为 0/1），其他类型保存为文本
+func historyValue(v any) (any, any) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case float64:
+		return val, nil
+	case bool:
+		if val {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	default:
+		return nil, fmt.Sprintf("%v", val)
+	}
+}
+
+// historianMaintain 删除超过保留天数的数据，对超过降采样时间的原始数据降采样
+func historianMaintain(cfgdb *redka.DB) {
+	rows, err := hisdb.Query("SELECT DISTINCT dev_id FROM history")
+	if err != nil {
+		log.Printf("historian: list devices: %v", err)
+		return
+	}
+	var devids []string
+	for rows.Next() {
+		var devid string
+		if rows.Scan(&devid) == nil {
+			devids = append(devids, devid)
+		}
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, devid := range devids {
+		hisConfig := getHistoryConfig(cfgdb, devid)
+		if hisConfig.RetentionDays > 0 {
+			cutoff := now.AddDate(0, 0, -hisConfig.RetentionDays).UnixMilli()
+			if _, err = hisdb.Exec("DELETE FROM history WHERE dev_id = ? AND ts < ?", devid, cutoff); err != nil {
+				log.Printf("historian: retention %s: %v", devid, err)
+			}
+		}
+		if hisConfig.DownsampleAfter > 0 && hisConfig.DownsampleBucket > 0 {
+			if err = historianDownsample(devid, hisConfig, now); err != nil {
+				log.Printf("historian: downsample %s: %v", devid, err)
+			}
+		}
+	}
+}
+
+// historianDownsample 把上次降采样位置到 降采样时间 之间的原始数据按时间桶合并：
+// 数值取平均值、文本取时间桶内的任一个值，结果保存在时间桶的起始时间。
+// 时间桶内有非 bad 的数据时只合并非 bad 的数据
+func historianDownsample(devid string, hisConfig HistoryConfig, now time.Time) error {
+	bucket := int64(hisConfig.DownsampleBucket) * 1000
+	cutoff := now.Add(-time.Duration(hisConfig.DownsampleAfter)*time.Hour).UnixMilli() / bucket * bucket
+	var from int64
+	err := hisdb.QueryRow("SELECT downsampled_to FROM history_meta WHERE dev_id = ?", devid).Scan(&from)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	from = from / bucket * bucket
+	if from >= cutoff {
+		return nil
+	}
+	tx, err := hisdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT OR REPLACE INTO history (dev_id, tag_id, ts, value, text, quality)
+		SELECT dev_id, tag_id, ts / ?1 * ?1,
+			coalesce(avg(CASE WHEN coalesce(quality, 'good') NOT LIKE 'bad%' THEN value END), avg(value)),
+			text, `+hisBucketQualitySQL+` FROM history
+		WHERE dev_id = ?2 AND ts >= ?3 AND ts < ?4
+		GROUP BY tag_id, ts / ?1`, bucket, devid, from, cutoff)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM history WHERE dev_id = ? AND ts >= ? AND ts < ? AND ts % ? != 0",
+		devid, from, cutoff, bucket)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO history_meta (dev_id, downsampled_to) VALUES (?, ?)", devid, cutoff)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// @Summary 查询设备点的历史数据
+// @Description 按时间范围查询设备点的历史数据，支持原始数据和按时间桶聚合(avg/min/max/last)，返回 点ID -> [[毫秒时间戳, 值, 质量], ...]，质量为 bad 的数据不参与聚合
+// @Tags Data Manager
+// @Accept json
+// @Produce json
+// @Param query body TagHistoryReq true "history query"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/getTagHistory [post]
+func GetTagHistory(c *gin.Context) {
+	var req TagHistoryReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if hisdb == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "historian is not running"})
+		return
+	}
+	if req.End == 0 {
+		req.End = time.Now().UnixMilli()
+	}
+	if req.Start == 0 {
+		req.Start = req.End - time.Hour.Milliseconds()
+	}
+	if req.Start >= req.End {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start must be earlier than end"})
+		return
+	}
+	if req.Aggregation == "" {
+		req.Aggregation = "raw"
+	}
+
+	var query string
+	args := []any{}
+	switch req.Aggregation {
+	case "raw":
+		query = "SELECT tag_id, ts, value, text, quality FROM history WHERE dev_id = ? AND ts >= ? AND ts <= ?"
+	case "avg", "min", "max", "last":
+		bucket := req.Bucket * 1000
+		if bucket <= 0 {
+			bucket = (req.End - req.Start) / hisDefaultBuckets
+			if bucket < 1000 {
+				bucket = 1000
+			}
+		}
+		if req.Aggregation == "last" {
+			// SQLite 中与 max() 一起查询的列取自 ts 最大的一行
+			query = "SELECT tag_id, ts / ? * ? AS bts, value, text, quality, max(ts) FROM history WHERE dev_id = ? AND ts >= ? AND ts <= ?"
+		} else {
+			query = fmt.Sprintf("SELECT tag_id, ts / ? * ? AS bts, %s(value), NULL, %s FROM history WHERE dev_id = ? AND ts >= ? AND ts <= ?",
+				req.Aggregation, hisBucketQualitySQL)
+		}
+		// 质量为 bad 的数据不参与聚合
+		query += " AND coalesce(quality, 'good') NOT LIKE 'bad%'"
+		args = append(args, bucket, bucket)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("aggregation '%s' is not supported", req.Aggregation)})
+		return
+	}
+	args = append(args, req.DevID, req.Start, req.End)
+	if len(req.TagIDs) != 0 {
+		query += " AND tag_id IN (?" + strings.Repeat(", ?", len(req.TagIDs)-1) + ")"
+		for _, tagid := range req.TagIDs {
+			args = append(args, tagid)
+		}
+	}
+	if req.Aggregation == "raw" {
+		query += fmt.Sprintf(" ORDER BY tag_id, ts LIMIT %d", hisMaxRawRows)
+	} else {
+		query += " GROUP BY tag_id, bts ORDER BY tag_id, bts"
+	}
+
+	rows, err := hisdb.Query(query, args...)
+	if err != nil {
+		log.Println("Error reading from history database:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Failed to read data from history database",
+		})
+		return
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	OutterMap := make(map[string][][]any)
+	for rows.Next() {
+		var tagid string
+		var ts int64
+		var value sql.NullFloat64
+		var text, quality sql.NullString
+		dest := []any{&tagid, &ts, &value, &text, &quality}
+		if len(cols) > len(dest) {
+			var maxts int64
+			dest = append(dest, &maxts)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			log.Println("Error reading from history database:", err)
+			continue
+		}
+		var v any
+		if value.Valid {
+			v = value.Float64
+		} else if text.Valid {
+			v = text.String
+		}
+		q := QualityGood
+		if quality.Valid && quality.String != "" {
+			q = quality.String
+		}
+		OutterMap[tagid] = append(OutterMap[tagid], []any{ts, v, q})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read data from history database",
+		"data":    OutterMap,
+	})
+}
+
+// @Summary 查询历史数据存储配置
+// @Description 查询设备的历史数据存储配置，devId 为空时返回所有已配置的设备和默认配置("*")
+// @Tags Data Manager
+// @Accept json
+// @Produce json
+// @Param devid body DevInfo true "DevId"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/getHistoryConfig [post]
+func GetHistoryConfig(c *gin.Context, cfgdb *redka.DB) {
+	var devInfo DevInfo
+	if err := c.ShouldBindJSON(&devInfo); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if devInfo.DevId != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "success to read history config",
+			"data":    getHistoryConfig(cfgdb, devInfo.DevId),
+		})
+		return
+	}
+	values, err := cfgdb.Hash().Items(HisConfigKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to read data from database"})
+		return
+	}
+	hisConfigs := map[string]HistoryConfig{"*": defaultHistoryConf}
+	for key, value := range values {
+		var hisConfig HistoryConfig
+		if erra := json.Unmarshal([]byte(value.String()), &hisConfig); erra != nil {
+			continue
+		}
+		hisConfigs[key] = hisConfig
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to read history config",
+		"data":    hisConfigs,
+	})
+}
+
+// @Summary 修改历史数据存储配置
+// @Description 修改设备的历史数据存储配置，devId 为 "*" 时修改默认配置
+// @Tags Data Manager
+// @Accept json
+// @Produce json
+// @Param config body HistoryConfig true "history config"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/setHistoryConfig [post]
+func SetHistoryConfig(c *gin.Context, cfgdb *redka.DB) {
+	var hisConfig HistoryConfig
+	if err := c.ShouldBindJSON(&hisConfig); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if hisConfig.DevID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "devId is required"})
+		return
+	}
+	if hisConfig.DevID != "*" {
+		isExist, _ := cfgdb.Hash().Exists(DevAtInstKey, hisConfig.DevID)
+		if !isExist {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devId '%s' is not exist", hisConfig.DevID)})
+			return
+		}
+	}
+	if hisConfig.Interval < 1 || hisConfig.RetentionDays < 0 || hisConfig.DownsampleAfter < 0 || hisConfig.DownsampleBucket < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be at least 1 second, other values must not be negative"})
+		return
+	}
+	before := getHistoryConfig(cfgdb, hisConfig.DevID)
+	jsonstr, _ := json.Marshal(hisConfig)
+	_, err := cfgdb.Hash().Set(HisConfigKey, hisConfig.DevID, jsonstr)
+	auditAPI(c, AuditUpdate, "historyConfig", hisConfig.DevID, before, hisConfig, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to write data to database"})
+		return
+	}
+	// 默认配置 "*" 不属于设备，不保存修订
+	if hisConfig.DevID != "*" {
+		commitRevision(c, cfgdb, AuditUpdate, "historyConfig", hisConfig.DevID)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to write history config",
+		"data":    hisConfig,
+	})
+}
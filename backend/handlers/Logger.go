@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 日志：基于 log/slog 的分级结构化日志，同时输出到控制台和 data/logs 下按大小滚动的 JSON 行文件，
+// 最近的日志保留在内存中，供 /api/v1/logs 查询和实时推送。
+// 标准库 log 的输出也经过这里，级别为 INFO；实例的工作线程通过 workerLogger 获取带 instId/appCode 的日志
+
+// 定义 LogEntry 结构体，一条日志
+type LogEntry struct {
+	Seq     int64          `json:"seq"` // 序号，用于增量查询
+	Ts      int64          `json:"ts"`  // 毫秒时间戳
+	Level   string         `json:"level"`
+	Msg     string         `json:"msg"`
+	InstID  string         `json:"instId,omitempty"`
+	AppCode string         `json:"appCode,omitempty"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// 定义 LogLevelReq 结构体
+type LogLevelReq struct {
+	Level string `json:"level" binding:"required"` // debug/info/warn/error
+}
+
+var (
+	logLevel       = new(slog.LevelVar)
+	logRingSize    = 5000     // 内存中保留的日志条数
+	logFileMaxSize = 10 << 20 // 单个日志文件的大小
+	logFileKeep    = 5        // 保留的历史日志文件数
+	logSinkInst    = &logSink{
+		ring:        make([]LogEntry, 0, logRingSize),
+		console:     os.Stdout,
+		subscribers: make(map[chan LogEntry]struct{}),
+	}
+)
+
+// InitLogger 初始化日志：日志文件保存在 dir 下，level 为 debug/info/warn/error
+func InitLogger(dir string, level string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level '%s'", level)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	w, err := newRotateWriter(filepath.Join(dir, "ginElement.log"), int64(logFileMaxSize), logFileKeep)
+	if err != nil {
+		return err
+	}
+	logSinkInst.mu.Lock()
+	logSinkInst.file = w
+	logSinkInst.mu.Unlock()
+	slog.SetDefault(slog.New(&logHandler{sink: logSinkInst}))
+	return nil
+}
+
+// workerLogger 返回实例工作线程的日志，附带 instId 和 appCode
+func workerLogger(instid string) *slog.Logger {
+	appcode, _, _ := strings.Cut(instid, "@")
+	return slog.Default().With("instId", instid, "appCode", appcode)
+}
+
+// 定义按大小滚动的日志文件：name 写满后依次改名为 name.1 ... name.N
+type rotateWriter struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+func newRotateWriter(name string, maxSize int64, keep int) (*rotateWriter, error) {
+	w := &rotateWriter{name: name, maxSize: maxSize, keep: keep}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, info.Size()
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+		w.f.Close()
+		for i := w.keep - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", w.name, i), fmt.Sprintf("%s.%d", w.name, i+1))
+		}
+		_ = os.Rename(w.name, w.name+".1")
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// 定义日志输出：控制台、文件、内存和实时订阅者
+type logSink struct {
+	mu          sync.Mutex
+	seq         int64
+	ring        []LogEntry // 环形缓冲，next 为下一条写入的位置
+	next        int
+	console     io.Writer
+	file        io.Writer
+	subscribers map[chan LogEntry]struct{}
+}
+
+func (s *logSink) write(entry LogEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	entry.Seq = s.seq
+	if len(s.ring) < logRingSize {
+		s.ring = append(s.ring, entry)
+	} else {
+		s.ring[s.next] = entry
+	}
+	s.next = (s.next + 1) % logRingSize
+
+	if s.file != nil {
+		line, _ := json.Marshal(entry)
+		_, _ = s.file.Write(append(line, '\n'))
+	}
+	if s.console != nil {
+		var b strings.Builder
+		b.WriteString(time.UnixMilli(entry.Ts).Format("2006-01-02 15:04:05.000 "))
+		b.WriteString(entry.Level)
+		if entry.InstID != "" {
+			b.WriteString(" [" + entry.InstID + "]")
+		}
+		b.WriteString(" " + entry.Msg)
+		for k, v := range entry.Attrs {
+			fmt.Fprintf(&b, " %s=%v", k, v)
+		}
+		b.WriteString("\n")
+		_, _ = io.WriteString(s.console, b.String())
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+// entries 返回序号大于 since 的日志，按时间顺序
+func (s *logSink) entries(since int64) []LogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]LogEntry, 0)
+	n := len(s.ring)
+	start := 0
+	if n == logRingSize {
+		start = s.next
+	}
+	for i := 0; i < n; i++ {
+		entry := s.ring[(start+i)%n]
+		if entry.Seq > since {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func (s *logSink) subscribe() chan LogEntry {
+	ch := make(chan LogEntry, 256)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *logSink) unsubscribe(ch chan LogEntry) {
+	s.mu.Lock()
+	delete(s.subscribers, ch)
+	s.mu.Unlock()
+}
+
+// 定义 slog 的 Handler，把日志转换为 LogEntry 交给 logSink
+type logHandler struct {
+	sink   *logSink
+	attrs  []slog.Attr
+	prefix string // WithGroup 的分组前缀
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *logHandler) Handle(_ context.Context, r slog.Record) error {
+	entry := LogEntry{
+		Ts:    r.Time.UnixMilli(),
+		Level: r.Level.String(),
+		Msg:   r.Message,
+	}
+	if r.Time.IsZero() {
+		entry.Ts = time.Now().UnixMilli()
+	}
+	add := func(a slog.Attr) {
+		a.Value = a.Value.Resolve()
+		if a.Equal(slog.Attr{}) {
+			return
+		}
+		switch {
+		case h.prefix == "" && a.Key == "instId":
+			entry.InstID = a.Value.String()
+		case h.prefix == "" && a.Key == "appCode":
+			entry.AppCode = a.Value.String()
+		default:
+			if entry.Attrs == nil {
+				entry.Attrs = make(map[string]any)
+			}
+			v := a.Value.Any()
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			entry.Attrs[h.prefix+a.Key] = v
+		}
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		add(a)
+		return true
+	})
+	h.sink.write(entry)
+	return nil
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &nh
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.prefix = h.prefix + name + "."
+	return &nh
+}
+
+// logMatch 判断日志是否满足查询条件
+func logMatch(entry LogEntry, level slog.Level, instid string, appcode string, keyword string) bool {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(entry.Level)); err == nil && l < level {
+		return false
+	}
+	if instid != "" && entry.InstID != instid {
+		return false
+	}
+	if appcode != "" && entry.AppCode != appcode {
+		return false
+	}
+	if keyword != "" && !strings.Contains(entry.Msg, keyword) {
+		return false
+	}
+	return true
+}
+
+// @Summary 查询日志
+// @Description 查询内存中最近的日志，按级别、实例和关键字过滤；follow=1 时通过 Server-Sent Events 先推送满足条件的日志，之后实时推送新日志
+// @Tags System
+// @Produce json
+// @Param level query string false "最低级别：debug/info/warn/error，默认 debug"
+// @Param instId query string false "实例ID"
+// @Param appCode query string false "应用类型"
+// @Param q query string false "消息关键字"
+// @Param since query int false "只返回序号大于 since 的日志"
+// @Param limit query int false "最多返回最近的条数，默认 500"
+// @Param follow query string false "1: 实时推送"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/logs [get]
+func GetLogs(c *gin.Context) {
+	level := slog.LevelDebug
+	if s := c.Query("level"); s != "" {
+		if err := level.UnmarshalText([]byte(s)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid level '%s'", s)})
+			return
+		}
+	}
+	var since int64
+	if s := c.Query("since"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an integer"})
+			return
+		}
+		since = v
+	}
+	limit := 500
+	if s := c.Query("limit"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = v
+	}
+	instid, appcode, keyword := c.Query("instId"), c.Query("appCode"), c.Query("q")
+
+	// 先订阅再读取已有日志，避免遗漏两者之间的日志
+	var ch chan LogEntry
+	if c.Query("follow") == "1" {
+		ch = logSinkInst.subscribe()
+		defer logSinkInst.unsubscribe(ch)
+	}
+	entries := make([]LogEntry, 0)
+	for _, entry := range logSinkInst.entries(since) {
+		if logMatch(entry, level, instid, appcode, keyword) {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	if ch == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "success to read logs",
+			"data":    entries,
+		})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	var lastSeq int64
+	for _, entry := range entries {
+		c.SSEvent("log", entry)
+		lastSeq = entry.Seq
+	}
+	c.Writer.Flush()
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case entry := <-ch:
+			if entry.Seq > lastSeq && logMatch(entry, level, instid, appcode, keyword) {
+				c.SSEvent("log", entry)
+			}
+			return true
+		case now := <-heartbeat.C:
+			c.SSEvent("ping", fmt.Sprintf("%d", now.UnixMilli()))
+			return true
+		}
+	})
+}
+
+// @Summary 修改日志级别
+// @Description 修改运行中的日志级别，重启后恢复为启动参数 -loglevel 指定的级别
+// @Tags System
+// @Accept json
+// @Produce json
+// @Param level body LogLevelReq true "level"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/setLogLevel [post]
+func SetLogLevel(c *gin.Context) {
+	var req LogLevelReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before := logLevel.Level().String()
+	if err := logLevel.UnmarshalText([]byte(req.Level)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid level '%s'", req.Level)})
+		return
+	}
+	auditAPI(c, AuditUpdate, "logLevel", "", before, logLevel.Level().String(), nil)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to set log level",
+		"data":    logLevel.Level().String(),
+	})
+}
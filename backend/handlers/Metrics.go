@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+)
+
+// 运行指标：/healthz 存活检查，/readyz 就绪检查，/metrics 按 Prometheus 文本格式输出实例状态、
+// 南向实例读取成功和失败的点数、实例的重连次数、北向实例发布/写入成功和失败的次数及队列长度、
+// rtdb 的键数量和 Go 运行时指标。
+// 南向实例的读取计数在更新设备通讯状态时按设备所属实例累计，其他计数由工作线程通过 metricsOf 登记，
+// 计数在程序运行期间累计，实例重启、设备删除或改变所属实例后不减少。InfluxDB 为异步批量写入，成功次数为提交到写入缓冲的点数，
+// 失败次数为写入失败的批次数
+
+// 连接状态
+const (
+	connStateUnknown = 0
+	connStateUp      = 1
+	connStateDown    = 2
+)
+
+// 定义 instMetrics 结构体，实例的运行计数
+type instMetrics struct {
+	reconnects    atomic.Int64 // 连接断开后重新连接的次数，不含第一次连接
+	reads         atomic.Int64 // 南向：读取正常的点数
+	readErrors    atomic.Int64 // 南向：读取失败或超时的点数
+	published     atomic.Int64 // 北向：发布或写入成功的次数
+	publishErrors atomic.Int64 // 北向：发布或写入失败的次数
+	connState     atomic.Int32 // 连接状态，没有连接的实例为 unknown
+	everConnected atomic.Bool
+	queue         atomic.Pointer[DataQueue] // 北向：待发送的数据队列
+}
+
+var (
+	instsMetrics     = make(map[string]*instMetrics) // 实例ID -> 运行计数
+	instsMetricsLock sync.Mutex
+	appReady         atomic.Bool // 启动完成（自启动实例已启动）
+	appStartTime     = time.Now()
+	// 北向实例的 appCode，其余为南向实例
+	northboundApps = map[string]bool{
+		"mqttpub":    true,
+		"dsTDengine": true,
+		"dsInfluxdb": true,
+	}
+)
+
+// metricsOf 返回实例的运行计数，不存在时创建
+func metricsOf(instid string) *instMetrics {
+	instsMetricsLock.Lock()
+	defer instsMetricsLock.Unlock()
+	m, ok := instsMetrics[instid]
+	if !ok {
+		m = &instMetrics{}
+		instsMetrics[instid] = m
+	}
+	return m
+}
+
+// setConnected 登记连接状态，断开后再次连接时重连次数加 1
+func (m *instMetrics) setConnected(connected bool) {
+	if !connected {
+		m.connState.Store(connStateDown)
+		return
+	}
+	if m.connState.Swap(connStateUp) != connStateUp && m.everConnected.Swap(true) {
+		m.reconnects.Add(1)
+	}
+}
+
+// publishResult 登记一次发布或写入的结果
+func (m *instMetrics) publishResult(err error) {
+	if err != nil {
+		m.publishErrors.Add(1)
+		return
+	}
+	m.published.Add(1)
+}
+
+// stopped 实例线程退出时清除连接状态和队列
+func (m *instMetrics) stopped() {
+	m.connState.Store(connStateUnknown)
+	m.queue.Store(nil)
+}
+
+// SetReady 启动完成后调用，/readyz 开始返回就绪
+func SetReady() {
+	appReady.Store(true)
+}
+
+// @Summary 存活检查
+// @Description 程序在运行且配置库和实时库可以访问时返回 200，不需要认证
+// @Tags System
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 503 {object} map[string]interface{}
+// @Router /healthz [get]
+func Healthz(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
+	if _, err := cfgdb.Key().Len(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "fail", "details": "config db: " + err.Error()})
+		return
+	}
+	if _, err := rtdb.Key().Len(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "fail", "details": "realtime db: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// @Summary 就绪检查
+// @Description 启动完成且所有设置为自启动的实例都在运行时返回 200，否则返回 503 和未运行的实例，不需要认证
+// @Tags System
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 503 {object} map[string]interface{}
+// @Router /readyz [get]
+func Readyz(c *gin.Context, cfgdb *redka.DB) {
+	if !appReady.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "starting"})
+		return
+	}
+	items, err := cfgdb.Hash().Items(InstListKey)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "fail", "details": "config db: " + err.Error()})
+		return
+	}
+	notRunning := make([]string, 0)
+	for instid, item := range items {
+		var appConfig AppConfig
+		if erra := json.Unmarshal([]byte(item.String()), &appConfig); erra != nil {
+			continue
+		}
+		if appConfig.AutoStart && !isWorkerRunning(instid) {
+			notRunning = append(notRunning, instid)
+		}
+	}
+	if len(notRunning) > 0 {
+		sort.Strings(notRunning)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "notRunning": notRunning})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// promWriter 按 Prometheus 文本格式输出指标
+type promWriter struct {
+	strings.Builder
+}
+
+// family 输出指标的说明和类型
+func (w *promWriter) family(name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample 输出一个值，labels 为标签名和值交替排列
+func (w *promWriter) sample(name string, value float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], promEscaper.Replace(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.WriteByte('\n')
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// @Summary 运行指标
+// @Description 按 Prometheus 文本格式输出实例状态、南向读取和重连次数、北向发布/写入次数和队列长度、
+// @Description 设备通讯状态、rtdb 键数量和 Go 运行时指标。Prometheus 可以使用 API Token 认证
+// @Tags System
+// @Produce plain
+// @Success 200 {string} string
+// @Router /metrics [get]
+func Metrics(c *gin.Context, cfgdb *redka.DB, rtdb *redka.DB) {
+	w := &promWriter{}
+
+	w.family("gateway_build_info", "gauge", "Gateway version.")
+	w.sample("gateway_build_info", 1, "version", AppVersion)
+	w.family("process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.")
+	w.sample("process_start_time_seconds", float64(appStartTime.Unix()))
+	w.family("gateway_ready", "gauge", "Whether startup has completed.")
+	w.sample("gateway_ready", boolFloat(appReady.Load()))
+
+	// 实例状态
+	apps := make(map[string]AppConfig)
+	if items, err := cfgdb.Hash().Items(InstListKey); err == nil {
+		for instid, item := range items {
+			var appConfig AppConfig
+			if erra := json.Unmarshal([]byte(item.String()), &appConfig); erra == nil {
+				apps[instid] = appConfig
+			}
+		}
+	}
+	instids := sortedKeys(apps)
+	w.family("gateway_instance_running", "gauge", "Whether the instance worker is running.")
+	for _, instid := range instids {
+		w.sample("gateway_instance_running", boolFloat(isWorkerRunning(instid)), "instance", instid, "app_code", apps[instid].AppCode)
+	}
+	w.family("gateway_instance_connected", "gauge", "Whether the instance is connected to its server, only for running instances with a connection.")
+	for _, instid := range instids {
+		if state := metricsOf(instid).connState.Load(); state != connStateUnknown {
+			w.sample("gateway_instance_connected", boolFloat(state == connStateUp), "instance", instid, "app_code", apps[instid].AppCode)
+		}
+	}
+	w.family("gateway_instance_reconnects_total", "counter", "Reconnections after the connection was lost.")
+	for _, instid := range instids {
+		w.sample("gateway_instance_reconnects_total", float64(metricsOf(instid).reconnects.Load()), "instance", instid)
+	}
+
+	// 南向实例：读取计数，设备状态
+	devStates := make(map[string]int)
+	if items, err := cfgdb.Hash().Items(DevAtInstKey); err == nil {
+		for devid := range items {
+			devStates[GetDevStatus(devid).Status]++
+		}
+	}
+	w.family("gateway_southbound_reads_total", "counter", "Tag values read with good quality.")
+	for _, instid := range instids {
+		if !northboundApps[apps[instid].AppCode] {
+			w.sample("gateway_southbound_reads_total", float64(metricsOf(instid).reads.Load()), "instance", instid)
+		}
+	}
+	w.family("gateway_southbound_read_errors_total", "counter", "Tag values failed to read or stale.")
+	for _, instid := range instids {
+		if !northboundApps[apps[instid].AppCode] {
+			w.sample("gateway_southbound_read_errors_total", float64(metricsOf(instid).readErrors.Load()), "instance", instid)
+		}
+	}
+	w.family("gateway_devices", "gauge", "Devices by communication status.")
+	for _, status := range []string{DevStatusOnline, DevStatusDegraded, DevStatusOffline, DevStatusUnknown} {
+		w.sample("gateway_devices", float64(devStates[status]), "status", status)
+	}
+
+	// 北向实例
+	w.family("gateway_northbound_published_total", "counter", "Successful publishes or writes.")
+	for _, instid := range instids {
+		if northboundApps[apps[instid].AppCode] {
+			w.sample("gateway_northbound_published_total", float64(metricsOf(instid).published.Load()), "instance", instid)
+		}
+	}
+	w.family("gateway_northbound_publish_errors_total", "counter", "Failed publishes or writes.")
+	for _, instid := range instids {
+		if northboundApps[apps[instid].AppCode] {
+			w.sample("gateway_northbound_publish_errors_total", float64(metricsOf(instid).publishErrors.Load()), "instance", instid)
+		}
+	}
+	w.family("gateway_northbound_queue_length", "gauge", "Data waiting in the queue, only for running instances.")
+	for _, instid := range instids {
+		if q := metricsOf(instid).queue.Load(); q != nil {
+			w.sample("gateway_northbound_queue_length", float64(q.Len()), "instance", instid)
+		}
+	}
+
+	// rtdb
+	keys, _ := rtdb.Key().Keys("*")
+	tags := 0
+	for _, key := range keys {
+		if n, err := rtdb.Hash().Len(key.Key); err == nil {
+			tags += n
+		}
+	}
+	w.family("gateway_rtdb_keys", "gauge", "Keys (devices) in the realtime database.")
+	w.sample("gateway_rtdb_keys", float64(len(keys)))
+	w.family("gateway_rtdb_tags", "gauge", "Tag values in the realtime database.")
+	w.sample("gateway_rtdb_tags", float64(tags))
+
+	// Go 运行时
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	w.family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	w.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	w.family("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	w.sample("go_memstats_alloc_bytes", float64(ms.Alloc))
+	w.family("go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	w.sample("go_memstats_heap_inuse_bytes", float64(ms.HeapInuse))
+	w.family("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.")
+	w.sample("go_memstats_sys_bytes", float64(ms.Sys))
+	w.family("go_memstats_heap_objects", "gauge", "Number of allocated objects.")
+	w.sample("go_memstats_heap_objects", float64(ms.HeapObjects))
+	w.family("go_gc_cycles_total", "counter", "Number of completed GC cycles.")
+	w.sample("go_gc_cycles_total", float64(ms.NumGC))
+	w.family("go_memstats_last_gc_time_seconds", "gauge", "Number of seconds since 1970 of last garbage collection.")
+	w.sample("go_memstats_last_gc_time_seconds", float64(ms.LastGC)/1e9)
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(w.String()))
+}
+
+// boolFloat 把布尔值转换为 1/0
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nalgeon/redka"
+)
+
+// 数据质量：rtdb 中每个点的值为 [时间, 值, 毫秒时间戳, 类型, 质量]，
+// 质量参照 OPC 定义为 good/uncertain/bad，冒号后为子状态，如 "bad:comm_failure"。
+// 早期写入的 4 元素数组没有质量，按 good 处理
+
+// 数据质量定义
+const (
+	QualityGood                = "good"
+	QualityGoodLocalOverride   = "good:local_override"
+	QualityUncertain           = "uncertain"
+	QualityUncertainLastUsable = "uncertain:last_usable"
+	QualityUncertainStale      = "uncertain:stale"
+	QualityUncertainInaccurate = "uncertain:sensor_not_accurate"
+	QualityUncertainEUExceeded = "uncertain:eu_exceeded"
+	QualityUncertainSubNormal  = "uncertain:sub_normal"
+	QualityBad                 = "bad"
+	QualityBadConfigError      = "bad:config_error"
+	QualityBadNotConnected     = "bad:not_connected"
+	QualityBadDeviceFailure    = "bad:device_failure"
+	QualityBadSensorFailure    = "bad:sensor_failure"
+	QualityBadLastKnown        = "bad:last_known_value"
+	QualityBadCommFailure      = "bad:comm_failure"
+	QualityBadOutOfService     = "bad:out_of_service"
+)
+
+// 实时值数组中各元素的位置
+const (
+	rtIdxTime    = 0
+	rtIdxValue   = 1
+	rtIdxMilli   = 2
+	rtIdxType    = 3
+	rtIdxQuality = 4
+)
+
+// rtValue 生成写入 rtdb 的实时值 JSON
+func rtValue(t time.Time, value any, quality string) []byte {
+	dataType := ""
+	if value != nil {
+		dataType = GetTypeString(value)
+	}
+	valueMap := []any{t.Local().Format("2006-01-02 15:04:05"), value, t.UnixMilli(), dataType, quality}
+	valueMapJson, _ := json.Marshal(valueMap)
+	return valueMapJson
+}
+
+// QualityOf 返回实时值数组中的质量，没有质量的数组按 good 处理
+func QualityOf(values []any) string {
+	if len(values) > rtIdxQuality {
+		if q, ok := values[rtIdxQuality].(string); ok && q != "" {
+			return q
+		}
+	}
+	return QualityGood
+}
+
+// IsBadQuality 判断质量是否为 bad
+func IsBadQuality(quality string) bool {
+	return strings.HasPrefix(quality, QualityBad)
+}
+
+// opcDAQuality 把 OPC DA 质量码（低 8 位：质量 2 位 + 子状态 4 位 + 限值 2 位）转换为质量
+func opcDAQuality(q uint16) string {
+	sub := (q >> 2) & 0x0F
+	switch (q >> 6) & 0x03 {
+	case 3:
+		if sub == 6 {
+			return QualityGoodLocalOverride
+		}
+		return QualityGood
+	case 1:
+		switch sub {
+		case 1:
+			return QualityUncertainLastUsable
+		case 4:
+			return QualityUncertainInaccurate
+		case 5:
+			return QualityUncertainEUExceeded
+		case 6:
+			return QualityUncertainSubNormal
+		}
+		return QualityUncertain
+	case 0:
+		switch sub {
+		case 1:
+			return QualityBadConfigError
+		case 2:
+			return QualityBadNotConnected
+		case 3:
+			return QualityBadDeviceFailure
+		case 4:
+			return QualityBadSensorFailure
+		case 5:
+			return QualityBadLastKnown
+		case 6:
+			return QualityBadCommFailure
+		case 7:
+			return QualityBadOutOfService
+		}
+		return QualityBad
+	}
+	return QualityBad
+}
+
+// setDevQuality 把设备点的质量设置为 quality，保留最后的值和它的采集时间，不把旧值当作新采集的值。
+// tagids 为空时设置设备的所有已有数据的点（不含通讯状态伪点）；指定的点还没有数据时按当前时间写入空值
+func setDevQuality(rtdb *redka.DB, devid string, tagids []string, quality string) {
+	values, err := rtdb.Hash().Items(devid)
+	if err != nil {
+		log.Printf("读取设备 %s 实时数据失败: %v\n", devid, err)
+		return
+	}
+	if len(tagids) == 0 {
+		for tagid := range values {
+			if tagid != CommStatusTag {
+				tagids = append(tagids, tagid)
+			}
+		}
+	}
+	now := time.Now()
+	datasmap := make(map[string]any)
+	for _, tagid := range tagids {
+		if v, ok := values[tagid]; ok {
+			var newValue []any
+			if erra := json.Unmarshal([]byte(v.String()), &newValue); erra == nil && len(newValue) > rtIdxType {
+				if QualityOf(newValue) == quality {
+					continue
+				}
+				// 早期写入的 4 元素数组没有质量
+				if len(newValue) == rtIdxQuality {
+					newValue = append(newValue, quality)
+				}
+				newValue[rtIdxQuality] = quality
+				valueJson, _ := json.Marshal(newValue)
+				datasmap[tagid] = valueJson
+				continue
+			}
+		}
+		datasmap[tagid] = rtValue(now, nil, quality)
+	}
+	if len(datasmap) == 0 {
+		return
+	}
+	// 保留的值已经是工程量，不再换算
+	if errw := writeDevValues(rtdb, devid, datasmap); errw != nil {
+		log.Printf("写入设备 %s 数据质量失败: %v\n", devid, errw)
+	}
+}
+
+// setInstanceQuality 把实例下所有设备的点的质量设置为 quality，用于连接断开和实例停止
+func setInstanceQuality(cfgdb *redka.DB, rtdb *redka.DB, instid string, quality string) {
+	devValues, err := cfgdb.Hash().Items(DevAtInstKey)
+	if err != nil {
+		return
+	}
+	for devkey, value := range devValues {
+		var devConfig DevConfig
+		if erra := json.Unmarshal([]byte(value.String()), &devConfig); erra != nil {
+			continue
+		}
+		if devConfig.InstID == instid {
+			setDevQuality(rtdb, devkey, nil, quality)
+		}
+	}
+}
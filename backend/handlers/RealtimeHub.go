@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nalgeon/redka"
+)
+
+// 实时数据推送：南向实例通过 WriteDevValues 写入 rtdb，写入后把数据推送给订阅的客户端，
+// 客户端通过 SSE 接口 /api/v1/subscribeValues 按设备和点订阅，无需轮询 getDevvalues
+
+// 定义 RtEvent 结构体，一次推送的设备数据
+type RtEvent struct {
+	DevID  string                     `json:"devId"`
+	Values map[string]json.RawMessage `json:"values"` // 点ID -> [时间, 值, 毫秒时间戳, 类型, 质量]
+}
+
+// 定义实时数据订阅者
+type rtSubscriber struct {
+	devIds   map[string]bool // 为空表示所有设备
+	tagIds   map[string]bool // 为空表示所有点
+	onChange bool            // 只推送值发生变化的点
+	ch       chan RtEvent
+	dropped  int // 客户端处理不及时被丢弃的推送数
+}
+
+// 定义实时数据推送中心
+type rtHub struct {
+	mu          sync.Mutex
+	subscribers map[*rtSubscriber]struct{}
+	lastValues  map[string]map[string]string // 设备ID -> 点ID -> 上次写入的值，用于判断是否变化
+}
+
+var realtimeHub = &rtHub{
+	subscribers: make(map[*rtSubscriber]struct{}),
+	lastValues:  make(map[string]map[string]string),
+}
+
+// WriteDevValues 把设备数据换算为工程量后写入 rtdb 并推送给订阅者，同时更新设备通讯状态，values 为 点ID -> 数组的 JSON
+func WriteDevValues(rtdb *redka.DB, devid string, values map[string]any) error {
+	applyTagEU(devid, values)
+	return writeDevValues(rtdb, devid, values)
+}
+
+// writeDevValues 把设备数据写入 rtdb 并更新设备通讯状态，不做工程量换算
+func writeDevValues(rtdb *redka.DB, devid string, values map[string]any) error {
+	if err := writeRtdb(rtdb, devid, values); err != nil {
+		return err
+	}
+	updateDevStatus(rtdb, devid, values)
+	return nil
+}
+
+// writeRtdb 把设备数据写入 rtdb 并推送给订阅者，同时判断报警规则
+func writeRtdb(rtdb *redka.DB, devid string, values map[string]any) error {
+	_, err := rtdb.Hash().SetMany(devid, values)
+	if err != nil {
+		return err
+	}
+	realtimeHub.publish(devid, values)
+	evaluateAlarms(devid, values)
+	return nil
+}
+
+// subscribe 登记订阅者
+func (h *rtHub) subscribe(devIds []string, tagIds []string, onChange bool) *rtSubscriber {
+	sub := &rtSubscriber{
+		devIds:   make(map[string]bool),
+		tagIds:   make(map[string]bool),
+		onChange: onChange,
+		ch:       make(chan RtEvent, 256),
+	}
+	for _, devid := range devIds {
+		sub.devIds[devid] = true
+	}
+	for _, tagid := range tagIds {
+		sub.tagIds[tagid] = true
+	}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// unsubscribe 注销订阅者
+func (h *rtHub) unsubscribe(sub *rtSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+	if sub.dropped > 0 {
+		log.Printf("实时数据订阅者处理不及时，共丢弃 %d 次推送", sub.dropped)
+	}
+}
+
+// removeDevice 设备删除后清除设备上次写入的值
+func (h *rtHub) removeDevice(devid string) {
+	h.mu.Lock()
+	delete(h.lastValues, devid)
+	h.mu.Unlock()
+}
+
+// publish 把写入的数据推送给订阅了该设备的订阅者，订阅者通道已满时丢弃本次推送，不阻塞写入
+func (h *rtHub) publish(devid string, values map[string]any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	all := make(map[string]json.RawMessage, len(values))
+	changed := make(map[string]bool)
+	lastValues := h.lastValues[devid]
+	if lastValues == nil {
+		lastValues = make(map[string]string)
+		h.lastValues[devid] = lastValues
+	}
+	for tagid, value := range values {
+		raw := rtRawJSON(value)
+		all[tagid] = raw
+		v := rtValueOf(raw)
+		if last, ok := lastValues[tagid]; !ok || last != v {
+			changed[tagid] = true
+		}
+		lastValues[tagid] = v
+	}
+	if len(h.subscribers) == 0 {
+		return
+	}
+	for sub := range h.subscribers {
+		if len(sub.devIds) != 0 && !sub.devIds[devid] {
+			continue
+		}
+		event := RtEvent{DevID: devid, Values: make(map[string]json.RawMessage)}
+		for tagid, raw := range all {
+			if len(sub.tagIds) != 0 && !sub.tagIds[tagid] {
+				continue
+			}
+			if sub.onChange && !changed[tagid] {
+				continue
+			}
+			event.Values[tagid] = raw
+		}
+		if len(event.Values) == 0 {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// rtRawJSON 把写入 rtdb 的值转换为 JSON
+func rtRawJSON(value any) json.RawMessage {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		return json.RawMessage(v)
+	default:
+		b, _ := json.Marshal(v)
+		return b
+	}
+}
+
+// rtValueOf 取出数组中的值（第 2 个元素），用于判断是否变化
+func rtValueOf(raw json.RawMessage) string {
+	var arr []json.RawMessage
+	if err := json.Unmarshal(raw, &arr); err != nil || len(arr) < 2 {
+		return string(raw)
+	}
+	return string(arr[1])
+}
+
+// splitParam 拆分逗号分隔的查询参数
+func splitParam(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// @Summary 订阅设备实时数据
+// @Description 通过 Server-Sent Events 推送设备实时数据。连接后先推送一次订阅范围内的当前值，之后每次南向实例写入数据时推送 values 事件，空闲时每 15 秒推送一次 ping 事件
+// @Tags Data Manager
+// @Produce text/event-stream
+// @Param devIds query string false "设备ID，多个用逗号分隔，为空表示所有设备"
+// @Param tagIds query string false "点ID，多个用逗号分隔，为空表示所有点"
+// @Param onChange query string false "1: 只推送值发生变化的点"
+// @Success 200 {object} RtEvent
+// @Router /api/v1/subscribeValues [get]
+func SubscribeValues(c *gin.Context, rtdb *redka.DB) {
+	devIds := splitParam(c.Query("devIds"))
+	tagIds := splitParam(c.Query("tagIds"))
+	onChange := c.Query("onChange") == "1"
+
+	// 先登记再读取当前值，避免遗漏两者之间写入的数据
+	sub := realtimeHub.subscribe(devIds, tagIds, onChange)
+	defer realtimeHub.unsubscribe(sub)
+
+	snapshotDevs := devIds
+	if len(snapshotDevs) == 0 {
+		keys, err := rtdb.Key().Keys("*")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Failed to read data from database",
+			})
+			return
+		}
+		for _, key := range keys {
+			snapshotDevs = append(snapshotDevs, key.Key)
+		}
+	}
+	var snapshot []RtEvent
+	for _, devid := range snapshotDevs {
+		values, err := rtdb.Hash().Items(devid)
+		if err != nil || len(values) == 0 {
+			continue
+		}
+		event := RtEvent{DevID: devid, Values: make(map[string]json.RawMessage)}
+		for tagid, value := range values {
+			if len(sub.tagIds) != 0 && !sub.tagIds[tagid] {
+				continue
+			}
+			event.Values[tagid] = json.RawMessage(value.String())
+		}
+		if len(event.Values) != 0 {
+			snapshot = append(snapshot, event)
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	for _, event := range snapshot {
+		c.SSEvent("values", event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event := <-sub.ch:
+			c.SSEvent("values", event)
+			return true
+		case now := <-heartbeat.C:
+			c.SSEvent("ping", fmt.Sprintf("%d", now.UnixMilli()))
+			return true
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nalgeon/redka"
+)
+
+// 实时数据快照：rtdb 为内存数据库，重启后最后的值会丢失。启用后周期把 rtdb 中设备的点保存到磁盘文件，
+// 启动时恢复仍存在的设备和点的值，质量设置为 uncertain:stale（bad 的保持不变），时间保持为原来的采集时间，
+// 南向实例采集到新值后覆盖。通讯状态伪点不保存，设备状态在收到新数据前为 unknown
+
+// 定义 rtSnapshotFile 结构体，快照文件的内容
+type rtSnapshotFile struct {
+	SavedAt int64                                 `json:"savedAt"` // 保存时间，毫秒时间戳
+	Devices map[string]map[string]json.RawMessage `json:"devices"` // 设备ID -> 点ID -> 实时值数组
+}
+
+var (
+	rtSnapshotPath string
+	rtSnapshotDB   *redka.DB
+	rtSnapshotLock sync.Mutex // 保证同一时间只有一个保存
+)
+
+// StartRtSnapshot 从快照文件恢复实时数据，并每隔 interval 保存一次快照，应在启动实例之前调用
+func StartRtSnapshot(path string, interval time.Duration, cfgdb *redka.DB, rtdb *redka.DB) error {
+	if interval <= 0 {
+		return fmt.Errorf("snapshot interval must be positive")
+	}
+	n, err := restoreRtSnapshot(path, cfgdb, rtdb)
+	if n > 0 {
+		log.Printf("已从快照 %s 恢复 %d 个点的实时数据", path, n)
+	}
+
+	rtSnapshotLock.Lock()
+	rtSnapshotPath, rtSnapshotDB = path, rtdb
+	rtSnapshotLock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if errs := SaveRtSnapshot(); errs != nil {
+				log.Printf("保存实时数据快照失败: %v", errs)
+			}
+		}
+	}()
+	return err
+}
+
+// SaveRtSnapshot 把 rtdb 中设备的点保存到快照文件，先写临时文件再替换，保存中断时不破坏上一个快照。
+// 未启用快照时不做任何操作
+func SaveRtSnapshot() error {
+	rtSnapshotLock.Lock()
+	defer rtSnapshotLock.Unlock()
+	if rtSnapshotDB == nil {
+		return nil
+	}
+	keys, err := rtSnapshotDB.Key().Keys("*")
+	if err != nil {
+		return err
+	}
+	snapshot := rtSnapshotFile{SavedAt: time.Now().UnixMilli(), Devices: make(map[string]map[string]json.RawMessage)}
+	for _, key := range keys {
+		values, erra := rtSnapshotDB.Hash().Items(key.Key)
+		if erra != nil {
+			continue
+		}
+		tags := make(map[string]json.RawMessage, len(values))
+		for tagid, value := range values {
+			if tagid == CommStatusTag || !json.Valid(value) {
+				continue
+			}
+			tags[tagid] = json.RawMessage(value.String())
+		}
+		if len(tags) > 0 {
+			snapshot.Devices[key.Key] = tags
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmpPath := rtSnapshotPath + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, rtSnapshotPath)
+}
+
+// restoreRtSnapshot 从快照文件恢复实时数据，只恢复当前点表中仍存在的点，返回恢复的点数。快照文件不存在时不恢复
+func restoreRtSnapshot(path string, cfgdb *redka.DB, rtdb *redka.DB) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var snapshot rtSnapshotFile
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return 0, fmt.Errorf("snapshot %s is broken: %w", path, err)
+	}
+	n := 0
+	for devid, tags := range snapshot.Devices {
+		if isExist, _ := cfgdb.Hash().Exists(DevAtInstKey, devid); !isExist {
+			continue
+		}
+		devTags := devTagsOf(cfgdb, devid)
+		datasmap := make(map[string]any)
+		for tagid, raw := range tags {
+			if _, ok := devTags[tagid]; !ok {
+				continue
+			}
+			var value []any
+			if erra := json.Unmarshal(raw, &value); erra != nil || len(value) <= rtIdxType {
+				continue
+			}
+			quality := QualityOf(value)
+			if !IsBadQuality(quality) {
+				quality = QualityUncertainStale
+			}
+			// 早期写入的 4 元素数组没有质量
+			if len(value) == rtIdxQuality {
+				value = append(value, quality)
+			}
+			value[rtIdxQuality] = quality
+			valueJson, _ := json.Marshal(value)
+			datasmap[tagid] = valueJson
+		}
+		if len(datasmap) == 0 {
+			continue
+		}
+		// 直接写入 rtdb，不更新设备通讯状态，也不判断报警
+		if _, errw := rtdb.Hash().SetMany(devid, datasmap); errw != nil {
+			return n, errw
+		}
+		n += len(datasmap)
+	}
+	return n, nil
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HTTPS：-tls 模式下使用 cert/key 文件提供 HTTPS 服务，文件不存在时生成自签名证书。
+// 证书通过 GetCertificate 读取，上传新证书后立即生效，不需要重启
+
+// 定义证书信息
+type CertInfo struct {
+	Subject     string   `json:"subject"`
+	Issuer      string   `json:"issuer"`
+	DNSNames    []string `json:"dnsNames"`
+	IPAddresses []string `json:"ipAddresses"`
+	NotBefore   int64    `json:"notBefore"` // 秒时间戳
+	NotAfter    int64    `json:"notAfter"`
+	SelfSigned  bool     `json:"selfSigned"`
+	Fingerprint string   `json:"fingerprint"` // SHA-256
+}
+
+var (
+	tlsCertFile  string
+	tlsKeyFile   string
+	tlsCert      *tls.Certificate
+	tlsLock      sync.RWMutex
+	tlsEnabled   bool
+	certMaxBytes int64 = 1 << 20 // 上传的证书和私钥文件的最大大小
+)
+
+// SetCertFiles 未启用 -tls 时设置证书文件，上传的证书在下次以 -tls 启动时使用
+func SetCertFiles(certFile string, keyFile string) {
+	tlsLock.Lock()
+	tlsCertFile, tlsKeyFile = certFile, keyFile
+	tlsLock.Unlock()
+}
+
+// InitTLS 设置证书文件，文件不存在时生成自签名证书，返回 HTTPS 服务使用的配置
+func InitTLS(certFile string, keyFile string) (*tls.Config, error) {
+	SetCertFiles(certFile, keyFile)
+	_, errc := os.Stat(certFile)
+	_, errk := os.Stat(keyFile)
+	if os.IsNotExist(errc) && os.IsNotExist(errk) {
+		if err := generateSelfSignedCert(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("generate self-signed certificate: %w", err)
+		}
+		log.Printf("已生成自签名证书 %s", certFile)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsLock.Lock()
+	tlsCert = &cert
+	tlsEnabled = true
+	tlsLock.Unlock()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tlsLock.RLock()
+			defer tlsLock.RUnlock()
+			return tlsCert, nil
+		},
+	}, nil
+}
+
+// generateSelfSignedCert 生成有效期 10 年的自签名证书，包含主机名和本机所有 IP 地址
+func generateSelfSignedCert(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ginElement " + hostname, Organization: []string{"ginElement"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, erra := net.InterfaceAddrs(); erra == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+				template.IPAddresses = append(template.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certInfoOf 读取证书链中第一个证书的信息
+func certInfoOf(cert *tls.Certificate) (*CertInfo, error) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(x.Raw)
+	info := &CertInfo{
+		Subject:     x.Subject.String(),
+		Issuer:      x.Issuer.String(),
+		DNSNames:    x.DNSNames,
+		IPAddresses: make([]string, 0, len(x.IPAddresses)),
+		NotBefore:   x.NotBefore.Unix(),
+		NotAfter:    x.NotAfter.Unix(),
+		SelfSigned:  x.Subject.String() == x.Issuer.String() && x.CheckSignature(x.SignatureAlgorithm, x.RawTBSCertificate, x.Signature) == nil,
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+	for _, ip := range x.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info, nil
+}
+
+// HTTPSRedirect 返回把 HTTP 请求重定向到 HTTPS 端口的处理函数
+func HTTPSRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := "https://" + net.JoinHostPort(host, httpsPort) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// readUploadFile 读取上传的文件，限制大小
+func readUploadFile(c *gin.Context, name string) ([]byte, error) {
+	fh, err := c.FormFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s file is required", name)
+	}
+	if fh.Size > certMaxBytes {
+		return nil, fmt.Errorf("%s file is too large", name)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, certMaxBytes))
+}
+
+// @Summary 查询 HTTPS 证书
+// @Description 查询当前使用的 HTTPS 证书信息，未启用 -tls 时读取证书文件
+// @Tags System
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/getCertInfo [get]
+func GetCertInfo(c *gin.Context) {
+	tlsLock.RLock()
+	cert, certFile, keyFile, enabled := tlsCert, tlsCertFile, tlsKeyFile, tlsEnabled
+	tlsLock.RUnlock()
+	if cert == nil {
+		loaded, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Get Cert Info Fail",
+				"details": fmt.Sprintf("no certificate: %v", err),
+			})
+			return
+		}
+		cert = &loaded
+	}
+	info, err := certInfoOf(cert)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Get Cert Info Fail", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success",
+		"data": gin.H{
+			"tls":  enabled,
+			"cert": info,
+		},
+	})
+}
+
+// @Summary 上传 HTTPS 证书
+// @Description 上传 PEM 格式的证书(可包含证书链)和私钥替换当前证书，校验通过后保存并立即生效，原文件备份为 .bak
+// @Tags System
+// @Accept multipart/form-data
+// @Produce json
+// @Param cert formData file true "证书 PEM 文件"
+// @Param key formData file true "私钥 PEM 文件"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/uploadCert [post]
+func UploadCert(c *gin.Context) {
+	certPEM, err := readUploadFile(c, "cert")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Upload Cert Fail", "details": err.Error()})
+		return
+	}
+	keyPEM, err := readUploadFile(c, "key")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Upload Cert Fail", "details": err.Error()})
+		return
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Upload Cert Fail",
+			"details": fmt.Sprintf("invalid certificate or key: %v", err),
+		})
+		return
+	}
+	info, err := certInfoOf(&cert)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Upload Cert Fail", "details": err.Error()})
+		return
+	}
+	if time.Now().Unix() >= info.NotAfter {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Upload Cert Fail", "details": "certificate is expired"})
+		return
+	}
+
+	tlsLock.Lock()
+	defer tlsLock.Unlock()
+	var before *CertInfo
+	backedUp := false
+	if old, errl := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile); errl == nil {
+		before, _ = certInfoOf(&old)
+		err = os.Rename(tlsCertFile, tlsCertFile+".bak")
+		if err == nil {
+			if err = os.Rename(tlsKeyFile, tlsKeyFile+".bak"); err != nil {
+				_ = os.Rename(tlsCertFile+".bak", tlsCertFile)
+			}
+		}
+		backedUp = err == nil
+	}
+	if err == nil {
+		err = os.WriteFile(tlsKeyFile, keyPEM, 0600)
+	}
+	if err == nil {
+		err = os.WriteFile(tlsCertFile, certPEM, 0644)
+	}
+	if err != nil && backedUp {
+		// 写入失败时恢复原来的证书和私钥
+		_ = os.Rename(tlsCertFile+".bak", tlsCertFile)
+		_ = os.Rename(tlsKeyFile+".bak", tlsKeyFile)
+	}
+	auditAPI(c, AuditUpdate, "certificate", tlsCertFile, before, info, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Upload Cert Fail", "details": err.Error()})
+		return
+	}
+	if tlsEnabled {
+		tlsCert = &cert
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Upload Cert OK",
+		"data":    info,
+	})
+}
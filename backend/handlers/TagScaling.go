@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/nalgeon/redka"
+)
+
+// 工程量换算：点表数组末尾可以带一个 JSON 对象描述点的工程量属性，如
+//
+//	["analog1", "模拟量1", "float", "ns=2;s=AI1", {"unit": "℃", "rawLow": 0, "rawHigh": 4095, "euLow": -20, "euHigh": 80, "decimals": 1}]
+//
+// 南向实例通过 WriteDevValues 写入的数值先按属性换算为工程量再写入 rtdb，北向应用看到的都是工程量；
+// 写点时按相反的方向把工程量换算为原始值。只改变质量的写入（setDevQuality）不再换算
+
+// 定义 TagEU 结构体，点的工程量属性，未配置的属性不生效
+type TagEU struct {
+	Unit      string   `json:"unit,omitempty"`      // 工程单位
+	RawLow    *float64 `json:"rawLow,omitempty"`    // 原始量程下限
+	RawHigh   *float64 `json:"rawHigh,omitempty"`   // 原始量程上限
+	EULow     *float64 `json:"euLow,omitempty"`     // 工程量程下限
+	EUHigh    *float64 `json:"euHigh,omitempty"`    // 工程量程上限
+	Scale     *float64 `json:"scale,omitempty"`     // 比例，未配置量程时 值*scale+offset
+	Offset    *float64 `json:"offset,omitempty"`    // 偏移
+	ClampLow  *float64 `json:"clampLow,omitempty"`  // 限幅下限，超出时质量为 uncertain:eu_exceeded
+	ClampHigh *float64 `json:"clampHigh,omitempty"` // 限幅上限
+	Decimals  *int     `json:"decimals,omitempty"`  // 保留的小数位数
+}
+
+var (
+	euCfgdb *redka.DB
+	euCache = make(map[string]map[string]*TagEU) // 设备ID -> 点ID -> 工程量属性，读取后缓存
+	euLock  sync.Mutex
+)
+
+// InitTagEU 设置读取点表的配置数据库
+func InitTagEU(cfgdb *redka.DB) {
+	euLock.Lock()
+	euCfgdb = cfgdb
+	euLock.Unlock()
+}
+
+// invalidateTagEU 点表修改后清除设备的工程量属性缓存
+func invalidateTagEU(devid string) {
+	euLock.Lock()
+	delete(euCache, devid)
+	euLock.Unlock()
+}
+
+// parseTagEU 解析点表数组末尾的工程量属性对象，没有时返回 nil
+func parseTagEU(tag []any) (*TagEU, error) {
+	if len(tag) == 0 {
+		return nil, nil
+	}
+	obj, ok := tag[len(tag)-1].(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+	b, _ := json.Marshal(obj)
+	var eu TagEU
+	if err := json.Unmarshal(b, &eu); err != nil {
+		return nil, err
+	}
+	if eu.linear() && *eu.RawHigh == *eu.RawLow {
+		return nil, fmt.Errorf("rawHigh must be different from rawLow")
+	}
+	if eu.linear() && *eu.EUHigh == *eu.EULow {
+		return nil, fmt.Errorf("euHigh must be different from euLow")
+	}
+	if eu.Scale != nil && *eu.Scale == 0 {
+		return nil, fmt.Errorf("scale must not be 0")
+	}
+	if eu.Decimals != nil && (*eu.Decimals < 0 || *eu.Decimals > 15) {
+		return nil, fmt.Errorf("decimals must be between 0 and 15")
+	}
+	return &eu, nil
+}
+
+// tagStrings 把点表数组转换为字符串数组，去掉末尾的工程量属性对象
+func tagStrings(tag []any) []string {
+	strValues := make([]string, 0, len(tag))
+	for _, v := range tag {
+		if _, ok := v.(map[string]any); ok {
+			continue
+		}
+		strValues = append(strValues, fmt.Sprintf("%v", v))
+	}
+	return strValues
+}
+
+// devTagEU 返回设备点的工程量属性，第一次使用时从 cfgdb 读取点表
+func devTagEU(devid string) map[string]*TagEU {
+	euLock.Lock()
+	defer euLock.Unlock()
+	if eus, ok := euCache[devid]; ok {
+		return eus
+	}
+	eus := make(map[string]*TagEU)
+	if euCfgdb == nil {
+		return eus
+	}
+	tags, err := euCfgdb.Hash().Items(devid)
+	if err != nil {
+		return eus
+	}
+	for tagid, tagvalue := range tags {
+		var tag []any
+		if erra := json.Unmarshal([]byte(tagvalue.String()), &tag); erra != nil {
+			continue
+		}
+		eu, erra := parseTagEU(tag)
+		if erra != nil {
+			log.Printf("点 %s.%s 的工程量属性错误: %v", devid, tagid, erra)
+			continue
+		}
+		if eu != nil {
+			eus[tagid] = eu
+		}
+	}
+	euCache[devid] = eus
+	return eus
+}
+
+// linear 是否配置了完整的线性量程
+func (eu *TagEU) linear() bool {
+	return eu.RawLow != nil && eu.RawHigh != nil && eu.EULow != nil && eu.EUHigh != nil
+}
+
+// toEU 把原始值换算为工程量，返回换算后的值和是否被限幅
+func (eu *TagEU) toEU(raw float64) (float64, bool) {
+	v := raw
+	if eu.linear() {
+		v = *eu.EULow + (raw-*eu.RawLow)*(*eu.EUHigh-*eu.EULow)/(*eu.RawHigh-*eu.RawLow)
+	} else {
+		if eu.Scale != nil {
+			v *= *eu.Scale
+		}
+		if eu.Offset != nil {
+			v += *eu.Offset
+		}
+	}
+	clamped := false
+	if eu.ClampLow != nil && v < *eu.ClampLow {
+		v, clamped = *eu.ClampLow, true
+	}
+	if eu.ClampHigh != nil && v > *eu.ClampHigh {
+		v, clamped = *eu.ClampHigh, true
+	}
+	if eu.Decimals != nil {
+		p := math.Pow(10, float64(*eu.Decimals))
+		v = math.Round(v*p) / p
+	}
+	return v, clamped
+}
+
+// toRaw 把工程量换算为原始值，用于写点
+func (eu *TagEU) toRaw(v float64) float64 {
+	if eu.linear() {
+		return *eu.RawLow + (v-*eu.EULow)*(*eu.RawHigh-*eu.RawLow)/(*eu.EUHigh-*eu.EULow)
+	}
+	if eu.Offset != nil {
+		v -= *eu.Offset
+	}
+	if eu.Scale != nil {
+		v /= *eu.Scale
+	}
+	return v
+}
+
+// scales 是否需要换算数值，只有单位的点保持原值
+func (eu *TagEU) scales() bool {
+	return eu.linear() || eu.Scale != nil || eu.Offset != nil || eu.ClampLow != nil || eu.ClampHigh != nil || eu.Decimals != nil
+}
+
+// applyTagEU 把写入的数值换算为工程量，布尔、字符串和空值保持不变
+func applyTagEU(devid string, values map[string]any) {
+	eus := devTagEU(devid)
+	if len(eus) == 0 {
+		return
+	}
+	for tagid, value := range values {
+		eu, ok := eus[tagid]
+		if !ok || !eu.scales() {
+			continue
+		}
+		var newValue []any
+		if err := json.Unmarshal(rtRawJSON(value), &newValue); err != nil || len(newValue) <= rtIdxValue {
+			continue
+		}
+		raw, ok := newValue[rtIdxValue].(float64)
+		if !ok {
+			continue
+		}
+		v, clamped := eu.toEU(raw)
+		newValue[rtIdxValue] = v
+		if len(newValue) > rtIdxType {
+			newValue[rtIdxType] = GetTypeString(v)
+		}
+		if clamped && len(newValue) > rtIdxQuality && QualityOf(newValue) == QualityGood {
+			newValue[rtIdxQuality] = QualityUncertainEUExceeded
+		}
+		valueMapJson, _ := json.Marshal(newValue)
+		values[tagid] = valueMapJson
+	}
+}
+
+// tagEURaw 写点时把工程量换算为原始值，没有配置换算或值不是数值时返回原值
+func tagEURaw(devid string, tagid string, value any) any {
+	eu, ok := devTagEU(devid)[tagid]
+	if !ok || !eu.scales() {
+		return value
+	}
+	if _, isBool := value.(bool); isBool {
+		return value
+	}
+	v, err := toFloat64(value)
+	if err != nil {
+		return value
+	}
+	return eu.toRaw(v)
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseTagEU(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     []any
+		wantNil bool
+		wantErr string
+	}{
+		{"empty", []any{}, true, ""},
+		{"no eu object", []any{"03", "1", "int16"}, true, ""},
+		{"linear", []any{"03", "1", "int16", map[string]any{"rawLow": 0, "rawHigh": 27648, "euLow": 0, "euHigh": 100}}, false, ""},
+		{"scale", []any{"03", "1", "int16", map[string]any{"scale": 0.1, "unit": "℃"}}, false, ""},
+		{"same raw range", []any{"03", "1", "int16", map[string]any{"rawLow": 10, "rawHigh": 10, "euLow": 0, "euHigh": 100}}, false, "rawHigh must be different from rawLow"},
+		{"same eu range", []any{"03", "1", "int16", map[string]any{"rawLow": 0, "rawHigh": 10, "euLow": 5, "euHigh": 5}}, false, "euHigh must be different from euLow"},
+		{"zero scale", []any{"03", "1", "int16", map[string]any{"scale": 0}}, false, "scale must not be 0"},
+		{"negative decimals", []any{"03", "1", "int16", map[string]any{"decimals": -1}}, false, "decimals must be between 0 and 15"},
+		{"too many decimals", []any{"03", "1", "int16", map[string]any{"decimals": 16}}, false, "decimals must be between 0 and 15"},
+		{"wrong type", []any{"03", "1", "int16", map[string]any{"scale": "x"}}, false, "json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eu, err := parseTagEU(tt.tag)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("parseTagEU() error = nil, want %q", tt.wantErr)
+				}
+				if tt.wantErr != "json" && err.Error() != tt.wantErr {
+					t.Fatalf("parseTagEU() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTagEU() error = %v", err)
+			}
+			if (eu == nil) != tt.wantNil {
+				t.Fatalf("parseTagEU() = %+v, want nil %v", eu, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestTagEUToEU(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	d := func(v int) *int { return &v }
+	tests := []struct {
+		name        string
+		eu          TagEU
+		raw         float64
+		want        float64
+		wantClamped bool
+	}{
+		{"none", TagEU{}, 12.5, 12.5, false},
+		{"linear", TagEU{RawLow: f(0), RawHigh: f(27648), EULow: f(0), EUHigh: f(100)}, 13824, 50, false},
+		{"linear with offset range", TagEU{RawLow: f(4), RawHigh: f(20), EULow: f(-50), EUHigh: f(150)}, 12, 50, false},
+		{"scale", TagEU{Scale: f(0.1)}, 235, 23.5, false},
+		{"scale and offset", TagEU{Scale: f(0.1), Offset: f(-40)}, 600, 20, false},
+		{"offset", TagEU{Offset: f(-273.15)}, 300, 26.85, false},
+		{"clamp high", TagEU{Scale: f(0.1), ClampHigh: f(100)}, 1200, 100, true},
+		{"clamp low", TagEU{ClampLow: f(0)}, -3, 0, true},
+		{"inside clamp", TagEU{ClampLow: f(0), ClampHigh: f(10)}, 5, 5, false},
+		{"decimals", TagEU{Scale: f(1.0 / 3), Decimals: d(2)}, 1, 0.33, false},
+		{"decimals 0", TagEU{Decimals: d(0)}, 2.5, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, clamped := tt.eu.toEU(tt.raw)
+			if math.Abs(got-tt.want) > 1e-9 || clamped != tt.wantClamped {
+				t.Fatalf("toEU(%v) = %v, %v, want %v, %v", tt.raw, got, clamped, tt.want, tt.wantClamped)
+			}
+			if tt.wantClamped || tt.eu.Decimals != nil {
+				return
+			}
+			// 未限幅、未舍入时 toRaw 是 toEU 的逆运算
+			if raw := tt.eu.toRaw(got); math.Abs(raw-tt.raw) > 1e-9 {
+				t.Fatalf("toRaw(%v) = %v, want %v", got, raw, tt.raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,782 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gopcua/opcua/ua"
+	"github.com/nalgeon/redka"
+)
+
+// 点表的 CSV/XLSX 导入导出和单个点的增删改。表格的列由实例的 appCode 决定：
+// 点表数组的各列(列数与 tags_default 中的示例点一致)，加上工程量属性列和 action 列。
+// 导入时 action 为空表示新增或修改，add 只新增，update 只修改，delete 删除该点；
+// mode=replace 时文件中没有的点也会删除
+
+// 各 appCode 点表数组的列名
+var tagColumns = map[string][]string{
+	"modbus":    {"tagId", "type", "desc", "unitId", "funcCode", "address", "dataType"},
+	"opcda":     {"tagId", "desc", "type", "itemId"},
+	"opcua":     {"tagId", "desc", "type", "nodeId"},
+	"calc":      {"tagId", "desc", "type", "expr"},
+	"simulator": {"tagId", "desc", "type"},
+}
+
+// 点表 type 列的数据类型
+var tagTypes = []string{"bool", "int", "float", "double", "string"}
+
+// Modbus 点表 dataType 列支持的数据类型和对应的功能码，见 ModbusRead
+var modbusDataTypes = map[string][]string{
+	"bool":    {"01", "02"},
+	"int16":   {"03", "04"},
+	"float32": {"03", "04"},
+}
+
+// 工程量属性列，导入时合并为点表末尾的工程量属性对象，见 TagEU
+var tagEUColumns = []string{"unit", "rawLow", "rawHigh", "euLow", "euHigh", "scale", "offset", "clampLow", "clampHigh", "decimals"}
+
+const tagActionColumn = "action"
+
+// 定义 DevTag 结构体，单个点
+type DevTag struct {
+	DevID string `json:"devId" binding:"required"`
+	TagID string `json:"tagId"` // 为空时取点表的第一列
+	Tag   []any  `json:"tag"`
+}
+
+// 定义 DevTagIDs 结构体
+type DevTagIDs struct {
+	DevID  string   `json:"devId" binding:"required"`
+	TagIDs []string `json:"tagIds" binding:"required"`
+}
+
+// 定义 TagRowError 结构体，导入文件中一行的错误
+type TagRowError struct {
+	Row     int    `json:"row"` // 文件中的行号，表头为第 1 行
+	TagID   string `json:"tagId,omitempty"`
+	Message string `json:"message"`
+}
+
+// 定义 TagImportReport 结构体，点表导入的结果
+type TagImportReport struct {
+	DevID     string        `json:"devId"`
+	Mode      string        `json:"mode"`
+	DryRun    bool          `json:"dryRun"`
+	Applied   bool          `json:"applied"`
+	Rows      int           `json:"rows"` // 数据行数
+	Errors    []TagRowError `json:"errors"`
+	Added     []string      `json:"added"`
+	Updated   []string      `json:"updated"`
+	Deleted   []string      `json:"deleted"`
+	Unchanged int           `json:"unchanged"`
+}
+
+// tagTemplate 返回 appCode 的点表列名和 tags_default 中的示例点，没有列名定义的 appCode 按示例点的长度使用 col1、col2 ...
+func tagTemplate(appCode string) ([]string, map[string][]any, error) {
+	samples := make(map[string][]any)
+	if def, ok := tags_default[appCode]; ok {
+		if tagsMap, ok := def["tagsMap"].(map[string]any); ok {
+			for tagid, tag := range tagsMap {
+				if values, ok := tag.([]any); ok {
+					samples[tagid] = values
+				}
+			}
+		}
+	}
+	if cols, ok := tagColumns[appCode]; ok {
+		return cols, samples, nil
+	}
+	width := 0
+	for _, tag := range samples {
+		width = max(width, len(tagStrings(tag)))
+	}
+	if width == 0 {
+		return nil, nil, fmt.Errorf("appCode '%s' has no tag table", appCode)
+	}
+	cols := make([]string, width)
+	for i := range cols {
+		cols[i] = fmt.Sprintf("col%d", i+1)
+	}
+	cols[0] = "tagId"
+	return cols, samples, nil
+}
+
+// tagNumericColumns 返回示例点中为数值的列，导入时这些列转换为数值
+func tagNumericColumns(cols []string, samples map[string][]any) []bool {
+	numeric := make([]bool, len(cols))
+	for _, tag := range samples {
+		for i := 0; i < len(tag) && i < len(cols); i++ {
+			switch tag[i].(type) {
+			case int, int64, float64:
+				numeric[i] = true
+			}
+		}
+	}
+	return numeric
+}
+
+// devAppCode 返回设备所属实例的 appCode
+func devAppCode(cfgdb *redka.DB, devid string) (string, error) {
+	value, err := cfgdb.Hash().Get(DevAtInstKey, devid)
+	if err != nil {
+		return "", fmt.Errorf("devId '%s' is not exist", devid)
+	}
+	var devConfig DevConfig
+	if err = json.Unmarshal([]byte(value.String()), &devConfig); err != nil {
+		return "", fmt.Errorf("failed to parse device config: %v", err)
+	}
+	return extractChar(devConfig.InstID)
+}
+
+// trimTag 清除点表中字符串的首尾空白字符
+func trimTag(values []any) []any {
+	trimmedValues := make([]any, len(values))
+	for i, v := range values {
+		if str, ok := v.(string); ok {
+			trimmedValues[i] = strings.TrimSpace(str)
+		} else {
+			trimmedValues[i] = v
+		}
+	}
+	return trimmedValues
+}
+
+// checkTag 校验单个点：不能为空，第一列为不为空的点ID，各列的值是 appCode 的实例能够使用的，
+// 末尾的工程量属性需要能够解析。appCode 为空或没有列名定义时只检查点ID和工程量属性
+func checkTag(appCode string, tagid string, tag []any) error {
+	if len(tag) == 0 {
+		return fmt.Errorf("tag is empty")
+	}
+	if tagid == "" {
+		return fmt.Errorf("tagId is required")
+	}
+	if first, _ := tag[0].(string); first != tagid {
+		return fmt.Errorf("the first column '%v' must be the tagId '%s'", tag[0], tagid)
+	}
+	if err := checkTagColumns(appCode, tag); err != nil {
+		return err
+	}
+	_, err := parseTagEU(tag)
+	return err
+}
+
+// checkTagColumns 按 appCode 的点表列名检查各列的值，避免导入后运行时才发现配置错误(bad:config_error)
+func checkTagColumns(appCode string, tag []any) error {
+	cols, ok := tagColumns[appCode]
+	if !ok {
+		return nil
+	}
+	values := tagStrings(tag)
+	if len(values) < len(cols) {
+		return fmt.Errorf("tag must have %d columns %v", len(cols), cols)
+	}
+	col := func(name string) string {
+		return strings.TrimSpace(values[ContainsIndex(cols, name)])
+	}
+	if t := col("type"); !ContainsString(tagTypes, t) {
+		return fmt.Errorf("type '%s' must be one of %v", t, tagTypes)
+	}
+	switch appCode {
+	case "modbus":
+		if err := checkTagInt("unitId", col("unitId"), 0, 255); err != nil {
+			return err
+		}
+		if err := checkTagInt("address", col("address"), 0, 65535); err != nil {
+			return err
+		}
+		funcCode, dataType := col("funcCode"), col("dataType")
+		if !ContainsString([]string{"01", "02", "03", "04"}, funcCode) {
+			// Excel 会把 01 保存为数值 1
+			return fmt.Errorf("funcCode '%s' must be 01, 02, 03 or 04 with the leading zero, format the column as text in Excel", funcCode)
+		}
+		funcCodes, ok := modbusDataTypes[dataType]
+		if !ok {
+			return fmt.Errorf("dataType '%s' must be bool, int16 or float32", dataType)
+		}
+		if !ContainsString(funcCodes, funcCode) {
+			return fmt.Errorf("dataType '%s' must use funcCode %v", dataType, funcCodes)
+		}
+	case "opcda":
+		if col("itemId") == "" {
+			return fmt.Errorf("itemId is required")
+		}
+	case "opcua":
+		if _, err := ua.ParseNodeID(col("nodeId")); err != nil {
+			return fmt.Errorf("nodeId '%s' is invalid: %v", col("nodeId"), err)
+		}
+	case "calc":
+		expr := col("expr")
+		if expr == "" {
+			return fmt.Errorf("expr is required")
+		}
+		if _, err := compileCalcExpr(expr, (&calcEngine{}).functions()); err != nil {
+			return fmt.Errorf("expr '%s' is invalid: %v", expr, err)
+		}
+	}
+	return nil
+}
+
+// checkTagInt 检查点表中整数列的值在 [low, high] 范围内
+func checkTagInt(name string, s string, low int, high int) error {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < low || v > high {
+		return fmt.Errorf("%s '%s' must be an integer between %d and %d", name, s, low, high)
+	}
+	return nil
+}
+
+// tagToRow 把点转换为表格的一行：点表的各列、工程量属性列和空的 action 列
+func tagToRow(cols []string, tag []any) []any {
+	row := make([]any, 0, len(cols)+len(tagEUColumns)+1)
+	values := make([]any, 0, len(tag))
+	for _, v := range tag {
+		if _, ok := v.(map[string]any); !ok {
+			values = append(values, v)
+		}
+	}
+	for i := range cols {
+		if i < len(values) {
+			row = append(row, values[i])
+		} else {
+			row = append(row, "")
+		}
+	}
+	var eu map[string]any
+	if len(tag) > 0 {
+		eu, _ = tag[len(tag)-1].(map[string]any)
+	}
+	for _, col := range tagEUColumns {
+		if v, ok := eu[col]; ok {
+			row = append(row, v)
+		} else {
+			row = append(row, "")
+		}
+	}
+	return append(row, "")
+}
+
+// tagFromRow 把表格的一行转换为点，返回点和 action
+func tagFromRow(cols []string, numeric []bool, header map[string]int, row []string) ([]any, string, error) {
+	cell := func(name string) string {
+		if idx, ok := header[name]; ok && idx < len(row) {
+			return strings.TrimSpace(row[idx])
+		}
+		return ""
+	}
+	tag := make([]any, len(cols))
+	for i, col := range cols {
+		s := cell(col)
+		tag[i] = s
+		if numeric[i] && s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, "", fmt.Errorf("%s: value '%s' is not a number", col, s)
+			}
+			tag[i] = f
+		}
+	}
+	eu := make(map[string]any)
+	for _, col := range tagEUColumns {
+		s := cell(col)
+		if s == "" {
+			continue
+		}
+		if col == "unit" {
+			eu[col] = s
+			continue
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: value '%s' is not a number", col, s)
+		}
+		eu[col] = f
+	}
+	if len(eu) > 0 {
+		tag = append(tag, eu)
+	}
+	action := strings.ToLower(cell(tagActionColumn))
+	switch action {
+	case "", "add", "update", "delete":
+	default:
+		return nil, "", fmt.Errorf("action must be add, update, delete or empty")
+	}
+	return tag, action, nil
+}
+
+// readTagRows 读取上传的 CSV 或 XLSX 文件的所有行
+func readTagRows(c *gin.Context) ([][]string, error) {
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return nil, fmt.Errorf("file is required")
+	}
+	if fh.Size > configMaxBytes {
+		return nil, fmt.Errorf("file is too large")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, configMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(fh.Filename), ".xlsx") || bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		rows, errx := readXLSX(data)
+		if errx != nil {
+			return nil, fmt.Errorf("invalid xlsx file: %w", errx)
+		}
+		return rows, nil
+	}
+	// Excel 保存的 UTF-8 CSV 带 BOM
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv file: %w", err)
+	}
+	return rows, nil
+}
+
+// writeTagTable 按 format 输出表格文件
+func writeTagTable(c *gin.Context, format string, name string, rows [][]any) {
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	var buf bytes.Buffer
+	if format == "xlsx" {
+		if err := writeXLSX(&buf, name, rows); err != nil {
+			c.Header("Content-Disposition", "")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", buf.Bytes())
+		return
+	}
+	// 写入 BOM，Excel 打开时能正确识别中文
+	buf.WriteString("\xef\xbb\xbf")
+	w := csv.NewWriter(&buf)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			if v != nil {
+				record[i] = fmt.Sprintf("%v", v)
+			}
+		}
+		_ = w.Write(record)
+	}
+	w.Flush()
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// tagTableHeader 返回表格的表头
+func tagTableHeader(cols []string) []any {
+	header := make([]any, 0, len(cols)+len(tagEUColumns)+1)
+	for _, col := range cols {
+		header = append(header, col)
+	}
+	for _, col := range tagEUColumns {
+		header = append(header, col)
+	}
+	return append(header, tagActionColumn)
+}
+
+// tableFormat 读取 format 参数，默认 csv
+func tableFormat(c *gin.Context) (string, bool) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or xlsx"})
+		return "", false
+	}
+	return format, true
+}
+
+// @Summary 下载点表模板
+// @Description 下载 appCode 的点表模板，包括表头和 tags_default 中的示例点
+// @Tags DEV Manager
+// @Produce text/csv
+// @Produce application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param appCode query string true "appCode"
+// @Param format query string false "csv/xlsx"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/getTagTemplate [get]
+func GetTagTemplate(c *gin.Context) {
+	format, ok := tableFormat(c)
+	if !ok {
+		return
+	}
+	appCode := c.Query("appCode")
+	cols, samples, err := tagTemplate(appCode)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tagids := make([]string, 0, len(samples))
+	for tagid := range samples {
+		tagids = append(tagids, tagid)
+	}
+	sort.Strings(tagids)
+	rows := [][]any{tagTableHeader(cols)}
+	for _, tagid := range tagids {
+		rows = append(rows, tagToRow(cols, samples[tagid]))
+	}
+	writeTagTable(c, format, "tags-"+appCode, rows)
+}
+
+// @Summary 导出设备点表
+// @Description 导出设备的点表为 CSV 或 XLSX，按点ID排序，列由设备所属实例的 appCode 决定
+// @Tags DEV Manager
+// @Produce text/csv
+// @Produce application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param devId query string true "设备ID"
+// @Param format query string false "csv/xlsx"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/exportDevtags [get]
+func ExportDevTags(c *gin.Context, cfgdb *redka.DB) {
+	format, ok := tableFormat(c)
+	if !ok {
+		return
+	}
+	devid := c.Query("devId")
+	appCode, err := devAppCode(cfgdb, devid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cols, _, err := tagTemplate(appCode)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tags := devTagsOf(cfgdb, devid)
+	tagids := make([]string, 0, len(tags))
+	for tagid := range tags {
+		tagids = append(tagids, tagid)
+	}
+	sort.Strings(tagids)
+	rows := [][]any{tagTableHeader(cols)}
+	for _, tagid := range tagids {
+		rows = append(rows, tagToRow(cols, tags[tagid]))
+	}
+	writeTagTable(c, format, devid, rows)
+}
+
+// @Summary 导入设备点表
+// @Description 从 CSV 或 XLSX 导入设备点表，第一行为表头(见点表模板)。action 列为空时新增或修改，add 只新增，update 只修改，delete 删除；
+// @Description mode=merge(默认) 保留文件中没有的点，mode=replace 删除文件中没有的点。有错误时按行返回，不写入；dryRun=1 只校验
+// @Tags DEV Manager
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "CSV 或 XLSX 文件"
+// @Param devId formData string true "设备ID"
+// @Param mode formData string false "merge/replace"
+// @Param dryRun formData string false "1 只校验不写入"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/importDevtags [post]
+func ImportDevTags(c *gin.Context, cfgdb *redka.DB) {
+	devid := c.PostForm("devId")
+	mode := c.DefaultPostForm("mode", "merge")
+	if mode != "merge" && mode != "replace" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be merge or replace"})
+		return
+	}
+	appCode, err := devAppCode(cfgdb, devid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cols, samples, err := tagTemplate(appCode)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rows, err := readTagRows(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report := &TagImportReport{
+		DevID:   devid,
+		Mode:    mode,
+		DryRun:  c.PostForm("dryRun") == "1" || c.PostForm("dryRun") == "true",
+		Errors:  []TagRowError{},
+		Added:   []string{},
+		Updated: []string{},
+		Deleted: []string{},
+	}
+
+	// 表头：列名和点表模板一致，顺序不限
+	known := make(map[string]bool)
+	for _, col := range tagTableHeader(cols) {
+		known[col.(string)] = true
+	}
+	header := make(map[string]int)
+	if len(rows) > 0 {
+		for i, name := range rows[0] {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !known[name] {
+				report.Errors = append(report.Errors, TagRowError{Row: 1, Message: fmt.Sprintf("unknown column '%s'", name)})
+				continue
+			}
+			header[name] = i
+		}
+	}
+	if _, ok := header["tagId"]; !ok {
+		report.Errors = append(report.Errors, TagRowError{Row: 1, Message: "column 'tagId' is required"})
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Import Devtags Fail", "data": report})
+		return
+	}
+
+	before := devTagsOf(cfgdb, devid)
+	after := make(map[string][]any, len(before))
+	for tagid, tag := range before {
+		after[tagid] = tag
+	}
+	numeric := tagNumericColumns(cols, samples)
+	seen := make(map[string]bool)
+	for i, row := range rows[1:] {
+		rowNum := i + 2
+		empty := true
+		for _, cell := range row {
+			if strings.TrimSpace(cell) != "" {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			continue
+		}
+		report.Rows++
+		tag, action, errr := tagFromRow(cols, numeric, header, row)
+		tagid := ""
+		if idx := header["tagId"]; idx < len(row) {
+			tagid = strings.TrimSpace(row[idx])
+		}
+		if errr == nil {
+			errr = checkTag(appCode, tagid, tag)
+		}
+		if errr == nil && seen[tagid] {
+			errr = fmt.Errorf("duplicate tagId")
+		}
+		if errr == nil {
+			_, exists := before[tagid]
+			switch {
+			case action == "add" && exists:
+				errr = fmt.Errorf("tag is already exist")
+			case (action == "update" || action == "delete") && !exists:
+				errr = fmt.Errorf("tag is not exist")
+			}
+		}
+		if errr != nil {
+			report.Errors = append(report.Errors, TagRowError{Row: rowNum, TagID: tagid, Message: errr.Error()})
+			continue
+		}
+		seen[tagid] = true
+		if action == "delete" {
+			delete(after, tagid)
+		} else {
+			after[tagid] = tag
+		}
+	}
+	if mode == "replace" {
+		for tagid := range after {
+			if !seen[tagid] {
+				delete(after, tagid)
+			}
+		}
+	}
+	if len(report.Errors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Import Devtags Fail", "data": report})
+		return
+	}
+
+	setMap := make(map[string]any)
+	for tagid, tag := range after {
+		old, exists := before[tagid]
+		switch {
+		case !exists:
+			report.Added = append(report.Added, tagid)
+		case len(auditDiff(old, tag)) > 0:
+			report.Updated = append(report.Updated, tagid)
+		default:
+			report.Unchanged++
+			continue
+		}
+		jsonstr, _ := json.Marshal(tag)
+		setMap[tagid] = string(jsonstr)
+	}
+	for tagid := range before {
+		if _, exists := after[tagid]; !exists {
+			report.Deleted = append(report.Deleted, tagid)
+		}
+	}
+	sort.Strings(report.Added)
+	sort.Strings(report.Updated)
+	sort.Strings(report.Deleted)
+	if report.DryRun || (len(setMap) == 0 && len(report.Deleted) == 0) {
+		c.JSON(http.StatusOK, gin.H{"message": "Import Devtags Check OK", "data": report})
+		return
+	}
+
+	err = cfgdb.Update(func(tx *redka.Tx) error {
+		if len(report.Deleted) > 0 {
+			if _, errd := tx.Hash().Delete(devid, report.Deleted...); errd != nil {
+				return errd
+			}
+		}
+		if len(setMap) > 0 {
+			if _, errs := tx.Hash().SetMany(devid, setMap); errs != nil {
+				return errs
+			}
+		}
+		return nil
+	})
+	invalidateTagEU(devid)
+	publishConfig("tags", AuditUpdate, devid)
+	auditAPI(c, AuditUpdate, "tags", devid, before, after, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Import Devtags Fail", "details": err.Error(), "data": report})
+		return
+	}
+	commitRevision(c, cfgdb, AuditImport, "tags", devid)
+	report.Applied = true
+	c.JSON(http.StatusOK, gin.H{"message": "Import Devtags OK", "data": report})
+}
+
+// setDevTag 新增或修改单个点，create 为 true 时点不能已存在，否则点需要存在
+func setDevTag(c *gin.Context, cfgdb *redka.DB, create bool) {
+	var req DevTag
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if isExist, _ := cfgdb.Hash().Exists(DevAtInstKey, req.DevID); !isExist {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devId '%s' is not exist", req.DevID)})
+		return
+	}
+	tag := trimTag(req.Tag)
+	if req.TagID == "" && len(tag) > 0 {
+		req.TagID, _ = tag[0].(string)
+	}
+	appCode, _ := devAppCode(cfgdb, req.DevID)
+	if err := checkTag(appCode, req.TagID, tag); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("tag '%s': %v", req.TagID, err)})
+		return
+	}
+	var before map[string][]any
+	if value, err := cfgdb.Hash().Get(req.DevID, req.TagID); err == nil {
+		if create {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("tag '%s' is already exist", req.TagID)})
+			return
+		}
+		var old []any
+		_ = json.Unmarshal([]byte(value.String()), &old)
+		before = map[string][]any{req.TagID: old}
+	} else if !create {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("tag '%s' is not exist", req.TagID)})
+		return
+	}
+	jsonstr, _ := json.Marshal(tag)
+	_, err := cfgdb.Hash().Set(req.DevID, req.TagID, jsonstr)
+	invalidateTagEU(req.DevID)
+	publishConfig("tags", AuditUpdate, req.DevID)
+	action := AuditUpdate
+	if create {
+		action = AuditCreate
+	}
+	auditAPI(c, action, "tags", req.DevID, before, map[string][]any{req.TagID: tag}, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to write data to database"})
+		return
+	}
+	commitRevision(c, cfgdb, action, "tags", req.DevID)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to write tag",
+		"data":    DevTag{DevID: req.DevID, TagID: req.TagID, Tag: tag},
+	})
+}
+
+// @Summary 新增设备点
+// @Description 向设备增加一个点，点已存在时失败，不影响设备的其他点
+// @Tags DEV Manager
+// @Accept json
+// @Produce json
+// @Param tag body DevTag true "tag"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/newTag [post]
+func NewTag(c *gin.Context, cfgdb *redka.DB) {
+	setDevTag(c, cfgdb, true)
+}
+
+// @Summary 修改设备点
+// @Description 修改设备的一个点，点不存在时失败
+// @Tags DEV Manager
+// @Accept json
+// @Produce json
+// @Param tag body DevTag true "tag"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/modTag [post]
+func ModTag(c *gin.Context, cfgdb *redka.DB) {
+	setDevTag(c, cfgdb, false)
+}
+
+// @Summary 删除设备点
+// @Description 删除设备的一个或多个点
+// @Tags DEV Manager
+// @Accept json
+// @Produce json
+// @Param tags body DevTagIDs true "tagIds"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/v1/delTag [post]
+func DelTag(c *gin.Context, cfgdb *redka.DB) {
+	var req DevTagIDs
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.TagIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tagIds is required"})
+		return
+	}
+	before := make(map[string][]any)
+	for _, tagid := range req.TagIDs {
+		value, err := cfgdb.Hash().Get(req.DevID, tagid)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("tag '%s' is not exist", tagid)})
+			return
+		}
+		var tag []any
+		_ = json.Unmarshal([]byte(value.String()), &tag)
+		before[tagid] = tag
+	}
+	_, err := cfgdb.Hash().Delete(req.DevID, req.TagIDs...)
+	invalidateTagEU(req.DevID)
+	publishConfig("tags", AuditDelete, req.DevID)
+	auditAPI(c, AuditDelete, "tags", req.DevID, before, nil, err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to write data to database"})
+		return
+	}
+	commitRevision(c, cfgdb, AuditDelete, "tags", req.DevID)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "success to delete tags",
+		"data":    req,
+	})
+}
@@ -1,144 +1,210 @@
 package handlers
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
 	"github.com/nalgeon/redka"
 )
 
+// influxSettings dsInfluxdb 实例的配置，配置变化时整体替换
+type influxSettings struct {
+	host             string
+	token            string
+	org              string
+	bucket           string
+	batchSize        uint // 每批写入的点数
+	flushInterval    uint // 最长刷新间隔(毫秒)
+	retryBufferLimit uint // 内存中等待重试的最大点数
+	maxRetries       uint // 重试次数，超过后写入溢出文件
+	overflowMaxMB    uint // 溢出文件的最大大小(MB)
+	cycle            float64
+	deviceList       []string
+}
+
+// connSig 返回连接和批量写入参数的签名，变化时重新创建客户端
+func (s *influxSettings) connSig() string {
+	return fmt.Sprint(s.host, s.token, s.org, s.bucket, s.batchSize, s.flushInterval, s.retryBufferLimit, s.maxRetries, s.overflowMaxMB)
+}
+
 // influxdbWriteData 函数：周期性地读取 redka 数据并写入 InfluxDB
 func dsInfluxdb(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.DB) {
-	// 通过 ID(实例ID) 获取实例的配置信息
-	appconfig, err := cfgdb.Hash().Get(InstListKey, id)
-	if err != nil {
-		fmt.Printf("database no instid\n")
-		return
-	}
-	configstr := appconfig.String()
-	var newConfig AppConfig
-	err = json.Unmarshal([]byte(configstr), &newConfig)
-	configMap := newConfig.Config
-	fmt.Printf("myConfig %+v\n", configMap)
-	config, ok := configMap.(map[string]any) // 类型断言为 map[string]any
-	if !ok {
-		fmt.Println("configMap is not a map[string]any or does not exist")
-		return
-	}
+	logger := workerLogger(id)
+	// 订阅配置变化，周期和设备列表原地生效，连接参数变化时重新创建客户端
+	cfgCh := subscribeConfig(id)
+	defer unsubscribeConfig(cfgCh)
+	metrics := metricsOf(id)
+	var cfgChanged atomic.Bool // 收到配置变化，消费者重新读取设备信息
 
-	// 获取 InfluxDB 连接配置
-	host, ok := config["host"].(string)
-	if !ok {
-		fmt.Println("host is not a string or does not exist")
-		return
-	}
-	token, ok := config["token"].(string)
-	if !ok {
-		fmt.Println("token is not a string or does not exist")
-		return
-	}
-	org, ok := config["org"].(string)
-	if !ok {
-		fmt.Println("org is not a string or does not exist")
-		return
-	}
-	bucket, ok := config["bucket"].(string)
-	if !ok {
-		fmt.Println("bucket is not a string or does not exist")
-		return
-	}
-	cycle, ok := config["cycle"].(float64)
-	if !ok {
-		fmt.Println("cycle is not a number or does not exist")
-		cycle = 5 // 默认5秒
-	}
-
-	deviceListany, ok := config["deviceList"].([]any)
-	if !ok {
-		fmt.Println("deviceList is not a []string or does not exist")
-	}
+	// loadSettings 通过 ID(实例ID) 获取实例的配置信息
+	loadSettings := func() (*influxSettings, error) {
+		config, err := loadInstConfig(cfgdb, id)
+		if err != nil {
+			return nil, err
+		}
+		s := &influxSettings{}
 
-	var deviceList []string
-	if len(deviceListany) != 0 {
-		for _, item := range deviceListany {
-			device, ok := item.(string)
+		// 获取 InfluxDB 连接配置
+		var ok bool
+		s.host, ok = config["host"].(string)
+		if !ok {
+			return nil, fmt.Errorf("host 不是字符串或不存在")
+		}
+		// version: v2(默认) 使用 token/org/bucket，v1 使用 username/password/database/retentionPolicy
+		version, _ := config["version"].(string)
+		if version == "v1" {
+			username, _ := config["username"].(string)
+			password, _ := config["password"].(string)
+			database, ok := config["database"].(string)
+			if !ok || database == "" {
+				return nil, fmt.Errorf("database 不是字符串或不存在")
+			}
+			retentionPolicy, _ := config["retentionPolicy"].(string)
+			// InfluxDB 1.8+ 的 2.x 兼容接口：token 为 用户名:密码，bucket 为 数据库/保留策略，org 不使用
+			if username != "" {
+				s.token = username + ":" + password
+			}
+			s.bucket = database + "/" + retentionPolicy
+		} else {
+			s.token, ok = config["token"].(string)
 			if !ok {
-				fmt.Println("deviceList contains non-string values")
-				return
+				return nil, fmt.Errorf("token 不是字符串或不存在")
+			}
+			s.org, ok = config["org"].(string)
+			if !ok {
+				return nil, fmt.Errorf("org 不是字符串或不存在")
+			}
+			s.bucket, ok = config["bucket"].(string)
+			if !ok {
+				return nil, fmt.Errorf("bucket 不是字符串或不存在")
 			}
-			deviceList = append(deviceList, device)
 		}
-	}
+		s.cycle, ok = config["cycle"].(float64)
+		if !ok {
+			logger.Warn("cycle 不是数字或不存在，使用默认值", "cycle", 5)
+			s.cycle = 5 // 默认5秒
+		}
 
-	// 通过 ID(实例ID) 获取当前函数可读写的设备配置信息和设备点表信息
-	devValues, err1 := cfgdb.Hash().Items(DevAtInstKey)
-	if err1 != nil {
-		fmt.Printf("Err: %v\n", err1)
-		return
+		// 批量写入参数
+		s.batchSize = configUint(config, "batchSize", 500)
+		s.flushInterval = configUint(config, "flushInterval", 1000)
+		s.retryBufferLimit = configUint(config, "retryBufferLimit", 50000)
+		s.maxRetries = configUint(config, "maxRetries", 5)
+		s.overflowMaxMB = configUint(config, "overflowMaxMB", 100)
+
+		s.deviceList, err = configDeviceList(config)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
 	}
-	if len(devValues) == 0 {
-		fmt.Printf("database no any device\n")
+	settings, err := loadSettings()
+	if err != nil {
+		logger.Error("读取实例配置失败", "err", err)
 		return
 	}
-
-	devMap := make(map[string]DevConfig)
-	for key, value := range devValues {
-		var newValue DevConfig
-		erra := json.Unmarshal([]byte(value.String()), &newValue)
-		if erra != nil {
-			fmt.Println("Error unmarshalling JSON:", erra)
-			return
-		}
-		if len(deviceList) == 0 {
-			devMap[key] = newValue
-		} else {
-			if ContainsString(deviceList, key) {
-				devMap[key] = newValue
-			}
-		}
+	var settingsLock sync.Mutex
+	// current 返回当前的配置
+	current := func() *influxSettings {
+		settingsLock.Lock()
+		defer settingsLock.Unlock()
+		return settings
 	}
 
-	if len(devMap) == 0 {
-		fmt.Printf("no match device in %+v\n", deviceList)
+	// deviceList 为空时写入所有设备，设备在运行中增加时自动跟随
+	devMap, err1 := loadDeviceMap(cfgdb, settings.deviceList)
+	if err1 != nil {
+		logger.Error("获取设备配置信息失败", "err", err1)
 		return
 	}
+	if len(devMap) == 0 {
+		logger.Warn("没有匹配的设备，等待添加设备", "deviceList", settings.deviceList)
+	}
 
-	// 创建 InfluxDB 客户端
-	client := influxdb2.NewClient(host, token)
-	defer client.Close()
+	// 重试次数用完仍失败的批次写入溢出文件，InfluxDB 恢复后补写
+	overflow := &influxOverflow{
+		path:     fmt.Sprintf("data/influx_%s.lp", ReplaceChars(id, "_")),
+		maxBytes: int64(settings.overflowMaxMB) * 1024 * 1024,
+	}
 
-	// 创建写入器
-	writeAPI := client.WriteAPIBlocking(org, bucket)
+	// newClient 创建 InfluxDB 客户端，数据由客户端在后台按批写入，失败的批次在内存中等待重试
+	newClient := func(s *influxSettings) (influxdb2.Client, api.WriteAPI) {
+		options := influxdb2.DefaultOptions().
+			SetPrecision(time.Millisecond).
+			SetBatchSize(s.batchSize).
+			SetFlushInterval(s.flushInterval).
+			SetRetryBufferLimit(s.retryBufferLimit).
+			SetMaxRetries(s.maxRetries)
+		client := influxdb2.NewClientWithOptions(s.host, s.token, options)
+
+		// 创建写入器
+		writeAPI := client.WriteAPI(s.org, s.bucket)
+		go func() {
+			for errw := range writeAPI.Errors() {
+				metrics.publishResult(errw)
+				logger.Error("写入 InfluxDB 失败", "err", errw)
+			}
+		}()
+		overflow.mu.Lock()
+		overflow.maxBytes = int64(s.overflowMaxMB) * 1024 * 1024
+		overflow.mu.Unlock()
+		maxRetries := s.maxRetries
+		writeAPI.SetWriteFailedCallback(func(batch string, errw influxhttp.Error, retryAttempts uint) bool {
+			if retryAttempts < maxRetries {
+				return true
+			}
+			if erro := overflow.Append(batch); erro != nil {
+				logger.Error("数据写入溢出文件失败，丢弃本批数据", "err", erro)
+			} else {
+				logger.Warn("写入 InfluxDB 失败，本批数据已写入溢出文件", "err", errw.Error(), "file", overflow.path)
+			}
+			return false
+		})
+		return client, writeAPI
+	}
 
 	// 创建队列
 	queue := NewDataQueue()
+	metrics.queue.Store(queue)
 
 	// 生产者 goroutine - 从 redka 读取数据
 	go func() {
 		for {
 			select {
 			case <-stopChan:
-				fmt.Println("生产者收到停止信号，退出")
+				logger.Info("生产者收到停止信号，退出")
 				return
 			default:
+				s := current()
 				if queue.Len() > 1000 {
-					log.Printf("队列长度超过1000，等待消费")
+					logger.Warn("队列长度超过1000，等待消费")
 					time.Sleep(1 * time.Second)
 					continue
 				}
+				// 每个周期重新读取设备列表，新增的设备随之写入
+				devMap, erra := loadDeviceMap(cfgdb, s.deviceList)
+				if erra != nil {
+					logger.Error("获取设备配置信息失败", "err", erra)
+				}
 				OutterMap := make(map[string]map[string][]any)
 				for devkey := range devMap {
 					values, erra := rtdb.Hash().Items(devkey)
 					if erra != nil {
-						log.Printf("Error reading from database: %v", erra)
+						logger.Error("读取实时数据失败", "devId", devkey, "err", erra)
 						continue
 					}
 					if len(values) == 0 {
-						log.Printf("%+v no value", devkey)
+						logger.Debug("设备没有实时数据", "devId", devkey)
 						continue
 					} else {
 						InnerMap := make(map[string][]any)
@@ -146,7 +212,7 @@ func dsInfluxdb(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 							var newValue []any
 							errb := json.Unmarshal([]byte(value.String()), &newValue)
 							if errb != nil {
-								fmt.Println("Error unmarshalling JSON:", errb)
+								logger.Error("解析实时数据失败", "devId", devkey, "tagId", key, "err", errb)
 								return
 							}
 							InnerMap[key] = newValue
@@ -158,70 +224,227 @@ func dsInfluxdb(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 				//fmt.Printf("生产者：缓存区存入前数据长度： %d \n", queue.Len())
 				queue.Enqueue(string(OutterMapstr))
 				//fmt.Printf("生产者：缓存区存入后数据长度： %d \n", queue.Len())
-				time.Sleep(time.Duration(cycle) * time.Second)
+				time.Sleep(time.Duration(s.cycle) * time.Second)
 			}
 		}
 	}()
 
-	// 消费者 goroutine - 写入 InfluxDB
+	// 消费者 goroutine - 写入 InfluxDB，客户端由消费者创建和关闭，连接参数变化时关闭原客户端（写入缓冲区中的数据）后重新创建
 	go func() {
+		var lastReplay time.Time
+		var client influxdb2.Client
+		var writeAPI api.WriteAPI
+		clientSig := ""
+		var devMap map[string]DevConfig // 缓存的设备信息，收到配置变化后重新读取
+		defer func() {
+			if client != nil {
+				client.Close()
+			}
+		}()
 		for {
 			select {
 			case <-stopChan:
-				fmt.Println("消费者收到停止信号，退出")
+				logger.Info("消费者收到停止信号，退出")
 				return
 			default:
+				s := current()
+				if s.connSig() != clientSig {
+					if client != nil {
+						logger.Info("连接参数变化，重新创建客户端")
+						client.Close()
+					}
+					client, writeAPI = newClient(s)
+					clientSig = s.connSig()
+				}
+				// 设备信息作为 tag 写入，便于按设备名称、类型和实例查询
+				if cfgChanged.Swap(false) || devMap == nil {
+					loaded, errl := loadDeviceMap(cfgdb, s.deviceList)
+					if errl != nil {
+						logger.Error("获取设备配置信息失败", "err", errl)
+						cfgChanged.Store(true)
+					} else {
+						devMap = loaded
+					}
+				}
 				for queue.Len() > 0 {
-					//fmt.Printf("消费者：缓存区取出前数据长度： %d \n", queue.Len())
-					if val, ok := queue.Dequeue(); ok {
-						var datasmap map[string]map[string][]any
-						errc := json.Unmarshal([]byte(val), &datasmap)
-						if errc != nil {
-							fmt.Println("解析失败:", errc)
-							continue
+					val, ok := queue.Dequeue()
+					if !ok {
+						logger.Error("队列数据取出失败")
+						break
+					}
+					var datasmap map[string]map[string][]any
+					errc := json.Unmarshal([]byte(val), &datasmap)
+					if errc != nil {
+						logger.Error("解析队列数据失败", "err", errc)
+						continue
+					}
+					for devkey, deviceData := range datasmap {
+						dev := devMap[devkey]
+						tags := map[string]string{
+							"dev_id":   devkey,
+							"dev_name": dev.DevName,
+							"dev_type": dev.DevType,
+							"inst_id":  dev.InstID,
 						}
-
-						for devkey, deviceData := range datasmap {
-							for measurement, values := range deviceData {
-								v := values[1] // 值
-								tsFloat := values[2].(float64)
-								tsInt := int64(tsFloat)
-								if tsInt <= 1e12 { // 毫秒级时间戳
-									tsInt = tsInt * 1000
-								}
-								tags := map[string]string{"dev_id": devkey}
-								fields := map[string]interface{}{
-									"value": v,
-								}
-								// 构建 Line Protocol
-								//fmt.Printf("measurement：%s, tags：%v, fields: %v, tsInt: %v ,now：%v \n", measurement, tags, fields, time.UnixMilli(tsInt), time.Now())
-								point := influxdb2.NewPoint(measurement, tags, fields, time.UnixMilli(tsInt))
-
-								// 写入 InfluxDB
-								err := writeAPI.WritePoint(context.Background(), point)
-								if err != nil {
-									log.Printf("写入 InfluxDB 失败: %v", err)
-								}
+						for measurement, values := range deviceData {
+							if len(values) < 3 {
+								continue
 							}
+							tsFloat, ok := values[2].(float64)
+							if !ok {
+								continue
+							}
+							fields := map[string]any{
+								"quality": QualityOf(values),
+							}
+							// 质量为 bad 时值可能为空，只写入质量
+							if values[1] != nil {
+								fields["value"] = values[1]
+							}
+							// 写入缓冲区，由客户端在后台批量写入
+							writeAPI.WritePoint(influxdb2.NewPoint(measurement, tags, fields, time.UnixMilli(int64(tsFloat))))
+							metrics.publishResult(nil)
+						}
+					}
+				}
+				// 溢出文件中有数据且 InfluxDB 可用时补写
+				if overflow.Size() > 0 && time.Since(lastReplay) >= reconnectDelay {
+					lastReplay = time.Now()
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					up, _ := client.Ping(ctx)
+					cancel()
+					if up {
+						n, errr := overflow.Replay(writeAPI)
+						if errr != nil {
+							logger.Error("溢出文件补写失败", "err", errr)
+						} else {
+							logger.Info("溢出文件补写完成", "lines", n)
 						}
-					} else {
-						log.Println("队列数据取出失败")
 					}
-					//fmt.Printf("消费者：缓存区取出后数据长度： %d \n", queue.Len())
 				}
 				if queue.Len() == 0 {
-					time.Sleep(time.Duration(cycle) * time.Second)
+					time.Sleep(time.Duration(s.cycle) * time.Second)
 				}
 			}
 		}
 	}()
 
-	// 当前线程处理退出信号
+	// 当前线程处理退出信号和配置变化
 	for {
 		select {
 		case <-stopChan:
-			fmt.Printf("子线程 InfluxDB 实例 %s 收到停止信号，退出\n", id)
+			logger.Info("收到停止信号，退出")
 			return
+		case event := <-cfgCh:
+			if !configNotified(cfgCh, id) && !event.concerns(id) {
+				continue
+			}
+			cfgChanged.Store(true)
+			s, errs := loadSettings()
+			if errs != nil {
+				logger.Error("重新读取实例配置失败，继续使用原配置", "err", errs)
+				continue
+			}
+			// 其他设备或点表的修改不影响本实例时配置不变
+			if fmt.Sprint(*s) == fmt.Sprint(*settings) {
+				continue
+			}
+			settingsLock.Lock()
+			settings = s
+			settingsLock.Unlock()
+			logger.Info("实例配置已重新加载", "deviceList", s.deviceList, "cycle", s.cycle)
+		}
+	}
+}
+
+// configUint 读取非负整数配置项，不存在或无效时返回默认值
+func configUint(config map[string]any, key string, def uint) uint {
+	v, ok := config[key].(float64)
+	if !ok || v < 0 {
+		return def
+	}
+	return uint(v)
+}
+
+// influxOverflow 溢出文件，保存重试后仍写入失败的 line protocol 数据
+type influxOverflow struct {
+	path     string
+	maxBytes int64
+	mu       sync.Mutex
+}
+
+// Append 追加一批数据，文件超过上限时拒绝写入
+func (o *influxOverflow) Append(batch string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.maxBytes > 0 && o.size()+int64(len(batch)) > o.maxBytes {
+		return fmt.Errorf("overflow file %s is full", o.path)
+	}
+	f, err := os.OpenFile(o.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !strings.HasSuffix(batch, "\n") {
+		batch += "\n"
+	}
+	_, err = f.WriteString(batch)
+	return err
+}
+
+// Size 返回待补写的数据大小
+func (o *influxOverflow) Size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.size() + fileSize(o.path+".replay")
+}
+
+func (o *influxOverflow) size() int64 {
+	return fileSize(o.path)
+}
+
+// Replay 把溢出文件中的数据重新提交给写入器，返回提交的条数。
+// 补写时再次失败的数据会由写入失败回调重新写入溢出文件
+func (o *influxOverflow) Replay(writeAPI api.WriteAPI) (int, error) {
+	replayPath := o.path + ".replay"
+	o.mu.Lock()
+	// 上次补写中断时先补写遗留的文件
+	if fileSize(replayPath) == 0 {
+		if err := os.Rename(o.path, replayPath); err != nil {
+			o.mu.Unlock()
+			return 0, err
 		}
 	}
+	o.mu.Unlock()
+
+	f, err := os.Open(replayPath)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		writeAPI.WriteRecord(line)
+		n++
+	}
+	f.Close()
+	if err = scanner.Err(); err != nil {
+		return n, err
+	}
+	writeAPI.Flush()
+	return n, os.Remove(replayPath)
+}
+
+// fileSize 返回文件大小，文件不存在时返回 0
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
@@ -0,0 +1,258 @@
+package handlers
+
+// MQTT 命令通道（云端到网关）
+//
+// mqttpub 实例连接到 Broker 后订阅配置项 cmdTopic（为空时使用 "<instId>/cmd"），
+// 每个请求处理完成后把结果发布到 respTopic（为空时使用 "<instId>/resp"），
+// 请求中带 replyTo 时改为回复到 replyTo 指定的主题，replyTo 只能是 respTopic 的下级主题（如 "<respTopic>/app1"），
+// 避免请求方让网关向 Broker 上的任意主题发布；不符合时在 respTopic 上回复 400 错误。请求和响应通过 id 关联。
+//
+// 请求格式:
+//
+//	{"id": "c-001", "method": "writeTag", "params": {"devId": "DEV_7JF3ZMbg", "tagId": "analog1", "value": 12.5}}
+//
+// 响应格式:
+//
+//	{"id": "c-001", "result": {...}, "ts": 1736300000000}
+//	{"id": "c-001", "error": {"code": 404, "message": "..."}, "ts": 1736300000000}
+//
+// 支持的方法:
+//
+//	writeTag    params: devId, tagId, value                  向设备点写值
+//	startApp    params: instId                               启动实例
+//	stopApp     params: instId                               停止实例
+//	restartApp  params: instId                               重启实例
+//	getConfig   params: instId(可选)                         查询实例配置，不带 instId 时返回所有实例，敏感字段返回 ******
+//	setConfig   params: instId, instName, autoStart, config  修改实例配置，未提供的字段保持不变，值为 ****** 的敏感字段保持原值，
+//	                                                         运行中的实例立即重新读取配置，只有连接参数变化时重新连接
+//
+// 错误码与 REST 接口的 HTTP 状态码含义一致: 400 请求错误, 404 对象不存在, 500 执行失败。
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nalgeon/redka"
+)
+
+// 定义 MQTT 命令请求结构体
+type mqttCmdReq struct {
+	ID      string          `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ReplyTo string          `json:"replyTo"`
+}
+
+// 定义 MQTT 命令参数结构体
+type mqttCmdParams struct {
+	InstID    string  `json:"instId"`
+	DevID     string  `json:"devId"`
+	TagID     string  `json:"tagId"`
+	Value     any     `json:"value"`
+	InstName  *string `json:"instName"`
+	AutoStart *bool   `json:"autoStart"`
+	Config    any     `json:"config"`
+}
+
+// 定义 MQTT 命令错误结构体
+type mqttCmdErr struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// 定义 MQTT 命令响应结构体
+type mqttCmdResp struct {
+	ID     string      `json:"id"`
+	Result any         `json:"result,omitempty"`
+	Error  *mqttCmdErr `json:"error,omitempty"`
+	Ts     int64       `json:"ts"`
+}
+
+func newCmdErr(code int, format string, args ...any) *mqttCmdErr {
+	return &mqttCmdErr{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// newMqttCmdHandler 创建命令主题的消息处理函数，id 为当前 mqttpub 实例ID
+func newMqttCmdHandler(id string, respTopic string, cfgdb *redka.DB, rtdb *redka.DB) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		payload := msg.Payload()
+		// 在独立协程中执行，写点和重启可能耗时数秒，不能阻塞 paho 的消息分发
+		go func() {
+			var req mqttCmdReq
+			resp := mqttCmdResp{}
+			var after func()
+			topic := respTopic
+			if err := json.Unmarshal(payload, &req); err != nil {
+				resp.Error = newCmdErr(http.StatusBadRequest, "invalid request: %v", err)
+			} else if !validReplyTo(respTopic, req.ReplyTo) {
+				resp.ID = req.ID
+				resp.Error = newCmdErr(http.StatusBadRequest, "replyTo must be a sub-topic of '%s'", respTopic)
+			} else {
+				resp.ID = req.ID
+				resp.Result, after, resp.Error = dispatchMqttCmd(id, req, cfgdb, rtdb)
+				if req.ReplyTo != "" {
+					topic = req.ReplyTo
+				}
+			}
+			resp.Ts = time.Now().UnixMilli()
+			respstr, _ := json.Marshal(resp)
+			token := client.Publish(topic, 1, false, respstr)
+			if token.Wait() && token.Error() != nil {
+				workerLogger(id).Error("发布命令回复失败", "topic", topic, "err", token.Error())
+			}
+			// 停止或重启当前实例时，先回复再执行
+			if after != nil {
+				after()
+			}
+		}()
+	}
+}
+
+// validReplyTo 检查回复主题：为空或是 respTopic 的下级主题，不能包含通配符
+func validReplyTo(respTopic string, replyTo string) bool {
+	if replyTo == "" {
+		return true
+	}
+	return strings.HasPrefix(replyTo, respTopic+"/") && len(replyTo) > len(respTopic)+1 &&
+		!strings.ContainsAny(replyTo, "+#")
+}
+
+// dispatchMqttCmd 执行命令，返回结果、回复后需要执行的动作和错误
+func dispatchMqttCmd(id string, req mqttCmdReq, cfgdb *redka.DB, rtdb *redka.DB) (any, func(), *mqttCmdErr) {
+	var params mqttCmdParams
+	if len(req.Params) != 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, nil, newCmdErr(http.StatusBadRequest, "invalid params: %v", err)
+		}
+	}
+	workerLogger(id).Info("收到命令", "id", req.ID, "method", req.Method)
+
+	switch req.Method {
+	case "writeTag":
+		if params.DevID == "" || params.TagID == "" || params.Value == nil {
+			return nil, nil, newCmdErr(http.StatusBadRequest, "devId, tagId and value are required")
+		}
+		err := WriteTagValue(cfgdb, params.DevID, params.TagID, params.Value)
+		auditMqtt(id, AuditWrite, "tag", params.DevID+"."+params.TagID, nil, params.Value, err)
+		if err != nil {
+			return nil, nil, newCmdErr(http.StatusInternalServerError, "%v", err)
+		}
+		return map[string]any{"devId": params.DevID, "tagId": params.TagID, "value": params.Value}, nil, nil
+
+	case "startApp", "stopApp", "restartApp":
+		if params.InstID == "" {
+			return nil, nil, newCmdErr(http.StatusBadRequest, "instId is required")
+		}
+		isExist, _ := cfgdb.Hash().Exists(InstListKey, params.InstID)
+		if !isExist {
+			return nil, nil, newCmdErr(http.StatusNotFound, "instId '%s' is not exist", params.InstID)
+		}
+		instid := params.InstID
+		result := map[string]any{"instId": instid}
+		switch req.Method {
+		case "startApp":
+			err := StartInstance(instid, cfgdb, rtdb)
+			auditMqtt(id, AuditStart, "app", instid, nil, nil, err)
+			if err != nil {
+				return nil, nil, newCmdErr(http.StatusInternalServerError, "%v", err)
+			}
+		case "stopApp":
+			if !isWorkerRunning(instid) {
+				return nil, nil, newCmdErr(http.StatusNotFound, "worker %s not found", instid)
+			}
+			if instid == id {
+				auditMqtt(id, AuditStop, "app", instid, nil, nil, nil)
+				return result, func() { _ = StopInstance(instid) }, nil
+			}
+			err := StopInstance(instid)
+			auditMqtt(id, AuditStop, "app", instid, nil, nil, err)
+			if err != nil {
+				return nil, nil, newCmdErr(http.StatusNotFound, "%v", err)
+			}
+		case "restartApp":
+			if instid == id {
+				auditMqtt(id, AuditRestart, "app", instid, nil, nil, nil)
+				return result, func() {
+					if err := RestartInstance(instid, cfgdb, rtdb); err != nil {
+						workerLogger(id).Error("重启失败", "err", err)
+					}
+				}, nil
+			}
+			err := RestartInstance(instid, cfgdb, rtdb)
+			auditMqtt(id, AuditRestart, "app", instid, nil, nil, err)
+			if err != nil {
+				return nil, nil, newCmdErr(http.StatusInternalServerError, "%v", err)
+			}
+		}
+		return result, nil, nil
+
+	case "getConfig":
+		if params.InstID != "" {
+			appConfig, err := getAppConfig(cfgdb, params.InstID)
+			if err != nil {
+				return nil, nil, newCmdErr(http.StatusNotFound, "%v", err)
+			}
+			// 与审计日志、配置修订相同，密码和令牌等敏感字段不发送到云端
+			appConfig.Config = maskSecrets(appConfig.Config)
+			return appConfig, nil, nil
+		}
+		values, err := cfgdb.Hash().Items(InstListKey)
+		if err != nil {
+			return nil, nil, newCmdErr(http.StatusInternalServerError, "%v", err)
+		}
+		appConfigs := make(map[string]AppConfig)
+		for key, value := range values {
+			var appConfig AppConfig
+			if erra := json.Unmarshal([]byte(value.String()), &appConfig); erra != nil {
+				continue
+			}
+			appConfig.Config = maskSecrets(appConfig.Config)
+			appConfigs[key] = appConfig
+		}
+		return appConfigs, nil, nil
+
+	case "setConfig":
+		if params.InstID == "" {
+			return nil, nil, newCmdErr(http.StatusBadRequest, "instId is required")
+		}
+		appConfig, err := getAppConfig(cfgdb, params.InstID)
+		if err != nil {
+			return nil, nil, newCmdErr(http.StatusNotFound, "%v", err)
+		}
+		before := appConfig
+		if params.InstName != nil {
+			appConfig.InstName = *params.InstName
+		}
+		if params.AutoStart != nil {
+			appConfig.AutoStart = *params.AutoStart
+		}
+		if params.Config != nil {
+			if _, ok := params.Config.(map[string]any); !ok {
+				return nil, nil, newCmdErr(http.StatusBadRequest, "config must be an object")
+			}
+			// getConfig 返回的 ****** 保持原来的值，云端可以把查询到的配置修改后直接下发
+			appConfig.Config = keepSecrets(params.Config, before.Config)
+		}
+		// 与 REST 接口修改实例相同的检查，deviceList 不能引用不存在的设备
+		if err = checkAppConfig(cfgdb, appConfig); err != nil {
+			return nil, nil, newCmdErr(http.StatusBadRequest, "%v", err)
+		}
+		jsonstr, _ := json.Marshal(appConfig)
+		_, err = cfgdb.Hash().Set(InstListKey, appConfig.InstID, jsonstr)
+		auditMqtt(id, AuditUpdate, "app", appConfig.InstID, before, appConfig, err)
+		if err != nil {
+			return nil, nil, newCmdErr(http.StatusInternalServerError, "%v", err)
+		}
+		publishConfig("app", AuditUpdate, appConfig.InstID)
+		commitRevisionMqtt(id, cfgdb, AuditUpdate, "app", appConfig.InstID)
+		appConfig.Config = maskSecrets(appConfig.Config)
+		return appConfig, nil, nil
+
+	default:
+		return nil, nil, newCmdErr(http.StatusBadRequest, "method '%s' is not supported", req.Method)
+	}
+}
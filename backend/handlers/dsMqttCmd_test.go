@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nalgeon/redka"
+)
+
+// mqttCmdTestDB 返回只有一个 mqttpub 实例的配置库
+func mqttCmdTestDB(t *testing.T) *redka.DB {
+	t.Helper()
+	db, err := redka.Open("file:/"+strings.ReplaceAll(t.Name(), "/", "_")+".db?vfs=memdb", &redka.Options{DriverName: "sqlite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	appConfig := AppConfig{AppCode: "mqttpub", InstID: "m1", InstName: "cloud",
+		Config: map[string]any{"broker": "tcp://127.0.0.1:1883", "username": "gw", "password": "p@ss"}}
+	jsonstr, _ := json.Marshal(appConfig)
+	if _, err = db.Hash().Set(InstListKey, "m1", jsonstr); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMqttCmdConfigSecrets(t *testing.T) {
+	db := mqttCmdTestDB(t)
+	call := func(method string, params any) any {
+		t.Helper()
+		raw, _ := json.Marshal(params)
+		result, _, cmdErr := dispatchMqttCmd("m1", mqttCmdReq{ID: "1", Method: method, Params: raw}, db, nil)
+		if cmdErr != nil {
+			t.Fatalf("%s: %+v", method, cmdErr)
+		}
+		b, _ := json.Marshal(result)
+		var v any
+		_ = json.Unmarshal(b, &v)
+		return v
+	}
+	masked := map[string]any{"broker": "tcp://127.0.0.1:1883", "username": "gw", "password": secretMask}
+
+	tests := []struct {
+		name   string
+		method string
+		params any
+		config func(result any) any
+	}{
+		{"get one", "getConfig", map[string]any{"instId": "m1"}, func(r any) any { return r.(map[string]any)["config"] }},
+		{"get all", "getConfig", map[string]any{}, func(r any) any { return r.(map[string]any)["m1"].(map[string]any)["config"] }},
+		{"set with masked password", "setConfig", map[string]any{"instId": "m1", "config": masked}, func(r any) any { return r.(map[string]any)["config"] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config(call(tt.method, tt.params)); !reflect.DeepEqual(got, masked) {
+				t.Fatalf("config = %#v, want %#v", got, masked)
+			}
+		})
+	}
+
+	// 下发的 ****** 保持原来的密码
+	saved, err := getAppConfig(db, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := saved.Config.(map[string]any)["password"]; password != "p@ss" {
+		t.Fatalf("saved password = %v, want the original one", password)
+	}
+}
+
+func TestValidReplyTo(t *testing.T) {
+	tests := []struct {
+		replyTo string
+		want    bool
+	}{
+		{"", true},
+		{"m1/resp/app1", true},
+		{"m1/resp/app1/req-7", true},
+		{"m1/resp", false},
+		{"m1/resp/", false},
+		{"m1/response", false},
+		{"m1/cmd", false},
+		{"other/topic", false},
+		{"m1/resp/+", false},
+		{"m1/resp/#", false},
+	}
+	for _, tt := range tests {
+		if got := validReplyTo("m1/resp", tt.replyTo); got != tt.want {
+			t.Errorf("validReplyTo(%q) = %v, want %v", tt.replyTo, got, tt.want)
+		}
+	}
+}
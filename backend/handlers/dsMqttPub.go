@@ -3,138 +3,171 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nalgeon/redka"
 )
 
+// 连接断开时缓存的最大报警事件数
+var mqttAlarmBufferSize = 1000
+
+// mqttPubSettings mqttpub 实例的配置，配置变化时整体替换，生产者、消费者和报警协程每次使用时读取
+type mqttPubSettings struct {
+	broker     string
+	port       float64
+	username   string
+	password   string
+	cmdTopic   string
+	respTopic  string
+	alarmTopic string
+	cycle      float64
+	deviceList []string
+	devMap     map[string]DevConfig
+}
+
+// connSig 返回连接参数的签名，变化时重新创建客户端
+func (s *mqttPubSettings) connSig() string {
+	return fmt.Sprint(s.broker, s.port, s.username, s.password, s.cmdTopic, s.respTopic)
+}
+
 // mqttPubData 函数：周期性地读取modbus设备数据
 func mqttPubData(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.DB) {
-	//通过ID(实例ID)获取实例的配置信息
-	appconfig, err := cfgdb.Hash().Get(InstListKey, id)
-	if err != nil {
-		fmt.Printf("database no instid\n")
-		return
-	}
-	configstr := appconfig.String()
-	var newConfig AppConfig
-	err = json.Unmarshal([]byte(configstr), &newConfig)
-	configMap := newConfig.Config
-	fmt.Printf("myConfig %+v\n", configMap)
-	config, ok := configMap.(map[string]any) // 类型断言为 map[string]any
-	if !ok {
-		fmt.Println("configMap is not a map[string]any or does not exist")
-		return
-	}
-	broker, ok := config["broker"].(string)
-	if !ok {
-		fmt.Println("broker is not a string or does not exist")
-	}
-	port, ok := config["port"].(float64)
-	if !ok {
-		fmt.Println("port is not a int or does not exist")
-	}
-	username, ok := config["username"].(string)
-	if !ok {
-		fmt.Println("username is not a int or does not exist")
-	}
-	password, ok := config["password"].(string)
-	if !ok {
-		fmt.Println("password is not a string or does not exist")
-	}
-	cycle, ok := config["cycle"].(float64)
-	if !ok {
-		fmt.Println("cycle is not a string or does not exist")
-	}
-	deviceListany, ok := config["deviceList"].([]any)
-	if !ok {
-		fmt.Println("deviceList is not a []string or does not exist")
-	}
-	fmt.Printf("%+v\n", deviceListany)
-	var deviceList []string
-	if len(deviceListany) != 0 {
-		for _, item := range deviceListany {
-			device, ok := item.(string)
-			if !ok {
-				fmt.Println("deviceList contains non-string values")
-				return
-			}
-			deviceList = append(deviceList, device)
+	logger := workerLogger(id)
+	// 订阅配置变化，周期、设备列表和报警主题原地生效，连接参数变化时重新连接
+	cfgCh := subscribeConfig(id)
+	defer unsubscribeConfig(cfgCh)
+	metrics := metricsOf(id)
+
+	// loadSettings 通过ID(实例ID)获取实例的配置信息和要发布的设备
+	loadSettings := func() (*mqttPubSettings, error) {
+		config, err := loadInstConfig(cfgdb, id)
+		if err != nil {
+			return nil, err
 		}
-	}
-	//fmt.Printf("%+v, %+v, %+v, %+v, %+v, %+v\n", broker, port, username, password, cycle, deviceList)
+		s := &mqttPubSettings{}
+		var ok bool
+		s.broker, ok = config["broker"].(string)
+		if !ok {
+			logger.Warn("broker 不是字符串或不存在")
+		}
+		s.port, ok = config["port"].(float64)
+		if !ok {
+			logger.Warn("port 不是整数或不存在")
+		}
+		s.username, ok = config["username"].(string)
+		if !ok {
+			logger.Warn("username 不是字符串或不存在")
+		}
+		s.password, ok = config["password"].(string)
+		if !ok {
+			logger.Warn("password 不是字符串或不存在")
+		}
+		s.cycle, ok = config["cycle"].(float64)
+		if !ok {
+			logger.Warn("cycle 不是数字或不存在")
+		}
+		// 命令通道主题，未配置时使用实例ID作为前缀
+		s.cmdTopic, _ = config["cmdTopic"].(string)
+		if s.cmdTopic == "" {
+			s.cmdTopic = id + "/cmd"
+		}
+		s.respTopic, _ = config["respTopic"].(string)
+		if s.respTopic == "" {
+			s.respTopic = id + "/resp"
+		}
+		// 报警事件发布主题，未配置时使用 "<instId>/alarm"
+		s.alarmTopic, _ = config["alarmTopic"].(string)
+		if s.alarmTopic == "" {
+			s.alarmTopic = id + "/alarm"
+		}
+		s.deviceList, err = configDeviceList(config)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("MQTT 连接参数", "broker", s.broker, "port", s.port, "username", s.username, "cycle", s.cycle, "deviceList", s.deviceList)
 
-	// 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息
-	devValues, err1 := cfgdb.Hash().Items(DevAtInstKey)
-	if err1 != nil {
-		fmt.Printf("Err: %v\n", err1)
-		return
+		// 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息
+		s.devMap, err = loadDeviceMap(cfgdb, s.deviceList)
+		if err != nil {
+			return nil, fmt.Errorf("获取设备配置信息失败: %v", err)
+		}
+		if len(s.devMap) == 0 {
+			logger.Warn("没有匹配的设备，等待添加设备", "deviceList", s.deviceList)
+		}
+		return s, nil
 	}
-	if len(devValues) == 0 {
-		fmt.Printf("database no any device\n")
-		return
+
+	var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+		logger.Debug("收到消息", "topic", msg.Topic(), "payload", string(msg.Payload()))
 	}
-	devMap := make(map[string]DevConfig)
-	for key, value := range devValues {
-		var newValue DevConfig
-		erra := json.Unmarshal([]byte(value.String()), &newValue)
-		if erra != nil {
-			fmt.Println("Error unmarshalling JSON:", erra)
-			return
-		}
-		fmt.Printf("键: %s, Queryid: %s, InstID: %s\n", key, id, newValue.InstID)
-		if len(deviceList) == 0 {
-			devMap[key] = newValue
-		} else {
-			if ContainsString(deviceList, key) {
-				devMap[key] = newValue
+	// newClient 按连接参数创建客户端，由消费者连接
+	newClient := func(s *mqttPubSettings) mqtt.Client {
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker(fmt.Sprintf("tcp://%s:%d", s.broker, int(s.port)))
+		opts.SetClientID(id)
+		opts.SetUsername(s.username)
+		opts.SetPassword(s.password)
+		opts.SetDefaultPublishHandler(f)
+		// 连接（含自动重连）成功后订阅命令主题
+		cmdHandler := newMqttCmdHandler(id, s.respTopic, cfgdb, rtdb)
+		opts.SetConnectionLostHandler(func(client mqtt.Client, errl error) {
+			logger.Warn("与 MQTT Broker 的连接断开", "err", errl)
+			metrics.setConnected(false)
+		})
+		opts.SetOnConnectHandler(func(client mqtt.Client) {
+			metrics.setConnected(true)
+			token := client.Subscribe(s.cmdTopic, 1, cmdHandler)
+			if token.Wait() && token.Error() != nil {
+				logger.Error("订阅命令主题失败", "topic", s.cmdTopic, "err", token.Error())
+				return
 			}
-		}
+			logger.Info("已订阅命令主题", "cmdTopic", s.cmdTopic, "respTopic", s.respTopic)
+		})
+		return mqtt.NewClient(opts)
 	}
-	if len(devMap) == 0 {
-		fmt.Printf("no match device in %+v\n", deviceList)
+
+	settings, err := loadSettings()
+	if err != nil {
+		logger.Error("读取实例配置失败", "err", err)
 		return
 	}
-
-	var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-		fmt.Printf("TOPIC: %s\n", msg.Topic())
-		fmt.Printf("MSG: %s\n", msg.Payload())
+	mqClient := newClient(settings)
+	var settingsLock sync.Mutex
+	// current 返回当前的配置和客户端
+	current := func() (*mqttPubSettings, mqtt.Client) {
+		settingsLock.Lock()
+		defer settingsLock.Unlock()
+		return settings, mqClient
 	}
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, int(port)))
-	opts.SetClientID(id)
-	opts.SetUsername(username)
-	opts.SetPassword(password)
-	opts.SetDefaultPublishHandler(f)
-	mqClient := mqtt.NewClient(opts)
-	// 通过设备ID获取设备点表信息
 
 	// 创建队列
 	queue := NewDataQueue()
+	metrics.queue.Store(queue)
 	// 生产者goroutine
 	go func() {
 		for {
 			select {
 			case <-stopChan:
-				fmt.Println("生产者收到停止信号，退出")
+				logger.Info("生产者收到停止信号，退出")
 				return
 			default:
+				s, _ := current()
 				if queue.Len() > 1000 {
-					log.Printf("队列长度超过1000，等待消费")
+					logger.Warn("队列长度超过1000，等待消费")
 					time.Sleep(1 * time.Second)
 					continue
 				}
 				OutterMap := make(map[string]map[string][]any)
-				for devkey := range devMap {
+				for devkey := range s.devMap {
 					values, erra := rtdb.Hash().Items(devkey)
 					if erra != nil {
-						log.Printf("Error reading from database: %+v", erra)
+						logger.Error("读取实时数据失败", "devId", devkey, "err", erra)
 						continue
 					}
 					if len(values) == 0 {
-						log.Printf("%+v no value", devkey)
+						logger.Debug("设备没有实时数据", "devId", devkey)
 						continue
 					} else {
 						InnerMap := make(map[string][]any)
@@ -143,7 +176,7 @@ func mqttPubData(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka
 							//fmt.Printf("newValue: %v\n", newValue)
 							errb := json.Unmarshal([]byte(value.String()), &newValue)
 							if errb != nil {
-								fmt.Println("Error unmarshalling JSON:", errb)
+								logger.Error("解析实时数据失败", "devId", devkey, "tagId", key, "err", errb)
 								return
 							}
 							InnerMap[key] = newValue
@@ -154,7 +187,7 @@ func mqttPubData(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka
 				}
 				OutterMapstr, _ := json.Marshal(OutterMap)
 				queue.Enqueue(string(OutterMapstr))
-				time.Sleep(time.Duration(cycle) * time.Second)
+				time.Sleep(time.Duration(s.cycle) * time.Second)
 			}
 		}
 	}()
@@ -164,22 +197,25 @@ func mqttPubData(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka
 		for {
 			select {
 			case <-stopChan:
-				fmt.Println("消费者收到停止信号，退出")
+				logger.Info("消费者收到停止信号，退出")
 				return
 			default:
-				// 检查MQTT连接状态，如果未连接则尝试连接
-				if !mqClient.IsConnected() {
+				s, client := current()
+				// 检查MQTT连接状态，如果未连接则尝试连接，连接参数变化后使用新的客户端
+				if !client.IsConnected() {
 					for {
-						token := mqClient.Connect()
+						token := client.Connect()
 						if token.Wait() && token.Error() == nil {
 							break
 						}
-						log.Printf("Failed to connect to MQTT broker. Retrying... Error: %v\n", token.Error())
-						time.Sleep(5)
-						if _, ok := <-stopChan; ok {
-							mqClient.Disconnect(250)
+						logger.Warn("连接 MQTT Broker 失败，等待后重试", "err", token.Error(), "delay", reconnectDelay)
+						metrics.setConnected(false)
+						select {
+						case <-stopChan:
 							return
+						case <-time.After(reconnectDelay):
 						}
+						s, client = current()
 					}
 				}
 				var datasmap map[string]map[string]any
@@ -187,35 +223,104 @@ func mqttPubData(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka
 					if val, ok := queue.Dequeue(); ok {
 						errc := json.Unmarshal([]byte(val), &datasmap)
 						if errc != nil {
-							fmt.Println("解析失败:", errc)
+							logger.Error("解析队列数据失败", "err", errc)
 							continue
 						}
 						for devkey := range datasmap {
 							pubDatastr, _ := json.Marshal(datasmap[devkey])
-							token := mqClient.Publish(devkey+"/datas", 0, false, pubDatastr)
+							token := client.Publish(devkey+"/datas", 0, false, pubDatastr)
 							// 发布数据到MQTT
-							if token.Wait() && token.Error() != nil {
-								log.Printf("Error publishing to MQTT: %v\n", token.Error())
+							token.Wait()
+							metrics.publishResult(token.Error())
+							if token.Error() != nil {
+								logger.Error("发布数据失败", "devId", devkey, "err", token.Error())
 							} else {
-								fmt.Printf("Published data to MQTT: %s\n", datasmap[devkey])
+								logger.Debug("发布数据成功", "devId", devkey, "topic", devkey+"/datas")
 							}
 						}
 
 					}
 				}
 				if queue.Len() == 0 {
-					time.Sleep(time.Duration(cycle) * time.Second)
+					time.Sleep(time.Duration(s.cycle) * time.Second)
+				}
+			}
+		}
+	}()
+
+	// 报警事件goroutine：发布 deviceList 中设备的报警事件，连接断开时缓存，重连后按顺序补发
+	alarmCh := subscribeAlarms()
+	go func() {
+		defer unsubscribeAlarms(alarmCh)
+		var pending [][]byte
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				return
+			case event := <-alarmCh:
+				s, _ := current()
+				if len(s.deviceList) != 0 && !ContainsString(s.deviceList, event.Alarm.DevID) {
+					continue
+				}
+				payload, _ := json.Marshal(event)
+				pending = append(pending, payload)
+				if len(pending) > mqttAlarmBufferSize {
+					logger.Warn("报警事件缓存已满，丢弃最早的事件", "size", mqttAlarmBufferSize)
+					pending = pending[len(pending)-mqttAlarmBufferSize:]
+				}
+			case <-ticker.C:
+			}
+			s, client := current()
+			for len(pending) > 0 && client.IsConnected() {
+				token := client.Publish(s.alarmTopic, 1, false, pending[0])
+				if token.Wait() && token.Error() != nil {
+					logger.Error("发布报警事件失败", "topic", s.alarmTopic, "err", token.Error())
+					break
 				}
+				pending = pending[1:]
 			}
 		}
 	}()
 
-	// 当前线程处理退出信号
+	// 当前线程处理退出信号和配置变化
 	for {
 		select {
 		case <-stopChan: // 如果收到停止信号，退出循环
-			fmt.Printf("子线程mqttPub实例 %s 收到停止信号，退出\n", id)
+			_, client := current()
+			if client.IsConnected() {
+				client.Disconnect(250)
+			}
+			logger.Info("收到停止信号，退出")
 			return
+		case event := <-cfgCh:
+			if !configNotified(cfgCh, id) && !event.concerns(id) {
+				continue
+			}
+			s, errs := loadSettings()
+			if errs != nil {
+				logger.Error("重新读取实例配置失败，继续使用原配置", "err", errs)
+				continue
+			}
+			// 其他设备或点表的修改不影响本实例时配置不变
+			if fmt.Sprint(*s) == fmt.Sprint(*settings) {
+				continue
+			}
+			settingsLock.Lock()
+			old := mqClient
+			reconnect := s.connSig() != settings.connSig()
+			if reconnect {
+				mqClient = newClient(s)
+			}
+			settings = s
+			settingsLock.Unlock()
+			if reconnect {
+				logger.Info("连接参数变化，重新连接")
+				if old.IsConnected() {
+					old.Disconnect(250)
+				}
+			}
 		}
 	}
 }
@@ -3,152 +3,162 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nalgeon/redka"
+	"github.com/taosdata/driver-go/v3/common"
+	"github.com/taosdata/driver-go/v3/common/param"
+	taosErrors "github.com/taosdata/driver-go/v3/errors"
 	_ "github.com/taosdata/driver-go/v3/taosWS"
+	"github.com/taosdata/driver-go/v3/ws/stmt"
 )
 
+// taosSettings dsTDengine 实例的配置，配置变化时整体替换
+type taosSettings struct {
+	conn        taosConnInfo
+	database    string
+	tbType      string // 建表方式：table 每个点一张普通表，stable 每种设备类型一张超级表、每个设备一张子表
+	cycle       float64
+	batchCycles float64 // 每次写入合并的周期数，数据库断开期间积压的数据也按此批量补写
+	deviceList  []string
+}
+
+// connSig 返回连接参数和建表方式的签名，变化时重新连接
+func (s *taosSettings) connSig() string {
+	return fmt.Sprint(s.conn, s.database, s.tbType)
+}
+
 // dsTDengine 函数：周期性地读取 redka 数据并写入TDengine
 func dsTDengine(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.DB) {
-	//通过ID(实例ID)获取实例的配置信息
-	appconfig, err := cfgdb.Hash().Get(InstListKey, id)
-	if err != nil {
-		fmt.Printf("database no instid\n")
-		return
-	}
-	configstr := appconfig.String()
-	var newConfig AppConfig
-	err = json.Unmarshal([]byte(configstr), &newConfig)
-	configMap := newConfig.Config
-	fmt.Printf("myConfig %+v\n", configMap)
-	config, ok := configMap.(map[string]any) // 类型断言为 map[string]any
-	if !ok {
-		fmt.Println("configMap is not a map[string]any or does not exist")
-		return
-	}
+	logger := workerLogger(id)
+	// 订阅配置变化，周期和设备列表原地生效，连接参数或建表方式变化时重新连接
+	cfgCh := subscribeConfig(id)
+	defer unsubscribeConfig(cfgCh)
+	metrics := metricsOf(id)
+	var cfgChanged atomic.Bool // 收到配置变化，消费者下次写入前检查设备和点表
 
-	// 获取TDengine连接配置
-	host, ok := config["host"].(string)
-	if !ok {
-		fmt.Println("host is not a string or does not exist")
-		return
-	}
-	port, ok := config["port"].(float64)
-	if !ok {
-		fmt.Println("port is not a number or does not exist")
-		return
-	}
-	username, ok := config["username"].(string)
-	if !ok {
-		fmt.Println("username is not a string or does not exist")
-		return
-	}
-	password, ok := config["password"].(string)
-	if !ok {
-		fmt.Println("password is not a string or does not exist")
-		return
-	}
-	database, ok := config["database"].(string)
-	if !ok {
-		fmt.Println("database is not a string or does not exist")
-		return
-	}
-	cycle, ok := config["cycle"].(float64)
-	if !ok {
-		fmt.Println("cycle is not a number or does not exist")
-		cycle = 5 // 默认5秒
-	}
+	// loadSettings 通过ID(实例ID)获取实例的配置信息
+	loadSettings := func() (*taosSettings, error) {
+		config, err := loadInstConfig(cfgdb, id)
+		if err != nil {
+			return nil, err
+		}
+		s := &taosSettings{}
 
-	//taosTbType, ok := config["tbType"].(string)
-	//if !ok {
-	//	fmt.Println("tbType is not a string or does not exist")
-	//}
+		// 获取TDengine连接配置
+		host, ok := config["host"].(string)
+		if !ok {
+			return nil, fmt.Errorf("host 不是字符串或不存在")
+		}
+		port, ok := config["port"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("port 不是数字或不存在")
+		}
+		username, ok := config["username"].(string)
+		if !ok {
+			return nil, fmt.Errorf("username 不是字符串或不存在")
+		}
+		password, ok := config["password"].(string)
+		if !ok {
+			return nil, fmt.Errorf("password 不是字符串或不存在")
+		}
+		s.database, ok = config["database"].(string)
+		if !ok {
+			return nil, fmt.Errorf("database 不是字符串或不存在")
+		}
+		// TDengine 连接信息
+		s.conn = taosConnInfo{host: host, port: int(port), username: username, password: password}
+		s.cycle, ok = config["cycle"].(float64)
+		if !ok {
+			logger.Warn("cycle 不是数字或不存在，使用默认值", "cycle", 5)
+			s.cycle = 5 // 默认5秒
+		}
 
-	deviceListany, ok := config["deviceList"].([]any)
-	if !ok {
-		fmt.Println("deviceList is not a []string or does not exist")
-	}
+		s.batchCycles, ok = config["batchCycles"].(float64)
+		if !ok || s.batchCycles < 1 {
+			s.batchCycles = 1
+		}
 
-	var deviceList []string
-	if len(deviceListany) != 0 {
-		for _, item := range deviceListany {
-			device, ok := item.(string)
-			if !ok {
-				fmt.Println("deviceList contains non-string values")
-				return
-			}
-			deviceList = append(deviceList, device)
+		s.tbType, ok = config["tbType"].(string)
+		if !ok || s.tbType == "" {
+			s.tbType = "table"
+		}
+		if s.tbType != "table" && s.tbType != "stable" {
+			logger.Warn("不支持的 tbType，使用 table", "tbType", s.tbType)
+			s.tbType = "table"
 		}
-	}
 
-	// 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息
-	devValues, err1 := cfgdb.Hash().Items(DevAtInstKey)
-	if err1 != nil {
-		fmt.Printf("Err: %v\n", err1)
-		return
+		s.deviceList, err = configDeviceList(config)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
 	}
-	if len(devValues) == 0 {
-		fmt.Printf("database no any device\n")
+	settings, err := loadSettings()
+	if err != nil {
+		logger.Error("读取实例配置失败", "err", err)
 		return
 	}
-
-	devMap := make(map[string]DevConfig)
-	for key, value := range devValues {
-		var newValue DevConfig
-		erra := json.Unmarshal([]byte(value.String()), &newValue)
-		if erra != nil {
-			fmt.Println("Error unmarshalling JSON:", erra)
-			return
-		}
-		fmt.Printf("键: %s, Queryid: %s, InstID: %s\n", key, id, newValue.InstID)
-		if len(deviceList) == 0 {
-			devMap[key] = newValue
-		} else {
-			if ContainsString(deviceList, key) {
-				devMap[key] = newValue
-			}
-		}
+	var settingsLock sync.Mutex
+	// current 返回当前的配置
+	current := func() *taosSettings {
+		settingsLock.Lock()
+		defer settingsLock.Unlock()
+		return settings
 	}
 
-	if len(devMap) == 0 {
-		fmt.Printf("no match device in %+v\n", deviceList)
+	// deviceList 为空时写入所有设备，设备和点表在运行中变化时自动跟随
+	devMap, err1 := loadDeviceMap(cfgdb, settings.deviceList)
+	if err1 != nil {
+		logger.Error("获取设备配置信息失败", "err", err1)
 		return
+	}
+	if len(devMap) == 0 {
+		logger.Warn("没有匹配的设备，等待添加设备", "deviceList", settings.deviceList)
 	} else {
-		fmt.Printf("match device in %+v\n", deviceList)
+		logger.Info("匹配的设备", "deviceList", settings.deviceList)
 	}
 
-	// 构建TDengine连接DSN
-	taosDSN := fmt.Sprintf("%s:%s@ws(%s:%d)/", username, password, host, int(port))
-
 	// 创建队列
 	queue := NewDataQueue()
+	metrics.queue.Store(queue)
 
 	// 生产者goroutine - 从redka读取数据
 	go func() {
 		for {
 			select {
 			case <-stopChan:
-				fmt.Println("生产者收到停止信号，退出")
+				logger.Info("生产者收到停止信号，退出")
 				return
 			default:
+				s := current()
 				if queue.Len() > 1000 {
-					log.Printf("队列长度超过1000，等待消费")
+					logger.Warn("队列长度超过1000，等待消费")
 					time.Sleep(1 * time.Second)
 					continue
 				}
+				// 每个周期重新读取设备列表，新增的设备随之写入
+				devMap, erra := loadDeviceMap(cfgdb, s.deviceList)
+				if erra != nil {
+					logger.Error("获取设备配置信息失败", "err", erra)
+				}
 				OutterMap := make(map[string]map[string][]any)
 				for devkey := range devMap {
 					values, erra := rtdb.Hash().Items(devkey)
 					if erra != nil {
-						log.Printf("Error reading from database: %v", erra)
+						logger.Error("读取实时数据失败", "devId", devkey, "err", erra)
 						continue
 					}
 					if len(values) == 0 {
-						log.Printf("%+v no value", devkey)
+						logger.Debug("设备没有实时数据", "devId", devkey)
 						continue
 					} else {
 						InnerMap := make(map[string][]any)
@@ -156,7 +166,7 @@ func dsTDengine(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 							var newValue []any
 							errb := json.Unmarshal([]byte(value.String()), &newValue)
 							if errb != nil {
-								fmt.Println("Error unmarshalling JSON:", errb)
+								logger.Error("解析实时数据失败", "devId", devkey, "tagId", key, "err", errb)
 								return
 							}
 							InnerMap[key] = newValue
@@ -166,234 +176,913 @@ func dsTDengine(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 				}
 				OutterMapstr, _ := json.Marshal(OutterMap)
 				queue.Enqueue(string(OutterMapstr))
-				time.Sleep(time.Duration(cycle) * time.Second)
+				time.Sleep(time.Duration(s.cycle) * time.Second)
 			}
 		}
 	}()
 
-	// 消费者goroutine - 写入TDengine
+	// 消费者goroutine - 通过参数绑定接口批量写入TDengine
 	go func() {
-		var db *sql.DB
+		var writer *taosWriter
 		var err error
-
-		// 连接TDengine
-		connectTDengine := func() bool {
-			if db != nil {
-				db.Close()
-			}
-			log.Printf("taosDSN: %v", taosDSN)
-			db, err = sql.Open("taosWS", taosDSN)
-			if err != nil {
-				log.Printf("Failed to connect to TDengine: %v", err)
-				return false
-			}
-
-			// 测试连接
-			err = db.Ping()
-			if err != nil {
-				log.Printf("Failed to ping TDengine: %v", err)
-				return false
-			}
-			log.Printf("Connected to TDengine successfully")
-			// create database
-			_, err := db.Exec("CREATE DATABASE IF NOT EXISTS " + database)
-			if err != nil {
-				log.Printf("Failed to create database %v, ErrMessage: %v", database, err.Error())
-			}
-			// 选择数据库
-			_, err = db.Exec("USE " + database)
-			if err != nil {
-				log.Printf("Failed to select database %v: %v", database, err)
-				return false
-			}
-			log.Printf("Database %v selected successfully", database)
-
-			for _, v := range deviceList {
-				values, _ := cfgdb.Hash().Items(v)
-				newtag := make(map[string][]any)
-				for key, value := range values {
-					var newValue []any
-					erra := json.Unmarshal([]byte(value.String()), &newValue)
-					if erra != nil {
-						fmt.Println("Error unmarshalling JSON:", erra)
-						break
-					}
-					newtag[key] = newValue
-				}
-				sqlstrs := CreateTableSQL(v, newtag)
-				for _, sqlstr := range sqlstrs {
-					log.Printf("sqlstr: %v", sqlstr)
-					// create table
-					_, err = db.Exec(sqlstr)
-					if err != nil {
-						log.Println("Failed to create table ErrMessage: " + err.Error())
-						return false
-					}
-				}
-			}
-
-			return true
-		}
-
-		// 初始连接
-		if !connectTDengine() {
-			log.Println("Initial connection to TDengine failed, will retry...")
-		}
+		writerSig := "" // 创建 writer 时的连接参数签名
+		// 待写入的周期数据，写入失败（连接错误）时保留，重连后重试
+		var pending []map[string]map[string][]any
+		lastFlush := time.Now()
 
 		defer func() {
-			if db != nil {
-				db.Close()
+			if writer != nil {
+				writer.Close()
 			}
 		}()
 
 		for {
 			select {
 			case <-stopChan:
-				fmt.Println("消费者收到停止信号，退出")
+				logger.Info("消费者收到停止信号，退出")
 				return
 			default:
+				s := current()
+				flushInterval := time.Duration(s.cycle*s.batchCycles) * time.Second
+				// 连接参数或建表方式变化时关闭原连接，待写入的数据使用新连接写入
+				if writer != nil && s.connSig() != writerSig {
+					logger.Info("连接参数变化，重新连接")
+					writer.Close()
+					writer = nil
+				}
 				// 如果没有连接，尝试重连
-				if db == nil {
-					if !connectTDengine() {
-						time.Sleep(5 * time.Second)
+				if writer == nil {
+					writer, err = newTaosWriter(s.conn, s.database, s.tbType, cfgdb, s.deviceList, logger)
+					if err != nil {
+						logger.Warn("连接 TDengine 失败，等待后重试", "err", err, "delay", reconnectDelay)
+						metrics.setConnected(false)
+						writer = nil
+						time.Sleep(reconnectDelay)
 						continue
 					}
+					writerSig = s.connSig()
+					metrics.setConnected(true)
+				}
+				// 收到配置变化（包括设备列表变化）后由 refresh 按新的设备和点表建表
+				writer.deviceList = s.deviceList
+				if cfgChanged.Swap(false) {
+					writer.dirty = true
 				}
 
-				// 处理队列中的数据
-				for queue.Len() > 0 {
-					if val, ok := queue.Dequeue(); ok {
-						//log.Printf("从队列中取出数据: %s", val) // 新增日志，确认队列数据
-						var datasmap map[string]map[string][]any
-						errc := json.Unmarshal([]byte(val), &datasmap)
-						if errc != nil {
-							fmt.Println("解析失败:", errc)
-							continue
-						}
-
-						// 检查 datasmap 是否为空
-						if len(datasmap) == 0 {
-							log.Println("解析后的设备数据为空，跳过处理")
-							continue
-						}
+				// 从队列中取出数据，每次最多合并 batchCycles 个周期
+				for len(pending) < int(s.batchCycles) && queue.Len() > 0 {
+					val, ok := queue.Dequeue()
+					if !ok {
+						logger.Error("队列数据取出失败")
+						break
+					}
+					var datasmap map[string]map[string][]any
+					errc := json.Unmarshal([]byte(val), &datasmap)
+					if errc != nil {
+						logger.Error("解析队列数据失败", "err", errc)
+						continue
+					}
+					// 检查 datasmap 是否为空
+					if len(datasmap) == 0 {
+						continue
+					}
+					pending = append(pending, datasmap)
+				}
 
-						// 遍历设备数据
-						for devkey, deviceData := range datasmap {
-							//log.Printf("处理设备数据 - devkey: %s, deviceData: %+v", devkey, deviceData) // 新增日志，确认设备数据
-							err := WriteTable(db, devkey, deviceData)
-							if err != nil {
-								log.Printf("写入 TDengine 失败: %v", err)
-								continue
-							}
-						}
-					} else {
-						log.Println("队列数据取出失败")
+				if len(pending) > 0 && (len(pending) >= int(s.batchCycles) || time.Since(lastFlush) >= flushInterval) {
+					errw := writer.Write(pending)
+					metrics.publishResult(errw)
+					if errw != nil {
+						// 连接错误：关闭连接，保留数据等待重连后重试
+						logger.Error("写入 TDengine 失败", "err", errw)
+						metrics.setConnected(false)
+						writer.Close()
+						writer = nil
+						continue
 					}
+					pending = nil
+					lastFlush = time.Now()
 				}
 				if queue.Len() == 0 {
-					time.Sleep(time.Duration(cycle) * time.Second)
+					time.Sleep(time.Duration(s.cycle) * time.Second)
 				}
 			}
 		}
 	}()
 
-	// 当前线程处理退出信号
+	// 当前线程处理退出信号和配置变化
 	for {
 		select {
 		case <-stopChan: // 如果收到停止信号，退出循环
-			fmt.Printf("子线程tdengine实例 %s 收到停止信号，退出\n", id)
+			logger.Info("收到停止信号，退出")
 			return
+		case event := <-cfgCh:
+			if !configNotified(cfgCh, id) && !event.concerns(id) {
+				continue
+			}
+			// 设备和点表的变化由消费者在下次写入前检查
+			cfgChanged.Store(true)
+			s, errs := loadSettings()
+			if errs != nil {
+				logger.Error("重新读取实例配置失败，继续使用原配置", "err", errs)
+				continue
+			}
+			// 其他设备或点表的修改不影响本实例时配置不变
+			if fmt.Sprint(*s) == fmt.Sprint(*settings) {
+				continue
+			}
+			settingsLock.Lock()
+			settings = s
+			settingsLock.Unlock()
+			logger.Info("实例配置已重新加载", "deviceList", s.deviceList, "cycle", s.cycle)
 		}
 	}
 }
 
-// 构建创建超级表的 SQL 语句
-func CreateSuperTableSQL(tableName, devType string, fields map[string][]any) string {
-	// 定义字段映射关系（JSON 数据类型 -> TDengine 数据类型）
-	typeMapping := map[string]string{
-		"float":  "float",
-		"bool":   "bool",
-		"int":    "int",
-		"string": "varchar(64)",
-	}
+// 定义字段映射关系（点表数据类型 -> TDengine 数据类型）
+var taosTypeMapping = map[string]string{
+	"float":  "float",
+	"double": "double",
+	"bool":   "bool",
+	"int":    "int",
+	"string": "varchar(64)",
+}
+
+// 数据质量列：普通表为 q 列，超级表为每个点对应的 <列名>_q 列
+var taosQualityType = taosTypeMapping["string"]
+
+// qualityColumn 返回超级表中点对应的质量列名
+func qualityColumn(col string) string {
+	return col + "_q"
+}
+
+// superTableName 按设备类型生成超级表名
+func superTableName(devType string) string {
+	return "st_" + ReplaceChars(devType, "_")
+}
+
+// 构建创建超级表的 SQL 语句，fields 为 列名 -> TDengine 数据类型
+func CreateSuperTableSQL(stbName string, fields map[string]string) string {
 	// 构建字段部分
 	var fieldParts []string
 	fieldParts = append(fieldParts, "ts timestamp") // 固定字段
-	for fieldName, fieldInfo := range fields {
-		//info := fieldInfo.([]any)
-		dataType := fieldInfo[2].(string) // 获取数据类型
-		tdengineType := typeMapping[dataType]
-		fieldParts = append(fieldParts, fmt.Sprintf("%s %s", fieldName, tdengineType))
+	for fieldName, tdengineType := range fields {
+		fieldParts = append(fieldParts, fmt.Sprintf("`%s` %s", fieldName, tdengineType))
 	}
 	// 构建 TAGS 部分
-	tagsPart := fmt.Sprintf("dev_id varchar(64)")
+	tagsPart := "dev_id varchar(64), dev_name nchar(64), inst_id varchar(64)"
 	// 拼接完整的 SQL 语句
 	sqlexc := fmt.Sprintf(
-		"CREATE STABLE IF NOT EXISTS %s(\n    %s\n) TAGS (\n    %s\n);",
-		devType,
+		"CREATE STABLE IF NOT EXISTS `%s`(\n    %s\n) TAGS (\n    %s\n);",
+		stbName,
 		strings.Join(fieldParts, ",\n    "),
 		tagsPart,
 	)
 	return sqlexc
 }
 
-// 构建创建普通表的 SQL 语句
-func CreateTableSQL(devid string, fields map[string][]any) []string {
-	// 定义字段映射关系（JSON 数据类型 -> TDengine 数据类型）
-	typeMapping := map[string]string{
-		"float":  "float",
-		"bool":   "bool",
-		"int":    "int",
-		"string": "varchar(64)",
+// 构建设备子表的 SQL 语句，标签为设备ID、设备名称和实例ID
+func CreateSubTableSQL(tbName string, stbName string, dev DevConfig) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS `%s` USING `%s` TAGS ('%s', '%s', '%s');",
+		tbName,
+		stbName,
+		strings.ReplaceAll(dev.DevID, "'", "''"),
+		strings.ReplaceAll(dev.DevName, "'", "''"),
+		strings.ReplaceAll(dev.InstID, "'", "''"),
+	)
+}
+
+// taosSubTable 已存在的子表所属的超级表和标签值
+type taosSubTable struct {
+	stable string
+	tags   map[string]string
+}
+
+// loadSubTables 查询数据库中已存在的子表，返回 子表名 -> 所属超级表和标签值
+func loadSubTables(db *sql.DB, database string) (map[string]taosSubTable, error) {
+	rows, err := db.Query(fmt.Sprintf(
+		"SELECT table_name, stable_name, tag_name, tag_value FROM information_schema.ins_tags WHERE db_name = '%s'",
+		strings.ReplaceAll(strings.ToLower(database), "'", "''")))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make(map[string]taosSubTable)
+	for rows.Next() {
+		var tbName, stbName, tagName, tagValue sql.NullString
+		if err := rows.Scan(&tbName, &stbName, &tagName, &tagValue); err != nil {
+			return nil, err
+		}
+		tb, ok := tables[tbName.String]
+		if !ok {
+			tb = taosSubTable{stable: stbName.String, tags: make(map[string]string)}
+			tables[tbName.String] = tb
+		}
+		tb.tags[tagName.String] = tagValue.String
+	}
+	return tables, rows.Err()
+}
+
+// subTableName 设备子表名默认为设备ID。设备类型修改后原子表仍属于旧的超级表，
+// TDengine 不能修改子表所属的超级表，为保留历史数据改用 设备ID_设备类型 作为新子表名
+func subTableName(dev DevConfig, existing map[string]taosSubTable) (string, error) {
+	stbName := superTableName(dev.DevType)
+	tbName := ReplaceChars(dev.DevID, "_")
+	if tb, ok := existing[tbName]; !ok || tb.stable == stbName {
+		return tbName, nil
+	}
+	altName := ReplaceChars(dev.DevID+"_"+dev.DevType, "_")
+	if tb, ok := existing[altName]; ok && tb.stable != stbName {
+		return "", fmt.Errorf("sub table %s belongs to stable %s", altName, tb.stable)
+	}
+	return altName, nil
+}
+
+// subTableTagSQL 设备名称或实例修改后子表标签不会随写入更新，返回修改标签的 SQL 语句
+func subTableTagSQL(tbName string, tb taosSubTable, dev DevConfig) []string {
+	var sqls []string
+	for _, tag := range []struct{ name, value string }{{"dev_name", dev.DevName}, {"inst_id", dev.InstID}} {
+		if tb.tags[tag.name] == tag.value {
+			continue
+		}
+		sqls = append(sqls, fmt.Sprintf("ALTER TABLE `%s` SET TAG %s = '%s'",
+			tbName, tag.name, strings.ReplaceAll(tag.value, "'", "''")))
+	}
+	return sqls
+}
+
+// devTagFields 读取设备点表，返回 列名 -> TDengine 数据类型
+func devTagFields(cfgdb *redka.DB, dev DevConfig) map[string]string {
+	fields := make(map[string]string)
+	values, err := cfgdb.Hash().Items(dev.DevID)
+	if err != nil {
+		log.Printf("Failed to read tags of %s: %v", dev.DevID, err)
+		return fields
+	}
+	for key, value := range values {
+		var tag []any
+		erra := json.Unmarshal([]byte(value.String()), &tag)
+		if erra != nil {
+			log.Printf("Error unmarshalling tag %s of %s: %v", key, dev.DevID, erra)
+			continue
+		}
+		dataType := tagDataType(dev.InstID, tag)
+		// 换算后的工程量是小数，整数和浮点数的点按 double 保存，避免截断或丢失精度
+		if eu, errp := parseTagEU(tag); errp == nil && eu != nil && eu.scales() && isTaosNumeric(taosTypeMapping[dataType]) {
+			dataType = "double"
+		}
+		tdengineType, ok := taosTypeMapping[dataType]
+		if !ok {
+			tdengineType = taosTypeMapping["string"]
+		}
+		fields[ReplaceChars(key, "_")] = tdengineType
+	}
+	// 通讯状态伪点
+	fields[CommStatusTag] = taosTypeMapping["string"]
+	return fields
+}
+
+// isTaosNumeric 是否为数值列类型
+func isTaosNumeric(tdengineType string) bool {
+	return tdengineType == "int" || tdengineType == "float" || tdengineType == "double"
+}
+
+// widerTaosType 合并同一列的两种类型，数值类型取精度高的，用于同一设备类型的设备点表不一致时
+func widerTaosType(a string, b string) string {
+	if a == "" || !isTaosNumeric(a) || !isTaosNumeric(b) {
+		return b
+	}
+	rank := map[string]int{"int": 0, "float": 1, "double": 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// existingColumnType 已存在的数值列类型与点表不一致时返回已存在的类型，写入时按该类型绑定。
+// TDengine 不能修改数值列的类型，点改为换算后需要手工删除旧列（普通表为旧表）才会按 double 重建
+func existingColumnType(existing map[string]string, col string, tdengineType string, tbName string, logger *slog.Logger) string {
+	colType, ok := existing[col]
+	if !ok || colType == tdengineType || !isTaosNumeric(colType) || !isTaosNumeric(tdengineType) {
+		return tdengineType
+	}
+	logger.Warn("TDengine 列类型与点表不一致，按已存在的类型写入", "table", tbName, "column", col, "type", colType, "want", tdengineType)
+	return colType
+}
+
+// describeColumns 查询表结构，返回已存在的列名 -> 小写的列类型
+func describeColumns(db *sql.DB, tbName string) (map[string]string, error) {
+	rows, err := db.Query(fmt.Sprintf("DESCRIBE `%s`", tbName))
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]string)
+	for rows.Next() {
+		row := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		colType := ""
+		if len(row) > 1 {
+			colType = strings.ToLower(fmt.Sprintf("%s", row[1]))
+		}
+		columns[fmt.Sprintf("%s", row[0])] = colType
+	}
+	return columns, rows.Err()
+}
+
+// ensureSuperTables 按设备类型创建超级表和设备子表，点表中新增的点自动增加为超级表的列，
+// fields 为 设备ID -> 列名 -> TDengine 数据类型，已存在的列类型不一致时改为已存在的类型。
+// 返回 设备ID -> 子表名，已存在的子表标签与设备配置不一致时修改标签
+func ensureSuperTables(db *sql.DB, database string, devMap map[string]DevConfig, fields map[string]map[string]string, logger *slog.Logger) (map[string]string, error) {
+	// 同一设备类型的所有设备点合并为超级表的列
+	stbFields := make(map[string]map[string]string)
+	for devkey, dev := range devMap {
+		stbName := superTableName(dev.DevType)
+		if stbFields[stbName] == nil {
+			stbFields[stbName] = make(map[string]string)
+		}
+		for col, tdengineType := range fields[devkey] {
+			stbFields[stbName][col] = widerTaosType(stbFields[stbName][col], tdengineType)
+			stbFields[stbName][qualityColumn(col)] = taosQualityType
+		}
+	}
+	for stbName, cols := range stbFields {
+		sqlstr := CreateSuperTableSQL(stbName, cols)
+		logger.Debug("执行 SQL", "sql", sqlstr)
+		if _, err := db.Exec(sqlstr); err != nil {
+			return nil, fmt.Errorf("create stable %s: %w", stbName, err)
+		}
+		existing, err := describeColumns(db, stbName)
+		if err != nil {
+			return nil, fmt.Errorf("describe stable %s: %w", stbName, err)
+		}
+		for col, tdengineType := range cols {
+			if _, ok := existing[col]; ok {
+				cols[col] = existingColumnType(existing, col, tdengineType, stbName, logger)
+				continue
+			}
+			sqlstr = fmt.Sprintf("ALTER STABLE `%s` ADD COLUMN `%s` %s", stbName, col, tdengineType)
+			logger.Debug("执行 SQL", "sql", sqlstr)
+			if _, err := db.Exec(sqlstr); err != nil {
+				return nil, fmt.Errorf("alter stable %s: %w", stbName, err)
+			}
+		}
+	}
+	// 同一超级表的设备按超级表的列类型写入
+	for devkey, dev := range devMap {
+		cols := stbFields[superTableName(dev.DevType)]
+		for col := range fields[devkey] {
+			fields[devkey][col] = cols[col]
+		}
+	}
+	existing, err := loadSubTables(db, database)
+	if err != nil {
+		return nil, fmt.Errorf("query sub tables: %w", err)
+	}
+	subTables := make(map[string]string)
+	for devkey, dev := range devMap {
+		tbName, err := subTableName(dev, existing)
+		if err != nil {
+			return nil, err
+		}
+		if tbName != ReplaceChars(dev.DevID, "_") {
+			logger.Warn("设备类型已修改，写入新的子表", "device", dev.DevID, "table", tbName, "stable", superTableName(dev.DevType))
+		}
+		subTables[devkey] = tbName
+		tb, ok := existing[tbName]
+		if !ok {
+			sqlstr := CreateSubTableSQL(tbName, superTableName(dev.DevType), dev)
+			logger.Debug("执行 SQL", "sql", sqlstr)
+			if _, err := db.Exec(sqlstr); err != nil {
+				return nil, fmt.Errorf("create sub table %s: %w", tbName, err)
+			}
+			continue
+		}
+		for _, sqlstr := range subTableTagSQL(tbName, tb, dev) {
+			logger.Debug("执行 SQL", "sql", sqlstr)
+			if _, err := db.Exec(sqlstr); err != nil {
+				return nil, fmt.Errorf("alter sub table %s: %w", tbName, err)
+			}
+		}
+	}
+	return subTables, nil
+}
+
+// 构建创建普通表的 SQL 语句，每个点一张表，fields 为 列名 -> TDengine 数据类型
+func CreateTableSQL(devid string, fields map[string]string) []string {
 	// 构建 SQL 语句
 	var sqlParts []string
-	for tableName, fieldInfo := range fields {
-		//info := fieldInfo.([]any)
-		tableName = ReplaceChars(tableName, "_")
-		dataType := fieldInfo[2].(string) // 获取数据类型
-		tdengineType := typeMapping[dataType]
+	for tableName, tdengineType := range fields {
 		sqlexc := fmt.Sprintf(
-			"CREATE TABLE IF NOT EXISTS %s(\n    ts timestamp,\n    v %s\n);",
+			"CREATE TABLE IF NOT EXISTS %s(\n    ts timestamp,\n    v %s,\n    q %s\n);",
 			devid+"_"+tableName,
 			tdengineType,
+			taosQualityType,
 		)
 		sqlParts = append(sqlParts, sqlexc)
 	}
 	return sqlParts
 }
 
-// 写入数据到 TDengine 普通表
-func WriteTable(db *sql.DB, devid string, data map[string][]any) error {
-	var sqlBuilder strings.Builder
-	// 遍历 JSON 数据
-	for tableName, values := range data {
-		// 解析值
-		tableName = ReplaceChars(tableName, "_")
-		v := values[1] // 值
-		tsFloat := values[2].(float64)
-		var tsInt = int64(tsFloat)
-		// 判断时间戳单位
-		if tsInt <= 1e12 { // 毫秒级时间戳（13位）
-			tsInt = tsInt * 1000
+// ensureTables 为每个设备点创建普通表，fields 为 设备ID -> 列名 -> TDengine 数据类型，
+// 已存在的表值列类型不一致时改为已存在的类型
+func ensureTables(db *sql.DB, fields map[string]map[string]string, logger *slog.Logger) error {
+	for devkey, cols := range fields {
+		for _, sqlstr := range CreateTableSQL(devkey, cols) {
+			logger.Debug("执行 SQL", "sql", sqlstr)
+			if _, err := db.Exec(sqlstr); err != nil {
+				return fmt.Errorf("create table: %w", err)
+			}
 		}
+		// 早期创建的表没有质量列
+		for col, tdengineType := range cols {
+			// 普通表建表时表名未加反引号，TDengine 中保存为小写
+			tbName := strings.ToLower(devkey + "_" + col)
+			existing, err := describeColumns(db, tbName)
+			if err != nil {
+				return fmt.Errorf("describe table %s: %w", tbName, err)
+			}
+			cols[col] = existingColumnType(existing, "v", tdengineType, tbName, logger)
+			if _, ok := existing["q"]; ok {
+				continue
+			}
+			sqlstr := fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN q %s", tbName, taosQualityType)
+			logger.Debug("执行 SQL", "sql", sqlstr)
+			if _, err = db.Exec(sqlstr); err != nil {
+				return fmt.Errorf("alter table %s: %w", tbName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// 定义 TDengine 连接信息
+type taosConnInfo struct {
+	host     string
+	port     int
+	username string
+	password string
+}
+
+// TDengine 写入错误分类
+const (
+	taosErrConn    = iota // 连接错误：保留数据，重连后重试
+	taosErrNoTable        // 表不存在
+	taosErrData           // 数据或表结构错误：丢弃该表本批数据
+)
+
+// classifyTaosErr 根据 TDengine 错误码对写入错误分类
+func classifyTaosErr(err error) int {
+	var taosErr *taosErrors.TaosError
+	if !errors.As(err, &taosErr) {
+		// 非 TDengine 返回的错误（网络断开、超时等）按连接错误处理
+		return taosErrConn
+	}
+	switch taosErr.Code {
+	case 0x000B, 0x0013, 0x0015, 0x020B: // 网络不可用、连接断开、超时、无效连接
+		return taosErrConn
+	case 0x0603, 0x2603, 0x2662: // Table does not exist
+		return taosErrNoTable
+	default:
+		return taosErrData
+	}
+}
+
+// 定义一张表本批次待写入的数据
+type taosTable struct {
+	name     string            // 表名
+	insert   string            // 参数绑定插入语句
+	cols     []string          // 数据列，不含 ts
+	types    []string          // 数据列的 TDengine 类型
+	tags     *param.Param      // 子表标签值（超级表模式）
+	tagTypes *param.ColumnType // 子表标签类型（超级表模式）
+	rows     map[int64][]any   // 毫秒时间戳 -> 各列的值
+}
+
+// taosWriter 通过 taosWS 的参数绑定(stmt)接口写入 TDengine，时间戳精度为毫秒
+type taosWriter struct {
+	db         *sql.DB                      // 用于建库建表等 DDL
+	connector  *stmt.Connector              // 用于参数绑定写入
+	stmts      map[string]*stmt.Stmt        // 按插入语句缓存的 stmt
+	database   string                       // 写入的数据库
+	tbType     string                       // table 或 stable
+	cfgdb      *redka.DB                    // 配置数据库，用于跟随设备和点表的变化
+	deviceList []string                     // 配置的设备列表，为空表示所有设备
+	signature  string                       // 上次建表时设备和点表的签名
+	devMap     map[string]DevConfig         // 写入的设备
+	fields     map[string]map[string]string // 设备ID -> 列名 -> TDengine 类型
+	subTables  map[string]string            // 设备ID -> 子表名（超级表模式）
+	dirty      bool                         // 设备或点表可能已变化，下次写入前检查并建表
+	logger     *slog.Logger                 // 所属实例的日志
+}
+
+// newTaosWriter 连接 TDengine，创建数据库和表，并建立参数绑定写入连接
+func newTaosWriter(conn taosConnInfo, database string, tbType string, cfgdb *redka.DB, deviceList []string, logger *slog.Logger) (*taosWriter, error) {
+	taosDSN := fmt.Sprintf("%s:%s@ws(%s:%d)/", conn.username, conn.password, conn.host, conn.port)
+	db, err := sql.Open("taosWS", taosDSN)
+	if err != nil {
+		return nil, err
+	}
+	w := &taosWriter{
+		db:         db,
+		stmts:      make(map[string]*stmt.Stmt),
+		database:   database,
+		tbType:     tbType,
+		cfgdb:      cfgdb,
+		deviceList: deviceList,
+		logger:     logger,
+	}
+	// 测试连接
+	err = db.Ping()
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("ping TDengine: %v", err)
+	}
+	logger.Info("连接 TDengine 成功")
+	// create database
+	_, err = db.Exec("CREATE DATABASE IF NOT EXISTS " + database + " PRECISION 'ms'")
+	if err != nil {
+		logger.Error("创建数据库失败", "database", database, "err", err)
+	}
+	// 选择数据库
+	_, err = db.Exec("USE " + database)
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("select database %v: %v", database, err)
+	}
+	logger.Info("选择数据库成功", "database", database)
+
+	// 按当前的设备和点表建表
+	err = w.refresh(true)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	// 建立参数绑定写入连接
+	config := stmt.NewConfig(fmt.Sprintf("ws://%s:%d", conn.host, conn.port), 0)
+	_ = config.SetConnectUser(conn.username)
+	_ = config.SetConnectPass(conn.password)
+	_ = config.SetConnectDB(database)
+	config.SetErrorHandler(func(connector *stmt.Connector, err error) {
+		logger.Error("TDengine 参数绑定连接错误", "err", err)
+	})
+	w.connector, err = stmt.NewConnector(config)
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("create stmt connector: %v", err)
+	}
+	return w, nil
+}
+
+// Close 关闭写入连接
+func (w *taosWriter) Close() {
+	for _, s := range w.stmts {
+		_ = s.Close()
+	}
+	w.stmts = make(map[string]*stmt.Stmt)
+	if w.connector != nil {
+		_ = w.connector.Close()
+		w.connector = nil
+	}
+	if w.db != nil {
+		_ = w.db.Close()
+		w.db = nil
+	}
+}
+
+// getStmt 获取插入语句对应的 stmt，不存在时创建并预编译
+func (w *taosWriter) getStmt(insert string) (*stmt.Stmt, error) {
+	if s, ok := w.stmts[insert]; ok {
+		return s, nil
+	}
+	s, err := w.connector.Init()
+	if err != nil {
+		return nil, err
+	}
+	if err = s.Prepare(insert); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	w.stmts[insert] = s
+	return s, nil
+}
 
-		var sqlexc string
-		sqlexc = fmt.Sprintf("INSERT INTO %s (ts, v) VALUES (%d, %v)", devid+"_"+tableName, tsInt, v)
-		if GetTypeString(v) == "string" {
-			v = strings.ReplaceAll(v.(string), "'", "''")
-			sqlexc = fmt.Sprintf("INSERT INTO %s (ts, v) VALUES (%d, '%v')", devid+"_"+tableName, tsInt, v)
+// dropStmt 执行出错后丢弃 stmt，下次使用时重新创建
+func (w *taosWriter) dropStmt(insert string) {
+	if s, ok := w.stmts[insert]; ok {
+		_ = s.Close()
+		delete(w.stmts, insert)
+	}
+}
+
+// refresh 检查设备和点表是否变化，变化时（或 force 为 true 时）重新建表，
+// 新增的设备和点随之创建表或超级表的列
+func (w *taosWriter) refresh(force bool) error {
+	devMap, err := loadDeviceMap(w.cfgdb, w.deviceList)
+	if err != nil {
+		return fmt.Errorf("read devices: %v", err)
+	}
+	fields := make(map[string]map[string]string)
+	for devkey, dev := range devMap {
+		fields[devkey] = devTagFields(w.cfgdb, dev)
+	}
+	// fmt 输出 map 时按键排序，可直接作为签名比较
+	signature := fmt.Sprint(devMap, fields)
+	if !force && signature == w.signature {
+		return nil
+	}
+	var subTables map[string]string
+	if w.tbType == "stable" {
+		subTables, err = ensureSuperTables(w.db, w.database, devMap, fields, w.logger)
+	} else {
+		err = ensureTables(w.db, fields, w.logger)
+	}
+	if err != nil {
+		return err
+	}
+	// 超级表的列可能已变化，已缓存的插入语句需要重新预编译
+	for insert := range w.stmts {
+		w.dropStmt(insert)
+	}
+	w.devMap = devMap
+	w.fields = fields
+	w.subTables = subTables
+	w.signature = signature
+	return nil
+}
+
+// buildTables 把多个周期的数据按目标表整理为按列绑定的数据
+func (w *taosWriter) buildTables(batch []map[string]map[string][]any) []*taosTable {
+	tables := make(map[string]*taosTable)
+	for _, datasmap := range batch {
+		for devkey, deviceData := range datasmap {
+			fields := w.fields[devkey]
+			for tagName, values := range deviceData {
+				if len(values) < 3 {
+					continue
+				}
+				tsFloat, ok := values[2].(float64)
+				if !ok {
+					continue
+				}
+				ts := int64(tsFloat)
+				col := ReplaceChars(tagName, "_")
+				tdengineType, ok := fields[col]
+				if !ok {
+					// 点表中已不存在的点不写入
+					continue
+				}
+				var tb *taosTable
+				var idx, qidx int
+				if w.tbType == "stable" {
+					tb = tables[devkey]
+					if tb == nil {
+						tb = w.newSubTable(devkey)
+						tables[devkey] = tb
+					}
+					idx = ContainsIndex(tb.cols, col)
+					qidx = ContainsIndex(tb.cols, qualityColumn(col))
+					if idx < 0 || qidx < 0 {
+						continue
+					}
+				} else {
+					name := devkey + "_" + col
+					tb = tables[name]
+					if tb == nil {
+						tb = &taosTable{
+							name:   name,
+							insert: "INSERT INTO ? (ts, v, q) VALUES (?, ?, ?)",
+							cols:   []string{"v", "q"},
+							types:  []string{tdengineType, taosQualityType},
+							rows:   make(map[int64][]any),
+						}
+						tables[name] = tb
+					}
+					qidx = 1
+				}
+				if tb.rows[ts] == nil {
+					tb.rows[ts] = make([]any, len(tb.cols))
+				}
+				tb.rows[ts][idx] = values[1]
+				tb.rows[ts][qidx] = QualityOf(values)
+			}
+		}
+	}
+	result := make([]*taosTable, 0, len(tables))
+	for _, tb := range tables {
+		result = append(result, tb)
+	}
+	return result
+}
+
+// newSubTable 构建设备子表的插入语句，列为超级表中该设备类型的全部列
+func (w *taosWriter) newSubTable(devkey string) *taosTable {
+	dev := w.devMap[devkey]
+	stbName := superTableName(dev.DevType)
+	tb := &taosTable{
+		name:     "`" + w.subTables[devkey] + "`",
+		tags:     param.NewParam(3).AddBinary([]byte(dev.DevID)).AddNchar(dev.DevName).AddBinary([]byte(dev.InstID)),
+		tagTypes: param.NewColumnType(3).AddBinary(64).AddNchar(64).AddBinary(64),
+		rows:     make(map[int64][]any),
+	}
+	// 同一设备类型的所有设备共用一条插入语句
+	colTypes := make(map[string]string)
+	for key, d := range w.devMap {
+		if d.DevType != dev.DevType {
+			continue
+		}
+		for col, tdengineType := range w.fields[key] {
+			colTypes[col] = tdengineType
+			colTypes[qualityColumn(col)] = taosQualityType
 		}
-		sqlBuilder.WriteString(sqlexc + ";\n")
 	}
-	// 执行批量插入
-	batchSQL := sqlBuilder.String()
-	//fmt.Printf("批量插入 SQL 语句:\n%s\n", batchSQL)
-	_, erra := db.Exec(batchSQL)
-	if erra != nil {
-		fmt.Printf("批量插入 SQL 语句:\n%s\n", batchSQL)
-		return fmt.Errorf("批量插入失败: %v", erra)
+	for col := range colTypes {
+		tb.cols = append(tb.cols, col)
 	}
+	sort.Strings(tb.cols)
+	quoted := []string{"ts"}
+	marks := []string{"?"}
+	for _, col := range tb.cols {
+		tb.types = append(tb.types, colTypes[col])
+		quoted = append(quoted, "`"+col+"`")
+		marks = append(marks, "?")
+	}
+	tb.insert = fmt.Sprintf("INSERT INTO ? USING `%s` TAGS (?, ?, ?) (%s) VALUES (%s)",
+		stbName, strings.Join(quoted, ", "), strings.Join(marks, ", "))
+	return tb
+}
 
+// bindTable 绑定一张表的数据到 stmt，无法转换的值按空值写入
+func (w *taosWriter) bindTable(s *stmt.Stmt, tb *taosTable) error {
+	if err := s.SetTableName(tb.name); err != nil {
+		return err
+	}
+	if tb.tags != nil {
+		if err := s.SetTags(tb.tags, tb.tagTypes); err != nil {
+			return err
+		}
+	}
+	tsList := make([]int64, 0, len(tb.rows))
+	for ts := range tb.rows {
+		tsList = append(tsList, ts)
+	}
+	sort.Slice(tsList, func(i, j int) bool { return tsList[i] < tsList[j] })
+
+	params := make([]*param.Param, len(tb.cols)+1)
+	bindTypes := param.NewColumnType(len(tb.cols) + 1).AddTimestamp()
+	params[0] = param.NewParam(len(tsList))
+	for _, ts := range tsList {
+		params[0].AddTimestamp(time.UnixMilli(ts), common.PrecisionMilliSecond)
+	}
+	for i, tdengineType := range tb.types {
+		p := param.NewParam(len(tsList))
+		for _, ts := range tsList {
+			if err := addTaosParam(p, tdengineType, tb.rows[ts][i]); err != nil {
+				w.logger.Warn("TDengine 列的值无效", "table", tb.name, "column", tb.cols[i], "err", err)
+				p.AddNull()
+			}
+		}
+		params[i+1] = p
+		addTaosColumnType(bindTypes, tdengineType)
+	}
+	if err := s.BindParam(params, bindTypes); err != nil {
+		return err
+	}
+	return s.AddBatch()
+}
+
+// execTables 用同一条插入语句写入多张表
+func (w *taosWriter) execTables(insert string, tables []*taosTable) error {
+	s, err := w.getStmt(insert)
+	if err != nil {
+		return err
+	}
+	for _, tb := range tables {
+		if err = w.bindTable(s, tb); err != nil {
+			w.dropStmt(insert)
+			return err
+		}
+	}
+	if err = s.Exec(); err != nil {
+		w.dropStmt(insert)
+		return err
+	}
 	return nil
 }
+
+// Write 写入一批周期数据，只有连接错误时返回错误（调用方保留数据重试），
+// 其他错误逐表隔离，只丢弃出错表的数据
+func (w *taosWriter) Write(batch []map[string]map[string][]any) error {
+	// 收到配置变化后先检查设备和点表，变化时建表
+	if w.dirty {
+		if err := w.refresh(false); err != nil {
+			if classifyTaosErr(err) == taosErrConn {
+				return err
+			}
+			w.logger.Error("TDengine 建表失败", "err", err)
+		} else {
+			w.dirty = false
+		}
+	}
+	groups := make(map[string][]*taosTable)
+	for _, tb := range w.buildTables(batch) {
+		if len(tb.rows) == 0 {
+			continue
+		}
+		groups[tb.insert] = append(groups[tb.insert], tb)
+	}
+	for insert, tables := range groups {
+		err := w.execTables(insert, tables)
+		if err != nil && classifyTaosErr(err) == taosErrNoTable {
+			// 表被删除或尚未创建：重新建表后重试
+			w.logger.Warn("TDengine 表不存在，重新建表", "err", err)
+			if errr := w.refresh(true); errr != nil {
+				w.logger.Error("TDengine 建表失败", "err", errr)
+			}
+			err = w.execTables(insert, tables)
+		}
+		if err == nil {
+			continue
+		}
+		if classifyTaosErr(err) == taosErrConn {
+			return err
+		}
+		// 批量写入失败时逐表写入，定位出错的表
+		for _, tb := range tables {
+			errt := w.execTables(insert, []*taosTable{tb})
+			if errt == nil {
+				continue
+			}
+			if classifyTaosErr(errt) == taosErrConn {
+				return errt
+			}
+			w.logger.Error("写入 TDengine 表失败，丢弃本批数据", "table", tb.name, "err", errt)
+		}
+	}
+	return nil
+}
+
+// addTaosParam 按列的 TDengine 类型添加绑定值
+func addTaosParam(p *param.Param, tdengineType string, v any) error {
+	if v == nil {
+		p.AddNull()
+		return nil
+	}
+	switch tdengineType {
+	case "bool":
+		b, err := toBool(v)
+		if err != nil {
+			return err
+		}
+		p.AddBool(b)
+	case "int":
+		f, err := toFloat64(v)
+		if err != nil {
+			return err
+		}
+		p.AddInt(int(f))
+	case "float":
+		f, err := toFloat64(v)
+		if err != nil {
+			return err
+		}
+		p.AddFloat(float32(f))
+	case "double":
+		f, err := toFloat64(v)
+		if err != nil {
+			return err
+		}
+		p.AddDouble(f)
+	default:
+		p.AddBinary([]byte(fmt.Sprintf("%v", v)))
+	}
+	return nil
+}
+
+// addTaosColumnType 按列的 TDengine 类型添加绑定类型
+func addTaosColumnType(c *param.ColumnType, tdengineType string) {
+	switch tdengineType {
+	case "bool":
+		c.AddBool()
+	case "int":
+		c.AddInt()
+	case "float":
+		c.AddFloat()
+	case "double":
+		c.AddDouble()
+	default:
+		c.AddBinary(64)
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	taosErrors "github.com/taosdata/driver-go/v3/errors"
+)
+
+func TestClassifyTaosErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"network error", errors.New("dial tcp 127.0.0.1:6030: connection refused"), taosErrConn},
+		{"connection broken", &taosErrors.TaosError{Code: 0x000B, ErrStr: "Unable to establish connection"}, taosErrConn},
+		{"timeout", &taosErrors.TaosError{Code: 0x0015, ErrStr: "Conn read timeout"}, taosErrConn},
+		{"invalid connection", &taosErrors.TaosError{Code: 0x020B, ErrStr: "Invalid connection"}, taosErrConn},
+		{"table not exist", &taosErrors.TaosError{Code: 0x2662, ErrStr: "Table does not exist"}, taosErrNoTable},
+		{"table not exist (old code)", &taosErrors.TaosError{Code: 0x0603, ErrStr: "Table does not exist"}, taosErrNoTable},
+		{"wrapped table not exist", fmt.Errorf("insert d1: %w", &taosErrors.TaosError{Code: 0x2603, ErrStr: "Table does not exist"}), taosErrNoTable},
+		{"invalid column", &taosErrors.TaosError{Code: 0x2603 + 1, ErrStr: "Invalid column name"}, taosErrData},
+		{"syntax error", &taosErrors.TaosError{Code: 0x2600, ErrStr: "syntax error"}, taosErrData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyTaosErr(tt.err); got != tt.want {
+				t.Fatalf("classifyTaosErr() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWiderTaosType(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"", "int", "int"},
+		{"int", "double", "double"},
+		{"double", "int", "double"},
+		{"float", "int", "float"},
+		{"binary(64)", "int", "int"},
+		{"int", "bool", "bool"},
+	}
+	for _, tt := range tests {
+		if got := widerTaosType(tt.a, tt.b); got != tt.want {
+			t.Errorf("widerTaosType(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSubTableName(t *testing.T) {
+	dev := DevConfig{DevID: "d1", DevName: "泵1", DevType: "pump", InstID: "m1"}
+	tests := []struct {
+		name     string
+		existing map[string]taosSubTable
+		want     string
+		wantErr  bool
+	}{
+		{"new device", map[string]taosSubTable{}, "d1", false},
+		{"same type", map[string]taosSubTable{"d1": {stable: "st_pump"}}, "d1", false},
+		{"type changed", map[string]taosSubTable{"d1": {stable: "st_valve"}}, "d1_pump", false},
+		{"type changed back", map[string]taosSubTable{"d1": {stable: "st_pump"}, "d1_valve": {stable: "st_valve"}}, "d1", false},
+		{"name taken", map[string]taosSubTable{"d1": {stable: "st_valve"}, "d1_pump": {stable: "st_fan"}}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := subTableName(dev, tt.existing)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: subTableName() = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSubTableTagSQL(t *testing.T) {
+	dev := DevConfig{DevID: "d1", DevName: "泵'1", DevType: "pump", InstID: "m2"}
+	tb := taosSubTable{stable: "st_pump", tags: map[string]string{"dev_id": "d1", "dev_name": "泵'1", "inst_id": "m1"}}
+	got := fmt.Sprint(subTableTagSQL("d1", tb, dev))
+	want := fmt.Sprint([]string{"ALTER TABLE `d1` SET TAG inst_id = 'm2'"})
+	if got != want {
+		t.Errorf("subTableTagSQL() = %s, want %s", got, want)
+	}
+	tb.tags["inst_id"] = "m2"
+	tb.tags["dev_name"] = "泵1"
+	got = fmt.Sprint(subTableTagSQL("d1", tb, dev))
+	want = fmt.Sprint([]string{"ALTER TABLE `d1` SET TAG dev_name = '泵''1'"})
+	if got != want {
+		t.Errorf("subTableTagSQL() = %s, want %s", got, want)
+	}
+}
@@ -20,7 +20,6 @@ var (
 	workersLock sync.Mutex                       // 用于保护 Workers 的并发访问
 	//nextID      = 1                              // 用于生成唯一的子线程 ID
 
-	//devsStatus = make(map[string]bool) // 存储所有设备ID的在线状态
 	// 定义redka数据库中的表名
 	InstListKey  = "inst@router"
 	DevAtInstKey = "dev@inst"
@@ -31,19 +30,25 @@ var (
 		"periodicPrint": PeriodicPrint,
 	}
 	// 定义字符串数组
-	iotappCode = []string{"simulator", "modbus", "opcda", "opcua", "mqttpub", "dsTDengine", "dsInfluxdb"}
-	IotappMap  = map[string]iotFunc{
+	iotappCode     = []string{"simulator", "modbus", "opcda", "opcua", "mqttpub", "dsTDengine", "dsInfluxdb"}
+	IotappMap      map[string]iotFunc
+	reconnectDelay = 5 * time.Second // 重连延迟
+
+)
+
+// IotappMap 在 init 中赋值：mqttpub 的命令通道会启动实例，直接初始化会形成初始化循环
+func init() {
+	IotappMap = map[string]iotFunc{
 		"simulator":  Simulator,
 		"modbus":     ModbusRead,
 		"opcda":      OpcDARead,
 		"opcua":      OpcUARead,
+		"calc":       calcData,
 		"mqttpub":    mqttPubData,
 		"dsTDengine": dsTDengine,
 		"dsInfluxdb": dsInfluxdb,
 	}
-	reconnectDelay = 5 * time.Second // 重连延迟
-
-)
+}
 
 // 定义 DataQueue 结构
 type DataQueue struct {
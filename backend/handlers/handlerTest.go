@@ -92,49 +92,59 @@ func findmax(id string, stopChan chan struct{}) {
 
 // Simulator函数：去设备点表中获取配置信息，然后模拟数据
 func Simulator(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.DB) {
+	logger := workerLogger(id)
 	// 使用当前时间的纳秒级时间戳作为种子
 	source := rand.NewSource(time.Now().UnixNano())
 	r := rand.New(source)
+	// 订阅配置变化，设备变化时重新读取，点表每个周期读取
+	cfgCh := subscribeConfig(id)
+	defer unsubscribeConfig(cfgCh)
 	// 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息
-	values, err1 := cfgdb.Hash().Items(DevAtInstKey)
+	OutterMap, err1 := loadInstDevices(cfgdb, id)
 	if err1 != nil {
-		fmt.Printf("Err: %v\n", err1)
+		logger.Error("获取设备配置信息失败", "err", err1)
 		return
 	}
-	if len(values) == 0 {
-		fmt.Printf("database no any device\n")
-		return
-	}
-	OutterMap := make(map[string]DevConfig)
-	for key, value := range values {
-		var newValue DevConfig
-		erra := json.Unmarshal([]byte(value.String()), &newValue)
-		if erra != nil {
-			fmt.Println("Error unmarshalling JSON:", erra)
-			return
-		}
-		//fmt.Printf("键: %s, Queryid: %s, InstID: %s\n", key, id, newValue.InstID)
-		if id == newValue.InstID {
-			OutterMap[key] = newValue
-		}
-	}
 	if len(OutterMap) == 0 {
-		fmt.Printf("instid %v no match device\n", id)
+		logger.Error("实例没有匹配的设备")
 		return
 	}
+	// 登记写点请求通道，写入的值会保持为该点的模拟值
+	writeChan := registerTagWriter(id)
+	defer unregisterTagWriter(id, writeChan)
+	forced := make(map[string]map[string]any)
 	for {
 		select {
 		case <-stopChan: // 如果收到停止信号，退出循环
-			now := time.Now()
-			formattedDate := now.Format("2006-01-02 15:04:05")
-			fmt.Printf("%v 子线程Simulator实例 %v stopped\n", formattedDate, id)
+			logger.Info("收到停止信号，退出")
 			return
+		case req := <-writeChan:
+			if _, ok := OutterMap[req.DevID]; !ok {
+				req.Result <- fmt.Errorf("devId '%s' is not bound to instance '%s'", req.DevID, id)
+				continue
+			}
+			if forced[req.DevID] == nil {
+				forced[req.DevID] = make(map[string]any)
+			}
+			forced[req.DevID][req.TagID] = req.Value
+			req.Result <- nil
+		case event := <-cfgCh:
+			if !configNotified(cfgCh, id) && !event.concerns(id) {
+				continue
+			}
+			devMap, erra := loadInstDevices(cfgdb, id)
+			if erra != nil {
+				logger.Error("重新读取设备配置失败", "err", erra)
+				continue
+			}
+			OutterMap = devMap
+			logger.Info("设备已重新加载", "devices", len(OutterMap))
 		default:
 			for devkey := range OutterMap {
 				// 从设备点表中获取配置信息
 				tags, err2 := cfgdb.Hash().Items(devkey)
 				if err2 != nil {
-					fmt.Printf("Err: %v\n", err2)
+					logger.Error("获取设备点表失败", "devId", devkey, "err", err2)
 					continue
 				}
 				if len(tags) != 0 {
@@ -142,16 +152,15 @@ func Simulator(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 					loc, _ := time.LoadLocation("Local")
 					// 获取当前时间（基于本地时区）
 					now := time.Now().In(loc)
-					formattedDate := now.Format("2006-01-02 15:04:05")
-					unixMilliTimestamp := now.UnixMilli()
 					// 遍历设备点表获取数据
 					for tagkey, tagvalue := range tags {
-						var newValue []string
-						erra := json.Unmarshal([]byte(tagvalue.String()), &newValue)
+						var tag []any
+						erra := json.Unmarshal([]byte(tagvalue.String()), &tag)
 						if erra != nil {
-							fmt.Println("Error unmarshalling JSON:", erra)
+							logger.Error("解析点表失败", "devId", devkey, "tagId", tagkey, "err", erra)
 							return
 						}
+						newValue := tagStrings(tag)
 						// 模拟数据
 						var value interface{}
 						if newValue[2] == "int" {
@@ -166,20 +175,20 @@ func Simulator(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 						if newValue[2] == "string" {
 							value = pickRandomElement(stringArr)
 						}
-						//fmt.Printf("时间： %s, 数值: %+v, 毫秒: %d\n", formattedDate, value, unixMilliTimestamp)
+						if fv, ok := forced[devkey][tagkey]; ok {
+							value = fv
+						}
 						if value == nil {
 							continue
 						}
-						valueMap := []any{formattedDate, value, unixMilliTimestamp, GetTypeString(value)}
-						valueMapJson, _ := json.Marshal(valueMap)
-						datasmap[tagkey] = valueMapJson
+						datasmap[tagkey] = rtValue(now, value, QualityGood)
 
 					}
 					//fmt.Printf("设备： %s, 数值三元组: %+v\n", devkey, datasmap)
 					//	统一将数据写入到redka数据库
-					_, err := rtdb.Hash().SetMany(devkey, datasmap)
+					err := WriteDevValues(rtdb, devkey, datasmap)
 					if err != nil {
-						fmt.Printf("Err: %v\n", err)
+						logger.Error("写入数据库失败", "devId", devkey, "err", err)
 						return
 					}
 
@@ -15,6 +15,7 @@ import (
 	"reflect"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -309,6 +310,8 @@ func appHasTag(id string, cfgdb *redka.DB) (bool, string) {
 
 func GetTypeString(v interface{}) string {
 	switch v.(type) {
+	case nil:
+		return ""
 	case bool:
 		return "bool"
 	case int:
@@ -333,3 +336,97 @@ func ReplaceChars(input string, dChar string) string {
 	// 使用 "_" 替换匹配到的字符
 	return re.ReplaceAllString(input, dChar)
 }
+
+// toFloat64 将 JSON 解析得到的数值、布尔或数字字符串转换为 float64
+func toFloat64(v any) (float64, error) {
+	switch x := v.(type) {
+	case float64:
+		return x, nil
+	case float32:
+		return float64(x), nil
+	case int:
+		return float64(x), nil
+	case int64:
+		return float64(x), nil
+	case uint16:
+		return float64(x), nil
+	case bool:
+		if x {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		if err != nil {
+			return 0, fmt.Errorf("value '%s' is not a number", x)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("value '%v' is not a number", v)
+	}
+}
+
+// toBool 将布尔、数值或 "true"/"false"/"1"/"0" 字符串转换为 bool
+func toBool(v any) (bool, error) {
+	switch x := v.(type) {
+	case bool:
+		return x, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(x))
+		if err != nil {
+			return false, fmt.Errorf("value '%s' is not a bool", x)
+		}
+		return b, nil
+	default:
+		f, err := toFloat64(v)
+		if err != nil {
+			return false, fmt.Errorf("value '%v' is not a bool", v)
+		}
+		return f != 0, nil
+	}
+}
+
+// tagDataType 获取点表中定义的数据类型：modbus 点表在第2列，其他应用在第3列
+func tagDataType(instid string, tag []any) string {
+	idx := 2
+	if appcode, _ := extractChar(instid); appcode == "modbus" {
+		idx = 1
+	}
+	if len(tag) <= idx {
+		return ""
+	}
+	dataType, _ := tag[idx].(string)
+	return dataType
+}
+
+// ContainsIndex 返回元素在数组中的下标，不存在时返回 -1
+func ContainsIndex[T comparable](slice []T, target T) int {
+	for i, item := range slice {
+		if item == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// loadDeviceMap 读取北向应用要转发的设备，deviceList 为空时返回所有设备
+func loadDeviceMap(cfgdb *redka.DB, deviceList []string) (map[string]DevConfig, error) {
+	devValues, err := cfgdb.Hash().Items(DevAtInstKey)
+	if err != nil {
+		return nil, err
+	}
+	devMap := make(map[string]DevConfig)
+	for key, value := range devValues {
+		if len(deviceList) != 0 && !ContainsString(deviceList, key) {
+			continue
+		}
+		var newValue DevConfig
+		erra := json.Unmarshal([]byte(value.String()), &newValue)
+		if erra != nil {
+			fmt.Println("Error unmarshalling JSON:", erra)
+			continue
+		}
+		devMap[key] = newValue
+	}
+	return devMap, nil
+}
@@ -0,0 +1,598 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/nalgeon/redka"
+)
+
+// 计算点：calc 实例的设备点表为 [点ID, 描述, 类型, 表达式]，表达式引用 rtdb 中其他点的值计算派生值，
+// 结果和南向实例采集的数据一样写入 rtdb。表达式语法为 govaluate：
+//
+//	[devId.tagId]  引用其他设备的点；不带设备ID的 tagId 引用同一设备的点（可以是其他计算点）
+//	运算符         + - * / % ** 比较 && || ! 位运算 & | ^ << >> 和 ?: 三目运算
+//	函数           abs sqrt pow min max round(x, n) floor ceil exp log log10 sin cos bit(x, n)
+//	有状态函数     delta(x)             与上次计算时的差值
+//	               integrate(x, scale)  对时间(秒)积分，scale 可选，如功率(kW)累计电量(kWh)用 1/3600
+//	               avg(x, window)       最近 window 秒内的平均值
+//
+// 引用的点值或质量变化时计算依赖它的点(onChange)，同时按 cycle 秒周期计算所有点。
+// 计算结果的质量取引用点中最差的质量，引用点为 bad 或没有数据时不计算，保持最后的值
+
+// 有状态函数：表达式编译前在参数前插入调用位置序号，用于区分同一表达式中的多次调用
+var calcStatefulFuncs = regexp.MustCompile(`\b(delta|integrate|avg)\s*\(`)
+
+// 定义计算点
+type calcTag struct {
+	key      string // devId.tagId
+	devID    string
+	tagID    string
+	dataType string
+	expr     *govaluate.EvaluableExpression
+	refs     []string // 引用的点 devId.tagId
+	params   []string // 表达式中的参数名，与 refs 一一对应
+	state    map[int]*calcFuncState
+	last     any    // 最后一次计算的值
+	err      string // 配置错误，不为空时不计算
+	reported bool   // 配置错误已写入 rtdb
+}
+
+// 定义有状态函数的状态
+type calcFuncState struct {
+	prev    float64
+	prevTs  time.Time
+	has     bool
+	sum     float64
+	samples []calcSample
+}
+
+type calcSample struct {
+	ts time.Time
+	v  float64
+}
+
+// 定义计算引擎，每个 calc 实例一个
+type calcEngine struct {
+	rtdb       *redka.DB
+	logger     *slog.Logger
+	tags       map[string]*calcTag   // devId.tagId -> 计算点
+	order      []*calcTag            // 按依赖关系排序，被引用的点在前
+	dependents map[string][]*calcTag // devId.tagId -> 直接引用它的计算点
+	cur        *calcTag              // 正在计算的点，供有状态函数使用
+}
+
+// calcData 函数：计算实例下设备的计算点
+func calcData(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.DB) {
+	logger := workerLogger(id)
+	// 订阅配置变化，计算点和周期变化时重新加载，不需要重启实例
+	cfgCh := subscribeConfig(id)
+	defer unsubscribeConfig(cfgCh)
+
+	var engine *calcEngine
+	var sub *rtSubscriber
+	var subCh chan RtEvent
+	var ticker *time.Ticker
+	var tickCh <-chan time.Time
+	defer func() {
+		if sub != nil {
+			realtimeHub.unsubscribe(sub)
+		}
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	signature := "" // 实例配置、设备和点表的签名，没有变化时不重新加载，保留有状态函数的状态
+	// load 通过ID(实例ID)获取实例的配置信息和计算点，订阅引用的其他设备的数据，返回是否重新加载
+	load := func() (bool, error) {
+		config, err := loadInstConfig(cfgdb, id)
+		if err != nil {
+			return false, err
+		}
+		cycle, onChange := 1.0, true
+		if v, ok := config["cycle"].(float64); ok {
+			cycle = v
+		}
+		if v, ok := config["onChange"].(bool); ok {
+			onChange = v
+		}
+		if cycle <= 0 && !onChange {
+			logger.Warn("cycle 为 0 且未启用 onChange，不会计算")
+		}
+
+		devMap, err := loadInstDevices(cfgdb, id)
+		if err != nil {
+			return false, fmt.Errorf("获取设备配置信息失败: %v", err)
+		}
+		var ownDevs []string
+		for devkey := range devMap {
+			ownDevs = append(ownDevs, devkey)
+		}
+		if len(ownDevs) == 0 {
+			return false, fmt.Errorf("实例没有匹配的设备")
+		}
+		sig := fmt.Sprint(config, devicesSignature(cfgdb, devMap))
+		if sig == signature {
+			return false, nil
+		}
+		newEngine := &calcEngine{rtdb: rtdb, logger: logger}
+		if err = newEngine.load(cfgdb, ownDevs); err != nil {
+			return false, fmt.Errorf("读取计算点失败: %v", err)
+		}
+		engine, signature = newEngine, sig
+
+		// 订阅引用的其他设备的数据
+		if sub != nil {
+			realtimeHub.unsubscribe(sub)
+			sub, subCh = nil, nil
+		}
+		if onChange {
+			var refDevs []string
+			for key := range engine.dependents {
+				devid, _, _ := strings.Cut(key, ".")
+				if !ContainsString(ownDevs, devid) && !ContainsString(refDevs, devid) {
+					refDevs = append(refDevs, devid)
+				}
+			}
+			if len(refDevs) != 0 {
+				sub = realtimeHub.subscribe(refDevs, nil, false)
+				subCh = sub.ch
+			}
+		}
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tickCh = nil, nil
+		}
+		if cycle > 0 {
+			ticker = time.NewTicker(time.Duration(cycle * float64(time.Second)))
+			tickCh = ticker.C
+		}
+		return true, nil
+	}
+	if _, err := load(); err != nil {
+		logger.Error("读取实例配置失败", "err", err)
+		return
+	}
+
+	engine.run(nil)
+	lastInputs := make(map[string]string) // devId.tagId -> 上次的值和质量
+	for {
+		select {
+		case <-stopChan:
+			logger.Info("收到停止信号，退出")
+			return
+		case event := <-cfgCh:
+			if !configNotified(cfgCh, id) && !event.concerns(id) {
+				continue
+			}
+			// 重新加载失败时继续使用原来的计算点
+			reloaded, err := load()
+			if err != nil {
+				logger.Error("重新读取计算点失败，继续使用原计算点", "err", err)
+				continue
+			}
+			if !reloaded {
+				continue
+			}
+			logger.Info("计算点已重新加载", "tags", len(engine.tags))
+			lastInputs = make(map[string]string)
+			engine.run(nil)
+		case event := <-subCh:
+			var changed []string
+			for tagid, raw := range event.Values {
+				key := event.DevID + "." + tagid
+				if _, ok := engine.dependents[key]; !ok {
+					continue
+				}
+				var newValue []any
+				if erra := json.Unmarshal(raw, &newValue); erra != nil || len(newValue) <= rtIdxValue {
+					continue
+				}
+				input := fmt.Sprint(newValue[rtIdxValue], "|", QualityOf(newValue))
+				if lastInputs[key] != input {
+					lastInputs[key] = input
+					changed = append(changed, key)
+				}
+			}
+			if len(changed) != 0 {
+				engine.run(changed)
+			}
+		case <-tickCh:
+			engine.run(nil)
+		}
+	}
+}
+
+// load 读取设备的点表，编译表达式并按依赖关系排序
+func (e *calcEngine) load(cfgdb *redka.DB, devs []string) error {
+	e.tags = make(map[string]*calcTag)
+	funcs := e.functions()
+	for _, devid := range devs {
+		tags, err := cfgdb.Hash().Items(devid)
+		if err != nil {
+			return err
+		}
+		for tagid, tagvalue := range tags {
+			var tag []any
+			if erra := json.Unmarshal([]byte(tagvalue.String()), &tag); erra != nil {
+				e.logger.Error("计算点点表格式错误", "devId", devid, "tagId", tagid, "err", erra)
+				continue
+			}
+			t := &calcTag{
+				key:      devid + "." + tagid,
+				devID:    devid,
+				tagID:    tagid,
+				dataType: tagDataType("calc@", tag),
+				state:    make(map[int]*calcFuncState),
+			}
+			e.tags[t.key] = t
+			// 最后的值用于引用点无效时保持输出和 integrate 继续累计
+			if v, errv := e.rtdb.Hash().Get(devid, tagid); errv == nil {
+				var newValue []any
+				if json.Unmarshal([]byte(v.String()), &newValue) == nil && len(newValue) > rtIdxValue {
+					t.last = newValue[rtIdxValue]
+				}
+			}
+			exprStr := ""
+			if len(tag) > 3 {
+				exprStr, _ = tag[3].(string)
+			}
+			if strings.TrimSpace(exprStr) == "" {
+				t.err = "expression is empty"
+				continue
+			}
+			expr, erra := compileCalcExpr(exprStr, funcs)
+			if erra != nil {
+				t.err = erra.Error()
+				continue
+			}
+			t.expr = expr
+			for _, param := range expr.Vars() {
+				if ContainsString(t.params, param) {
+					continue
+				}
+				ref := param
+				if !strings.Contains(param, ".") {
+					ref = devid + "." + param
+				}
+				t.params = append(t.params, param)
+				t.refs = append(t.refs, ref)
+			}
+		}
+	}
+	e.sortTags()
+	for _, t := range e.order {
+		if t.err != "" {
+			e.logger.Error("计算点配置错误", "tag", t.key, "err", t.err)
+		}
+	}
+	return nil
+}
+
+// sortTags 建立点的依赖关系并按引用顺序排序计算点，被引用的点排在前面，循环引用的点标记为配置错误后排在最后
+func (e *calcEngine) sortTags() {
+	e.dependents = make(map[string][]*calcTag)
+	e.order = nil
+	for _, t := range e.tags {
+		for _, ref := range t.refs {
+			e.dependents[ref] = append(e.dependents[ref], t)
+		}
+	}
+
+	indegree := make(map[*calcTag]int)
+	for _, t := range e.tags {
+		for _, ref := range t.refs {
+			if _, ok := e.tags[ref]; ok {
+				indegree[t]++
+			}
+		}
+	}
+	var queue []*calcTag
+	for _, t := range e.tags {
+		if indegree[t] == 0 {
+			queue = append(queue, t)
+		}
+	}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		e.order = append(e.order, t)
+		for _, d := range e.dependents[t.key] {
+			indegree[d]--
+			if indegree[d] == 0 {
+				queue = append(queue, d)
+			}
+		}
+	}
+	for _, t := range e.tags {
+		if indegree[t] > 0 {
+			t.err = "circular reference"
+			e.order = append(e.order, t)
+		}
+	}
+}
+
+// compileCalcExpr 编译计算点的表达式，有状态函数的第一个参数为调用位置序号
+func compileCalcExpr(exprStr string, funcs map[string]govaluate.ExpressionFunction) (*govaluate.EvaluableExpression, error) {
+	n := 0
+	exprStr = calcStatefulFuncs.ReplaceAllStringFunc(exprStr, func(s string) string {
+		n++
+		return fmt.Sprintf("%s%d, ", s, n)
+	})
+	return govaluate.NewEvaluableExpressionWithFunctions(exprStr, funcs)
+}
+
+// run 计算点：changed 为空时计算所有点，否则计算直接或间接引用 changed 的点
+func (e *calcEngine) run(changed []string) {
+	var affected map[*calcTag]bool
+	if len(changed) != 0 {
+		affected = make(map[*calcTag]bool)
+		queue := append([]string{}, changed...)
+		for len(queue) > 0 {
+			key := queue[0]
+			queue = queue[1:]
+			for _, t := range e.dependents[key] {
+				if !affected[t] {
+					affected[t] = true
+					queue = append(queue, t.key)
+				}
+			}
+		}
+	}
+
+	now := time.Now()
+	computed := make(map[string][]any) // 本次计算的结果，供后面的计算点引用
+	datasmap := make(map[string]map[string]any)
+	for _, t := range e.order {
+		if affected != nil && !affected[t] {
+			continue
+		}
+		value, quality := e.evaluate(t, computed)
+		if quality == "" {
+			continue
+		}
+		computed[t.key] = []any{nil, value, now.UnixMilli(), GetTypeString(value), quality}
+		if datasmap[t.devID] == nil {
+			datasmap[t.devID] = make(map[string]any)
+		}
+		datasmap[t.devID][t.tagID] = rtValue(now, value, quality)
+	}
+	for devid, values := range datasmap {
+		if err := WriteDevValues(e.rtdb, devid, values); err != nil {
+			e.logger.Error("写入计算点失败", "devId", devid, "err", err)
+		}
+	}
+}
+
+// evaluate 计算一个点，返回值和质量；质量为空表示不需要写入
+func (e *calcEngine) evaluate(t *calcTag, computed map[string][]any) (any, string) {
+	if t.err != "" {
+		if t.reported {
+			return nil, ""
+		}
+		t.reported = true
+		return t.last, QualityBadConfigError
+	}
+	params := make(map[string]any, len(t.params))
+	quality := QualityGood
+	for i, ref := range t.refs {
+		newValue, ok := computed[ref]
+		if !ok {
+			devid, tagid, _ := strings.Cut(ref, ".")
+			v, err := e.rtdb.Hash().Get(devid, tagid)
+			if err != nil || json.Unmarshal([]byte(v.String()), &newValue) != nil || len(newValue) <= rtIdxValue {
+				return t.last, QualityBad
+			}
+		}
+		q := QualityOf(newValue)
+		if IsBadQuality(q) {
+			return t.last, q
+		}
+		if !strings.HasPrefix(q, QualityGood) {
+			quality = QualityUncertain
+		}
+		params[t.params[i]] = newValue[rtIdxValue]
+	}
+	e.cur = t
+	result, err := t.expr.Evaluate(params)
+	e.cur = nil
+	if err != nil {
+		e.logger.Warn("计算点计算失败", "tag", t.key, "err", err)
+		return t.last, QualityBadConfigError
+	}
+	value, err := calcConvert(result, t.dataType)
+	if err != nil {
+		e.logger.Warn("计算点计算失败", "tag", t.key, "err", err)
+		return t.last, QualityBadConfigError
+	}
+	t.last = value
+	return value, quality
+}
+
+// calcConvert 把计算结果转换为点表定义的类型，非有限数值返回错误
+func calcConvert(result any, dataType string) (any, error) {
+	if f, ok := result.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return nil, fmt.Errorf("result is %v", f)
+	}
+	switch dataType {
+	case "int":
+		f, err := toFloat64(result)
+		if err != nil {
+			return nil, err
+		}
+		return int64(math.Round(f)), nil
+	case "float":
+		f, err := toFloat64(result)
+		if err != nil {
+			return nil, err
+		}
+		return float32(f), nil
+	case "bool":
+		return toBool(result)
+	case "string":
+		return fmt.Sprint(result), nil
+	}
+	return result, nil
+}
+
+// funcState 返回正在计算的点在调用位置 n 的有状态函数状态
+func (e *calcEngine) funcState(args []any) (*calcFuncState, []float64, error) {
+	if e.cur == nil || len(args) < 2 {
+		return nil, nil, fmt.Errorf("missing arguments")
+	}
+	nums, err := calcFloats(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	n := int(nums[0])
+	st, ok := e.cur.state[n]
+	if !ok {
+		st = &calcFuncState{}
+		e.cur.state[n] = st
+	}
+	return st, nums[1:], nil
+}
+
+// calcFloats 把函数参数转换为 float64
+func calcFloats(args []any) ([]float64, error) {
+	nums := make([]float64, len(args))
+	for i, arg := range args {
+		f, err := toFloat64(arg)
+		if err != nil {
+			return nil, err
+		}
+		nums[i] = f
+	}
+	return nums, nil
+}
+
+// calcMath 生成单参数数学函数
+func calcMath(fn func(float64) float64) govaluate.ExpressionFunction {
+	return func(args ...any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expect 1 argument, got %d", len(args))
+		}
+		f, err := toFloat64(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return fn(f), nil
+	}
+}
+
+// functions 返回表达式可用的函数
+func (e *calcEngine) functions() map[string]govaluate.ExpressionFunction {
+	return map[string]govaluate.ExpressionFunction{
+		"abs":   calcMath(math.Abs),
+		"sqrt":  calcMath(math.Sqrt),
+		"floor": calcMath(math.Floor),
+		"ceil":  calcMath(math.Ceil),
+		"exp":   calcMath(math.Exp),
+		"log":   calcMath(math.Log),
+		"log10": calcMath(math.Log10),
+		"sin":   calcMath(math.Sin),
+		"cos":   calcMath(math.Cos),
+		"pow": func(args ...any) (any, error) {
+			nums, err := calcFloats(args)
+			if err != nil || len(nums) != 2 {
+				return nil, fmt.Errorf("pow expects 2 numbers")
+			}
+			return math.Pow(nums[0], nums[1]), nil
+		},
+		"min": func(args ...any) (any, error) {
+			nums, err := calcFloats(args)
+			if err != nil || len(nums) == 0 {
+				return nil, fmt.Errorf("min expects numbers")
+			}
+			m := nums[0]
+			for _, f := range nums[1:] {
+				m = math.Min(m, f)
+			}
+			return m, nil
+		},
+		"max": func(args ...any) (any, error) {
+			nums, err := calcFloats(args)
+			if err != nil || len(nums) == 0 {
+				return nil, fmt.Errorf("max expects numbers")
+			}
+			m := nums[0]
+			for _, f := range nums[1:] {
+				m = math.Max(m, f)
+			}
+			return m, nil
+		},
+		"round": func(args ...any) (any, error) {
+			nums, err := calcFloats(args)
+			if err != nil || len(nums) == 0 || len(nums) > 2 {
+				return nil, fmt.Errorf("round expects 1 or 2 numbers")
+			}
+			scale := 1.0
+			if len(nums) == 2 {
+				scale = math.Pow(10, nums[1])
+			}
+			return math.Round(nums[0]*scale) / scale, nil
+		},
+		"bit": func(args ...any) (any, error) {
+			nums, err := calcFloats(args)
+			if err != nil || len(nums) != 2 {
+				return nil, fmt.Errorf("bit expects 2 numbers")
+			}
+			return float64((int64(nums[0]) >> uint(nums[1])) & 1), nil
+		},
+		"delta": func(args ...any) (any, error) {
+			st, nums, err := e.funcState(args)
+			if err != nil {
+				return nil, fmt.Errorf("delta: %v", err)
+			}
+			d := 0.0
+			if st.has {
+				d = nums[0] - st.prev
+			}
+			st.prev, st.has = nums[0], true
+			return d, nil
+		},
+		"integrate": func(args ...any) (any, error) {
+			st, nums, err := e.funcState(args)
+			if err != nil {
+				return nil, fmt.Errorf("integrate: %v", err)
+			}
+			scale := 1.0
+			if len(nums) > 1 {
+				scale = nums[1]
+			}
+			now := time.Now()
+			if st.has {
+				// 梯形积分
+				st.sum += (nums[0] + st.prev) / 2 * now.Sub(st.prevTs).Seconds() * scale
+			} else if last, errf := toFloat64(e.cur.last); errf == nil {
+				// 实例重启后从 rtdb 中最后的值继续累计
+				st.sum = last
+			}
+			st.prev, st.prevTs, st.has = nums[0], now, true
+			return st.sum, nil
+		},
+		"avg": func(args ...any) (any, error) {
+			st, nums, err := e.funcState(args)
+			if err != nil || len(nums) != 2 {
+				return nil, fmt.Errorf("avg expects value and window")
+			}
+			now := time.Now()
+			st.samples = append(st.samples, calcSample{ts: now, v: nums[0]})
+			window := time.Duration(nums[1] * float64(time.Second))
+			for len(st.samples) > 1 && now.Sub(st.samples[0].ts) > window {
+				st.samples = st.samples[1:]
+			}
+			sum := 0.0
+			for _, s := range st.samples {
+				sum += s.v
+			}
+			return sum / float64(len(st.samples)), nil
+		},
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import "testing"
+
+func TestCalcSortTags(t *testing.T) {
+	tag := func(key string, refs ...string) *calcTag {
+		return &calcTag{key: key, refs: refs}
+	}
+	e := &calcEngine{tags: map[string]*calcTag{}}
+	for _, ct := range []*calcTag{
+		tag("calc.a", "dev1.t1"), // 只引用采集点
+		tag("calc.b", "calc.a"),
+		tag("calc.c", "calc.b", "calc.a"),
+		tag("calc.d", "calc.e"), // d、e 循环引用
+		tag("calc.e", "calc.d"),
+		tag("calc.f", "calc.f"), // 引用自身
+		tag("calc.g", "calc.d"), // 引用循环中的点
+	} {
+		e.tags[ct.key] = ct
+	}
+	e.sortTags()
+
+	if len(e.order) != len(e.tags) {
+		t.Fatalf("order has %d tags, want %d", len(e.order), len(e.tags))
+	}
+	pos := make(map[string]int)
+	for i, ct := range e.order {
+		pos[ct.key] = i
+	}
+	for _, dep := range [][2]string{{"calc.a", "calc.b"}, {"calc.b", "calc.c"}, {"calc.a", "calc.c"}} {
+		if pos[dep[0]] > pos[dep[1]] {
+			t.Errorf("%s is calculated after %s", dep[0], dep[1])
+		}
+	}
+
+	tests := []struct {
+		key     string
+		wantErr string
+	}{
+		{"calc.a", ""},
+		{"calc.b", ""},
+		{"calc.c", ""},
+		{"calc.d", "circular reference"},
+		{"calc.e", "circular reference"},
+		{"calc.f", "circular reference"},
+		{"calc.g", "circular reference"},
+	}
+	for _, tt := range tests {
+		if got := e.tags[tt.key].err; got != tt.wantErr {
+			t.Errorf("%s err = %q, want %q", tt.key, got, tt.wantErr)
+		}
+	}
+
+	// 采集点的变化触发直接引用它的计算点
+	if deps := e.dependents["dev1.t1"]; len(deps) != 1 || deps[0].key != "calc.a" {
+		t.Errorf("dependents of dev1.t1 = %v", deps)
+	}
+	if deps := e.dependents["calc.a"]; len(deps) != 2 {
+		t.Errorf("dependents of calc.a = %d tags, want 2", len(deps))
+	}
+
+	// 重新排序时清除上次的结果
+	delete(e.tags, "calc.g")
+	e.sortTags()
+	if len(e.order) != len(e.tags) || len(e.dependents["calc.d"]) != 1 {
+		t.Errorf("sortTags() kept results of the previous load")
+	}
+}
@@ -5,117 +5,112 @@ import (
 	"fmt"
 	"github.com/nalgeon/redka"
 	"github.com/simonvetter/modbus"
-	"log"
+	"math"
 	_ "modernc.org/sqlite"
 	"strconv"
 	"time"
 )
 
+// 点表功能码对应的寄存器类型，读写使用同一个映射
+var mbfcode = map[string]modbus.RegType{
+	"03": modbus.INPUT_REGISTER,
+	"04": modbus.HOLDING_REGISTER,
+}
+
 // ModbusRead 函数：周期性地读取 Modbus 设备数据
 func ModbusRead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.DB) {
+	logger := workerLogger(id)
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("ModbusRead 发生 panic: %v\n", r)
+			logger.Error("ModbusRead 发生 panic", "panic", r)
 		}
 	}()
 
-	// 通过ID(实例ID)获取实例的配置信息
-	appconfig, err := cfgdb.Hash().Get(InstListKey, id)
-	if err != nil {
-		log.Printf("数据库中没有实例ID: %v\n", id)
-		return
-	}
-	configstr := appconfig.String()
-	var newConfig AppConfig
-	err = json.Unmarshal([]byte(configstr), &newConfig)
-	configMap := newConfig.Config
-	log.Printf("实例配置: %+v\n", configMap)
-
-	// 提取外层的 "Config"
-	config, ok := configMap.(map[string]any)
-	if !ok {
-		log.Println("配置不是 map[string]any 或不存在")
-		return
-	}
-
-	channel, ok := config["channel"].(string)
-	if !ok {
-		log.Println("channel 不是字符串或不存在")
-	}
-	host, ok := config["host"].(string)
-	if !ok {
-		log.Println("host 不是字符串或不存在")
-	}
-	port, ok := config["port"].(float64)
-	if !ok {
-		log.Println("port 不是整数或不存在")
-	}
-	slaveId, ok := config["slaveId"].(float64)
-	if !ok {
-		log.Println("slaveId 不是整数或不存在")
-	}
-	protocol, ok := config["protocol"].(string)
-	if !ok {
-		log.Println("protocol 不是字符串或不存在")
-	}
-	log.Printf("%+v, %+v, %+v, %+v, %+v\n", channel, host, port, slaveId, protocol)
+	// 订阅配置变化，点表变化时原地生效，连接参数变化时重新连接
+	cfgCh := subscribeConfig(id)
+	defer unsubscribeConfig(cfgCh)
+	metrics := metricsOf(id)
 
-	// 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息
-	devValues, err1 := cfgdb.Hash().Items(DevAtInstKey)
-	if err1 != nil {
-		log.Printf("获取设备配置信息失败: %v\n", err1)
-		return
-	}
-	if len(devValues) == 0 {
-		log.Printf("数据库中没有设备\n")
-		return
-	}
-	devMap := make(map[string]DevConfig)
-	for key, value := range devValues {
-		var newValue DevConfig
-		erra := json.Unmarshal([]byte(value.String()), &newValue)
-		if erra != nil {
-			log.Println("解析 JSON 失败:", erra)
-			return
+	// 连接参数
+	var channel, host, protocol string
+	var port, slaveId float64
+	// loadConfig 通过ID(实例ID)获取实例的配置信息，返回连接参数的签名
+	loadConfig := func() (string, error) {
+		config, err := loadInstConfig(cfgdb, id)
+		if err != nil {
+			return "", err
+		}
+		var ok bool
+		channel, ok = config["channel"].(string)
+		if !ok {
+			logger.Warn("channel 不是字符串或不存在")
+		}
+		host, ok = config["host"].(string)
+		if !ok {
+			logger.Warn("host 不是字符串或不存在")
+		}
+		port, ok = config["port"].(float64)
+		if !ok {
+			logger.Warn("port 不是整数或不存在")
+		}
+		slaveId, ok = config["slaveId"].(float64)
+		if !ok {
+			logger.Warn("slaveId 不是整数或不存在")
 		}
-		log.Printf("键: %s, Queryid: %s, InstID: %s\n", key, id, newValue.InstID)
-		if id == newValue.InstID {
-			devMap[key] = newValue
+		protocol, ok = config["protocol"].(string)
+		if !ok {
+			logger.Warn("protocol 不是字符串或不存在")
 		}
+		logger.Info("Modbus 连接参数", "channel", channel, "host", host, "port", port, "slaveId", slaveId, "protocol", protocol)
+		return fmt.Sprint(channel, host, port, slaveId, protocol), nil
 	}
-	if len(devMap) == 0 {
-		log.Printf("实例ID %v 没有匹配的设备\n", id)
+	connSig, err := loadConfig()
+	if err != nil {
+		logger.Error("读取实例配置失败", "err", err)
 		return
 	}
 
 	// 通过设备ID获取设备点表信息
 	mbtags := make([][]string, 0)
 	mbParent := make(map[string]string)
-	for devkey := range devMap {
-		tags, err2 := cfgdb.Hash().Items(devkey)
-		if err2 != nil {
-			log.Printf("获取设备点表失败: %v\n", err2)
-			continue
+	// 设备ID/点ID -> 点表配置，用于写点请求
+	mbIndex := make(map[string][]string)
+	// loadTags 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息
+	loadTags := func() error {
+		devMap, err1 := loadInstDevices(cfgdb, id)
+		if err1 != nil {
+			return fmt.Errorf("获取设备配置信息失败: %v", err1)
 		}
-		if len(tags) != 0 {
+		tagList := make([][]string, 0)
+		parent := make(map[string]string)
+		index := make(map[string][]string)
+		for devkey := range devMap {
+			tags, err2 := cfgdb.Hash().Items(devkey)
+			if err2 != nil {
+				logger.Error("获取设备点表失败", "devId", devkey, "err", err2)
+				continue
+			}
 			for tagkey, tagvalue := range tags {
 				var newValue []any
 				erra := json.Unmarshal([]byte(tagvalue.String()), &newValue)
 				if erra != nil {
-					log.Println("解析 JSON 失败:", erra)
-					return
-				}
-				var strValues []string
-				for _, v := range newValue {
-					strValues = append(strValues, fmt.Sprintf("%v", v))
+					return fmt.Errorf("解析点表失败 %s.%s: %v", devkey, tagkey, erra)
 				}
-				mbtags = append(mbtags, strValues)
-				mbParent[tagkey] = devkey
+				strValues := tagStrings(newValue)
+				tagList = append(tagList, strValues)
+				parent[tagkey] = devkey
+				index[devkey+"/"+tagkey] = strValues
 			}
 		}
+		mbtags, mbParent, mbIndex = tagList, parent, index
+		return nil
+	}
+	if err = loadTags(); err != nil {
+		logger.Error("读取点表失败", "err", err)
+		return
 	}
 	if len(mbtags) == 0 {
-		log.Printf("实例ID %v 没有标签\n", id)
+		logger.Error("实例没有标签")
 		return
 	}
 
@@ -123,6 +118,29 @@ func ModbusRead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 	var mbConnected = false
 	var mbErrCount = 0
 
+	// reload 配置变化后重新读取配置和点表，连接参数变化时断开连接，由重连机制使用新参数连接
+	reload := func() {
+		sig, errc := loadConfig()
+		if errc != nil {
+			logger.Error("重新读取实例配置失败", "err", errc)
+			return
+		}
+		if errt := loadTags(); errt != nil {
+			logger.Error("重新读取点表失败，继续使用原点表", "err", errt)
+		} else {
+			logger.Info("点表已重新加载", "tags", len(mbtags))
+		}
+		if sig != connSig {
+			connSig = sig
+			logger.Info("连接参数变化，重新连接")
+			if client != nil {
+				client.Close()
+			}
+			mbConnected = false
+			metrics.setConnected(false)
+		}
+	}
+
 	// 连接 Modbus 服务器
 	connect := func() error {
 		client, err = modbus.NewClient(&modbus.ClientConfiguration{
@@ -140,25 +158,31 @@ func ModbusRead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 		}
 
 		mbConnected = true
-		log.Println("成功连接到 Modbus 服务器")
+		metrics.setConnected(true)
+		logger.Info("成功连接到 Modbus 服务器")
 		return nil
 	}
 
-	// 重连机制
+	// 重连机制，等待重连期间修改的连接参数在下次连接时使用
 	reconnect := func() bool {
 		for {
 			select {
 			case <-stopChan:
-				log.Printf("收到停止信号，退出重连循环\n")
+				logger.Info("收到停止信号，退出重连循环")
 				return false
 			default:
-				log.Printf("尝试连接 Modbus 服务器\n")
-				if err := connect(); err == nil {
-					log.Println("连接成功")
+				if configNotified(cfgCh, id) {
+					reload()
+				}
+				logger.Debug("尝试连接 Modbus 服务器")
+				err := connect()
+				if err == nil {
 					mbErrCount = 0
 					return true
 				}
-				log.Printf("连接失败，等待 %v 后重试\n", reconnectDelay)
+				logger.Warn("连接失败，等待后重试", "err", err, "delay", reconnectDelay)
+				metrics.setConnected(false)
+				setInstanceQuality(cfgdb, rtdb, id, QualityBadNotConnected)
 				time.Sleep(reconnectDelay)
 			}
 		}
@@ -174,31 +198,60 @@ func ModbusRead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 		}
 	}()
 
-	mbfcode := map[string]modbus.RegType{
-		"03": modbus.INPUT_REGISTER,
-		"04": modbus.HOLDING_REGISTER,
-	}
+	// 登记写点请求通道
+	writeChan := registerTagWriter(id)
+	defer unregisterTagWriter(id, writeChan)
 
 	// 监听停止信号
 	for {
 		select {
 		case <-stopChan:
-			log.Printf("子线程 Modbus 实例 %s 收到停止信号，退出\n", id)
+			logger.Info("收到停止信号，退出")
 			return
 		default:
+			// 配置变化时重新读取
+			if configNotified(cfgCh, id) {
+				reload()
+			}
 			// 检查连接状态
 			if !mbConnected {
-				log.Println("检测到连接断开，尝试重新连接")
+				logger.Warn("检测到连接断开，尝试重新连接")
 				reconnect()
 				continue
 			}
 
+			// 处理写点请求
+			for pending := true; pending; {
+				select {
+				case req := <-writeChan:
+					m, ok := mbIndex[req.DevID+"/"+req.TagID]
+					if !ok {
+						req.Result <- fmt.Errorf("tag '%s.%s' is not bound to instance '%s'", req.DevID, req.TagID, id)
+						continue
+					}
+					errw := modbusWrite(client, m, req.Value)
+					if errw != nil {
+						logger.Error("写入 Modbus 数据失败", "devId", req.DevID, "tagId", req.TagID, "err", errw)
+					}
+					req.Result <- errw
+				default:
+					pending = false
+				}
+			}
+
 			// 读取数据
 			loc, _ := time.LoadLocation("Local")
 			now := time.Now().In(loc)
-			formattedDate := now.Format("2006-01-02 15:04:05")
-			unixMilliTimestamp := now.UnixMilli()
 			datasmap := make(map[string]map[string]any)
+			// 读取失败的点，设备ID -> 质量 -> 点ID
+			badTags := make(map[string]map[string][]string)
+			markBad := func(tagid string, quality string) {
+				devkey := mbParent[tagid]
+				if badTags[devkey] == nil {
+					badTags[devkey] = make(map[string][]string)
+				}
+				badTags[devkey][quality] = append(badTags[devkey][quality], tagid)
+			}
 
 			for _, m := range mbtags {
 				//从Modbus点表中获取指令所需的参数:单元地址，功能码，寄存器起始地址，数据类型
@@ -209,7 +262,7 @@ func ModbusRead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 
 				err = client.SetUnitId(uint8(deviceUnitid))
 				if err != nil {
-					log.Printf("设置 Unit ID 失败: %v\n", err)
+					logger.Error("设置 Unit ID 失败", "unitId", deviceUnitid, "err", err)
 					//mbConnected = false
 					break
 				}
@@ -226,46 +279,98 @@ func ModbusRead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.
 				case dataType == "bool" && fccode == "02":
 					value, errmb = client.ReadDiscreteInput(uint16(registerAddress))
 				default:
-					log.Printf("不支持的数据类型: %s\n", dataType)
+					logger.Warn("不支持的数据类型", "tagId", m[0], "dataType", dataType)
+					markBad(m[0], QualityBadConfigError)
 					continue
 				}
 
 				if errmb != nil {
-					log.Printf("读取 Modbus 数据失败: %v\n", errmb)
+					logger.Warn("读取 Modbus 数据失败", "tagId", m[0], "err", errmb)
 					mbErrCount = mbErrCount + 1
+					markBad(m[0], QualityBadCommFailure)
 					continue
 					//mbConnected = false
 					//break
 				}
 				if value == nil {
-					log.Printf("读取 Modbus 数据为空\n")
+					logger.Warn("读取 Modbus 数据为空", "tagId", m[0])
 					continue
 				}
 
 				tagid := m[0]
-				valueMap := []any{formattedDate, value, unixMilliTimestamp, GetTypeString(value)}
-				valueMapJson, _ := json.Marshal(valueMap)
 				devkey := mbParent[tagid]
 				if datasmap[devkey] == nil {
 					datasmap[devkey] = make(map[string]any)
 				}
-				datasmap[devkey][tagid] = valueMapJson
+				datasmap[devkey][tagid] = rtValue(now, value, QualityGood)
 			}
 
 			// 统一将数据写入到 redka 数据库
 			for devkey := range datasmap {
-				_, errz := rtdb.Hash().SetMany(devkey, datasmap[devkey])
+				errz := WriteDevValues(rtdb, devkey, datasmap[devkey])
 				if errz != nil {
-					log.Printf("写入数据库失败: %v\n", errz)
+					logger.Error("写入数据库失败", "devId", devkey, "err", errz)
 					continue
 				}
 			}
 
+			// 读取失败的点保留最后的值，质量设置为 bad
+			for devkey, qualities := range badTags {
+				for quality, tagids := range qualities {
+					setDevQuality(rtdb, devkey, tagids, quality)
+				}
+			}
+
 			if mbErrCount >= 5 {
-				log.Printf("连续 %d 次读取失败，尝试重新连接\n", mbErrCount)
+				logger.Warn("连续读取失败，尝试重新连接", "errCount", mbErrCount)
 				mbConnected = false
+				metrics.setConnected(false)
+				setInstanceQuality(cfgdb, rtdb, id, QualityBadNotConnected)
 			}
 			time.Sleep(1 * time.Second)
 		}
 	}
 }
+
+// modbusWrite 按点表配置向 Modbus 设备写值，支持线圈(01)和保持寄存器(int16/float32)，
+// 离散输入和输入寄存器只读
+func modbusWrite(client *modbus.ModbusClient, m []string, value any) error {
+	deviceUnitid, _ := strconv.Atoi(m[3])
+	fccode := m[4]
+	registerAddress, _ := strconv.Atoi(m[5])
+	dataType := m[6]
+
+	err := client.SetUnitId(uint8(deviceUnitid))
+	if err != nil {
+		return fmt.Errorf("设置 Unit ID 失败: %v", err)
+	}
+	switch {
+	case dataType == "bool" && fccode == "01":
+		b, err := toBool(value)
+		if err != nil {
+			return err
+		}
+		return client.WriteCoil(uint16(registerAddress), b)
+	case (dataType == "int16" || dataType == "float32") && mbfcode[fccode] != modbus.HOLDING_REGISTER:
+		return fmt.Errorf("function code %s is read only", fccode)
+	case dataType == "int16":
+		f, err := toFloat64(value)
+		if err != nil {
+			return err
+		}
+		// int16 点按无符号 16 位寄存器读取，写入的范围与读取一致
+		f = math.Round(f)
+		if f < 0 || f > math.MaxUint16 {
+			return fmt.Errorf("value %v is out of uint16 register range 0-65535", value)
+		}
+		return client.WriteRegister(uint16(registerAddress), uint16(f))
+	case dataType == "float32":
+		f, err := toFloat64(value)
+		if err != nil {
+			return err
+		}
+		return client.WriteFloat32(uint16(registerAddress), float32(f))
+	default:
+		return fmt.Errorf("data type %s with function code %s is not writable", dataType, fccode)
+	}
+}
@@ -4,51 +4,54 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/huskar-t/opcda"
 	"github.com/huskar-t/opcda/com"
 	"github.com/nalgeon/redka"
-	"log"
 	"time"
 )
 
 // OpcDARead函数：去设备点表中获取配置信息，然后连接OPC Server订阅数据
 func OpcDARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.DB) {
+	logger := workerLogger(id)
+	// 订阅配置变化：OPC 组和标签在连接时创建，配置或点表变化时由工作线程重启实例
+	cfgCh := subscribeConfig(id)
+	defer unsubscribeConfig(cfgCh)
 	//通过ID(实例ID)获取实例的配置信息
 	appconfig, err := cfgdb.Hash().Get(InstListKey, id)
 	if err != nil {
-		fmt.Printf("database no instid\n")
+		logger.Error("数据库中没有实例ID")
 		return
 	}
 	configstr := appconfig.String()
 	var newConfig AppConfig
 	err = json.Unmarshal([]byte(configstr), &newConfig)
 	configMap := newConfig.Config
-	fmt.Printf("myConfig %+v\n", configMap)
 	// 提取外层的 "Config"
 	config, ok := configMap.(map[string]any) // 类型断言为 map[string]any
 	if !ok {
-		fmt.Println("Config is not a map[string]any or does not exist")
+		logger.Error("配置不是 map[string]any 或不存在")
 		return
 	}
 	//host := "localhost"
 	//progID := "Matrikon.OPC.Simulation.1"
 	host, ok := config["host"].(string)
 	if !ok {
-		fmt.Println("host is not a string or does not exist")
+		logger.Warn("host 不是字符串或不存在")
 	}
 	progID, ok := config["progID"].(string)
 	if !ok {
-		fmt.Println("progID is not a string or does not exist")
+		logger.Warn("progID 不是字符串或不存在")
 	}
 	// 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息
 	devValues, err1 := cfgdb.Hash().Items(DevAtInstKey)
 	if err1 != nil {
-		fmt.Printf("Err: %v\n", err1)
+		logger.Error("获取设备配置信息失败", "err", err1)
 		return
 	}
 	if len(devValues) == 0 {
-		fmt.Printf("database no any device\n")
+		logger.Error("数据库中没有设备")
 		return
 	}
 	devMap := make(map[string]DevConfig)
@@ -56,16 +59,15 @@ func OpcDARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 		var newValue DevConfig
 		erra := json.Unmarshal([]byte(value.String()), &newValue)
 		if erra != nil {
-			fmt.Println("Error unmarshalling JSON:", erra)
+			logger.Error("解析设备配置失败", "devId", key, "err", erra)
 			return
 		}
-		fmt.Printf("键: %s, Queryid: %s, InstID: %s\n", key, id, newValue.InstID)
 		if id == newValue.InstID {
 			devMap[key] = newValue
 		}
 	}
 	if len(devMap) == 0 {
-		fmt.Printf("instid %v no match device\n", id)
+		logger.Error("实例没有匹配的设备")
 		return
 	}
 	// 通过设备ID获取设备点表信息
@@ -78,18 +80,19 @@ func OpcDARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 		// 从设备点表中获取配置信息
 		tags, err2 := cfgdb.Hash().Items(devkey)
 		if err2 != nil {
-			fmt.Printf("Err: %v\n", err2)
+			logger.Error("获取设备点表失败", "devId", devkey, "err", err2)
 			continue
 		}
 		if len(tags) != 0 {
 			// 遍历设备点表获取数据
 			for tagkey, tagvalue := range tags {
-				var newValue []string
-				erra := json.Unmarshal([]byte(tagvalue.String()), &newValue)
+				var tag []any
+				erra := json.Unmarshal([]byte(tagvalue.String()), &tag)
 				if erra != nil {
-					fmt.Println("Error unmarshalling JSON:", erra)
+					logger.Error("解析点表失败", "devId", devkey, "tagId", tagkey, "err", erra)
 					return
 				}
+				newValue := tagStrings(tag)
 				//OPC DA标签为点表二维数组中的第4个元素
 				//opcitem := newValue[0]
 				opcitem := newValue[3]
@@ -100,32 +103,37 @@ func OpcDARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 		}
 	}
 	if len(opctags) == 0 {
-		fmt.Printf("instid %v no tag\n", id)
+		logger.Error("实例没有标签")
 		return
 	}
+	signature := fmt.Sprint(config, devicesSignature(cfgdb, devMap))
 	//从OPCDA Server读取数据处理逻辑
 	com.Initialize()
 	defer com.Uninitialize()
 	server, err := opcda.Connect(progID, host)
 	if err != nil {
-		log.Printf("connect to opc server failed: %s\n", err)
+		logger.Error("连接 OPC Server 失败", "progID", progID, "host", host, "err", err)
+		metricsOf(id).setConnected(false)
+		setInstanceQuality(cfgdb, rtdb, id, QualityBadNotConnected)
 		return
 	}
 	defer server.Disconnect()
+	metricsOf(id).setConnected(true)
 	// 使用当前时间的纳秒级时间戳作为种子
 	groups := server.GetOPCGroups()
 	group, err := groups.Add("group1")
 	if err != nil {
-		log.Printf("add group failed: %s\n", err)
+		logger.Error("添加组失败", "err", err)
 	}
 	items := group.OPCItems()
 	itemList, errs, err := items.AddItems(opctags)
 	if err != nil {
-		log.Printf("add items failed: %s\n", err)
+		logger.Error("添加标签失败", "err", err)
 	}
 	for i, err := range errs {
 		if err != nil {
-			log.Printf("add item %s failed: %s\n", opctags[i], err)
+			logger.Warn("添加标签失败", "item", opctags[i], "err", err)
+			setDevQuality(rtdb, opcParent[opctags[i]], []string{opcBind[opctags[i]]}, QualityBadConfigError)
 		}
 	}
 	// Wait for the OPC server to be ready
@@ -145,18 +153,13 @@ func OpcDARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 							opcitem = trimInvisible(item.GetItemID())
 						}
 					}
-					// 将 data.Values[i] 转换为字符串
-					if data.Values[i] == nil {
+					quality := opcDAQuality(uint16(data.Qualities[i]))
+					// 质量为 bad 时值可能为空，仍写入质量
+					if data.Values[i] == nil && !IsBadQuality(quality) {
 						continue
 					}
-					unixTime := data.TimeStamps[i].Unix()
-					timestampstr := data.TimeStamps[i].Format("2006-01-02 15:04:05")
-					//valueStr := fmt.Sprintf("%v", data.Values[i])
-					//quality := uint8(data.Qualities[i])
-					//fmt.Printf("data : %s %s %d %s %d\n", opcitem, timestampstr, quality, valueStr, unixTime)
 					//	将数据增加到设备数据集合中
-					valueMap := []any{timestampstr, data.Values[i], unixTime, GetTypeString(data.Values[i])}
-					valueMapJson, _ := json.Marshal(valueMap)
+					valueMapJson := rtValue(data.TimeStamps[i], data.Values[i], quality)
 					devkey := opcParent[opcitem]
 					if datasmap[devkey] == nil {
 						datasmap[devkey] = make(map[string]any)
@@ -167,9 +170,9 @@ func OpcDARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 				}
 				//	统一将数据写入到redka数据库
 				for devkey := range datasmap {
-					_, errz := rtdb.Hash().SetMany(devkey, datasmap[devkey])
+					errz := WriteDevValues(rtdb, devkey, datasmap[devkey])
 					if errz != nil {
-						fmt.Printf("Err: %v\n", errz)
+						logger.Error("写入数据库失败", "devId", devkey, "err", errz)
 						continue
 					}
 				}
@@ -178,17 +181,38 @@ func OpcDARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 	}()
 	err = group.RegisterDataChange(ch)
 	if err != nil {
-		log.Printf("register data change failed: %s\n", err)
-	}
-	log.Println("Registered data change in OPCDA")
-	select {
-	case <-stopChan:
-		group.Release()
-		fmt.Printf("子线程OPCDA实例 %s 收到停止信号，退出\n", id)
-		err := server.Disconnect()
-		if err != nil {
+		logger.Error("注册数据变化回调失败", "err", err)
+	}
+	logger.Info("已注册数据变化回调")
+	for {
+		select {
+		case <-stopChan:
+			group.Release()
+			logger.Info("收到停止信号，退出")
+			err := server.Disconnect()
+			if err != nil {
+				return
+			} // 断开连接
 			return
-		} // 断开连接
-		return
+		case event := <-cfgCh:
+			if !configNotified(cfgCh, id) && !event.concerns(id) {
+				continue
+			}
+			newConfig, errc := loadInstConfig(cfgdb, id)
+			devs, errd := loadInstDevices(cfgdb, id)
+			if errc != nil || errd != nil {
+				logger.Error("重新读取实例配置失败", "err", errors.Join(errc, errd))
+				continue
+			}
+			if fmt.Sprint(newConfig, devicesSignature(cfgdb, devs)) == signature {
+				continue
+			}
+			logger.Info("配置变化，重启实例")
+			go func() {
+				if errr := RestartInstance(id, cfgdb, rtdb); errr != nil {
+					logger.Error("重启失败", "err", errr)
+				}
+			}()
+		}
 	}
 }
@@ -8,86 +8,60 @@ import (
 	"github.com/gopcua/opcua/monitor"
 	"github.com/gopcua/opcua/ua"
 	"github.com/nalgeon/redka"
-	"log"
+	"log/slog"
 	"sync"
 	"time"
 )
 
 // OpcUARead 函数：去设备点表中获取配置信息，然后连接OPC Server订阅数据
 func OpcUARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.DB) {
+	logger := workerLogger(id)
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("OpcUARead 发生 panic: %v\n", r)
+			logger.Error("OpcUARead 发生 panic", "panic", r)
 		}
 	}()
 
-	// 通过ID(实例ID)获取实例的配置信息
-	appconfig, err := cfgdb.Hash().Get(InstListKey, id)
-	if err != nil {
-		log.Printf("数据库中没有实例ID: %v\n", id)
-		return
-	}
-	configstr := appconfig.String()
-	var newConfig AppConfig
-	err = json.Unmarshal([]byte(configstr), &newConfig)
-	configMap := newConfig.Config
-	log.Printf("实例配置: %+v\n", configMap)
-
-	// 提取外层的 "Config"
-	config, ok := configMap.(map[string]any)
-	if !ok {
-		log.Println("配置不是 map[string]any 或不存在")
-		return
-	}
-
-	endpoint, ok := config["endpoint"].(string)
-	if !ok {
-		log.Println("endpoint 不是字符串或不存在")
-	}
-	policy, ok := config["policy"].(string)
-	if !ok {
-		log.Println("policy 不是字符串或不存在")
-	}
-	mode, ok := config["mode"].(string)
-	if !ok {
-		log.Println("mode 不是字符串或不存在")
-	}
-	certFile, ok := config["cert"].(string)
-	if !ok {
-		log.Println("certFile 不是字符串或不存在")
-	}
-	keyFile, ok := config["key"].(string)
-	if !ok {
-		log.Println("keyFile 不是字符串或不存在")
-	}
+	// 订阅配置变化，点表变化时重新订阅节点，连接参数变化时重新连接
+	cfgCh := subscribeConfig(id)
+	defer unsubscribeConfig(cfgCh)
+	metrics := metricsOf(id)
 
-	log.Printf("endpoint: %+v, policy: %+v, mode: %+v, certFile: %+v, keyFile: %+v\n", endpoint, policy, mode, certFile, keyFile)
-	// 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息
-	devValues, err1 := cfgdb.Hash().Items(DevAtInstKey)
-	if err1 != nil {
-		log.Printf("获取设备配置信息失败: %v\n", err1)
-		return
-	}
-	if len(devValues) == 0 {
-		log.Printf("数据库中没有设备\n")
-		return
-	}
-	//通过设备ID获取设备点信息
-	devMap := make(map[string]DevConfig)
-	for key, value := range devValues {
-		var newValue DevConfig
-		erra := json.Unmarshal([]byte(value.String()), &newValue)
-		if erra != nil {
-			log.Println("解析 JSON 失败:", erra)
-			return
+	// 连接参数
+	var endpoint, policy, mode, certFile, keyFile string
+	// loadConfig 通过ID(实例ID)获取实例的配置信息，返回连接参数的签名
+	loadConfig := func() (string, error) {
+		config, err := loadInstConfig(cfgdb, id)
+		if err != nil {
+			return "", err
+		}
+		var ok bool
+		endpoint, ok = config["endpoint"].(string)
+		if !ok {
+			logger.Warn("endpoint 不是字符串或不存在")
+		}
+		policy, ok = config["policy"].(string)
+		if !ok {
+			logger.Warn("policy 不是字符串或不存在")
 		}
-		log.Printf("键: %s, Queryid: %s, InstID: %s\n", key, id, newValue.InstID)
-		if id == newValue.InstID {
-			devMap[key] = newValue
+		mode, ok = config["mode"].(string)
+		if !ok {
+			logger.Warn("mode 不是字符串或不存在")
 		}
+		certFile, ok = config["cert"].(string)
+		if !ok {
+			logger.Warn("certFile 不是字符串或不存在")
+		}
+		keyFile, ok = config["key"].(string)
+		if !ok {
+			logger.Warn("keyFile 不是字符串或不存在")
+		}
+		logger.Info("OPC UA 连接参数", "endpoint", endpoint, "policy", policy, "mode", mode, "certFile", certFile, "keyFile", keyFile)
+		return fmt.Sprint(endpoint, policy, mode, certFile, keyFile), nil
 	}
-	if len(devMap) == 0 {
-		log.Printf("实例ID %v 没有匹配的设备\n", id)
+	connSig, err := loadConfig()
+	if err != nil {
+		logger.Error("读取实例配置失败", "err", err)
 		return
 	}
 
@@ -95,34 +69,56 @@ func OpcUARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 	opctags := make([]string, 0)
 	opcBind := make(map[string]string, 0)
 	opcParent := make(map[string]string, 0)
-	for devkey := range devMap {
-		tags, err2 := cfgdb.Hash().Items(devkey)
-		if err2 != nil {
-			log.Printf("获取设备点表失败: %v\n", err2)
-			continue
+	// 设备ID/点ID -> OPC UA 节点，用于写点请求
+	opcNodes := make(map[string]string, 0)
+	tagsSig := "" // 设备和点表的签名，没有变化时不重新订阅
+	// loadTags 通过ID(实例ID)获取当前函数可读写的设备配置信息和设备点表信息，返回点表是否变化
+	loadTags := func() (bool, error) {
+		devMap, err1 := loadInstDevices(cfgdb, id)
+		if err1 != nil {
+			return false, fmt.Errorf("获取设备配置信息失败: %v", err1)
 		}
-		if len(tags) != 0 {
+		sig := devicesSignature(cfgdb, devMap)
+		if sig == tagsSig {
+			return false, nil
+		}
+		tagList := make([]string, 0)
+		bind := make(map[string]string)
+		parent := make(map[string]string)
+		nodes := make(map[string]string)
+		for devkey := range devMap {
+			tags, err2 := cfgdb.Hash().Items(devkey)
+			if err2 != nil {
+				logger.Error("获取设备点表失败", "devId", devkey, "err", err2)
+				continue
+			}
 			for tagkey, tagvalue := range tags {
-				var newValue []string
-				erra := json.Unmarshal([]byte(tagvalue.String()), &newValue)
+				var tag []any
+				erra := json.Unmarshal([]byte(tagvalue.String()), &tag)
 				if erra != nil {
-					log.Println("解析 JSON 失败:", erra)
-					return
+					return false, fmt.Errorf("解析点表失败 %s.%s: %v", devkey, tagkey, erra)
 				}
+				newValue := tagStrings(tag)
 				//OPC UA标签为点表二维数组中的第4个元素
-				//opcitem := newValue[0]
 				opcitem := newValue[3]
-				opctags = append(opctags, opcitem)
-				opcParent[opcitem] = devkey
-				opcBind[opcitem] = tagkey
+				tagList = append(tagList, opcitem)
+				parent[opcitem] = devkey
+				bind[opcitem] = tagkey
+				nodes[devkey+"/"+tagkey] = opcitem
 			}
 		}
+		opctags, opcBind, opcParent, opcNodes, tagsSig = tagList, bind, parent, nodes, sig
+		return true, nil
+	}
+	if _, err = loadTags(); err != nil {
+		logger.Error("读取点表失败", "err", err)
+		return
 	}
 	if len(opctags) == 0 {
-		log.Printf("实例ID %v 没有标签\n", id)
+		logger.Error("实例没有标签")
 		return
 	} else {
-		fmt.Printf("实例ID %v 可订阅标签点: %+v\n", id, opctags)
+		logger.Info("可订阅标签点", "tags", opctags)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -132,6 +128,24 @@ func OpcUARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 	var m *monitor.NodeMonitor
 	var wg sync.WaitGroup
 
+	// reload 配置变化后重新读取配置和点表，返回连接参数和点表是否变化
+	reload := func() (connChanged bool, tagsChanged bool) {
+		sig, errc := loadConfig()
+		if errc != nil {
+			logger.Error("重新读取实例配置失败", "err", errc)
+			return false, false
+		}
+		tagsChanged, errt := loadTags()
+		if errt != nil {
+			logger.Error("重新读取点表失败，继续使用原点表", "err", errt)
+		} else if tagsChanged {
+			logger.Info("点表已重新加载", "tags", len(opctags))
+		}
+		connChanged = sig != connSig
+		connSig = sig
+		return connChanged, tagsChanged
+	}
+
 	// 连接 OPC UA Server
 	connect := func() error {
 		endpoints, err := opcua.GetEndpoints(ctx, endpoint)
@@ -142,7 +156,7 @@ func OpcUARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 		if err != nil {
 			return fmt.Errorf("选择端点失败: %v", err)
 		}
-		log.Print("*", ep.SecurityPolicyURI, ep.SecurityMode)
+		logger.Debug("选择端点", "securityPolicy", ep.SecurityPolicyURI, "securityMode", ep.SecurityMode)
 
 		opts := []opcua.Option{
 			opcua.SecurityPolicy(policy),
@@ -164,26 +178,33 @@ func OpcUARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 		}
 
 		m.SetErrorHandler(func(_ *opcua.Client, sub *monitor.Subscription, err error) {
-			log.Printf("错误: sub=%d err=%s", sub.SubscriptionID(), err.Error())
+			logger.Error("订阅错误", "sub", sub.SubscriptionID(), "err", err)
 		})
 
 		return nil
 	}
 
-	// 重连机制
+	// 重连机制，等待重连期间修改的配置在下次连接时使用
 	reconnect := func() bool {
 		for {
 			select {
 			case <-stopChan:
-				log.Printf("收到停止信号，退出重连循环\n")
+				logger.Info("收到停止信号，退出重连循环")
 				return false
 			default:
-				log.Printf("尝试连接 OPC UA Server\n")
-				if err := connect(); err == nil {
-					log.Println("连接成功")
+				if configNotified(cfgCh, id) {
+					reload()
+				}
+				logger.Info("尝试连接 OPC UA Server")
+				err := connect()
+				if err == nil {
+					logger.Info("连接成功")
+					metrics.setConnected(true)
 					return true
 				}
-				log.Printf("连接失败，等待 %v 后重试\n", reconnectDelay)
+				logger.Warn("连接失败，等待后重试", "err", err, "delay", reconnectDelay)
+				metrics.setConnected(false)
+				setInstanceQuality(cfgdb, rtdb, id, QualityBadNotConnected)
 				time.Sleep(reconnectDelay)
 			}
 		}
@@ -202,30 +223,93 @@ func OpcUARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 	// 创建队列
 	queue := NewDataQueue()
 
-	// 启动子线程
-	wg.Add(1)
-	// 修改原调用处：
-	validTags := validateNodes(ctx, c, opctags)
-	log.Printf("有效NodeId：%+v", validTags)
-	go startCallbackSub(ctx, m, 1, 0, &wg, queue, validTags...)
+	// 登记写点请求通道
+	writeChan := registerTagWriter(id)
+	defer unregisterTagWriter(id, writeChan)
+
+	// 订阅当前点表中的有效节点，连接或点表变化后先停止原订阅再重新订阅
+	var subCancel context.CancelFunc
+	startSub := func() {
+		validTags := validateNodes(ctx, c, logger, opctags)
+		logger.Info("有效NodeId", "nodes", validTags)
+		// 无效节点的点质量设置为配置错误
+		for _, opcitem := range opctags {
+			if !ContainsString(validTags, opcitem) {
+				setDevQuality(rtdb, opcParent[opcitem], []string{opcBind[opcitem]}, QualityBadConfigError)
+			}
+		}
+		if len(validTags) == 0 {
+			return
+		}
+		var subCtx context.Context
+		subCtx, subCancel = context.WithCancel(ctx)
+		wg.Add(1)
+		go startCallbackSub(subCtx, m, 1, 0, &wg, queue, logger, validTags...)
+	}
+	stopSub := func() {
+		if subCancel != nil {
+			subCancel()
+			wg.Wait()
+			subCancel = nil
+		}
+	}
+	startSub()
 	// 监听停止信号
 	for {
 		select {
 		case <-stopChan:
-			log.Printf("子线程 OPCUA 实例 %s 收到停止信号，退出\n", id)
+			logger.Info("收到停止信号，退出")
 			cancel()  // 取消上下文，确保 startCallbackSub 退出
 			wg.Wait() // 等待子线程退出
 			return
 		default:
+			// 配置变化时重新读取，连接参数变化时断开连接由重连机制使用新参数连接，点表变化时重新订阅
+			if configNotified(cfgCh, id) {
+				connChanged, tagsChanged := reload()
+				if connChanged {
+					logger.Info("连接参数变化，重新连接")
+					stopSub()
+					if c != nil {
+						c.Close(ctx)
+					}
+					c = nil
+				} else if tagsChanged {
+					stopSub()
+					startSub()
+				}
+			}
 			// 检查连接状态
 			if c == nil || c.State() != opcua.Connected {
-				log.Println("检测到连接断开，尝试重新连接")
+				logger.Warn("检测到连接断开，尝试重新连接")
+				metrics.setConnected(false)
+				setInstanceQuality(cfgdb, rtdb, id, QualityBadNotConnected)
+				stopSub()
 				if !reconnect() {
 					return
 				}
+				startSub()
 				continue
 			}
 
+			// 处理写点请求
+			for pending := true; pending; {
+				select {
+				case req := <-writeChan:
+					node, ok := opcNodes[req.DevID+"/"+req.TagID]
+					if !ok {
+						req.Result <- fmt.Errorf("tag '%s.%s' is not bound to instance '%s'", req.DevID, req.TagID, id)
+						continue
+					}
+					errw := opcuaWrite(ctx, c, node, req.Value)
+					if errw != nil {
+						logger.Error("写入 OPC UA 节点失败", "node", node, "err", errw)
+					}
+					req.Result <- errw
+				default:
+					pending = false
+				}
+			}
+
 			// 处理数据
 			datasmap := make(map[string]map[string]any)
 			for queue.Len() > 0 {
@@ -233,26 +317,30 @@ func OpcUARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 					var data []any
 					err := json.Unmarshal([]byte(val), &data)
 					if err != nil {
-						log.Println("解析失败:", err)
+						logger.Error("解析订阅数据失败", "err", err)
 						return
 					}
 
 					opcitem := data[0].(string)
-					devkey := opcParent[opcitem]
+					// 点表重新加载后已删除的节点
+					devkey, ok := opcParent[opcitem]
+					if !ok {
+						continue
+					}
 					if datasmap[devkey] == nil {
 						datasmap[devkey] = make(map[string]any)
 					}
 					tagkey := opcBind[opcitem]
-					valueMap := []any{data[1], data[2], data[3]}
+					valueMap := []any{data[1], data[2], data[3], data[4], data[5]}
 					valueMapJson, _ := json.Marshal(valueMap)
 					datasmap[devkey][tagkey] = valueMapJson
 				}
 			}
 			// 统一将数据写入到redka数据库
 			for devkey := range datasmap {
-				_, errz := rtdb.Hash().SetMany(devkey, datasmap[devkey])
+				errz := WriteDevValues(rtdb, devkey, datasmap[devkey])
 				if errz != nil {
-					log.Printf("写入数据库失败: %v\n", errz)
+					logger.Error("写入数据库失败", "devId", devkey, "err", errz)
 					continue
 				}
 			}
@@ -260,7 +348,7 @@ func OpcUARead(id string, stopChan chan struct{}, cfgdb *redka.DB, rtdb *redka.D
 		}
 	}
 }
-func startCallbackSub(ctx context.Context, m *monitor.NodeMonitor, interval, lag time.Duration, wg *sync.WaitGroup, queue *DataQueue, nodes ...string) {
+func startCallbackSub(ctx context.Context, m *monitor.NodeMonitor, interval, lag time.Duration, wg *sync.WaitGroup, queue *DataQueue, logger *slog.Logger, nodes ...string) {
 	defer wg.Done() // 确保在函数退出时调用 Done()
 	sub, err := m.Subscribe(
 		ctx,
@@ -270,9 +358,18 @@ func startCallbackSub(ctx context.Context, m *monitor.NodeMonitor, interval, lag
 
 		func(s *monitor.Subscription, msg *monitor.DataChangeMessage) {
 			if msg.Error != nil {
-				log.Printf("[callback] sub=%d error=%s", s.SubscriptionID(), msg.Error)
+				logger.Error("订阅回调错误", "sub", s.SubscriptionID(), "err", msg.Error)
+				return
 			}
-			valueMap := []any{msg.NodeID, msg.ServerTimestamp.Local().Format("2006-01-02 15:04:05"), msg.Value.Value(), msg.ServerTimestamp.Unix(), GetTypeString(msg.Value.Value())}
+			var value any
+			dataType := ""
+			if msg.Value != nil {
+				value = msg.Value.Value()
+				if value != nil {
+					dataType = GetTypeString(value)
+				}
+			}
+			valueMap := []any{msg.NodeID, msg.ServerTimestamp.Local().Format("2006-01-02 15:04:05"), value, msg.ServerTimestamp.UnixMilli(), dataType, opcUAQuality(msg.Status)}
 			valueMapJson, _ := json.Marshal(valueMap)
 			queue.Enqueue(string(valueMapJson))
 			time.Sleep(lag)
@@ -280,30 +377,147 @@ func startCallbackSub(ctx context.Context, m *monitor.NodeMonitor, interval, lag
 		nodes...)
 
 	if err != nil {
-		log.Println(err)
+		logger.Error("订阅失败", "err", err)
 		//log.Fatal(err)
+		return
 	}
 
-	defer cleanup(ctx, sub)
+	defer cleanup(ctx, sub, logger)
 
 	<-ctx.Done()
 }
 
-func cleanup(ctx context.Context, sub *monitor.Subscription) {
-	log.Printf("统计: sub=%d 已传递=%d 已丢弃=%d", sub.SubscriptionID(), sub.Delivered(), sub.Dropped())
+func cleanup(ctx context.Context, sub *monitor.Subscription, logger *slog.Logger) {
+	logger.Info("订阅统计", "sub", sub.SubscriptionID(), "delivered", sub.Delivered(), "dropped", sub.Dropped())
 	sub.Unsubscribe(ctx)
 }
 
 // 在订阅前添加节点有效性检查（新增函数）
-func validateNodes(ctx context.Context, c *opcua.Client, nodes []string) []string {
+func validateNodes(ctx context.Context, c *opcua.Client, logger *slog.Logger, nodes []string) []string {
 	validNodes := make([]string, 0)
 	for _, nodeID := range nodes {
 		_, err := c.Node(ua.MustParseNodeID(nodeID)).Attributes(ctx, ua.AttributeIDNodeClass)
 		if err == nil {
 			validNodes = append(validNodes, nodeID)
 		} else {
-			log.Printf("[PRECHECK] 无效节点 %s 已被排除", nodeID)
+			logger.Warn("无效节点已被排除", "node", nodeID)
 		}
 	}
 	return validNodes
 }
+
+// opcuaWrite 向 OPC UA 节点写值，按节点当前值的数据类型转换写入值
+func opcuaWrite(ctx context.Context, c *opcua.Client, node string, value any) error {
+	nodeID, err := ua.ParseNodeID(node)
+	if err != nil {
+		return fmt.Errorf("解析节点失败: %v", err)
+	}
+	cur, err := c.Node(nodeID).Value(ctx)
+	if err != nil {
+		return fmt.Errorf("读取节点类型失败: %v", err)
+	}
+	v, err := uaVariantOf(value, cur.Type())
+	if err != nil {
+		return err
+	}
+	resp, err := c.Write(ctx, &ua.WriteRequest{
+		NodesToWrite: []*ua.WriteValue{
+			{
+				NodeID:      nodeID,
+				AttributeID: ua.AttributeIDValue,
+				Value: &ua.DataValue{
+					EncodingMask: ua.DataValueValue,
+					Value:        v,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Results) > 0 && resp.Results[0] != ua.StatusOK {
+		return resp.Results[0]
+	}
+	return nil
+}
+
+// uaVariantOf 将写入值转换为指定 OPC UA 数据类型的 Variant
+func uaVariantOf(value any, typ ua.TypeID) (*ua.Variant, error) {
+	switch typ {
+	case ua.TypeIDBoolean:
+		b, err := toBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return ua.NewVariant(b)
+	case ua.TypeIDString:
+		return ua.NewVariant(fmt.Sprintf("%v", value))
+	}
+	f, err := toFloat64(value)
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case ua.TypeIDSByte:
+		return ua.NewVariant(int8(f))
+	case ua.TypeIDByte:
+		return ua.NewVariant(uint8(f))
+	case ua.TypeIDInt16:
+		return ua.NewVariant(int16(f))
+	case ua.TypeIDUint16:
+		return ua.NewVariant(uint16(f))
+	case ua.TypeIDInt32:
+		return ua.NewVariant(int32(f))
+	case ua.TypeIDUint32:
+		return ua.NewVariant(uint32(f))
+	case ua.TypeIDInt64:
+		return ua.NewVariant(int64(f))
+	case ua.TypeIDUint64:
+		return ua.NewVariant(uint64(f))
+	case ua.TypeIDFloat:
+		return ua.NewVariant(float32(f))
+	case ua.TypeIDDouble:
+		return ua.NewVariant(f)
+	default:
+		return nil, fmt.Errorf("data type %v is not writable", typ)
+	}
+}
+
+// opcUAQuality 把 OPC UA 状态码转换为质量
+func opcUAQuality(code ua.StatusCode) string {
+	switch code {
+	case ua.StatusOK:
+		return QualityGood
+	case ua.StatusGoodLocalOverride:
+		return QualityGoodLocalOverride
+	case ua.StatusUncertainLastUsableValue:
+		return QualityUncertainLastUsable
+	case ua.StatusUncertainSensorNotAccurate:
+		return QualityUncertainInaccurate
+	case ua.StatusUncertainEngineeringUnitsExceeded:
+		return QualityUncertainEUExceeded
+	case ua.StatusUncertainSubNormal:
+		return QualityUncertainSubNormal
+	case ua.StatusBadConfigurationError, ua.StatusBadNodeIDUnknown, ua.StatusBadNodeIDInvalid:
+		return QualityBadConfigError
+	case ua.StatusBadNotConnected, ua.StatusBadServerNotConnected, ua.StatusBadConnectionClosed:
+		return QualityBadNotConnected
+	case ua.StatusBadDeviceFailure:
+		return QualityBadDeviceFailure
+	case ua.StatusBadSensorFailure:
+		return QualityBadSensorFailure
+	case ua.StatusBadCommunicationError, ua.StatusBadNoCommunication:
+		return QualityBadCommFailure
+	case ua.StatusBadOutOfService:
+		return QualityBadOutOfService
+	}
+	// 状态码最高 2 位为严重程度：00 good, 01 uncertain, 10/11 bad
+	switch uint32(code) >> 30 {
+	case 0:
+		return QualityGood
+	case 1:
+		return QualityUncertain
+	default:
+		return QualityBad
+	}
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 简单的 XLSX 读写：导出只写一个工作表，字符串使用内联字符串；导入读取第一个工作表的单元格文本，
+// 不处理公式、日期格式和合并单元格。点表只需要这些，不引入完整的 Excel 库
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`
+	xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+)
+
+// 读取时允许的最大行号和列数，行号或列号不连续时会补充空行和空单元格，需要限制避免占用过多内存
+const (
+	xlsxMaxRows = 100000
+	xlsxMaxCols = 1024
+)
+
+// xlsxColName 返回列号(从 0 开始)对应的列名 A、B ... Z、AA ...
+func xlsxColName(col int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxColIndex 返回单元格引用(如 AB12)的列号，从 0 开始，超过 xlsxMaxCols 时返回 xlsxMaxCols
+func xlsxColIndex(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+		if col > xlsxMaxCols {
+			return xlsxMaxCols
+		}
+	}
+	return col - 1
+}
+
+// xlsxEscape 转义单元格文本
+func xlsxEscape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// writeXLSX 把数据写为只有一个工作表的 XLSX，数值写为数值单元格，其他值写为文本
+func writeXLSX(w io.Writer, sheetName string, rows [][]any) error {
+	var sheet strings.Builder
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range rows {
+		fmt.Fprintf(&sheet, `<row r="%d">`, i+1)
+		for j, v := range row {
+			ref := xlsxColName(j) + strconv.Itoa(i+1)
+			switch x := v.(type) {
+			case nil:
+				continue
+			case int, int64, float64:
+				fmt.Fprintf(&sheet, `<c r="%s"><v>%v</v></c>`, ref, x)
+			default:
+				s := fmt.Sprintf("%v", x)
+				if s == "" {
+					continue
+				}
+				fmt.Fprintf(&sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, xlsxEscape(s))
+			}
+		}
+		sheet.WriteString(`</row>`)
+	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+
+	zw := zip.NewWriter(w)
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, xlsxEscape(sheetName))},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/worksheets/sheet1.xml", sheet.String()},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(fw, f.content); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// XLSX 中读取需要的结构
+type xlsxRichText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxRichText) text() string {
+	s := t.T
+	for _, r := range t.R {
+		s += r.T
+	}
+	return s
+}
+
+type xlsxSheetXML struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R  string       `xml:"r,attr"`
+			T  string       `xml:"t,attr"`
+			V  string       `xml:"v"`
+			Is xlsxRichText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX 读取 XLSX 第一个工作表的所有行，单元格转换为文本，空行保留为空数组
+func readXLSX(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	readXML := func(name string, v any) error {
+		f, ok := files[name]
+		if !ok {
+			return fmt.Errorf("%s is missing", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return xml.NewDecoder(io.LimitReader(rc, configMaxBytes)).Decode(v)
+	}
+
+	// 第一个工作表：workbook.xml 中第一个 sheet 的关系ID 对应的文件
+	var workbook struct {
+		Sheets []struct {
+			RID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var rels struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err = readXML("xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	if len(workbook.Sheets) == 0 {
+		return nil, fmt.Errorf("workbook has no sheet")
+	}
+	if err = readXML("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	sheetFile := ""
+	for _, rel := range rels.Rels {
+		if rel.ID == workbook.Sheets[0].RID {
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetFile = strings.TrimPrefix(rel.Target, "/")
+			} else {
+				sheetFile = path.Join("xl", rel.Target)
+			}
+		}
+	}
+	if sheetFile == "" {
+		return nil, fmt.Errorf("first sheet is not found")
+	}
+
+	var shared struct {
+		SI []xlsxRichText `xml:"si"`
+	}
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err = readXML("xl/sharedStrings.xml", &shared); err != nil {
+			return nil, err
+		}
+	}
+	var sheet xlsxSheetXML
+	if err = readXML(sheetFile, &sheet); err != nil {
+		return nil, err
+	}
+
+	rows := make([][]string, 0, len(sheet.Rows))
+	for _, row := range sheet.Rows {
+		if row.R > xlsxMaxRows || len(rows) >= xlsxMaxRows {
+			return nil, fmt.Errorf("row %d: the sheet has more than %d rows", max(row.R, len(rows)+1), xlsxMaxRows)
+		}
+		// 行号不连续时补充空行，保证返回的行号和 Excel 中一致
+		for row.R > len(rows)+1 {
+			rows = append(rows, nil)
+		}
+		var cells []string
+		for i, cell := range row.Cells {
+			col := i
+			if cell.R != "" {
+				col = xlsxColIndex(cell.R)
+			}
+			if col < 0 {
+				continue
+			}
+			if col >= xlsxMaxCols {
+				return nil, fmt.Errorf("cell %s: the sheet has more than %d columns", cell.R, xlsxMaxCols)
+			}
+			var text string
+			switch cell.T {
+			case "s":
+				idx, erri := strconv.Atoi(cell.V)
+				if erri != nil || idx < 0 || idx >= len(shared.SI) {
+					return nil, fmt.Errorf("cell %s: invalid shared string", cell.R)
+				}
+				text = shared.SI[idx].text()
+			case "inlineStr":
+				text = cell.Is.text()
+			case "b":
+				text = map[string]string{"1": "true", "0": "false"}[cell.V]
+			case "str", "e":
+				text = cell.V
+			default:
+				// 数值单元格：Excel 保存的浮点数如 4.0999999999999996 转换为最短的文本
+				text = cell.V
+				if f, errf := strconv.ParseFloat(cell.V, 64); errf == nil {
+					text = strconv.FormatFloat(f, 'g', 15, 64)
+					if g, errg := strconv.ParseFloat(text, 64); errg == nil {
+						text = strconv.FormatFloat(g, 'f', -1, 64)
+					}
+				}
+			}
+			for len(cells) < col {
+				cells = append(cells, "")
+			}
+			cells = append(cells[:col], text)
+		}
+		rows = append(rows, cells)
+	}
+	return rows, nil
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestXlsxColIndex(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want int
+	}{
+		{"A1", 0},
+		{"Z9", 25},
+		{"AA1", 26},
+		{"AB12", 27},
+		{"AMJ1", 1023},
+		{"AMK1", xlsxMaxCols},
+		{"XFD1", xlsxMaxCols},
+		{"ZZZZZZZZZZZZZZ1", xlsxMaxCols},
+		{"1", -1},
+	}
+	for _, tt := range tests {
+		if got := xlsxColIndex(tt.ref); got != tt.want {
+			t.Errorf("xlsxColIndex(%q) = %d, want %d", tt.ref, got, tt.want)
+		}
+	}
+}
+
+// xlsxWithSheet 生成一个 XLSX，并把工作表替换为 sheetData 中的行
+func xlsxWithSheet(t *testing.T, sheetData string) []byte {
+	t.Helper()
+	var src bytes.Buffer
+	if err := writeXLSX(&src, "tags", [][]any{{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(src.Bytes()), int64(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for _, f := range zr.File {
+		w, _ := zw.Create(f.Name)
+		if strings.HasPrefix(f.Name, "xl/worksheets/") {
+			fmt.Fprintf(w, `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>%s</sheetData></worksheet>`, sheetData)
+			continue
+		}
+		rc, _ := f.Open()
+		_, _ = io.Copy(w, rc)
+		rc.Close()
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestReadXLSX(t *testing.T) {
+	var roundTrip bytes.Buffer
+	if err := writeXLSX(&roundTrip, "tags", [][]any{
+		{"tagId", "funcCode", "address", "scale"},
+		{"t1", "03", 1, 0.1},
+		{},
+		{"t<2>", nil, int64(40001), "a & b"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    [][]string
+		wantErr string
+	}{
+		{
+			name: "round trip",
+			data: roundTrip.Bytes(),
+			want: [][]string{
+				{"tagId", "funcCode", "address", "scale"},
+				{"t1", "03", "1", "0.1"},
+				nil,
+				{"t<2>", "", "40001", "a & b"},
+			},
+		},
+		{
+			name: "row gap and float text",
+			data: xlsxWithSheet(t, `<row r="1"><c r="B1"><v>4.0999999999999996</v></c></row><row r="3"><c r="A3" t="b"><v>1</v></c></row>`),
+			want: [][]string{{"", "4.1"}, nil, {"true"}},
+		},
+		{
+			name:    "row limit",
+			data:    xlsxWithSheet(t, fmt.Sprintf(`<row r="%d"><c r="A%d" t="str"><v>x</v></c></row>`, xlsxMaxRows+1, xlsxMaxRows+1)),
+			wantErr: fmt.Sprintf("row %d: the sheet has more than %d rows", xlsxMaxRows+1, xlsxMaxRows),
+		},
+		{
+			name:    "column limit",
+			data:    xlsxWithSheet(t, `<row r="1"><c r="XFD1" t="str"><v>x</v></c></row>`),
+			wantErr: fmt.Sprintf("cell XFD1: the sheet has more than %d columns", xlsxMaxCols),
+		},
+		{
+			name:    "invalid shared string",
+			data:    xlsxWithSheet(t, `<row r="1"><c r="A1" t="s"><v>5</v></c></row>`),
+			wantErr: "cell A1: invalid shared string",
+		},
+		{
+			name:    "not a zip",
+			data:    []byte("tagId,funcCode"),
+			wantErr: "zip: not a valid zip file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readXLSX(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("readXLSX() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readXLSX() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("readXLSX() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
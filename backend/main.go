@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -10,15 +11,19 @@ import (
 	"ginElement/routes"
 	"github.com/gin-gonic/gin"
 	"github.com/nalgeon/redka"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"syscall"
+	"time"
 
 	swaggerFiles "github.com/swaggo/files"     // 用于提供 Swagger UI 静态文件
 	ginSwagger "github.com/swaggo/gin-swagger" // 用于集成 Swagger UI 到 Gin
 	"log"
-	"sync"
 )
 
 func main() {
@@ -26,6 +31,12 @@ func main() {
 		port      = flag.String("port", "8880", "listen port, Default: 8880")
 		startWeb  = flag.String("startweb", "0", "startWeb mode: 1, 0, Default: 0")
 		enableNpc = flag.String("enablenpc", "0", "enableNpc mode: 1, 0, Default: 0")
+		logLevel  = flag.String("loglevel", "info", "log level: debug, info, warn, error, Default: info")
+		enableTLS = flag.String("tls", "0", "https mode: 1, 0, Default: 0")
+		certFile  = flag.String("cert", "data/server.crt", "https certificate file, self-signed if not exist, Default: data/server.crt")
+		keyFile   = flag.String("key", "data/server.key", "https private key file, Default: data/server.key")
+		httpPort  = flag.String("httpport", "", "http port redirecting to https in tls mode, Default: disabled")
+		snapshot  = flag.String("snapshot", "0", "realtime data snapshot interval in seconds, 0 disables, Default: 0")
 	)
 	//flag.BoolVar(&debug.Enable, "debug", false, "enable debug logging")
 	flag.Parse()
@@ -52,6 +63,13 @@ func main() {
 		fmt.Printf("Error: %v\n", errx)
 		return
 	}
+
+	// 初始化日志，写入 data/logs 并保留最近的日志供 WEB 查看
+	errl := handlers.InitLogger("data/logs", *logLevel)
+	if errl != nil {
+		fmt.Printf("Failed to init logger: %v\n", errl)
+		return
+	}
 	//err = handlers.CheckDBAndDelete("data/rt.db")
 	// 初始化数据库连接
 	opts := redka.Options{
@@ -96,8 +114,57 @@ func main() {
 		}
 	}
 
-	// 创建 Gin 引擎
-	r := gin.Default()
+	// 初始化用户认证，第一次启动时创建 admin 用户
+	if errt := handlers.InitAuth(cfgdb, "data/initial_admin_password.txt"); errt != nil {
+		log.Fatalf("Failed to init authentication: %v", errt)
+	}
+
+	// 打开审计日志
+	if erru := handlers.StartAuditLog("data/audit.db"); erru != nil {
+		log.Printf("Failed to open audit log: %v", erru)
+	}
+	// 配置修订
+	if errv := handlers.StartConfigRevision("data/revision.db", cfgdb); errv != nil {
+		log.Printf("Failed to open config revision: %v", errv)
+	}
+
+	// 点表工程量换算
+	handlers.InitTagEU(cfgdb)
+
+	// 实时数据快照，恢复上次保存的值，退出时再保存一次
+	if interval, _ := strconv.Atoi(*snapshot); interval > 0 {
+		if errs := handlers.StartRtSnapshot("data/rtsnapshot.json", time.Duration(interval)*time.Second, cfgdb, rtdb); errs != nil {
+			log.Printf("Failed to restore realtime snapshot: %v", errs)
+		}
+		go func() {
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+			<-sigCh
+			if errs := handlers.SaveRtSnapshot(); errs != nil {
+				log.Printf("Failed to save realtime snapshot: %v", errs)
+			}
+			os.Exit(0)
+		}()
+	}
+
+	// 启动历史数据存储
+	errh := handlers.StartHistorian("data/history.db", cfgdb, rtdb)
+	if errh != nil {
+		log.Printf("Failed to start historian: %v", errh)
+	}
+
+	// 启动报警引擎
+	erra := handlers.StartAlarmEngine("data/alarm.db", cfgdb)
+	if erra != nil {
+		log.Printf("Failed to start alarm engine: %v", erra)
+	}
+
+	// 启动设备数据超时检测
+	handlers.StartDevMonitor(cfgdb, rtdb)
+
+	// 创建 Gin 引擎，访问日志之前移除 URL 中的 access_token
+	r := gin.New()
+	r.Use(handlers.StripQueryToken(), gin.Logger(), gin.Recovery())
 
 	// 设置静态文件服务，将静态文件目录映射到URL路径
 	r.Static("/html", "./html")
@@ -111,11 +178,15 @@ func main() {
 	r.GET("/", func(c *gin.Context) {
 		c.File("./html/index.html")
 	})
+	// 登录页面，未登录时前端跳转到这里
+	r.GET("/login", func(c *gin.Context) {
+		c.File("./html/index.html")
+	})
 	// 调用 routes.SetupRouter，传递数据库连接
 	routes.SetupRouter(r, cfgdb, rtdb)
 
 	// 提供 Swagger UI 静态文件
-	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	r.GET("/swagger/*any", handlers.RequireRole(handlers.RoleViewer), ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	// 启动配置中设置为程序运行自启动的实例
 	items, err := cfgdb.Hash().Items(handlers.InstListKey)
@@ -131,9 +202,12 @@ func main() {
 		}
 		//fmt.Printf("hashkey: %v, InstId: %v, AppCode: %v, AutoStart: %v\n", key, appconfig.InstID, appconfig.AppCode, appconfig.AutoStart)
 		if appconfig.AutoStart == true {
-			startWorker(handlers.IotappMap[appconfig.AppCode], cfgdb, rtdb, appconfig.InstID)
+			if errs := handlers.StartInstance(appconfig.InstID, cfgdb, rtdb); errs != nil {
+				log.Printf("Error: start worker %s failed: %v", appconfig.InstID, errs)
+			}
 		}
 	}
+	handlers.SetReady()
 
 	// 启动npc客户端
 	enablenpc := *enableNpc
@@ -151,10 +225,23 @@ func main() {
 		}()
 	}
 
+	// HTTPS 配置
+	var tlsConfig *tls.Config
+	scheme := "http"
+	if *enableTLS == "1" {
+		tlsConfig, err = handlers.InitTLS(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Failed to init https: %v", err)
+		}
+		scheme = "https"
+	} else {
+		handlers.SetCertFiles(*certFile, *keyFile)
+	}
+
 	// 启动WEB浏览器
 	startweb := *startWeb
 	if startweb == "1" {
-		url := "http://localhost:" + *port
+		url := scheme + "://localhost:" + *port
 		erra := openBrowser(url)
 		if erra != nil {
 			fmt.Printf("Failed to open browser: %s\n", erra)
@@ -162,45 +249,34 @@ func main() {
 	}
 
 	// 启动WEB服务
-	fmt.Println("Server is running on :8880...")
-	err = r.Run(":" + *port)
+	srv := &http.Server{
+		Addr:      ":" + *port,
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig == nil {
+		log.Printf("Server is running on :%s...", *port)
+		err = srv.ListenAndServe()
+	} else {
+		// HTTP 端口重定向到 HTTPS
+		if *httpPort != "" {
+			go func() {
+				log.Printf("Redirecting http :%s to https :%s", *httpPort, *port)
+				if errr := http.ListenAndServe(":"+*httpPort, handlers.HTTPSRedirect(*port)); errr != nil {
+					log.Printf("Failed to start http redirect: %v", errr)
+				}
+			}()
+		}
+		log.Printf("Server is running on https :%s...", *port)
+		err = srv.ListenAndServeTLS("", "")
+	}
 	if err != nil {
+		log.Printf("Server stopped: %v", err)
 		return
 	}
 
 }
 
-func startWorker(workerFunc func(string, chan struct{}, *redka.DB, *redka.DB), cfgdb *redka.DB, rtdb *redka.DB, workerName string) {
-	if workerFunc == nil {
-		log.Printf("Error: workerFunc is nil for worker %s", workerName)
-		return
-	}
-	workersLock := &sync.Mutex{}
-	workersLock.Lock()
-	defer workersLock.Unlock()
-	//newUUID := uuid.New()
-	//uuidstr := workerName + "@" + newUUID.String()
-	stopChan := make(chan struct{})
-	go func() {
-		defer func() {
-			select {
-			case <-stopChan:
-			default:
-				close(stopChan)
-			}
-			// 通知全局变量 Workers 删除对应的线程 ID
-			workersLock.Lock()
-			delete(handlers.Workers, workerName)
-			workersLock.Unlock()
-			fmt.Printf("子线程 %s 已从全局变量中删除\n", workerName)
-		}()
-		workerFunc(workerName, stopChan, cfgdb, rtdb)
-	}()
-	//workersLock.Lock()
-	handlers.Workers[workerName] = stopChan
-	//workersLock.Unlock()
-}
-
 func openBrowser(url string) error {
 	var cmd string
 	var args []string
@@ -7,105 +7,279 @@ import (
 )
 
 func SetupRouter(r *gin.Engine, cfgdb *redka.DB, rtdb *redka.DB) {
+	// 按角色授权的认证中间件
+	viewer := handlers.RequireRole(handlers.RoleViewer)
+	operator := handlers.RequireRole(handlers.RoleOperator)
+	engineer := handlers.RequireRole(handlers.RoleEngineer)
+	admin := handlers.RequireRole(handlers.RoleAdmin)
+
 	// 注册路由
 
+	// 存活、就绪检查不需要认证，运行指标可以使用 API Token 采集
+	r.GET("/healthz", func(c *gin.Context) {
+		handlers.Healthz(c, cfgdb, rtdb)
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		handlers.Readyz(c, cfgdb)
+	})
+	r.GET("/metrics", viewer, func(c *gin.Context) {
+		handlers.Metrics(c, cfgdb, rtdb)
+	})
+
 	// 线程管理
-	r.POST("/api/v1/startWorker/:appcode", func(c *gin.Context) {
+	r.POST("/api/v1/startWorker/:appcode", operator, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.StartWorker
 		handlers.StartWorker(c)
 	}) // 启动子线程
-	r.POST("/api/v1/stopWorker/:workerid", handlers.StopWorker) // 停止子线程
-	r.GET("/api/v1/listWorkers", handlers.ListWorkers)          // 查询运行的子线程
+	r.POST("/api/v1/stopWorker/:workerid", operator, handlers.StopWorker) // 停止子线程
+	r.GET("/api/v1/listWorkers", viewer, handlers.ListWorkers)            // 查询运行的子线程
 
 	// App管理...
 	// 查询程序支持的Appcode
-	r.GET("/api/v1/listAppcode", handlers.ListAppcode)
+	r.GET("/api/v1/listAppcode", viewer, handlers.ListAppcode)
 	// 查询程序已经注册的App
-	r.GET("/api/v1/listApps", func(c *gin.Context) {
+	r.GET("/api/v1/listApps", viewer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.ListApps
 		handlers.ListApps(c, cfgdb)
 	})
 	// 查询指定App的默认配置
-	r.POST("/api/v1/getAppDefault", func(c *gin.Context) {
+	r.POST("/api/v1/getAppDefault", viewer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.GetAppDefault
 		handlers.GetAppDefault(c)
 	})
 	// 查询指定App实例的信息
-	r.POST("/api/v1/getApp", func(c *gin.Context) {
+	r.POST("/api/v1/getApp", viewer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.GetApp
 		handlers.GetApp(c, cfgdb)
 	})
-	r.POST("/api/v1/newApp", func(c *gin.Context) {
+	r.POST("/api/v1/newApp", engineer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.NewApp
 		handlers.NewApp(c, cfgdb)
 	}) // 新建App实例
 	// 删除App实例
-	r.POST("/api/v1/delApp", func(c *gin.Context) {
+	r.POST("/api/v1/delApp", engineer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.NewApp
-		handlers.DelApp(c, cfgdb)
+		handlers.DelApp(c, cfgdb, rtdb)
 	})
 	// 修改App实例
-	r.POST("/api/v1/modApp", func(c *gin.Context) {
+	r.POST("/api/v1/modApp", engineer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.NewApp
 		handlers.ModApp(c, cfgdb)
 	})
 	// 启动App实例
-	r.POST("/api/v1/startApp", func(c *gin.Context) {
+	r.POST("/api/v1/startApp", operator, func(c *gin.Context) {
 		handlers.StartApp(c, cfgdb, rtdb)
 	})
 	// 停止App实例
-	r.POST("/api/v1/stopApp", func(c *gin.Context) {
+	r.POST("/api/v1/stopApp", operator, func(c *gin.Context) {
 		handlers.StopApp(c)
 	})
 	// 重启App实例
-	r.POST("/api/v1/restartApp", func(c *gin.Context) {
+	r.POST("/api/v1/restartApp", operator, func(c *gin.Context) {
 		handlers.RestartApp(c, cfgdb, rtdb)
 	})
 
 	// 设备管理
 	//查询设备列表
-	r.POST("/api/v1/listDevices", func(c *gin.Context) {
+	r.POST("/api/v1/listDevices", viewer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.ListDevices
 		handlers.ListDevices(c, cfgdb)
 	})
 
 	// 创建设备
-	r.POST("/api/v1/newDev", func(c *gin.Context) {
+	r.POST("/api/v1/newDev", engineer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.NewDev
 		handlers.NewDev(c, cfgdb)
 	})
 	// 删除设备
-	r.POST("/api/v1/delDev", func(c *gin.Context) {
+	r.POST("/api/v1/delDev", engineer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.DelDev
-		handlers.DelDev(c, cfgdb)
+		handlers.DelDev(c, cfgdb, rtdb)
+	})
+
+	// 修改设备
+	r.POST("/api/v1/modDev", engineer, func(c *gin.Context) {
+		handlers.ModDev(c, cfgdb)
 	})
 
 	// 新增设备点表
-	r.POST("/api/v1/newDevtags", func(c *gin.Context) {
+	r.POST("/api/v1/newDevtags", engineer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.NewDevTags
 		handlers.NewDevTags(c, cfgdb)
 	})
 	// 查询设备点表
-	r.POST("/api/v1/getDevtags", func(c *gin.Context) {
+	r.POST("/api/v1/getDevtags", viewer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.NewDevTags
 		handlers.GetDevTags(c, cfgdb)
 	})
+	// 新增设备点
+	r.POST("/api/v1/newTag", engineer, func(c *gin.Context) {
+		handlers.NewTag(c, cfgdb)
+	})
+	// 修改设备点
+	r.POST("/api/v1/modTag", engineer, func(c *gin.Context) {
+		handlers.ModTag(c, cfgdb)
+	})
+	// 删除设备点
+	r.POST("/api/v1/delTag", engineer, func(c *gin.Context) {
+		handlers.DelTag(c, cfgdb)
+	})
+	// 下载点表模板
+	r.GET("/api/v1/getTagTemplate", viewer, handlers.GetTagTemplate)
+	// 导出设备点表(CSV/XLSX)
+	r.GET("/api/v1/exportDevtags", viewer, func(c *gin.Context) {
+		handlers.ExportDevTags(c, cfgdb)
+	})
+	// 导入设备点表(CSV/XLSX)
+	r.POST("/api/v1/importDevtags", engineer, func(c *gin.Context) {
+		handlers.ImportDevTags(c, cfgdb)
+	})
+	// 设备模板
+	// 查询设备模板列表
+	r.GET("/api/v1/listTemplates", viewer, func(c *gin.Context) {
+		handlers.ListTemplates(c, cfgdb)
+	})
+	// 查询设备模板
+	r.POST("/api/v1/getTemplate", viewer, func(c *gin.Context) {
+		handlers.GetTemplate(c, cfgdb)
+	})
+	// 新建设备模板
+	r.POST("/api/v1/newTemplate", engineer, func(c *gin.Context) {
+		handlers.NewTemplate(c, cfgdb)
+	})
+	// 修改设备模板
+	r.POST("/api/v1/modTemplate", engineer, func(c *gin.Context) {
+		handlers.ModTemplate(c, cfgdb)
+	})
+	// 删除设备模板
+	r.POST("/api/v1/delTemplate", engineer, func(c *gin.Context) {
+		handlers.DelTemplate(c, cfgdb)
+	})
+	// 按模板创建设备
+	r.POST("/api/v1/newDevsFromTemplate", engineer, func(c *gin.Context) {
+		handlers.NewDevsFromTemplate(c, cfgdb)
+	})
 	// 数据管理
 	// 读取设备实时数据
-	r.POST("/api/v1/getDevvalues", func(c *gin.Context) {
+	r.POST("/api/v1/getDevvalues", viewer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.GetDevValues
 		handlers.GetDevValues(c, rtdb)
 	})
 	// 读取设备点实时数据
-	r.POST("/api/v1/getTagvalues", func(c *gin.Context) {
+	r.POST("/api/v1/getTagvalues", viewer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.GetTagValues
 		handlers.GetTagValues(c, rtdb)
 	})
+	// 订阅设备实时数据(SSE)
+	r.GET("/api/v1/subscribeValues", viewer, func(c *gin.Context) {
+		handlers.SubscribeValues(c, rtdb)
+	})
+	// 查询设备点历史数据
+	r.POST("/api/v1/getTagHistory", viewer, handlers.GetTagHistory)
+	// 查询历史数据存储配置
+	r.POST("/api/v1/getHistoryConfig", viewer, func(c *gin.Context) {
+		handlers.GetHistoryConfig(c, cfgdb)
+	})
+	// 修改历史数据存储配置
+	r.POST("/api/v1/setHistoryConfig", engineer, func(c *gin.Context) {
+		handlers.SetHistoryConfig(c, cfgdb)
+	})
+	// 报警管理
+	// 查询报警规则
+	r.POST("/api/v1/getAlarmRules", viewer, func(c *gin.Context) {
+		handlers.GetAlarmRules(c, cfgdb)
+	})
+	// 修改报警规则
+	r.POST("/api/v1/setAlarmRules", engineer, func(c *gin.Context) {
+		handlers.SetAlarmRules(c, cfgdb)
+	})
+	// 查询活动报警
+	r.POST("/api/v1/listAlarms", viewer, handlers.ListAlarms)
+	// 确认报警
+	r.POST("/api/v1/ackAlarms", operator, handlers.AckAlarms)
+	// 屏蔽报警
+	r.POST("/api/v1/shelveAlarms", operator, handlers.ShelveAlarms)
+	// 查询报警日志
+	r.POST("/api/v1/getAlarmJournal", viewer, handlers.GetAlarmJournal)
+	// 配置备份
+	// 导出配置
+	r.GET("/api/v1/config/export", engineer, func(c *gin.Context) {
+		handlers.ExportConfig(c, cfgdb)
+	})
+	// 导入配置
+	r.POST("/api/v1/config/import", admin, func(c *gin.Context) {
+		handlers.ImportConfig(c, cfgdb, rtdb)
+	})
+	// 检查配置的引用关系
+	r.GET("/api/v1/config/check", engineer, func(c *gin.Context) {
+		handlers.CheckConfig(c, cfgdb)
+	})
+	// 配置修订
+	r.GET("/api/v1/config/revisions", engineer, handlers.ListRevisions)
+	r.GET("/api/v1/config/revisions/diff", engineer, func(c *gin.Context) {
+		handlers.DiffRevisions(c, cfgdb)
+	})
+	// 回滚配置
+	r.POST("/api/v1/config/rollback", engineer, func(c *gin.Context) {
+		handlers.RollbackConfig(c, cfgdb, rtdb)
+	})
 	// 日志管理
+	// 查询审计日志
+	r.GET("/api/v1/auditLog", admin, handlers.GetAuditLog)
+	// 查询运行日志，follow=1 时持续推送新日志
+	r.GET("/api/v1/logs", engineer, handlers.GetLogs)
+	// 设置日志级别
+	r.POST("/api/v1/setLogLevel", admin, handlers.SetLogLevel)
+
+	// 用户管理
+	// 登录，不需要认证
+	r.POST("/api/v1/login", func(c *gin.Context) {
+		handlers.Login(c, cfgdb)
+	})
+	// 退出登录
+	r.POST("/api/v1/logout", handlers.Logout)
+	// 查询当前用户
+	r.GET("/api/v1/currentUser", viewer, handlers.CurrentUser)
+	// 修改当前用户的密码
+	r.POST("/api/v1/changePassword", viewer, func(c *gin.Context) {
+		handlers.ChangePassword(c, cfgdb)
+	})
+	// 查询用户列表
+	r.GET("/api/v1/listUsers", admin, func(c *gin.Context) {
+		handlers.ListUsers(c, cfgdb)
+	})
+	// 创建用户
+	r.POST("/api/v1/newUser", admin, func(c *gin.Context) {
+		handlers.NewUser(c, cfgdb)
+	})
+	// 修改用户
+	r.POST("/api/v1/modUser", admin, func(c *gin.Context) {
+		handlers.ModUser(c, cfgdb)
+	})
+	// 删除用户
+	r.POST("/api/v1/delUser", admin, func(c *gin.Context) {
+		handlers.DelUser(c, cfgdb)
+	})
+	// 查询 API Token 列表
+	r.GET("/api/v1/listTokens", admin, func(c *gin.Context) {
+		handlers.ListTokens(c, cfgdb)
+	})
+	// 创建 API Token
+	r.POST("/api/v1/newToken", admin, func(c *gin.Context) {
+		handlers.NewToken(c, cfgdb)
+	})
+	// 删除 API Token
+	r.POST("/api/v1/delToken", admin, func(c *gin.Context) {
+		handlers.DelToken(c, cfgdb)
+	})
 
 	// 系统信息
+	// 查询 HTTPS 证书
+	r.GET("/api/v1/getCertInfo", admin, handlers.GetCertInfo)
+	// 上传 HTTPS 证书
+	r.POST("/api/v1/uploadCert", admin, handlers.UploadCert)
 	// 查询软件的基本信息
-	r.GET("/api/v1/getSysinfo", func(c *gin.Context) {
+	r.GET("/api/v1/getSysinfo", viewer, func(c *gin.Context) {
 		// 将数据库连接传递给 handlers.GetSysInfo
 		handlers.GetSysInfo(c, cfgdb)
 	})
@@ -0,0 +1,36 @@
+import type { UserModule } from '~/types'
+import axios from 'axios'
+import { clearToken, getToken } from '~/utils/auth'
+
+// 登录页面，不需要认证
+const loginPath = '/login'
+
+// 安装认证：请求携带令牌，未登录或令牌失效时跳转到登录页面
+export const install: UserModule = ({ isClient, router }) => {
+  if (!isClient)
+    return
+
+  axios.interceptors.request.use((config) => {
+    const token = getToken()
+    if (token && !config.headers.Authorization)
+      config.headers.Authorization = `Bearer ${token}`
+    return config
+  })
+
+  axios.interceptors.response.use(
+    response => response,
+    (error) => {
+      const current = router.currentRoute.value
+      if (error.response?.status === 401 && current.path !== loginPath) {
+        clearToken()
+        router.replace({ path: loginPath, query: { redirect: current.fullPath } })
+      }
+      return Promise.reject(error)
+    },
+  )
+
+  router.beforeEach((to) => {
+    if (to.path !== loginPath && !getToken())
+      return { path: loginPath, query: { redirect: to.fullPath } }
+  })
+}
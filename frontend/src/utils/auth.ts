@@ -0,0 +1,62 @@
+// src/utils/auth.ts
+
+import axios from 'axios'
+import { ref } from 'vue'
+
+// 登录用户信息
+export interface AuthUser {
+  username: string
+  role: string
+  expiresAt: number // 令牌过期时间，秒级时间戳
+}
+
+const tokenKey = 'ge_token'
+const userKey = 'ge_user'
+
+// 当前登录用户，未登录时为 null
+export const currentUser = ref<AuthUser | null>(null)
+
+// 读取保存的令牌，已过期时清除
+export function getToken(): string {
+  if (typeof localStorage === 'undefined')
+    return ''
+  const token = localStorage.getItem(tokenKey) || ''
+  const savedUser = localStorage.getItem(userKey)
+  const user: AuthUser | null = savedUser ? JSON.parse(savedUser) : null
+  if (!token || !user || user.expiresAt * 1000 <= Date.now()) {
+    clearToken()
+    return ''
+  }
+  currentUser.value = user
+  return token
+}
+
+// 清除保存的令牌和用户信息
+export function clearToken() {
+  if (typeof localStorage !== 'undefined') {
+    localStorage.removeItem(tokenKey)
+    localStorage.removeItem(userKey)
+  }
+  currentUser.value = null
+}
+
+// 登录，成功后保存令牌；后端同时写入 HttpOnly Cookie
+export async function login(username: string, password: string) {
+  const response = await axios.post('/api/v1/login', { username, password })
+  const { token, expiresAt, role } = response.data.data
+  const user: AuthUser = { username: response.data.data.username, role, expiresAt }
+  localStorage.setItem(tokenKey, token)
+  localStorage.setItem(userKey, JSON.stringify(user))
+  currentUser.value = user
+  return user
+}
+
+// 退出登录，清除 Cookie 和本地令牌
+export async function logout() {
+  try {
+    await axios.post('/api/v1/logout')
+  }
+  finally {
+    clearToken()
+  }
+}